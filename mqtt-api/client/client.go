@@ -0,0 +1,752 @@
+// Code generated by mqtt-api openapi; DO NOT EDIT.
+
+// Package client is a typed client of the home automation dashboard API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the API of the home automation dashboard
+type Client struct {
+	// BaseURL is the address of the API, e.g. http://localhost:8080
+	BaseURL string
+	// HTTPClient sends the requests, http.DefaultClient when nil
+	HTTPClient *http.Client
+	// Token is sent as a bearer token when set
+	Token string
+}
+
+// New returns a client of the API at baseURL
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Error is returned for responses with an error status. Code and Param are
+// set when a parameter of the request is invalid.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Message    string `json:"error"`
+	Code       string `json:"code"`
+	Param      string `json:"param"`
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Message)
+}
+
+// send sends a request and returns the response of a successful status
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	target := c.BaseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		json.Unmarshal(data, apiErr)
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+// do sends a request with an optional JSON body and decodes the JSON
+// response into out, if set
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	resp, err := c.send(ctx, method, path, query, "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// escapePath escapes each segment of a path parameter, keeping the slashes
+// of MQTT topics
+func escapePath(value string) string {
+	segments := strings.Split(value, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func setString(query url.Values, name, value string) {
+	if value != "" {
+		query.Set(name, value)
+	}
+}
+
+func setList(query url.Values, name string, values []string) {
+	for _, value := range values {
+		query.Add(name, value)
+	}
+}
+
+func setInt(query url.Values, name string, value int) {
+	if value != 0 {
+		query.Set(name, strconv.Itoa(value))
+	}
+}
+
+func setBool(query url.Values, name string, value bool) {
+	if value {
+		query.Set(name, "true")
+	}
+}
+
+// GetTopicsParams are the query parameters of GetTopics
+type GetTopicsParams struct {
+	// Only names starting with prefix
+	Prefix string
+	// Next of the previous page
+	After string
+	// Page size, at most 1000
+	Limit int
+}
+
+// GetTopics calls GET /api/v1/topics: List the stored topics
+func (c *Client) GetTopics(ctx context.Context, params GetTopicsParams) (*DiscoveryResponse, error) {
+	query := url.Values{}
+	setString(query, "prefix", params.Prefix)
+	setString(query, "after", params.After)
+	setInt(query, "limit", params.Limit)
+	out := new(DiscoveryResponse)
+	if err := c.do(ctx, http.MethodGet, "/api/v1/topics", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetDevicesParams are the query parameters of GetDevices
+type GetDevicesParams struct {
+	// Only names starting with prefix
+	Prefix string
+	// Next of the previous page
+	After string
+	// Page size, at most 1000
+	Limit int
+}
+
+// GetDevices calls GET /api/v1/devices: List the devices of the stored readings
+func (c *Client) GetDevices(ctx context.Context, params GetDevicesParams) (*DiscoveryResponse, error) {
+	query := url.Values{}
+	setString(query, "prefix", params.Prefix)
+	setString(query, "after", params.After)
+	setInt(query, "limit", params.Limit)
+	out := new(DiscoveryResponse)
+	if err := c.do(ctx, http.MethodGet, "/api/v1/devices", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetRoomsParams are the query parameters of GetRooms
+type GetRoomsParams struct {
+	// Only names starting with prefix
+	Prefix string
+	// Next of the previous page
+	After string
+	// Page size, at most 1000
+	Limit int
+}
+
+// GetRooms calls GET /api/v1/rooms: List the rooms of the stored readings
+func (c *Client) GetRooms(ctx context.Context, params GetRoomsParams) (*DiscoveryResponse, error) {
+	query := url.Values{}
+	setString(query, "prefix", params.Prefix)
+	setString(query, "after", params.After)
+	setInt(query, "limit", params.Limit)
+	out := new(DiscoveryResponse)
+	if err := c.do(ctx, http.MethodGet, "/api/v1/rooms", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetEventsParams are the query parameters of GetEvents
+type GetEventsParams struct {
+	// Start of the range: RFC3339, a date, epoch seconds or milliseconds, or relative to now such as now-6h
+	Start string
+	// End of the range, in the same forms as start
+	End string
+	// IANA time zone of dates, timestamps without an offset and rounding, UTC by default
+	TZ string
+	// Topics or MQTT topic filters
+	Topic []string
+	// Devices
+	Device []string
+	// Rooms
+	Room []string
+	// Sensor types
+	SensorType []string
+	// Tag predicates, <key>:<value>
+	Tag []string
+	// Value predicates, [<op>:]<value> with op one of eq, ne, gt, gte, lt, lte
+	Value []string
+	// Page size, at most 1000
+	Limit int
+	// Order of the timestamps
+	Order string
+	// Next of the previous page
+	Cursor string
+}
+
+// GetEvents calls GET /api/v1/events: List stored readings, a page at a time
+func (c *Client) GetEvents(ctx context.Context, params GetEventsParams) (*EventsResponse, error) {
+	query := url.Values{}
+	setString(query, "start", params.Start)
+	setString(query, "end", params.End)
+	setString(query, "tz", params.TZ)
+	setList(query, "topic", params.Topic)
+	setList(query, "device", params.Device)
+	setList(query, "room", params.Room)
+	setList(query, "sensor_type", params.SensorType)
+	setList(query, "tag", params.Tag)
+	setList(query, "value", params.Value)
+	setInt(query, "limit", params.Limit)
+	setString(query, "order", params.Order)
+	setString(query, "cursor", params.Cursor)
+	out := new(EventsResponse)
+	if err := c.do(ctx, http.MethodGet, "/api/v1/events", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetExportParams are the query parameters of GetExport
+type GetExportParams struct {
+	// Topics or MQTT topic filters
+	Topic []string
+	// Devices
+	Device []string
+	// Rooms
+	Room []string
+	// Sensor types
+	SensorType []string
+	// Start of the range: RFC3339, a date, epoch seconds or milliseconds, or relative to now such as now-6h
+	Start string
+	// End of the range, in the same forms as start
+	End string
+	// IANA time zone of dates, timestamps without an offset and rounding, UTC by default
+	TZ string
+	// File format
+	Format string
+}
+
+// GetExport calls GET /api/v1/export: Download the selected readings
+func (c *Client) GetExport(ctx context.Context, params GetExportParams) (io.ReadCloser, error) {
+	query := url.Values{}
+	setList(query, "topic", params.Topic)
+	setList(query, "device", params.Device)
+	setList(query, "room", params.Room)
+	setList(query, "sensor_type", params.SensorType)
+	setString(query, "start", params.Start)
+	setString(query, "end", params.End)
+	setString(query, "tz", params.TZ)
+	setString(query, "format", params.Format)
+	resp, err := c.send(ctx, http.MethodGet, "/api/v1/export", query, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// GetStreamParams are the query parameters of GetStream
+type GetStreamParams struct {
+	// Topics or MQTT topic filters
+	Topic []string
+	// Devices
+	Device []string
+	// Rooms
+	Room []string
+	// Sensor types
+	SensorType []string
+	// Resume after this reading id, like the Last-Event-ID header
+	LastEventID string
+}
+
+// GetStream calls GET /api/v1/stream: Server-Sent Events stream of new readings
+func (c *Client) GetStream(ctx context.Context, params GetStreamParams) (io.ReadCloser, error) {
+	query := url.Values{}
+	setList(query, "topic", params.Topic)
+	setList(query, "device", params.Device)
+	setList(query, "room", params.Room)
+	setList(query, "sensor_type", params.SensorType)
+	setString(query, "last_event_id", params.LastEventID)
+	resp, err := c.send(ctx, http.MethodGet, "/api/v1/stream", query, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// GetStatsParams are the query parameters of GetStats
+type GetStatsParams struct {
+	// Topics or MQTT topic filters
+	Topic []string
+	// Devices
+	Device []string
+	// Rooms
+	Room []string
+	// Sensor types
+	SensorType []string
+	// Start of the range: RFC3339, a date, epoch seconds or milliseconds, or relative to now such as now-6h
+	Start string
+	// End of the range, in the same forms as start
+	End string
+	// IANA time zone of dates, timestamps without an offset and rounding, UTC by default
+	TZ string
+	// Comma separated percentiles, or none
+	Percentiles string
+}
+
+// GetStats calls GET /api/v1/stats: Statistics over the numeric readings of the selected topics
+func (c *Client) GetStats(ctx context.Context, params GetStatsParams) (*StatsResponse, error) {
+	query := url.Values{}
+	setList(query, "topic", params.Topic)
+	setList(query, "device", params.Device)
+	setList(query, "room", params.Room)
+	setList(query, "sensor_type", params.SensorType)
+	setString(query, "start", params.Start)
+	setString(query, "end", params.End)
+	setString(query, "tz", params.TZ)
+	setString(query, "percentiles", params.Percentiles)
+	out := new(StatsResponse)
+	if err := c.do(ctx, http.MethodGet, "/api/v1/stats", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetSeriesParams are the query parameters of GetSeries
+type GetSeriesParams struct {
+	// Topics or MQTT topic filters
+	Topic []string
+	// Devices
+	Device []string
+	// Rooms
+	Room []string
+	// Sensor types
+	SensorType []string
+	// Start of the range: RFC3339, a date, epoch seconds or milliseconds, or relative to now such as now-6h
+	Start string
+	// End of the range, in the same forms as start
+	End string
+	// IANA time zone of dates, timestamps without an offset and rounding, UTC by default
+	TZ string
+	// Bucket size such as 5m or 1h, picked from the range when empty
+	Step string
+	// Aggregation of each bucket
+	Agg string
+	// Filling of empty buckets
+	Fill string
+}
+
+// GetSeries calls GET /api/v1/series: Readings aggregated into evenly spaced buckets
+func (c *Client) GetSeries(ctx context.Context, params GetSeriesParams) (*SeriesResponse, error) {
+	query := url.Values{}
+	setList(query, "topic", params.Topic)
+	setList(query, "device", params.Device)
+	setList(query, "room", params.Room)
+	setList(query, "sensor_type", params.SensorType)
+	setString(query, "start", params.Start)
+	setString(query, "end", params.End)
+	setString(query, "tz", params.TZ)
+	setString(query, "step", params.Step)
+	setString(query, "agg", params.Agg)
+	setString(query, "fill", params.Fill)
+	out := new(SeriesResponse)
+	if err := c.do(ctx, http.MethodGet, "/api/v1/series", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetStateParams are the query parameters of GetState
+type GetStateParams struct {
+	// Topics or MQTT topic filters
+	Topic []string
+}
+
+// GetState calls GET /api/v1/state: Latest reading of every topic
+func (c *Client) GetState(ctx context.Context, params GetStateParams) (*StateResponse, error) {
+	query := url.Values{}
+	setList(query, "topic", params.Topic)
+	out := new(StateResponse)
+	if err := c.do(ctx, http.MethodGet, "/api/v1/state", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetTopicState calls GET /api/v1/state/{topic}: Latest reading of a topic, or of the topics matching a topic filter
+func (c *Client) GetTopicState(ctx context.Context, topic string) (*StateEntry, error) {
+	out := new(StateEntry)
+	if err := c.do(ctx, http.MethodGet, "/api/v1/state/"+escapePath(topic), nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetSwitchActivityParams are the query parameters of GetSwitchActivity
+type GetSwitchActivityParams struct {
+	// Start of the range: RFC3339, a date, epoch seconds or milliseconds, or relative to now such as now-6h
+	Start string
+	// End of the range, in the same forms as start
+	End string
+	// IANA time zone of dates, timestamps without an offset and rounding, UTC by default
+	TZ string
+}
+
+// GetSwitchActivity calls GET /api/v1/switches/{topic}/activity: On/off activity of a switch
+func (c *Client) GetSwitchActivity(ctx context.Context, topic string, params GetSwitchActivityParams) (*SwitchActivity, error) {
+	query := url.Values{}
+	setString(query, "start", params.Start)
+	setString(query, "end", params.End)
+	setString(query, "tz", params.TZ)
+	out := new(SwitchActivity)
+	if err := c.do(ctx, http.MethodGet, "/api/v1/switches/"+escapePath(topic)+"/activity", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetMediaUsageParams are the query parameters of GetMediaUsage
+type GetMediaUsageParams struct {
+	// Start of the range: RFC3339, a date, epoch seconds or milliseconds, or relative to now such as now-6h
+	Start string
+	// End of the range, in the same forms as start
+	End string
+	// IANA time zone of dates, timestamps without an offset and rounding, UTC by default
+	TZ string
+	// Streaming devices
+	Device []string
+}
+
+// GetMediaUsage calls GET /api/v1/media/usage: App sessions of the streaming devices with daily and weekly totals
+func (c *Client) GetMediaUsage(ctx context.Context, params GetMediaUsageParams) (*MediaUsageResponse, error) {
+	query := url.Values{}
+	setString(query, "start", params.Start)
+	setString(query, "end", params.End)
+	setString(query, "tz", params.TZ)
+	setList(query, "device", params.Device)
+	out := new(MediaUsageResponse)
+	if err := c.do(ctx, http.MethodGet, "/api/v1/media/usage", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PostIngest calls POST /api/v1/ingest: Store readings sent as JSON
+func (c *Client) PostIngest(ctx context.Context, body []Reading) (*IngestResponse, error) {
+	out := new(IngestResponse)
+	if err := c.do(ctx, http.MethodPost, "/api/v1/ingest", nil, body, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetAverageTemperatureParams are the query parameters of GetAverageTemperature
+type GetAverageTemperatureParams struct {
+	// Temperature topic
+	Topic string
+	// Start of the range: RFC3339, a date, epoch seconds or milliseconds, or relative to now such as now-6h
+	Start string
+	// End of the range, in the same forms as start
+	End string
+	// IANA time zone of dates, timestamps without an offset and rounding, UTC by default
+	TZ string
+}
+
+// GetAverageTemperature calls GET /api/v1/temperature/average: Average temperature over the range
+func (c *Client) GetAverageTemperature(ctx context.Context, params GetAverageTemperatureParams) (*TemperatureResponse, error) {
+	query := url.Values{}
+	setString(query, "topic", params.Topic)
+	setString(query, "start", params.Start)
+	setString(query, "end", params.End)
+	setString(query, "tz", params.TZ)
+	out := new(TemperatureResponse)
+	if err := c.do(ctx, http.MethodGet, "/api/v1/temperature/average", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetMaxTemperatureParams are the query parameters of GetMaxTemperature
+type GetMaxTemperatureParams struct {
+	// Temperature topic
+	Topic string
+	// Start of the range: RFC3339, a date, epoch seconds or milliseconds, or relative to now such as now-6h
+	Start string
+	// End of the range, in the same forms as start
+	End string
+	// IANA time zone of dates, timestamps without an offset and rounding, UTC by default
+	TZ string
+}
+
+// GetMaxTemperature calls GET /api/v1/temperature/max: Highest temperature over the range
+func (c *Client) GetMaxTemperature(ctx context.Context, params GetMaxTemperatureParams) (*TemperatureResponse, error) {
+	query := url.Values{}
+	setString(query, "topic", params.Topic)
+	setString(query, "start", params.Start)
+	setString(query, "end", params.End)
+	setString(query, "tz", params.TZ)
+	out := new(TemperatureResponse)
+	if err := c.do(ctx, http.MethodGet, "/api/v1/temperature/max", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetMinTemperatureParams are the query parameters of GetMinTemperature
+type GetMinTemperatureParams struct {
+	// Temperature topic
+	Topic string
+	// Start of the range: RFC3339, a date, epoch seconds or milliseconds, or relative to now such as now-6h
+	Start string
+	// End of the range, in the same forms as start
+	End string
+	// IANA time zone of dates, timestamps without an offset and rounding, UTC by default
+	TZ string
+}
+
+// GetMinTemperature calls GET /api/v1/temperature/min: Lowest temperature over the range
+func (c *Client) GetMinTemperature(ctx context.Context, params GetMinTemperatureParams) (*TemperatureResponse, error) {
+	query := url.Values{}
+	setString(query, "topic", params.Topic)
+	setString(query, "start", params.Start)
+	setString(query, "end", params.End)
+	setString(query, "tz", params.TZ)
+	out := new(TemperatureResponse)
+	if err := c.do(ctx, http.MethodGet, "/api/v1/temperature/min", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PurgeCache calls DELETE /api/v1/cache: Drop every cached query result, e.g. after importing older readings
+func (c *Client) PurgeCache(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/cache", nil, nil, nil)
+}
+
+// AppSession mirrors api.AppSession
+type AppSession struct {
+	App             string    `json:"app"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Open            bool      `json:"open"`
+}
+
+// DeviceUsage mirrors api.DeviceUsage
+type DeviceUsage struct {
+	Device       string             `json:"device"`
+	Topic        string             `json:"topic"`
+	TotalSeconds float64            `json:"total_seconds"`
+	Apps         map[string]float64 `json:"apps"`
+	Daily        []UsagePeriod      `json:"daily"`
+	Weekly       []UsagePeriod      `json:"weekly"`
+	Sessions     []AppSession       `json:"sessions"`
+}
+
+// DiscoveryEntry mirrors api.DiscoveryEntry
+type DiscoveryEntry struct {
+	Name      string    `json:"name"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     int64     `json:"count"`
+	Topics    int64     `json:"topics,omitempty"`
+	ValueType string    `json:"value_type"`
+	Values    []string  `json:"values,omitempty"`
+	Unit      string    `json:"unit,omitempty"`
+}
+
+// DiscoveryResponse mirrors api.DiscoveryResponse
+type DiscoveryResponse struct {
+	Items []DiscoveryEntry `json:"items"`
+	Next  string           `json:"next,omitempty"`
+}
+
+// EventEntry mirrors api.EventEntry
+type EventEntry struct {
+	ID        string                 `json:"id"`
+	Topic     string                 `json:"topic"`
+	Device    string                 `json:"device"`
+	Value     interface{}            `json:"value"`
+	Timestamp time.Time              `json:"timestamp"`
+	Tags      map[string]interface{} `json:"tags"`
+}
+
+// EventsResponse mirrors api.EventsResponse
+type EventsResponse struct {
+	Events []EventEntry `json:"events"`
+	Next   string       `json:"next,omitempty"`
+}
+
+// IngestResponse mirrors api.IngestResponse
+type IngestResponse struct {
+	Accepted int `json:"accepted"`
+}
+
+// MediaUsageResponse mirrors api.MediaUsageResponse
+type MediaUsageResponse struct {
+	Start   time.Time     `json:"start"`
+	End     time.Time     `json:"end"`
+	Devices []DeviceUsage `json:"devices"`
+}
+
+// OnInterval mirrors api.OnInterval
+type OnInterval struct {
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Open            bool      `json:"open"`
+}
+
+// Point mirrors api.Point
+type Point struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     *float64  `json:"value"`
+}
+
+// Reading mirrors ingest.Reading
+type Reading struct {
+	Topic     string                 `json:"topic"`
+	Value     json.RawMessage        `json:"value"`
+	Timestamp json.RawMessage        `json:"timestamp,omitempty"`
+	Device    string                 `json:"device,omitempty"`
+	Tags      map[string]interface{} `json:"tags,omitempty"`
+}
+
+// Sample mirrors api.Sample
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// Series mirrors api.Series
+type Series struct {
+	Topic      string  `json:"topic"`
+	Resolution string  `json:"resolution"`
+	Points     []Point `json:"points"`
+}
+
+// SeriesResponse mirrors api.SeriesResponse
+type SeriesResponse struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Step        string    `json:"step"`
+	Aggregation string    `json:"agg"`
+	Fill        string    `json:"fill"`
+	Series      []Series  `json:"series"`
+}
+
+// StateEntry mirrors api.StateEntry
+type StateEntry struct {
+	Topic      string      `json:"topic"`
+	Device     string      `json:"device"`
+	Room       string      `json:"room"`
+	SensorType string      `json:"sensor_type"`
+	Value      interface{} `json:"value"`
+	Unit       string      `json:"unit,omitempty"`
+	Timestamp  time.Time   `json:"timestamp"`
+	AgeSeconds float64     `json:"age_seconds"`
+}
+
+// StateResponse mirrors api.StateResponse
+type StateResponse struct {
+	States []StateEntry `json:"states"`
+}
+
+// StatsResponse mirrors api.StatsResponse
+type StatsResponse struct {
+	Start   time.Time    `json:"start"`
+	End     time.Time    `json:"end"`
+	Results []TopicStats `json:"results"`
+}
+
+// SwitchActivity mirrors api.SwitchActivity
+type SwitchActivity struct {
+	Topic              string       `json:"topic"`
+	Start              time.Time    `json:"start"`
+	End                time.Time    `json:"end"`
+	OnCount            int64        `json:"on_count"`
+	OffCount           int64        `json:"off_count"`
+	OnSeconds          float64      `json:"on_seconds"`
+	DutyCyclePercent   float64      `json:"duty_cycle_percent"`
+	LongestOnSeconds   float64      `json:"longest_on_seconds"`
+	Intervals          []OnInterval `json:"intervals"`
+	IntervalsTruncated bool         `json:"intervals_truncated"`
+}
+
+// TemperatureResponse mirrors api.TemperatureResponse
+type TemperatureResponse struct {
+	Value float64 `json:"value"`
+}
+
+// TopicStats mirrors api.TopicStats
+type TopicStats struct {
+	Topic       string             `json:"topic"`
+	Resolution  string             `json:"resolution"`
+	Count       int64              `json:"count"`
+	Sum         float64            `json:"sum"`
+	Avg         float64            `json:"avg"`
+	Min         float64            `json:"min"`
+	Max         float64            `json:"max"`
+	StdDev      float64            `json:"stddev"`
+	Percentiles map[string]float64 `json:"percentiles,omitempty"`
+	First       Sample             `json:"first"`
+	Last        Sample             `json:"last"`
+}
+
+// UsagePeriod mirrors api.UsagePeriod
+type UsagePeriod struct {
+	Start        time.Time          `json:"start"`
+	TotalSeconds float64            `json:"total_seconds"`
+	Apps         map[string]float64 `json:"apps"`
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/mqtt-api/services/backup"
+	"home_automation_dashboard/mqtt-api/services/materialize"
+)
+
+func backupCommand(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("out", "", "archive to write, defaults to backup-<time>.tar.<compression>")
+	start := flags.String("start", "", "only export readings from this time on (RFC3339 or YYYY-MM-DD)")
+	end := flags.String("end", "", "only export readings before this time (RFC3339 or YYYY-MM-DD)")
+	compression := flags.String("compression", backup.CompressionZstd, "gzip or zstd")
+	collections := flags.String("collections", "", "comma separated collections to export, defaults to all")
+	flags.Parse(args)
+
+	opts := backup.Options{Compression: *compression}
+	var err error
+	if opts.Start, err = parseTimeFlag(*start); err != nil {
+		return fmt.Errorf("invalid -start: %w", err)
+	}
+	if opts.End, err = parseTimeFlag(*end); err != nil {
+		return fmt.Errorf("invalid -end: %w", err)
+	}
+	if *collections != "" {
+		opts.Collections = strings.Split(*collections, ",")
+	}
+
+	path := *out
+	if path == "" {
+		extension := map[string]string{backup.CompressionGzip: "gz", backup.CompressionZstd: "zst"}[opts.Compression]
+		path = fmt.Sprintf("backup-%s.tar.%s", time.Now().UTC().Format("20060102T150405Z"), extension)
+	}
+
+	mongoDb, err := connectMongoDB()
+	if err != nil {
+		return err
+	}
+	defer mongoDb.Disconnect(context.Background())
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	manifest, err := backup.Backup(context.Background(), mongoDb.Database, f, opts)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	for _, entry := range manifest.Collections {
+		log.Printf("Exported %d documents from %s", entry.Documents, entry.Name)
+	}
+	log.Printf("Backup written to %s", path)
+	return nil
+}
+
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := flags.String("in", "", "archive to restore")
+	database := flags.String("db", "", "database to restore into, defaults to MONGO_DB")
+	flags.Parse(args)
+
+	if *in == "" {
+		return fmt.Errorf("-in is required")
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mongoDb, err := connectMongoDB()
+	if err != nil {
+		return err
+	}
+	defer mongoDb.Disconnect(context.Background())
+
+	target := mongoDb.Database
+	if *database != "" {
+		target = mongoDb.Client.Database(*database)
+	}
+
+	// Restored readings expire by the policies in force now
+	retention, err := loadRetention(context.Background(), mongoDb)
+	if err != nil {
+		return err
+	}
+
+	manifest, results, err := backup.Restore(context.Background(), target, f, retention)
+	for _, result := range results {
+		log.Printf("Restored %s: %d inserted, %d duplicates skipped", result.Collection, result.Inserted, result.Duplicates)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Restored backup of %s taken at %s into %s", manifest.Database, manifest.CreatedAt.Format(time.RFC3339), target.Name())
+	// Restored events predate the materialized totals, the API folds them again
+	if err := materialize.InvalidateAll(context.Background(), target); err != nil {
+		return fmt.Errorf("invalidate materialized state: %w", err)
+	}
+	if target.Name() == mongoDb.Database.Name() {
+		purgeQueryCache(context.Background())
+	}
+	return nil
+}
+
+// parseTimeFlag parses an RFC3339 timestamp or a UTC date. An empty value
+// yields the zero time.
+func parseTimeFlag(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"home_automation_dashboard/mqtt-api/services/api"
+	"home_automation_dashboard/mqtt-api/services/media"
+	"home_automation_dashboard/mqtt-api/services/querycache"
+	"home_automation_dashboard/shared/db"
+)
+
+// command is a CLI subcommand. Without a subcommand mqtt-api runs the API server.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"backup": {
+		usage: "export stored readings and all other collections to a compressed archive",
+		run:   backupCommand,
+	},
+	"restore": {
+		usage: "load a backup archive, skipping documents that already exist",
+		run:   restoreCommand,
+	},
+	"export": {
+		usage: "write stored readings as CSV, NDJSON or Parquet",
+		run:   exportCommand,
+	},
+	"import-ha": {
+		usage: "backfill readings from a copy of the Home Assistant recorder database",
+		run:   importHACommand,
+	},
+	"keys": {
+		usage: "create, list and revoke API keys",
+		run:   keysCommand,
+	},
+	"openapi": {
+		usage: "print the OpenAPI document, or write and check it and the generated Go client",
+		run:   openapiCommand,
+	},
+	"rebuild-state": {
+		usage: "recompute the persisted switch and app durations from all stored events",
+		run:   rebuildState,
+	},
+}
+
+func runCommand(name string, args []string) {
+	cmd, ok := commands[name]
+	if !ok {
+		printUsage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(args); err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "Usage: mqtt-api [command] [flags]")
+	fmt.Fprintln(os.Stderr, "\nWithout a command the API server is started.\n\nCommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].usage)
+	}
+}
+
+// purgeQueryCache purges the cached query results after historical readings
+// were written, through Redis when the API shares its cache there. Results
+// only kept in the memory of the API have to be purged through the API.
+func purgeQueryCache(ctx context.Context) {
+	config, err := querycache.FromEnv()
+	if err != nil || config.Size == 0 {
+		return
+	}
+	if config.RedisURL == "" {
+		log.Printf("Cached query results predate the new readings, purge them with DELETE /api/v1/cache")
+		return
+	}
+
+	queries, err := querycache.New(config)
+	if err != nil {
+		log.Printf("Purging the query cache failed: %v", err)
+		return
+	}
+	defer queries.Close()
+
+	_, deleted, err := queries.Purge(ctx)
+	if err != nil {
+		log.Printf("Purging the query cache failed: %v", err)
+		return
+	}
+	log.Printf("Purged %d cached query results", deleted)
+}
+
+// connectMongoDB connects to the database configured in the environment.
+func connectMongoDB() (*db.MongoDB, error) {
+	cfg, err := db.ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return db.ConnectMongoDB(context.Background(), cfg)
+}
+
+func rebuildState(args []string) error {
+	flags := flag.NewFlagSet("rebuild-state", flag.ExitOnError)
+	flags.Parse(args)
+
+	mongoDb, err := connectMongoDB()
+	if err != nil {
+		return err
+	}
+	defer mongoDb.Disconnect(context.Background())
+
+	rules, err := media.RulesFromEnv()
+	if err != nil {
+		return err
+	}
+
+	handler := api.NewHandler(mongoDb, api.HandlerOptions{Media: rules})
+	if err := handler.RebuildMaterializedState(context.Background()); err != nil {
+		return err
+	}
+
+	log.Println("Materialized state rebuilt")
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"home_automation_dashboard/mqtt-api/services/export"
+	"home_automation_dashboard/shared/db"
+)
+
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", export.FormatCSV, "csv, ndjson or parquet")
+	out := flags.String("out", "-", "file to write, - for stdout")
+	topics := flags.String("topic", "", "comma separated topics, MQTT wildcards allowed")
+	devices := flags.String("device", "", "comma separated devices")
+	rooms := flags.String("room", "", "comma separated rooms")
+	sensorTypes := flags.String("sensor-type", "", "comma separated sensor types")
+	start := flags.String("start", "", "only export readings from this time on (RFC3339 or YYYY-MM-DD)")
+	end := flags.String("end", "", "only export readings before this time (RFC3339 or YYYY-MM-DD)")
+	flags.Parse(args)
+
+	if !contains(export.Formats, *format) {
+		return fmt.Errorf("invalid -format %q, expected one of %s", *format, strings.Join(export.Formats, ", "))
+	}
+	startTime, err := parseTimeFlag(*start)
+	if err != nil {
+		return fmt.Errorf("invalid -start: %w", err)
+	}
+	endTime, err := parseTimeFlag(*end)
+	if err != nil {
+		return fmt.Errorf("invalid -end: %w", err)
+	}
+
+	sel := db.Selector{
+		Topics:      splitFlag(*topics),
+		Devices:     splitFlag(*devices),
+		Rooms:       splitFlag(*rooms),
+		SensorTypes: splitFlag(*sensorTypes),
+	}
+
+	mongoDb, err := connectMongoDB()
+	if err != nil {
+		return err
+	}
+	defer mongoDb.Disconnect(context.Background())
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	collection := mongoDb.Database.Collection("mqtt_events")
+	count, err := export.Export(context.Background(), collection, export.Filter(sel, startTime, endTime), *format, w)
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported %d readings", count)
+	return nil
+}
+
+// splitFlag splits a comma separated flag value, dropping empty entries
+func splitFlag(value string) []string {
+	var values []string
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			values = append(values, field)
+		}
+	}
+	return values
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"home_automation_dashboard/mqtt-api/services/haimport"
+	"home_automation_dashboard/mqtt-api/services/materialize"
+)
+
+func importHACommand(args []string) error {
+	flags := flag.NewFlagSet("import-ha", flag.ExitOnError)
+	recorderFile := flags.String("recorder", "", "copy of home-assistant_v2.db to import from")
+	template := flags.String("topic-template", haimport.DefaultTopicTemplate, "topic for an entity, expanding {entity_id}, {domain} and {object_id}")
+	mapFile := flags.String("map", "", "JSON file mapping entity ids to topics, overriding -topic-template")
+	entities := flags.String("entities", "", "comma separated entity id globs to import, e.g. sensor.*,switch.*")
+	start := flags.String("start", "", "only import history from this time on (RFC3339 or YYYY-MM-DD)")
+	end := flags.String("end", "", "only import history before this time (RFC3339 or YYYY-MM-DD)")
+	statistics := flags.Bool("statistics", true, "import long-term statistics for periods without states")
+	dryRun := flags.Bool("dry-run", false, "report what would be imported without writing")
+	flags.Parse(args)
+
+	if *recorderFile == "" {
+		return fmt.Errorf("-recorder is required")
+	}
+
+	opts := haimport.Options{
+		TopicTemplate: *template,
+		Statistics:    *statistics,
+		DryRun:        *dryRun,
+	}
+	var err error
+	if opts.Start, err = parseTimeFlag(*start); err != nil {
+		return fmt.Errorf("invalid -start: %w", err)
+	}
+	if opts.End, err = parseTimeFlag(*end); err != nil {
+		return fmt.Errorf("invalid -end: %w", err)
+	}
+	if *entities != "" {
+		opts.Entities = strings.Split(*entities, ",")
+	}
+	if *mapFile != "" {
+		data, err := os.ReadFile(*mapFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &opts.TopicMap); err != nil {
+			return fmt.Errorf("invalid -map: %w", err)
+		}
+	}
+
+	recorder, err := haimport.OpenRecorder(*recorderFile)
+	if err != nil {
+		return err
+	}
+	defer recorder.Close()
+
+	mongoDb, err := connectMongoDB()
+	if err != nil {
+		return err
+	}
+	defer mongoDb.Disconnect(context.Background())
+
+	ctx := context.Background()
+	retention, err := loadRetention(ctx, mongoDb)
+	if err != nil {
+		return err
+	}
+
+	importer := haimport.New(recorder, mongoDb.Database.Collection("mqtt_events"), retention, opts)
+	_, err = importer.Import(ctx, func(result haimport.Result) {
+		if result.States+result.Statistics+result.Duplicates == 0 {
+			return
+		}
+		log.Printf("%s -> %s: %d states and %d statistics inserted, %d duplicates skipped",
+			result.EntityID, result.Topic, result.States, result.Statistics, result.Duplicates)
+	})
+	if err != nil || opts.DryRun {
+		return err
+	}
+
+	// Imported events predate the materialized totals, the API folds them again
+	if err := materialize.InvalidateAll(ctx, mongoDb.Database); err != nil {
+		return fmt.Errorf("invalidate materialized state: %w", err)
+	}
+	purgeQueryCache(ctx)
+
+	log.Println("Import finished")
+	return nil
+}
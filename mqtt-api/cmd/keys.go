@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"home_automation_dashboard/mqtt-api/services/apikeys"
+)
+
+const keysUsage = "usage: mqtt-api keys create|list|revoke [flags]"
+
+func keysCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(keysUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		return createKeyCommand(args[1:])
+	case "list":
+		return listKeysCommand(args[1:])
+	case "revoke":
+		return revokeKeyCommand(args[1:])
+	default:
+		return errors.New(keysUsage)
+	}
+}
+
+func createKeyCommand(args []string) error {
+	flags := flag.NewFlagSet("keys create", flag.ExitOnError)
+	name := flags.String("name", "", "what the key is for, e.g. grafana (required)")
+	scope := flags.String("scope", apikeys.ScopeReadReadings, "comma separated scopes: "+strings.Join(apikeys.Scopes, ", "))
+	rooms := flags.String("room", "", "comma separated rooms the key is restricted to")
+	devices := flags.String("device", "", "comma separated devices the key is restricted to")
+	flags.Parse(args)
+
+	if *name == "" {
+		return fmt.Errorf("-name is required")
+	}
+	scopes, err := apikeys.ParseScopes(*scope)
+	if err != nil {
+		return fmt.Errorf("invalid -scope: %w", err)
+	}
+
+	store, closeStore, err := openKeyStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	ctx := context.Background()
+	if err := store.EnsureIndexes(ctx); err != nil {
+		return err
+	}
+	token, key, err := store.Create(ctx, *name, scopes, splitFlag(*rooms), splitFlag(*devices))
+	if err != nil {
+		return err
+	}
+
+	// The key is printed alone on stdout so it can be piped into a file
+	fmt.Fprintf(os.Stderr, "Created key %s (%s), it is shown only once:\n", key.ID.Hex(), key.Prefix)
+	fmt.Println(token)
+	return nil
+}
+
+func listKeysCommand(args []string) error {
+	flags := flag.NewFlagSet("keys list", flag.ExitOnError)
+	flags.Parse(args)
+
+	store, closeStore, err := openKeyStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	keys, err := store.List(context.Background())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPREFIX\tNAME\tSCOPES\tROOMS\tDEVICES\tCREATED\tLAST USED\tREVOKED")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			key.ID.Hex(), key.Prefix, key.Name, strings.Join(key.Scopes, ","),
+			listOrAll(key.Rooms), listOrAll(key.Devices),
+			formatKeyTime(key.CreatedAt), formatKeyTime(key.LastUsedAt), formatKeyTime(key.RevokedAt))
+	}
+	return w.Flush()
+}
+
+func revokeKeyCommand(args []string) error {
+	flags := flag.NewFlagSet("keys revoke", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: mqtt-api keys revoke <id or prefix>")
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	store, closeStore, err := openKeyStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	key, err := store.Revoke(context.Background(), flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Revoked key %s (%s, %s)\n", key.ID.Hex(), key.Prefix, key.Name)
+	return nil
+}
+
+// openKeyStore connects to the database of the API keys
+func openKeyStore() (*apikeys.Store, func(), error) {
+	mongoDb, err := connectMongoDB()
+	if err != nil {
+		return nil, nil, err
+	}
+	return apikeys.NewStore(mongoDb.Database), func() { mongoDb.Disconnect(context.Background()) }, nil
+}
+
+func listOrAll(values []string) string {
+	if len(values) == 0 {
+		return "*"
+	}
+	return strings.Join(values, ",")
+}
+
+func formatKeyTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
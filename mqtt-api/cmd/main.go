@@ -1,24 +1,88 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strings"
 	"time"
+	_ "time/tzdata" // the runtime image has no zoneinfo for the tz parameter
 
 	"home_automation_dashboard/mqtt-api/services/api"
+	"home_automation_dashboard/mqtt-api/services/apikeys"
+	"home_automation_dashboard/mqtt-api/services/ingest"
+	"home_automation_dashboard/mqtt-api/services/limits"
+	"home_automation_dashboard/mqtt-api/services/media"
+	"home_automation_dashboard/mqtt-api/services/oidc"
+	"home_automation_dashboard/mqtt-api/services/querycache"
+	"home_automation_dashboard/mqtt-api/services/state"
 	"home_automation_dashboard/shared/db"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
-	mongoURI := os.Getenv("MONGO_URI")
-	databaseName := os.Getenv("MONGO_DB")
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	mongoDb, err := connectMongoDB()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := mongoDb.Disconnect(context.Background()); err != nil {
+			log.Printf("%v", err)
+		}
+	}()
+
+	retention := setupRetention(mongoDb)
 
-	mongoDb := db.ConnectMongoDB(mongoURI, databaseName)
-	defer mongoDb.Disconnect()
+	rules, err := media.RulesFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 
-	handler := api.NewHandler(mongoDb.Client, databaseName)
+	tokens, err := ingest.TokensFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	keys, verifier := setupAuth(mongoDb)
+
+	lim, err := limits.FromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	queries := newQueryCache()
+	defer queries.Close()
+
+	cache := newStateCache(mongoDb)
+	handler := api.NewHandler(mongoDb, api.HandlerOptions{
+		Retention:    retention,
+		State:        cache,
+		Media:        rules,
+		IngestTokens: tokens,
+		Keys:         keys,
+		OIDC:         verifier,
+		Limits:       lim,
+		Queries:      queries,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if err := handler.EnsureIndexes(ctx); err != nil {
+		log.Printf("Failed to create indexes: %v", err)
+	}
+	cancel()
+
+	// Warming the cache relies on the handler's indexes
+	if err := cache.Start(context.Background()); err != nil {
+		log.Fatalf("Failed to start state cache: %v", err)
+	}
 
 	go func() {
 		ticker := time.NewTicker(30 * time.Second)
@@ -26,16 +90,23 @@ func main() {
 
 		for range ticker.C {
 			handler.UpdateSwitchMetrics()
-			handler.UpdateTotalSwitchOnDuration()
-			handler.RokuAppDetails()
+			handler.UpdateDurationMetrics()
 		}
 	}()
 
-	// Initialize Gin router
-	router := gin.Default()
+	// Initialize Gin router. Credentials are taken out of the query before
+	// the logger prints it.
+	router := gin.New()
+	router.Use(api.HideQueryCredentials, gin.Logger(), gin.Recovery())
+
+	// Client addresses are rate limited, so X-Forwarded-For is only believed
+	// from the proxies in TRUSTED_PROXIES
+	if err := router.SetTrustedProxies(trustedProxies()); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
 
 	// Set up routes
-	api.SetupRoutes(router, mongoDb.Client, databaseName)
+	api.SetupRoutes(router, handler)
 
 	// Start the server
 	port := os.Getenv("PORT")
@@ -47,3 +118,117 @@ func main() {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// trustedProxies reads the comma separated addresses and CIDR ranges of
+// TRUSTED_PROXIES, none when it is unset
+func trustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// setupRetention parses RETENTION_POLICIES and, when policies are configured,
+// starts the background job that builds rollups and expires readings.
+func setupRetention(mongoDb *db.MongoDB) *db.Retention {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	retention, err := loadRetention(ctx, mongoDb)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if len(retention.Policies()) == 0 {
+		return retention
+	}
+
+	interval := time.Minute
+	if value := os.Getenv("RETENTION_INTERVAL"); value != "" {
+		if interval, err = db.ParseDuration(value); err != nil {
+			log.Fatalf("Invalid RETENTION_INTERVAL: %v", err)
+		}
+	}
+
+	if err := retention.EnsureIndexes(ctx); err != nil {
+		log.Fatalf("Failed to create retention indexes: %v", err)
+	}
+
+	go db.RunRetention(context.Background(), retention, interval)
+	return retention
+}
+
+// setupAuth returns the store of API keys and, when OIDC_ISSUER is set, the
+// verifier of user tokens. Both are nil unless API_AUTH is required.
+func setupAuth(mongoDb *db.MongoDB) (*apikeys.Store, *oidc.Verifier) {
+	required, err := apikeys.EnabledFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if !required {
+		log.Printf("WARNING: API_AUTH is off, the API is open to anyone who can reach it. " +
+			"Create API keys, configure Prometheus with one and set API_AUTH=required to protect it.")
+		if os.Getenv("OIDC_ISSUER") != "" {
+			log.Printf("WARNING: OIDC_ISSUER is ignored while API_AUTH is off")
+		}
+		return nil, nil
+	}
+
+	config, err := oidc.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	var verifier *oidc.Verifier
+	if config != nil {
+		verifier = oidc.NewVerifier(*config, &http.Client{Timeout: 10 * time.Second})
+		log.Printf("Accepting tokens of OIDC issuer %s", config.Issuer)
+	}
+	return apikeys.NewStore(mongoDb.Database), verifier
+}
+
+// newQueryCache creates the cache of aggregate query results configured by
+// the QUERY_CACHE variables, nil when QUERY_CACHE_SIZE is 0.
+func newQueryCache() *querycache.Cache {
+	config, err := querycache.FromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	queries, err := querycache.New(config)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if queries == nil {
+		log.Printf("The query cache is off, aggregates are computed for every request")
+	}
+	return queries
+}
+
+// newStateCache creates the cache of latest readings, with units assigned to
+// topics by STATE_UNITS.
+func newStateCache(mongoDb *db.MongoDB) *state.Cache {
+	units, err := state.ParseUnits(os.Getenv("STATE_UNITS"))
+	if err != nil {
+		log.Fatalf("Invalid STATE_UNITS: %v", err)
+	}
+
+	return state.New(mongoDb.Database.Collection("mqtt_events"), units)
+}
+
+// loadRetention creates the Retention configured by RETENTION_POLICIES with
+// the progress of its rollup tiers loaded from the database.
+func loadRetention(ctx context.Context, mongoDb *db.MongoDB) (*db.Retention, error) {
+	policies, err := db.ParseRetentionPolicies(os.Getenv("RETENTION_POLICIES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RETENTION_POLICIES: %w", err)
+	}
+
+	retention := db.NewRetention(mongoDb.Database, "mqtt_events", policies)
+	if len(policies) > 0 {
+		if err := retention.LoadWatermarks(ctx); err != nil {
+			return nil, fmt.Errorf("failed to load retention state: %w", err)
+		}
+	}
+	return retention, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"home_automation_dashboard/mqtt-api/services/api"
+	"home_automation_dashboard/mqtt-api/services/openapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:generate go run . openapi -out ../openapi.json -client ../client/client.go
+
+func openapiCommand(args []string) error {
+	flags := flag.NewFlagSet("openapi", flag.ExitOnError)
+	out := flags.String("out", "", "file to write the OpenAPI document to, stdout when neither -out nor -client is set")
+	clientOut := flags.String("client", "", "file to write the generated Go client to")
+	check := flags.Bool("check", false, "fail if the routes and operations disagree or -out and -client are not up to date")
+	flags.Parse(args)
+
+	if err := checkRoutes(); err != nil {
+		return err
+	}
+
+	doc, err := api.Spec()
+	if err != nil {
+		return err
+	}
+	spec, err := doc.JSON()
+	if err != nil {
+		return err
+	}
+	client, err := openapi.GenerateClient("client", api.Operations())
+	if err != nil {
+		return err
+	}
+
+	if *out == "" && *clientOut == "" {
+		if *check {
+			return fmt.Errorf("-check needs -out or -client")
+		}
+		_, err := os.Stdout.Write(spec)
+		return err
+	}
+
+	files := []struct {
+		path    string
+		content []byte
+	}{{*out, spec}, {*clientOut, client}}
+	for _, file := range files {
+		if file.path == "" {
+			continue
+		}
+		if *check {
+			current, err := os.ReadFile(file.path)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(current, file.content) {
+				return fmt.Errorf("%s is out of date, run go generate ./cmd", file.path)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(file.path), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file.path, file.content, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRoutes compares the routes of the server with the operations of the
+// OpenAPI document
+func checkRoutes() error {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	api.SetupRoutes(router, new(api.Handler))
+	return openapi.CheckRoutes(router.Routes(), api.Operations())
+}
@@ -0,0 +1,9 @@
+package main
+
+import "testing"
+
+func TestGeneratedFilesUpToDate(t *testing.T) {
+	if err := openapiCommand([]string{"-check", "-out", "../openapi.json", "-client", "../client/client.go"}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,245 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"home_automation_dashboard/mqtt-api/services/apikeys"
+	"home_automation_dashboard/mqtt-api/services/oidc"
+	"home_automation_dashboard/shared/db"
+	"home_automation_dashboard/shared/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// principalContext is the gin context key of the authenticated principal
+const principalContext = "principal"
+
+// principal is who a request authenticated as, an *apikeys.Key or a user's
+// *oidc.Identity
+type principal interface {
+	HasScope(scope string) bool
+	Allowlist() db.Allowlist
+}
+
+// requireScope returns middleware that rejects requests without an API key
+// or user token granting scope. It lets every request through when
+// authentication is off.
+func (h *Handler) requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := h.authenticate(c, scope); !ok {
+			c.Abort()
+		}
+	}
+}
+
+// requireUnrestricted is requireScope for routes whose responses cannot be
+// limited to the readings of an allowlist.
+func (h *Handler) requireUnrestricted(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, ok := h.authenticate(c, scope)
+		if !ok {
+			c.Abort()
+			return
+		}
+		if p != nil && !p.Allowlist().IsEmpty() {
+			authFailure(c, http.StatusForbidden, "forbidden", "this API key is restricted to some rooms or devices and cannot access this route")
+			c.Abort()
+		}
+	}
+}
+
+// authRequired reports whether requests need an API key or user token
+func (h *Handler) authRequired() bool {
+	return h.keys != nil || h.oidc != nil
+}
+
+// authenticate returns the request's principal, checking it grants scope.
+// The principal is nil when authentication is off. It responds with an error
+// and returns false when the request is not authorised.
+func (h *Handler) authenticate(c *gin.Context, scope string) (principal, bool) {
+	if !h.authRequired() {
+		return nil, true
+	}
+
+	credential := requestCredential(c)
+	if credential == "" {
+		authFailure(c, http.StatusUnauthorized, "missing", "an API key or token is required")
+		return nil, false
+	}
+
+	var p principal
+	if h.oidc != nil && oidc.IsToken(credential) {
+		identity, err := h.oidc.Verify(c.Request.Context(), credential)
+		switch {
+		case errors.Is(err, oidc.ErrExpired):
+			authFailure(c, http.StatusUnauthorized, "expired", "token has expired")
+			return nil, false
+		case errors.Is(err, oidc.ErrInvalidToken):
+			authFailure(c, http.StatusUnauthorized, "invalid", "invalid token")
+			return nil, false
+		case err != nil:
+			log.Printf("Token verification failed: %v", err)
+			respondError(c, http.StatusServiceUnavailable, "the identity provider cannot be reached")
+			return nil, false
+		}
+		p = identity
+	} else {
+		if h.keys == nil {
+			authFailure(c, http.StatusUnauthorized, "invalid", "invalid API key")
+			return nil, false
+		}
+
+		ctx, cancel := h.mongoDb.WithTimeout(c.Request.Context())
+		defer cancel()
+
+		key, err := h.keys.Authenticate(ctx, credential)
+		switch {
+		case errors.Is(err, apikeys.ErrUnknownKey):
+			authFailure(c, http.StatusUnauthorized, "invalid", "invalid API key")
+			return nil, false
+		case errors.Is(err, apikeys.ErrRevokedKey):
+			authFailure(c, http.StatusUnauthorized, "revoked", "API key has been revoked")
+			return nil, false
+		case err != nil:
+			internalError(c, err)
+			return nil, false
+		}
+		p = key
+	}
+
+	if !p.HasScope(scope) {
+		authFailure(c, http.StatusForbidden, "forbidden", "the "+scope+" scope is required")
+		return nil, false
+	}
+	if !h.limitClient(c, principalID(p)) {
+		return nil, false
+	}
+	c.Set(principalContext, p)
+	return p, true
+}
+
+// principalID identifies the principal, e.g. for rate limiting
+func principalID(p principal) string {
+	switch p := p.(type) {
+	case *apikeys.Key:
+		return "key:" + p.ID.Hex()
+	case *oidc.Identity:
+		return "user:" + p.Subject
+	}
+	return ""
+}
+
+// principalName names the principal, e.g. as the source of ingested readings
+func principalName(p principal) string {
+	switch p := p.(type) {
+	case *apikeys.Key:
+		return p.Name
+	case *oidc.Identity:
+		if p.Email != "" {
+			return p.Email
+		}
+		return p.Subject
+	}
+	return ""
+}
+
+// requestCredential returns the API key or user token sent as
+// "Authorization: Bearer <key>", "Authorization: Token <key>" as InfluxDB
+// clients do, or the X-API-Key header.
+func requestCredential(c *gin.Context) string {
+	scheme, token, _ := strings.Cut(c.GetHeader("Authorization"), " ")
+	if strings.EqualFold(scheme, "Bearer") || strings.EqualFold(scheme, "Token") {
+		return strings.TrimSpace(token)
+	}
+	return c.GetHeader("X-API-Key")
+}
+
+// queryCredential is the query parameter clients like EventSource, which
+// cannot set headers, send their API key or token in
+const queryCredential = "api_key"
+
+// queryCredentialRoutes are the routes accepting queryCredential
+var queryCredentialRoutes = map[string]bool{
+	"/api/v1/stream":    true,
+	"/api/v1/stream/ws": true,
+}
+
+// HideQueryCredentials is middleware that removes the api_key query
+// parameter from requests, so access logs registered after it never print
+// it. The live stream routes receive it as the X-API-Key header instead,
+// other routes ignore it.
+func HideQueryCredentials(c *gin.Context) {
+	query := c.Request.URL.Query()
+	if !query.Has(queryCredential) {
+		return
+	}
+	credential := query.Get(queryCredential)
+	query.Del(queryCredential)
+	c.Request.URL.RawQuery = query.Encode()
+
+	if queryCredentialRoutes[c.FullPath()] && requestCredential(c) == "" {
+		c.Request.Header.Set("X-API-Key", credential)
+	}
+}
+
+// authFailure counts a failed authentication and responds with an error
+func authFailure(c *gin.Context, status int, reason, message string) {
+	apiAuthFailures.WithLabelValues(reason).Inc()
+	if status == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", `Bearer realm="api"`)
+	}
+	respondError(c, status, message)
+}
+
+// allowlist returns the readings the request's principal may access, all of
+// them when authentication is off or the principal is unrestricted.
+func allowlist(c *gin.Context) db.Allowlist {
+	if value, ok := c.Get(principalContext); ok {
+		return value.(principal).Allowlist()
+	}
+	return db.Allowlist{}
+}
+
+// topicAllowed reports whether the request may access the readings of topic,
+// judged by the room and device of its latest reading or, without one, the
+// room and device MQTT readings derive from the topic levels.
+func (h *Handler) topicAllowed(c *gin.Context, topic string) bool {
+	allowed := allowlist(c)
+	if allowed.IsEmpty() {
+		return true
+	}
+	if h.state != nil {
+		if entry, ok := h.state.Get(topic); ok {
+			return allowed.Allows(entry.Room, entry.Device)
+		}
+	}
+	return allowed.Allows(models.ExtractRoomFromTopic(topic), models.ExtractDeviceFromTopic(topic))
+}
+
+// authorizeTopic reports whether the request may access the readings of
+// topic, responding with an error when it may not
+func (h *Handler) authorizeTopic(c *gin.Context, topic string) bool {
+	if !h.topicAllowed(c, topic) {
+		authFailure(c, http.StatusForbidden, "forbidden", fmt.Sprintf("API key may not read topic %q", topic))
+		return false
+	}
+	return true
+}
+
+// messagesAllowed reports whether the request's API key may write all the
+// messages, responding with an error when it may not
+func messagesAllowed(c *gin.Context, messages []models.MqttMessage) bool {
+	allowed := allowlist(c)
+	for _, msg := range messages {
+		room, _ := msg.Tags["room"].(string)
+		if !allowed.Allows(room, msg.Device) {
+			authFailure(c, http.StatusForbidden, "forbidden", fmt.Sprintf("API key may not write readings of topic %q", msg.Topic))
+			return false
+		}
+	}
+	return true
+}
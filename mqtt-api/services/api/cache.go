@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/mqtt-api/services/querycache"
+	"home_automation_dashboard/shared/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// queryCacheKey normalises the query of a request for the query cache.
+// Historical ranges are keyed by their bounds, so now-1d/d and the equivalent
+// dates share a result. Ranges including now move with every request and are
+// keyed by the start, end and tz parameters as given instead.
+func queryCacheKey(c *gin.Context, startTime, endTime, now time.Time, parts ...string) string {
+	parts = append([]string{endpointName(c.FullPath())}, parts...)
+	if querycache.Historical(endTime, now) {
+		parts = append(parts, startTime.UTC().Format(time.RFC3339Nano), endTime.UTC().Format(time.RFC3339Nano))
+	} else {
+		parts = append(parts, c.DefaultQuery("start", defaultStart), c.DefaultQuery("end", defaultEnd), c.Query("tz"))
+	}
+	return strings.Join(parts, "|")
+}
+
+// respondCached responds with the result cached under key, returning false
+// on a miss
+func (h *Handler) respondCached(c *gin.Context, key string) bool {
+	data, layer, ok := h.queries.Get(c.Request.Context(), key)
+	if !ok {
+		if h.queries != nil {
+			queryCacheMisses.Inc()
+		}
+		return false
+	}
+	queryCacheHits.WithLabelValues(layer).Inc()
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+	return true
+}
+
+// respondAndCache responds with result and caches it under key, for longer
+// when the range ending at endTime is historical
+func (h *Handler) respondAndCache(c *gin.Context, key string, endTime, now time.Time, result interface{}) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	h.queries.Set(c.Request.Context(), key, data, h.queries.TTL(endTime, now))
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
+
+// invalidateHistorical purges the query cache when messages were stored in
+// ranges that are cached as historical, whose results they change
+func (h *Handler) invalidateHistorical(ctx context.Context, messages []models.MqttMessage) {
+	if h.queries == nil {
+		return
+	}
+
+	now := time.Now()
+	for _, msg := range messages {
+		if !querycache.Historical(msg.Timestamp, now) {
+			continue
+		}
+		memory, redis, err := h.queries.Purge(ctx)
+		if err != nil {
+			log.Printf("Purging the query cache after a late reading of %s failed: %v", msg.Topic, err)
+			return
+		}
+		log.Printf("Purged the query cache after a late reading of %s: %d results in memory, %d in Redis", msg.Topic, memory, redis)
+		return
+	}
+}
+
+// PurgeCache handles DELETE /api/v1/cache, dropping every cached query result
+func (h *Handler) PurgeCache(c *gin.Context) {
+	memory, redis, err := h.queries.Purge(c.Request.Context())
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	log.Printf("Purged the query cache: %d results in memory, %d in Redis", memory, redis)
+	c.Status(http.StatusNoContent)
+}
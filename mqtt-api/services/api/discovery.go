@@ -0,0 +1,227 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Page sizes of the discovery endpoints
+const (
+	defaultDiscoveryLimit = 100
+	maxDiscoveryLimit     = 1000
+)
+
+// maxEnumValues is the most distinct strings a value type counts as an enum
+const maxEnumValues = 10
+
+// Value types reported by the discovery endpoints
+const (
+	ValueNumeric = "numeric"
+	ValueBinary  = "binary"
+	ValueEnum    = "enum"
+	ValueText    = "text"
+	ValueJSON    = "json"
+	ValueMixed   = "mixed"
+)
+
+// binaryStates are the string pairs that make a binary value
+var binaryStates = map[string]string{
+	"on": "off", "off": "on",
+	"true": "false", "false": "true",
+	"open": "closed", "closed": "open",
+	"detected": "clear", "clear": "detected",
+	"home": "not_home", "not_home": "home",
+}
+
+// unitKeywords infer the unit of numeric readings from their name
+var unitKeywords = []struct {
+	keyword string
+	unit    string
+}{
+	{"humidity", "%"},
+	{"battery", "%"},
+	{"energy", "kWh"},
+	{"power", "W"},
+	{"voltage", "V"},
+	{"current", "A"},
+	{"illuminance", "lx"},
+	{"lux", "lx"},
+	{"pressure", "hPa"},
+	{"co2", "ppm"},
+}
+
+// DiscoveryResponse is returned by GET /api/v1/{topics,devices,rooms}. Next
+// is passed as after to fetch the following page.
+type DiscoveryResponse struct {
+	Items []DiscoveryEntry `json:"items"`
+	Next  string           `json:"next,omitempty"`
+}
+
+// DiscoveryEntry describes the readings of one topic, device or room
+type DiscoveryEntry struct {
+	Name      string    `json:"name"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     int64     `json:"count"`
+	Topics    int64     `json:"topics,omitempty"`
+	ValueType string    `json:"value_type"`
+	// Values lists the states of binary and enum values
+	Values []string `json:"values,omitempty"`
+	Unit   string   `json:"unit,omitempty"`
+}
+
+// GetTopics handles requests for the stored topics
+func (h *Handler) GetTopics(c *gin.Context) {
+	h.discover(c, "topic")
+}
+
+// GetDevices handles requests for the stored devices
+func (h *Handler) GetDevices(c *gin.Context) {
+	h.discover(c, "device")
+}
+
+// GetRooms handles requests for the stored rooms
+func (h *Handler) GetRooms(c *gin.Context) {
+	h.discover(c, "tags.room")
+}
+
+// discover lists the distinct values of field with the prefix, after and
+// limit query parameters
+func (h *Handler) discover(c *gin.Context, field string) {
+	limit := defaultDiscoveryLimit
+	if value := c.Query("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxDiscoveryLimit {
+			badRequest(c, &RequestError{Code: "invalid_limit", Param: "limit", Message: fmt.Sprintf("limit must be between 1 and %d", maxDiscoveryLimit)})
+			return
+		}
+	}
+
+	ctx, cancel := h.mongoDb.WithTimeout(c.Request.Context())
+	defer cancel()
+
+	// One more than requested tells whether there is a next page
+	collection := h.mongoDb.Database.Collection(h.collection)
+	results, err := db.Discover(ctx, collection, field, c.Query("prefix"), c.Query("after"), allowlist(c), limit+1)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	response := DiscoveryResponse{Items: []DiscoveryEntry{}}
+	if len(results) > limit {
+		results = results[:limit]
+		response.Next = results[limit-1].Name
+	}
+	for _, result := range results {
+		entry := DiscoveryEntry{
+			Name:      result.Name,
+			FirstSeen: result.FirstSeen,
+			LastSeen:  result.LastSeen,
+			Count:     result.Count,
+			ValueType: valueType(result),
+		}
+		if field != "topic" {
+			entry.Topics = result.Topics
+		}
+		if entry.ValueType == ValueBinary || entry.ValueType == ValueEnum {
+			entry.Values = result.Strings
+		}
+		if entry.ValueType == ValueNumeric {
+			entry.Unit = h.unit(field, result)
+		}
+		response.Items = append(response.Items, entry)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// valueType classifies the values of the readings summarised by result
+func valueType(result db.Discovered) string {
+	var numeric, texts, objects, bools, other bool
+	for _, t := range result.ValueTypes {
+		switch t {
+		case "double", "int", "long", "decimal":
+			numeric = true
+		case "string":
+			texts = true
+		case "object":
+			objects = true
+		case "bool":
+			bools = true
+		case "null":
+		default:
+			other = true
+		}
+	}
+
+	switch {
+	case other || countTrue(numeric, texts, objects, bools) > 1:
+		return ValueMixed
+	case numeric:
+		return ValueNumeric
+	case objects:
+		return ValueJSON
+	case bools:
+		return ValueBinary
+	case texts && isBinary(result.Strings, result.StringCount):
+		return ValueBinary
+	case texts && result.StringCount <= maxEnumValues:
+		return ValueEnum
+	case texts:
+		return ValueText
+	}
+	return ValueMixed
+}
+
+// isBinary reports whether the distinct values are one or both states of a
+// binary pair
+func isBinary(values []string, count int64) bool {
+	if count == 0 || count > 2 {
+		return false
+	}
+	opposite, ok := binaryStates[strings.ToLower(values[0])]
+	return ok && (count == 1 || strings.ToLower(values[1]) == opposite)
+}
+
+func countTrue(values ...bool) int {
+	n := 0
+	for _, value := range values {
+		if value {
+			n++
+		}
+	}
+	return n
+}
+
+// unit returns the unit of numeric readings. Topics use STATE_UNITS first;
+// otherwise it is inferred from the name, and temperatures from whether the
+// average looks like Celsius or Fahrenheit.
+func (h *Handler) unit(field string, result db.Discovered) string {
+	if field == "topic" && h.state != nil {
+		if unit := h.state.Unit(result.Name); unit != "" {
+			return unit
+		}
+	}
+
+	name := strings.ToLower(result.Name)
+	if strings.Contains(name, "temperature") && result.Avg != nil {
+		if *result.Avg < 45 {
+			return "°C"
+		}
+		return "°F"
+	}
+	for _, keyword := range unitKeywords {
+		if strings.Contains(name, keyword.keyword) {
+			return keyword.unit
+		}
+	}
+	return ""
+}
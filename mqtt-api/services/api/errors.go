@@ -0,0 +1,73 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrorResponse is the body of every error response. Code and Param are set
+// for invalid requests.
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+	Param string `json:"param,omitempty"`
+}
+
+// RequestError is an invalid query parameter, reported to clients with a
+// machine readable code and the offending parameter
+type RequestError struct {
+	Code    string
+	Param   string
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+// Extensions reports the code and parameter in GraphQL errors
+func (e *RequestError) Extensions() map[string]interface{} {
+	extensions := map[string]interface{}{"code": e.Code}
+	if e.Param != "" {
+		extensions["param"] = e.Param
+	}
+	return extensions
+}
+
+// limitCodes are the codes of requests rejected by a limit rather than for
+// being malformed, with their status
+var limitCodes = map[string]int{
+	"range_too_large": http.StatusBadRequest,
+	"too_many_points": http.StatusBadRequest,
+	"batch_too_large": http.StatusRequestEntityTooLarge,
+	"body_too_large":  http.StatusRequestEntityTooLarge,
+}
+
+// badRequest responds with 400, including the code and parameter when err is
+// a RequestError. Requests rejected by a limit are counted, and oversized
+// bodies answered with 413.
+func badRequest(c *gin.Context, err error) {
+	var requestErr *RequestError
+	if errors.As(err, &requestErr) {
+		status := http.StatusBadRequest
+		if limitStatus, ok := limitCodes[requestErr.Code]; ok {
+			apiRequestsRejected.WithLabelValues(requestErr.Code).Inc()
+			status = limitStatus
+		}
+		c.JSON(status, ErrorResponse{Error: requestErr.Message, Code: requestErr.Code, Param: requestErr.Param})
+		return
+	}
+	respondError(c, http.StatusBadRequest, err.Error())
+}
+
+// internalError responds with 500 and the error
+func internalError(c *gin.Context, err error) {
+	respondError(c, http.StatusInternalServerError, err.Error())
+}
+
+// respondError responds with status and message
+func respondError(c *gin.Context, status int, message string) {
+	c.JSON(status, ErrorResponse{Error: message})
+}
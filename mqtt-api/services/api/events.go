@@ -0,0 +1,165 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Page sizes of the events endpoint
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+)
+
+// tagName matches the tag keys that may be filtered on
+var tagName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// valueOperators maps the operators of the value parameter to MongoDB
+var valueOperators = map[string]string{
+	"eq":  "$eq",
+	"ne":  "$ne",
+	"gt":  "$gt",
+	"gte": "$gte",
+	"lt":  "$lt",
+	"lte": "$lte",
+}
+
+// EventsResponse is returned by GET /api/v1/events. Next is passed as cursor
+// to fetch the following page.
+type EventsResponse struct {
+	Events []EventEntry `json:"events"`
+	Next   string       `json:"next,omitempty"`
+}
+
+// EventEntry is a stored reading
+type EventEntry struct {
+	ID        string                 `json:"id"`
+	Topic     string                 `json:"topic"`
+	Device    string                 `json:"device"`
+	Value     interface{}            `json:"value"`
+	Timestamp time.Time              `json:"timestamp"`
+	Tags      map[string]interface{} `json:"tags"`
+}
+
+// GetEvents handles requests for stored readings, a page at a time
+func (h *Handler) GetEvents(c *gin.Context) {
+	startTime, endTime, err := h.parseTimeRange(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	conditions, err := parseEventConditions(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+	filter := bson.D{{Key: "$and", Value: append(conditions, db.TimeRangeFilter(startTime, endTime))}}
+
+	limit := defaultEventsLimit
+	if value := c.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxEventsLimit {
+			badRequest(c, &RequestError{Code: "invalid_limit", Param: "limit", Message: fmt.Sprintf("limit must be between 1 and %d", maxEventsLimit)})
+			return
+		}
+	}
+
+	var descending bool
+	switch order := c.DefaultQuery("order", "desc"); order {
+	case "asc":
+	case "desc":
+		descending = true
+	default:
+		badRequest(c, &RequestError{Code: "invalid_order", Param: "order", Message: fmt.Sprintf("invalid order %q, expected asc or desc", order)})
+		return
+	}
+
+	var after *db.EventCursor
+	if token := c.Query("cursor"); token != "" {
+		cursor, err := db.ParseEventCursor(token)
+		if err != nil {
+			badRequest(c, &RequestError{Code: "invalid_cursor", Param: "cursor", Message: err.Error()})
+			return
+		}
+		after = &cursor
+	}
+
+	events, next, err := h.mongoDb.FindEvents(c.Request.Context(), h.collection, filter, after, descending, limit)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	response := EventsResponse{Events: make([]EventEntry, 0, len(events))}
+	for _, event := range events {
+		response.Events = append(response.Events, newEventEntry(event))
+	}
+	if next != nil {
+		response.Next = next.String()
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func newEventEntry(event db.Event) EventEntry {
+	return EventEntry{
+		ID:        event.ID.Hex(),
+		Topic:     event.Topic,
+		Device:    event.Device,
+		Value:     event.Value,
+		Timestamp: event.Timestamp,
+		Tags:      event.Tags,
+	}
+}
+
+// parseEventConditions reads the selector parameters, tag=<key>:<value> and
+// value=[<op>:]<value> predicates. Repeated tags and value predicates must
+// all match.
+func parseEventConditions(c *gin.Context) (bson.A, error) {
+	sel := db.Selector{
+		Topics:      queryList(c, "topic"),
+		Devices:     queryList(c, "device"),
+		Rooms:       queryList(c, "room"),
+		SensorTypes: queryList(c, "sensor_type"),
+		Allowed:     allowlist(c),
+	}
+	conditions := bson.A{}
+	if !sel.IsEmpty() || !sel.Allowed.IsEmpty() {
+		conditions = append(conditions, sel.Filter())
+	}
+
+	for _, tag := range c.QueryArray("tag") {
+		key, value, ok := strings.Cut(tag, ":")
+		if !ok || !tagName.MatchString(key) {
+			return nil, &RequestError{Code: "invalid_tag", Param: "tag", Message: fmt.Sprintf("invalid tag %q, expected <key>:<value>", tag)}
+		}
+		conditions = append(conditions, bson.D{{Key: "tags." + key, Value: value}})
+	}
+
+	for _, predicate := range c.QueryArray("value") {
+		operator, operand := "eq", predicate
+		if op, rest, ok := strings.Cut(predicate, ":"); ok {
+			if _, known := valueOperators[op]; known {
+				operator, operand = op, rest
+			}
+		}
+
+		var value interface{} = operand
+		if number, err := strconv.ParseFloat(operand, 64); err == nil {
+			value = number
+		} else if operator != "eq" && operator != "ne" {
+			return nil, &RequestError{Code: "invalid_value", Param: "value", Message: fmt.Sprintf("%s needs a number, got %q", operator, operand)}
+		}
+		conditions = append(conditions, bson.D{{Key: "value", Value: bson.D{{Key: valueOperators[operator], Value: value}}}})
+	}
+	return conditions, nil
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"home_automation_dashboard/mqtt-api/services/export"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetExport handles requests to download the selected readings as CSV,
+// NDJSON or Parquet. The response is streamed as the readings are read.
+func (h *Handler) GetExport(c *gin.Context) {
+	sel, err := parseSelector(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	startTime, endTime, err := h.parseTimeRange(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	format := c.DefaultQuery("format", export.FormatCSV)
+	if !contains(export.Formats, format) {
+		badRequest(c, &RequestError{Code: "invalid_format", Param: "format", Message: fmt.Sprintf("invalid format %q, expected one of %s", format, strings.Join(export.Formats, ", "))})
+		return
+	}
+
+	filename := fmt.Sprintf("readings-%s-%s.%s", startTime.UTC().Format("20060102T150405Z"), endTime.UTC().Format("20060102T150405Z"), format)
+	c.Header("Content-Type", export.ContentType(format))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Status(http.StatusOK)
+
+	// Exports may take longer than the operation timeout, they end with the request
+	collection := h.mongoDb.Database.Collection(h.collection)
+	count, err := export.Export(c.Request.Context(), collection, export.Filter(sel, startTime, endTime), format, c.Writer)
+	if err != nil {
+		// The status has been sent, so the client only sees a truncated body
+		log.Printf("Export failed after %d readings: %v", count, err)
+		c.Abort()
+	}
+}
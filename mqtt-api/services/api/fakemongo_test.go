@@ -0,0 +1,237 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Wire protocol op codes
+const (
+	opReply = 1
+	opQuery = 2004
+	opMsg   = 2013
+)
+
+// fakeMongo speaks enough of the MongoDB wire protocol for the handlers to
+// run against an empty database. Find and aggregate commands return the
+// documents set with setResults, distinct commands the values set with
+// setDistinct, every write succeeds.
+type fakeMongo struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	results  []interface{}
+	distinct []string
+}
+
+// startFakeMongo starts a fakeMongo and connects to it
+func startFakeMongo(t *testing.T) (*fakeMongo, *db.MongoDB) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeMongo{listener: listener}
+	go f.serve()
+	t.Cleanup(func() { listener.Close() })
+
+	cfg := db.DefaultConfig("mongodb://"+listener.Addr().String()+"/?directConnection=true", "test")
+	cfg.ConnectRetries = 0
+	mongoDb, err := db.ConnectMongoDB(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mongoDb.Disconnect(context.Background()) })
+	return f, mongoDb
+}
+
+// setResults sets the documents returned by every find and aggregate
+func (f *fakeMongo) setResults(docs ...interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.results = docs
+}
+
+// setDistinct sets the values returned by every distinct
+func (f *fakeMongo) setDistinct(values ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.distinct = values
+}
+
+func (f *fakeMongo) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeMongo) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := int32(binary.LittleEndian.Uint32(header))
+		requestID := int32(binary.LittleEndian.Uint32(header[4:]))
+		opCode := int32(binary.LittleEndian.Uint32(header[12:]))
+		body := make([]byte, length-16)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		var reply []byte
+		switch opCode {
+		case opQuery:
+			// flags, then the collection name and the skip and return counts
+			rest := body[4:]
+			rest = rest[bytes.IndexByte(rest, 0)+1+8:]
+			reply = opReplyMessage(requestID, f.reply(bson.Raw(rest), 0))
+		case opMsg:
+			command, documents, err := parseMsg(body)
+			if err != nil {
+				return
+			}
+			reply = opMsgMessage(requestID, f.reply(command, documents))
+		default:
+			return
+		}
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+// parseMsg returns the command of an OP_MSG and the number of documents of
+// its document sequences
+func parseMsg(body []byte) (bson.Raw, int, error) {
+	var command bson.Raw
+	documents := 0
+	rest := body[4:]
+	for len(rest) > 0 {
+		kind := rest[0]
+		rest = rest[1:]
+		size := int(binary.LittleEndian.Uint32(rest))
+		switch kind {
+		case 0:
+			command = bson.Raw(rest[:size])
+		case 1:
+			section := rest[4:size]
+			section = section[bytes.IndexByte(section, 0)+1:]
+			for len(section) > 0 {
+				docSize := int(binary.LittleEndian.Uint32(section))
+				section = section[docSize:]
+				documents++
+			}
+		default:
+			return nil, 0, errors.New("unknown section kind")
+		}
+		rest = rest[size:]
+	}
+	if command == nil {
+		return nil, 0, errors.New("missing command")
+	}
+	return command, documents, nil
+}
+
+// reply answers command, whose document sequences hold documents
+func (f *fakeMongo) reply(command bson.Raw, documents int) bson.D {
+	elements, err := command.Elements()
+	if err != nil || len(elements) == 0 {
+		return bson.D{{Key: "ok", Value: 0}, {Key: "errmsg", Value: "invalid command"}}
+	}
+	name := elements[0].Key()
+	collection, _ := elements[0].Value().StringValueOK()
+	database, _ := command.Lookup("$db").StringValueOK()
+	ns := database + "." + collection
+
+	switch strings.ToLower(name) {
+	case "hello", "ismaster":
+		return bson.D{
+			{Key: "ismaster", Value: true},
+			{Key: "isWritablePrimary", Value: true},
+			{Key: "helloOk", Value: true},
+			{Key: "maxBsonObjectSize", Value: 16 * 1024 * 1024},
+			{Key: "maxMessageSizeBytes", Value: 48000000},
+			{Key: "maxWriteBatchSize", Value: 100000},
+			{Key: "localTime", Value: time.Now()},
+			{Key: "logicalSessionTimeoutMinutes", Value: 30},
+			{Key: "connectionId", Value: 1},
+			{Key: "minWireVersion", Value: 0},
+			{Key: "maxWireVersion", Value: 21},
+			{Key: "ok", Value: 1},
+		}
+	case "find", "aggregate":
+		f.mu.Lock()
+		results := f.results
+		f.mu.Unlock()
+		if results == nil {
+			results = []interface{}{}
+		}
+		return bson.D{
+			{Key: "cursor", Value: bson.D{{Key: "id", Value: int64(0)}, {Key: "ns", Value: ns}, {Key: "firstBatch", Value: results}}},
+			{Key: "ok", Value: 1},
+		}
+	case "getmore":
+		return bson.D{
+			{Key: "cursor", Value: bson.D{{Key: "id", Value: int64(0)}, {Key: "ns", Value: ns}, {Key: "nextBatch", Value: bson.A{}}}},
+			{Key: "ok", Value: 1},
+		}
+	case "insert":
+		if inline, err := command.LookupErr("documents"); err == nil {
+			values, _ := inline.Array().Values()
+			documents += len(values)
+		}
+		return bson.D{{Key: "n", Value: documents}, {Key: "ok", Value: 1}}
+	case "update", "delete", "count":
+		return bson.D{{Key: "n", Value: 0}, {Key: "nModified", Value: 0}, {Key: "ok", Value: 1}}
+	case "distinct":
+		f.mu.Lock()
+		values := bson.A{}
+		for _, value := range f.distinct {
+			values = append(values, value)
+		}
+		f.mu.Unlock()
+		return bson.D{{Key: "values", Value: values}, {Key: "ok", Value: 1}}
+	default:
+		return bson.D{{Key: "ok", Value: 1}}
+	}
+}
+
+func opReplyMessage(responseTo int32, doc bson.D) []byte {
+	data, _ := bson.Marshal(doc)
+	body := make([]byte, 20, 20+len(data))
+	// flags 0, cursor id 0, starting from 0, one document
+	binary.LittleEndian.PutUint32(body[16:], 1)
+	return message(responseTo, opReply, append(body, data...))
+}
+
+func opMsgMessage(responseTo int32, doc bson.D) []byte {
+	data, _ := bson.Marshal(doc)
+	// no flags, one body section
+	body := append(make([]byte, 4), 0)
+	return message(responseTo, opMsg, append(body, data...))
+}
+
+func message(responseTo int32, opCode int32, body []byte) []byte {
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header, uint32(16+len(body)))
+	binary.LittleEndian.PutUint32(header[8:], uint32(responseTo))
+	binary.LittleEndian.PutUint32(header[12:], uint32(opCode))
+	return append(header, body...)
+}
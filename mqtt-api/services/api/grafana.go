@@ -0,0 +1,469 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// grafanaTagFields maps the ad-hoc filter keys offered to Grafana to the
+// fields of stored readings
+var grafanaTagFields = map[string]string{
+	"device":      "device",
+	"room":        "tags.room",
+	"sensor_type": "tags.sensor_type",
+}
+
+// grafanaTagKeys lists the ad-hoc filter keys in the order Grafana shows them
+var grafanaTagKeys = []string{"room", "device", "sensor_type"}
+
+// grafanaTable is the type of table targets, all others are time series
+const grafanaTable = "table"
+
+// GrafanaRange is the time range of a Grafana request
+type GrafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// GrafanaFilter is an ad-hoc filter of a Grafana dashboard
+type GrafanaFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+// GrafanaSearchRequest is the body of POST /grafana/search
+type GrafanaSearchRequest struct {
+	Target string `json:"target"`
+}
+
+// GrafanaTarget is one query of a Grafana panel. Target is a topic or MQTT
+// topic filter; the payload may set agg and fill as for the series endpoint.
+type GrafanaTarget struct {
+	Target  string          `json:"target"`
+	RefID   string          `json:"refId"`
+	Type    string          `json:"type"`
+	Hide    bool            `json:"hide"`
+	Payload json.RawMessage `json:"payload"`
+	// Data is the payload of older plugin versions
+	Data json.RawMessage `json:"data"`
+}
+
+// GrafanaQueryRequest is the body of POST /grafana/query
+type GrafanaQueryRequest struct {
+	Range         GrafanaRange    `json:"range"`
+	IntervalMs    int64           `json:"intervalMs"`
+	MaxDataPoints int             `json:"maxDataPoints"`
+	Targets       []GrafanaTarget `json:"targets"`
+	AdhocFilters  []GrafanaFilter `json:"adhocFilters"`
+}
+
+// GrafanaTimeSeries is a time series answer; each datapoint is [value, unix ms]
+type GrafanaTimeSeries struct {
+	Target     string           `json:"target"`
+	RefID      string           `json:"refId,omitempty"`
+	Datapoints [][2]interface{} `json:"datapoints"`
+}
+
+// GrafanaTable is a table answer
+type GrafanaTable struct {
+	Type    string          `json:"type"`
+	RefID   string          `json:"refId,omitempty"`
+	Columns []GrafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// GrafanaColumn is a column of a GrafanaTable
+type GrafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+// GrafanaAnnotationRequest is the body of POST /grafana/annotations. The
+// annotation query is a topic or MQTT topic filter.
+type GrafanaAnnotationRequest struct {
+	Range      GrafanaRange `json:"range"`
+	Annotation struct {
+		Name   string `json:"name"`
+		Query  string `json:"query"`
+		Enable bool   `json:"enable"`
+	} `json:"annotation"`
+}
+
+// GrafanaAnnotation marks a change of a topic's value
+type GrafanaAnnotation struct {
+	Annotation interface{} `json:"annotation"`
+	Time       int64       `json:"time"`
+	Title      string      `json:"title"`
+	Text       string      `json:"text"`
+	Tags       []string    `json:"tags"`
+}
+
+// GrafanaTagKey is an ad-hoc filter key
+type GrafanaTagKey struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// GrafanaTagValuesRequest is the body of POST /grafana/tag-values
+type GrafanaTagValuesRequest struct {
+	Key string `json:"key"`
+}
+
+// GrafanaTagValue is a value of an ad-hoc filter key
+type GrafanaTagValue struct {
+	Text string `json:"text"`
+}
+
+// grafanaPayload are the options of a target
+type grafanaPayload struct {
+	Aggregation string `json:"agg"`
+	Fill        string `json:"fill"`
+}
+
+// GrafanaTest answers the connection test of the Grafana datasource
+func (h *Handler) GrafanaTest(c *gin.Context) {
+	c.String(http.StatusOK, "OK")
+}
+
+// GrafanaSearch handles the metric lookup of the query editor. The target is
+// matched as an MQTT topic filter when it has wildcards, otherwise as a
+// case-insensitive substring of the topics.
+func (h *Handler) GrafanaSearch(c *gin.Context) {
+	var request GrafanaSearchRequest
+	if err := c.ShouldBindJSON(&request); err != nil && c.Request.ContentLength != 0 {
+		badRequest(c, err)
+		return
+	}
+
+	sel := db.Selector{Allowed: allowlist(c)}
+	if db.IsTopicPattern(request.Target) {
+		sel.Topics = []string{request.Target}
+	}
+
+	ctx, cancel := h.mongoDb.WithTimeout(c.Request.Context())
+	defer cancel()
+
+	topics, err := db.DistinctStrings(ctx, h.mongoDb.Database.Collection(h.collection), "topic", sel.Filter())
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	matches := []string{}
+	search := strings.ToLower(request.Target)
+	for _, topic := range topics {
+		if db.IsTopicPattern(request.Target) || strings.Contains(strings.ToLower(topic), search) {
+			matches = append(matches, topic)
+		}
+	}
+	c.JSON(http.StatusOK, matches)
+}
+
+// GrafanaQuery answers the queries of a Grafana panel, as time series of
+// aggregated numeric readings or as tables of raw readings
+func (h *Handler) GrafanaQuery(c *gin.Context) {
+	var request GrafanaQueryRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		badRequest(c, err)
+		return
+	}
+	if err := validateGrafanaRange(request.Range, h.limits.Span("grafana")); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	base, err := grafanaSelector(request.AdhocFilters)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+	base.Allowed = allowlist(c)
+
+	ctx, cancel := h.mongoDb.WithTimeout(c.Request.Context())
+	defer cancel()
+
+	response := []interface{}{}
+	points := 0
+	for _, target := range request.Targets {
+		if target.Hide || target.Target == "" {
+			continue
+		}
+		sel := base
+		sel.Topics = []string{target.Target}
+
+		if target.Type == grafanaTable {
+			table, err := h.grafanaTable(c, sel, request.Range, target.RefID)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			response = append(response, table)
+			continue
+		}
+
+		payload, err := parseGrafanaPayload(target)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+
+		start, end := request.Range.From, request.Range.To
+		step := grafanaStep(request.IntervalMs, request.MaxDataPoints, end.Sub(start), h.limits.Points())
+		queries, err := h.planQuery(ctx, sel, start, end, step)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		count, err := h.countSeries(ctx, queries, start, end)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		points += count * bucketCount(end.Sub(start), step)
+		if err := checkPoints(points, h.limits.Points()); err != nil {
+			badRequest(c, err)
+			return
+		}
+
+		var series []Series
+		for _, query := range queries {
+			collection := h.mongoDb.Database.Collection(query.source.Collection)
+			buckets, err := db.AggregateSeries(ctx, collection, query.source, query.filter, start, end, step, payload.Aggregation)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			series = append(series, buildSeries(buckets, start, end, step, payload.Fill)...)
+		}
+		sort.Slice(series, func(i, j int) bool {
+			return series[i].Topic < series[j].Topic
+		})
+
+		for _, s := range series {
+			datapoints := make([][2]interface{}, 0, len(s.Points))
+			for _, point := range s.Points {
+				datapoints = append(datapoints, [2]interface{}{point.Value, point.Timestamp.UnixMilli()})
+			}
+			response = append(response, GrafanaTimeSeries{Target: s.Topic, RefID: target.RefID, Datapoints: datapoints})
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// grafanaTable returns the newest raw readings selected by sel in the range
+func (h *Handler) grafanaTable(c *gin.Context, sel db.Selector, timeRange GrafanaRange, refID string) (GrafanaTable, error) {
+	filter := bson.D{{Key: "$and", Value: bson.A{sel.Filter(), db.TimeRangeFilter(timeRange.From, timeRange.To)}}}
+	events, _, err := h.mongoDb.FindEvents(c.Request.Context(), h.collection, filter, nil, true, maxEventsLimit)
+	if err != nil {
+		return GrafanaTable{}, err
+	}
+
+	table := GrafanaTable{
+		Type:  grafanaTable,
+		RefID: refID,
+		Columns: []GrafanaColumn{
+			{Text: "Time", Type: "time"},
+			{Text: "Topic", Type: "string"},
+			{Text: "Device", Type: "string"},
+			{Text: "Room", Type: "string"},
+			{Text: "Sensor type", Type: "string"},
+			{Text: "Value", Type: "string"},
+		},
+		Rows: make([][]interface{}, 0, len(events)),
+	}
+	for _, event := range events {
+		table.Rows = append(table.Rows, []interface{}{
+			event.Timestamp.UnixMilli(), event.Topic, event.Device, event.Room(), event.SensorType(), event.Value,
+		})
+	}
+	return table, nil
+}
+
+// GrafanaAnnotations returns an annotation for every change of value of the
+// topics matching the annotation query, such as switches turning on and off
+func (h *Handler) GrafanaAnnotations(c *gin.Context) {
+	var request GrafanaAnnotationRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		badRequest(c, err)
+		return
+	}
+	if err := validateGrafanaRange(request.Range, h.limits.Span("grafana")); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	annotations := []GrafanaAnnotation{}
+	if request.Annotation.Query == "" {
+		c.JSON(http.StatusOK, annotations)
+		return
+	}
+
+	sel := db.Selector{Topics: []string{request.Annotation.Query}, Allowed: allowlist(c)}
+	filter := bson.D{{Key: "$and", Value: bson.A{sel.Filter(), db.TimeRangeFilter(request.Range.From, request.Range.To)}}}
+	events, _, err := h.mongoDb.FindEvents(c.Request.Context(), h.collection, filter, nil, false, maxEventsLimit)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	previous := make(map[string]string)
+	for _, event := range events {
+		text := fmt.Sprint(event.Value)
+		if last, ok := previous[event.Topic]; ok && last == text {
+			continue
+		}
+		previous[event.Topic] = text
+
+		var tags []string
+		for _, tag := range []string{event.Device, event.Room()} {
+			if tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		annotations = append(annotations, GrafanaAnnotation{
+			Annotation: request.Annotation,
+			Time:       event.Timestamp.UnixMilli(),
+			Title:      event.Topic,
+			Text:       text,
+			Tags:       tags,
+		})
+	}
+
+	c.JSON(http.StatusOK, annotations)
+}
+
+// GrafanaTagKeys lists the keys available to ad-hoc filters
+func (h *Handler) GrafanaTagKeys(c *gin.Context) {
+	keys := make([]GrafanaTagKey, 0, len(grafanaTagKeys))
+	for _, key := range grafanaTagKeys {
+		keys = append(keys, GrafanaTagKey{Type: "string", Text: key})
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// GrafanaTagValues lists the values of an ad-hoc filter key
+func (h *Handler) GrafanaTagValues(c *gin.Context) {
+	var request GrafanaTagValuesRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		badRequest(c, err)
+		return
+	}
+	field, ok := grafanaTagFields[request.Key]
+	if !ok {
+		badRequest(c, &RequestError{Code: "invalid_tag_key", Param: "key", Message: fmt.Sprintf("invalid key %q, expected one of %s", request.Key, strings.Join(grafanaTagKeys, ", "))})
+		return
+	}
+
+	ctx, cancel := h.mongoDb.WithTimeout(c.Request.Context())
+	defer cancel()
+
+	sel := db.Selector{Allowed: allowlist(c)}
+	values, err := db.DistinctStrings(ctx, h.mongoDb.Database.Collection(h.collection), field, sel.Filter())
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	response := make([]GrafanaTagValue, 0, len(values))
+	for _, value := range values {
+		response = append(response, GrafanaTagValue{Text: value})
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// validateGrafanaRange checks the range of a Grafana request like
+// parseTimeRange checks query parameters, allowing ranges up to maxSpan
+func validateGrafanaRange(r GrafanaRange, maxSpan time.Duration) error {
+	if r.From.IsZero() || r.To.IsZero() {
+		return &RequestError{Code: "invalid_time", Param: "range", Message: "range.from and range.to are required"}
+	}
+	if !r.From.Before(r.To) {
+		return &RequestError{Code: "invalid_range", Param: "range", Message: "range.from must be before range.to"}
+	}
+	if r.To.Sub(r.From) > maxSpan {
+		return &RequestError{Code: "range_too_large", Param: "range", Message: fmt.Sprintf("time range exceeds the maximum of %s", db.FormatDuration(maxSpan))}
+	}
+	return nil
+}
+
+// grafanaSelector turns ad-hoc filters into a selector. Filters on the same
+// key are alternatives; only equality is supported.
+func grafanaSelector(filters []GrafanaFilter) (db.Selector, error) {
+	var sel db.Selector
+	for _, filter := range filters {
+		if filter.Operator != "=" {
+			return sel, &RequestError{Code: "invalid_filter", Param: "adhocFilters", Message: fmt.Sprintf("unsupported operator %q for %s, only = is supported", filter.Operator, filter.Key)}
+		}
+		switch filter.Key {
+		case "device":
+			sel.Devices = append(sel.Devices, filter.Value)
+		case "room":
+			sel.Rooms = append(sel.Rooms, filter.Value)
+		case "sensor_type":
+			sel.SensorTypes = append(sel.SensorTypes, filter.Value)
+		default:
+			return sel, &RequestError{Code: "invalid_filter", Param: "adhocFilters", Message: fmt.Sprintf("invalid filter key %q, expected one of %s", filter.Key, strings.Join(grafanaTagKeys, ", "))}
+		}
+	}
+	return sel, nil
+}
+
+// parseGrafanaPayload reads the agg and fill options of a target
+func parseGrafanaPayload(target GrafanaTarget) (grafanaPayload, error) {
+	payload := grafanaPayload{Aggregation: "avg", Fill: FillNull}
+	raw := target.Payload
+	if len(raw) == 0 {
+		raw = target.Data
+	}
+	if len(raw) > 0 && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &payload); err != nil {
+			return payload, &RequestError{Code: "invalid_payload", Param: "payload", Message: fmt.Sprintf("invalid payload of %s: %v", target.RefID, err)}
+		}
+	}
+
+	if payload.Aggregation == "" {
+		payload.Aggregation = "avg"
+	}
+	if !contains(db.SeriesAggregations, payload.Aggregation) {
+		return payload, &RequestError{Code: "invalid_aggregation", Param: "payload", Message: fmt.Sprintf("invalid agg %q, expected one of %s", payload.Aggregation, strings.Join(db.SeriesAggregations, ", "))}
+	}
+	if payload.Fill == "" {
+		payload.Fill = FillNull
+	}
+	if payload.Fill != FillNull && payload.Fill != FillPrevious && payload.Fill != FillLinear {
+		return payload, &RequestError{Code: "invalid_fill", Param: "payload", Message: fmt.Sprintf("invalid fill %q, expected null, previous or linear", payload.Fill)}
+	}
+	return payload, nil
+}
+
+// grafanaStep is the bucket width of a panel: Grafana's interval, widened to
+// keep within maxDataPoints and maxPoints and rounded to whole seconds
+func grafanaStep(intervalMs int64, maxDataPoints int, span time.Duration, maxPoints int) time.Duration {
+	step := time.Duration(intervalMs) * time.Millisecond
+	if step <= 0 {
+		step, _ = parseStep("", span, maxPoints)
+	}
+
+	if maxDataPoints > 0 && maxDataPoints < maxPoints {
+		maxPoints = maxDataPoints
+	}
+	if minimum := (span + time.Duration(maxPoints) - 1) / time.Duration(maxPoints); step < minimum {
+		step = minimum
+	}
+
+	if step%time.Second != 0 {
+		step = step.Truncate(time.Second) + time.Second
+	}
+	return step
+}
@@ -0,0 +1,797 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"home_automation_dashboard/mqtt-api/services/state"
+	"home_automation_dashboard/shared/db"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// Limits of GraphQL queries
+const (
+	// maxGraphQLDepth bounds the nesting of fields
+	maxGraphQLDepth = 10
+	// maxGraphQLComplexity bounds the cost of a query: one per field, plus
+	// graphqlQueryCost per field that queries the database. Fields are loaded
+	// in batches, so the cost does not grow with the number of entities.
+	maxGraphQLComplexity = 500
+	graphqlQueryCost     = 10
+)
+
+// graphqlQueryFields are the fields that query the database
+var graphqlQueryFields = map[string]bool{
+	"series":          true,
+	"switch_activity": true,
+	"first_seen":      true,
+	"last_seen":       true,
+	"reading_count":   true,
+}
+
+// GraphQLRequest is the body of POST /graphql
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// GraphQLResponse is the result of a GraphQL request
+type GraphQLResponse struct {
+	Data   interface{}                `json:"data,omitempty"`
+	Errors []gqlerrors.FormattedError `json:"errors,omitempty"`
+}
+
+// GraphQL answers GraphQL queries over rooms, devices and entities, the
+// topics known to the state cache. Queries are sent as the body of a POST or
+// as the query, operationName and variables parameters of a GET.
+func (h *Handler) GraphQL(c *gin.Context) {
+	if h.state == nil {
+		respondError(c, http.StatusServiceUnavailable, "GraphQL is not available")
+		return
+	}
+
+	var request GraphQLRequest
+	if c.Request.Method == http.MethodGet {
+		request.Query = c.Query("query")
+		request.OperationName = c.Query("operationName")
+		if variables := c.Query("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &request.Variables); err != nil {
+				badRequest(c, &RequestError{Code: "invalid_variables", Param: "variables", Message: fmt.Sprintf("invalid variables: %v", err)})
+				return
+			}
+		}
+	} else if err := c.ShouldBindJSON(&request); err != nil {
+		badRequest(c, err)
+		return
+	}
+	if strings.TrimSpace(request.Query) == "" {
+		badRequest(c, &RequestError{Code: "missing_query", Param: "query", Message: "query is required"})
+		return
+	}
+
+	schema, err := graphqlSchema()
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	document, err := parser.Parse(parser.ParseParams{Source: request.Query})
+	if err != nil {
+		c.JSON(http.StatusOK, GraphQLResponse{Errors: gqlerrors.FormatErrors(err)})
+		return
+	}
+	if validation := graphql.ValidateDocument(&schema, document, nil); !validation.IsValid {
+		c.JSON(http.StatusOK, GraphQLResponse{Errors: validation.Errors})
+		return
+	}
+	if err := checkGraphQLLimits(document, request.OperationName); err != nil {
+		c.JSON(http.StatusOK, GraphQLResponse{Errors: gqlerrors.FormatErrors(err)})
+		return
+	}
+
+	ctx := context.WithValue(c.Request.Context(), graphqlContextKey{}, h.newGraphQLContext(c.Request.Context(), allowlist(c)))
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        schema,
+		AST:           document,
+		OperationName: request.OperationName,
+		Args:          request.Variables,
+		Context:       ctx,
+	})
+	c.JSON(http.StatusOK, GraphQLResponse{Data: result.Data, Errors: result.Errors})
+}
+
+// checkGraphQLLimits rejects operations nested deeper than maxGraphQLDepth or
+// costing more than maxGraphQLComplexity. Introspection fields are free.
+func checkGraphQLLimits(document *ast.Document, operationName string) error {
+	fragments := make(map[string]*ast.FragmentDefinition)
+	var operations []*ast.OperationDefinition
+	for _, definition := range document.Definitions {
+		switch definition := definition.(type) {
+		case *ast.FragmentDefinition:
+			fragments[definition.Name.Value] = definition
+		case *ast.OperationDefinition:
+			if operationName == "" || (definition.Name != nil && definition.Name.Value == operationName) {
+				operations = append(operations, definition)
+			}
+		}
+	}
+
+	for _, operation := range operations {
+		walker := limitWalker{fragments: fragments, visiting: make(map[string]bool)}
+		walker.walk(operation.SelectionSet, 1)
+		if walker.depth > maxGraphQLDepth {
+			return fmt.Errorf("query depth %d exceeds the limit of %d", walker.depth, maxGraphQLDepth)
+		}
+		if walker.cost > maxGraphQLComplexity {
+			return fmt.Errorf("query complexity %d exceeds the limit of %d", walker.cost, maxGraphQLComplexity)
+		}
+	}
+	return nil
+}
+
+// limitWalker measures the depth and cost of a selection set, expanding
+// fragments where they are spread
+type limitWalker struct {
+	fragments map[string]*ast.FragmentDefinition
+	visiting  map[string]bool
+	depth     int
+	cost      int
+}
+
+func (w *limitWalker) walk(set *ast.SelectionSet, depth int) {
+	if set == nil {
+		return
+	}
+	for _, selection := range set.Selections {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			name := selection.Name.Value
+			if strings.HasPrefix(name, "__") {
+				continue
+			}
+			if depth > w.depth {
+				w.depth = depth
+			}
+			w.cost++
+			if graphqlQueryFields[name] {
+				w.cost += graphqlQueryCost
+			}
+			w.walk(selection.SelectionSet, depth+1)
+		case *ast.InlineFragment:
+			w.walk(selection.SelectionSet, depth)
+		case *ast.FragmentSpread:
+			name := selection.Name.Value
+			fragment, ok := w.fragments[name]
+			if !ok || w.visiting[name] {
+				continue
+			}
+			w.visiting[name] = true
+			w.walk(fragment.SelectionSet, depth)
+			w.visiting[name] = false
+		}
+	}
+}
+
+type graphqlContextKey struct{}
+
+// graphqlContext holds a snapshot of the topics the request may read and the
+// batch loaders of one request
+type graphqlContext struct {
+	h   *Handler
+	ctx context.Context
+	now time.Time
+
+	allowed  db.Allowlist
+	entries  []state.Entry
+	rooms    []string
+	devices  []string
+	byRoom   map[string][]state.Entry
+	byDevice map[string][]state.Entry
+
+	deviceStats *batchLoader[string, db.Discovered]
+
+	mu       sync.Mutex
+	series   map[seriesKey]*batchLoader[string, *Series]
+	switches map[rangeKey]*batchLoader[string, *SwitchActivity]
+	// points counts the points of all series loaded so far
+	points int
+}
+
+// rangeKey identifies the time range of a field's arguments
+type rangeKey struct {
+	start, end int64
+}
+
+// seriesKey identifies the arguments of a series field
+type seriesKey struct {
+	rangeKey
+	step        time.Duration
+	aggregation string
+	fill        string
+}
+
+func (h *Handler) newGraphQLContext(ctx context.Context, allowed db.Allowlist) *graphqlContext {
+	gc := &graphqlContext{
+		h:        h,
+		ctx:      ctx,
+		now:      time.Now(),
+		allowed:  allowed,
+		byRoom:   make(map[string][]state.Entry),
+		byDevice: make(map[string][]state.Entry),
+		series:   make(map[seriesKey]*batchLoader[string, *Series]),
+		switches: make(map[rangeKey]*batchLoader[string, *SwitchActivity]),
+	}
+	for _, entry := range h.state.Match("") {
+		if !allowed.Allows(entry.Room, entry.Device) {
+			continue
+		}
+		gc.entries = append(gc.entries, entry)
+		if entry.Room != "" {
+			if _, ok := gc.byRoom[entry.Room]; !ok {
+				gc.rooms = append(gc.rooms, entry.Room)
+			}
+			gc.byRoom[entry.Room] = append(gc.byRoom[entry.Room], entry)
+		}
+		if entry.Device != "" {
+			if _, ok := gc.byDevice[entry.Device]; !ok {
+				gc.devices = append(gc.devices, entry.Device)
+			}
+			gc.byDevice[entry.Device] = append(gc.byDevice[entry.Device], entry)
+		}
+	}
+	sort.Strings(gc.rooms)
+	sort.Strings(gc.devices)
+
+	gc.deviceStats = newBatchLoader(func(devices []string) (map[string]db.Discovered, error) {
+		ctx, cancel := h.mongoDb.WithTimeout(gc.ctx)
+		defer cancel()
+
+		results, err := db.DiscoverNames(ctx, h.mongoDb.Database.Collection(h.collection), "device", devices, allowed)
+		if err != nil {
+			return nil, err
+		}
+		stats := make(map[string]db.Discovered, len(results))
+		for _, result := range results {
+			stats[result.Name] = result
+		}
+		return stats, nil
+	})
+	return gc
+}
+
+func graphqlContextFrom(p graphql.ResolveParams) *graphqlContext {
+	return p.Context.Value(graphqlContextKey{}).(*graphqlContext)
+}
+
+// graphqlRoom and graphqlDevice group the entities of a room or device
+type graphqlRoom struct {
+	name string
+}
+
+type graphqlDevice struct {
+	name string
+}
+
+func (gc *graphqlContext) room(name string) interface{} {
+	if _, ok := gc.byRoom[name]; !ok {
+		return nil
+	}
+	return graphqlRoom{name: name}
+}
+
+func (gc *graphqlContext) device(name string) interface{} {
+	if _, ok := gc.byDevice[name]; !ok {
+		return nil
+	}
+	return graphqlDevice{name: name}
+}
+
+func (gc *graphqlContext) deviceList(names []string) []graphqlDevice {
+	devices := make([]graphqlDevice, 0, len(names))
+	for _, name := range names {
+		devices = append(devices, graphqlDevice{name: name})
+	}
+	return devices
+}
+
+// timeRange parses the start, end and tz arguments of a field
+func (gc *graphqlContext) timeRange(args map[string]interface{}) (time.Time, time.Time, error) {
+	start, _ := args["start"].(string)
+	end, _ := args["end"].(string)
+	tz, _ := args["tz"].(string)
+	return parseTimeRangeValues(start, end, tz, gc.now, gc.h.limits.Span("graphql"))
+}
+
+// seriesLoader returns the loader of the series with the given arguments
+func (gc *graphqlContext) seriesLoader(key seriesKey, start, end time.Time) *batchLoader[string, *Series] {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if loader, ok := gc.series[key]; ok {
+		return loader
+	}
+	loader := newBatchLoader(func(topics []string) (map[string]*Series, error) {
+		ctx, cancel := gc.h.mongoDb.WithTimeout(gc.ctx)
+		defer cancel()
+
+		queries, err := gc.h.planQuery(ctx, db.Selector{Topics: topics, Allowed: gc.allowed}, start, end, key.step)
+		if err != nil {
+			return nil, err
+		}
+		count, err := gc.h.countSeries(ctx, queries, start, end)
+		if err != nil {
+			return nil, err
+		}
+		if err := gc.addPoints(count * bucketCount(end.Sub(start), key.step)); err != nil {
+			return nil, err
+		}
+		series := make(map[string]*Series, len(topics))
+		for _, query := range queries {
+			collection := gc.h.mongoDb.Database.Collection(query.source.Collection)
+			buckets, err := db.AggregateSeries(ctx, collection, query.source, query.filter, start, end, key.step, key.aggregation)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range buildSeries(buckets, start, end, key.step, key.fill) {
+				s.Resolution = resolutionName(query.source)
+				s := s
+				series[s.Topic] = &s
+			}
+		}
+		return series, nil
+	})
+	gc.series[key] = loader
+	return loader
+}
+
+// addPoints counts the points of series about to be loaded, refusing them
+// once the series of the request hold more than the limit together
+func (gc *graphqlContext) addPoints(points int) error {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	gc.points += points
+	return checkPoints(gc.points, gc.h.limits.Points())
+}
+
+// switchLoader returns the loader of the switch activity over a range
+func (gc *graphqlContext) switchLoader(start, end time.Time) *batchLoader[string, *SwitchActivity] {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	key := rangeKey{start: start.UnixNano(), end: end.UnixNano()}
+	if loader, ok := gc.switches[key]; ok {
+		return loader
+	}
+	loader := newBatchLoader(func(topics []string) (map[string]*SwitchActivity, error) {
+		ctx, cancel := gc.h.mongoDb.WithTimeout(gc.ctx)
+		defer cancel()
+
+		histories, err := db.SwitchHistories(ctx, gc.h.mongoDb.Database.Collection(gc.h.collection), topics, start, end)
+		if err != nil {
+			return nil, err
+		}
+		activities := make(map[string]*SwitchActivity, len(histories))
+		for topic, history := range histories {
+			activity := newSwitchActivity(topic, start, end, history)
+			activities[topic] = &activity
+		}
+		return activities, nil
+	})
+	gc.switches[key] = loader
+	return loader
+}
+
+var (
+	graphqlSchemaOnce sync.Once
+	graphqlSchemaVal  graphql.Schema
+	graphqlSchemaErr  error
+)
+
+// graphqlSchema returns the schema of the GraphQL endpoint
+func graphqlSchema() (graphql.Schema, error) {
+	graphqlSchemaOnce.Do(func() {
+		graphqlSchemaVal, graphqlSchemaErr = newGraphQLSchema()
+	})
+	return graphqlSchemaVal, graphqlSchemaErr
+}
+
+// jsonScalar passes reading values through as they are stored
+var jsonScalar = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "JSON",
+	Description: "A reading value: a number, a string or an object",
+	Serialize:   func(value interface{}) interface{} { return value },
+	ParseValue:  func(value interface{}) interface{} { return value },
+	ParseLiteral: func(value ast.Value) interface{} {
+		return value.GetValue()
+	},
+})
+
+// timeRangeArgs are the arguments of fields over a time range
+func timeRangeArgs() graphql.FieldConfigArgument {
+	return graphql.FieldConfigArgument{
+		"start": &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: defaultStart, Description: "Start of the range, as for the REST API"},
+		"end":   &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: defaultEnd, Description: "End of the range, as for the REST API"},
+		"tz":    &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: "", Description: "Time zone of dates and rounding"},
+	}
+}
+
+func newGraphQLSchema() (graphql.Schema, error) {
+	reading := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Reading",
+		Description: "The latest reading of an entity",
+		Fields: graphql.Fields{
+			"value":       &graphql.Field{Type: jsonScalar},
+			"timestamp":   &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"age_seconds": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+		},
+	})
+
+	point := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Point",
+		Fields: graphql.Fields{
+			"timestamp": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"value":     &graphql.Field{Type: graphql.Float, Description: "Null for buckets without readings"},
+		},
+	})
+
+	series := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Series",
+		Description: "Evenly spaced buckets of an entity's readings",
+		Fields: graphql.Fields{
+			"topic":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"resolution": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"points":     &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(point)))},
+		},
+	})
+
+	onInterval := graphql.NewObject(graphql.ObjectConfig{
+		Name: "OnInterval",
+		Fields: graphql.Fields{
+			"start":            &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"end":              &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"duration_seconds": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"open":             &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+		},
+	})
+
+	switchActivity := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "SwitchActivity",
+		Description: "On/off activity of a switch entity",
+		Fields: graphql.Fields{
+			"start":              &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"end":                &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"on_count":           &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"off_count":          &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"on_seconds":         &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"duty_cycle_percent": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"longest_on_seconds": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"intervals": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(onInterval))),
+				Description: "The first 1000 intervals of the range",
+			},
+			"intervals_truncated": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Set when the range holds more intervals, the totals cover all of them",
+			},
+		},
+	})
+
+	// Rooms, devices and entities refer to each other, so their fields are
+	// declared once all three exist
+	var room, device, entity *graphql.Object
+
+	room = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Room",
+		Description: "A room and the devices and entities in it",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"name": &graphql.Field{
+					Type:    graphql.NewNonNull(graphql.String),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(graphqlRoom).name, nil },
+				},
+				"devices": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(device))),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						gc := graphqlContextFrom(p)
+						var names []string
+						seen := make(map[string]bool)
+						for _, entry := range gc.byRoom[p.Source.(graphqlRoom).name] {
+							if entry.Device != "" && !seen[entry.Device] {
+								seen[entry.Device] = true
+								names = append(names, entry.Device)
+							}
+						}
+						sort.Strings(names)
+						return gc.deviceList(names), nil
+					},
+				},
+				"entities": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(entity))),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return graphqlContextFrom(p).byRoom[p.Source.(graphqlRoom).name], nil
+					},
+				},
+			}
+		}),
+	})
+
+	// deviceStat resolves a field of the batched statistics of a device
+	deviceStat := func(field func(db.Discovered) interface{}) graphql.FieldResolveFn {
+		return func(p graphql.ResolveParams) (interface{}, error) {
+			load := graphqlContextFrom(p).deviceStats.Load(p.Source.(graphqlDevice).name)
+			return func() (interface{}, error) {
+				stats, err := load()
+				if err != nil {
+					return nil, err
+				}
+				return field(stats), nil
+			}, nil
+		}
+	}
+
+	device = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Device",
+		Description: "A device and the entities it reports",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"name": &graphql.Field{
+					Type:    graphql.NewNonNull(graphql.String),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(graphqlDevice).name, nil },
+				},
+				"room": &graphql.Field{
+					Type:        room,
+					Description: "The room of the device's first entity with one",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						gc := graphqlContextFrom(p)
+						for _, entry := range gc.byDevice[p.Source.(graphqlDevice).name] {
+							if entry.Room != "" {
+								return gc.room(entry.Room), nil
+							}
+						}
+						return nil, nil
+					},
+				},
+				"entities": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(entity))),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return graphqlContextFrom(p).byDevice[p.Source.(graphqlDevice).name], nil
+					},
+				},
+				"first_seen": &graphql.Field{
+					Type:    graphql.DateTime,
+					Resolve: deviceStat(func(stats db.Discovered) interface{} { return nullTime(stats.FirstSeen) }),
+				},
+				"last_seen": &graphql.Field{
+					Type:    graphql.DateTime,
+					Resolve: deviceStat(func(stats db.Discovered) interface{} { return nullTime(stats.LastSeen) }),
+				},
+				"reading_count": &graphql.Field{
+					Type:    graphql.NewNonNull(graphql.Int),
+					Resolve: deviceStat(func(stats db.Discovered) interface{} { return stats.Count }),
+				},
+			}
+		}),
+	})
+
+	seriesArgs := timeRangeArgs()
+	seriesArgs["step"] = &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: "", Description: "Bucket width, picked from the range when empty"}
+	seriesArgs["agg"] = &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: "avg", Description: "One of " + strings.Join(db.SeriesAggregations, ", ")}
+	seriesArgs["fill"] = &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: FillNull, Description: "null, previous or linear"}
+
+	entity = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Entity",
+		Description: "A topic and its latest reading",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"topic": &graphql.Field{
+					Type:    graphql.NewNonNull(graphql.String),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(state.Entry).Topic, nil },
+				},
+				"sensor_type": &graphql.Field{
+					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return nullString(p.Source.(state.Entry).SensorType), nil
+					},
+				},
+				"unit": &graphql.Field{
+					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return nullString(p.Source.(state.Entry).Unit), nil
+					},
+				},
+				"room": &graphql.Field{
+					Type: room,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return graphqlContextFrom(p).room(p.Source.(state.Entry).Room), nil
+					},
+				},
+				"device": &graphql.Field{
+					Type: device,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return graphqlContextFrom(p).device(p.Source.(state.Entry).Device), nil
+					},
+				},
+				"state": &graphql.Field{
+					Type: graphql.NewNonNull(reading),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return newStateEntry(p.Source.(state.Entry), graphqlContextFrom(p).now), nil
+					},
+				},
+				"series": &graphql.Field{
+					Type:        series,
+					Description: "Null when the entity has no numeric readings in the range",
+					Args:        seriesArgs,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						gc := graphqlContextFrom(p)
+						start, end, err := gc.timeRange(p.Args)
+						if err != nil {
+							return nil, err
+						}
+						stepValue, _ := p.Args["step"].(string)
+						step, err := parseStep(stepValue, end.Sub(start), gc.h.limits.Points())
+						if err != nil {
+							return nil, err
+						}
+						aggregation, _ := p.Args["agg"].(string)
+						if !contains(db.SeriesAggregations, aggregation) {
+							return nil, fmt.Errorf("invalid agg %q, expected one of %s", aggregation, strings.Join(db.SeriesAggregations, ", "))
+						}
+						fill, _ := p.Args["fill"].(string)
+						if fill != FillNull && fill != FillPrevious && fill != FillLinear {
+							return nil, fmt.Errorf("invalid fill %q, expected null, previous or linear", fill)
+						}
+
+						key := seriesKey{rangeKey: rangeKey{start: start.UnixNano(), end: end.UnixNano()}, step: step, aggregation: aggregation, fill: fill}
+						load := gc.seriesLoader(key, start, end).Load(p.Source.(state.Entry).Topic)
+						return func() (interface{}, error) {
+							series, err := load()
+							if err != nil || series == nil {
+								return nil, err
+							}
+							return series, nil
+						}, nil
+					},
+				},
+				"switch_activity": &graphql.Field{
+					Type:        switchActivity,
+					Description: "On/off activity, for switch entities",
+					Args:        timeRangeArgs(),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						gc := graphqlContextFrom(p)
+						start, end, err := gc.timeRange(p.Args)
+						if err != nil {
+							return nil, err
+						}
+						start, end = untilNow(start, end)
+						load := gc.switchLoader(start, end).Load(p.Source.(state.Entry).Topic)
+						return func() (interface{}, error) {
+							activity, err := load()
+							if err != nil || activity == nil {
+								return nil, err
+							}
+							return activity, nil
+						}, nil
+					},
+				},
+			}
+		}),
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"rooms": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(room))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					gc := graphqlContextFrom(p)
+					rooms := make([]graphqlRoom, 0, len(gc.rooms))
+					for _, name := range gc.rooms {
+						rooms = append(rooms, graphqlRoom{name: name})
+					}
+					return rooms, nil
+				},
+			},
+			"room": &graphql.Field{
+				Type: room,
+				Args: graphql.FieldConfigArgument{"name": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return graphqlContextFrom(p).room(p.Args["name"].(string)), nil
+				},
+			},
+			"devices": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(device))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					gc := graphqlContextFrom(p)
+					return gc.deviceList(gc.devices), nil
+				},
+			},
+			"device": &graphql.Field{
+				Type: device,
+				Args: graphql.FieldConfigArgument{"name": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return graphqlContextFrom(p).device(p.Args["name"].(string)), nil
+				},
+			},
+			"entities": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(entity))),
+				Description: "Entities matching any of the topic filters and the sensor type, all without arguments",
+				Args: graphql.FieldConfigArgument{
+					"topic":       &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String)), Description: "Topics or MQTT topic filters"},
+					"sensor_type": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var patterns []string
+					if topics, ok := p.Args["topic"].([]interface{}); ok {
+						for _, topic := range topics {
+							patterns = append(patterns, topic.(string))
+						}
+					}
+					sensorType, _ := p.Args["sensor_type"].(string)
+
+					entities := []state.Entry{}
+					for _, entry := range graphqlContextFrom(p).entries {
+						if sensorType != "" && entry.SensorType != sensorType {
+							continue
+						}
+						if len(patterns) > 0 && !matchesAnyTopic(patterns, entry.Topic) {
+							continue
+						}
+						entities = append(entities, entry)
+					}
+					return entities, nil
+				},
+			},
+			"entity": &graphql.Field{
+				Type: entity,
+				Args: graphql.FieldConfigArgument{"topic": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					entry, ok := graphqlContextFrom(p).h.state.Get(p.Args["topic"].(string))
+					if !ok {
+						return nil, nil
+					}
+					return entry, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query})
+}
+
+func matchesAnyTopic(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		if db.TopicMatches(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// nullString returns nil for empty tags and units
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullTime returns nil for the zero time, of devices without stored readings
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
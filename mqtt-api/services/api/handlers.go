@@ -6,20 +6,59 @@ import (
 	"net/http"
 	"time"
 
+	"home_automation_dashboard/mqtt-api/services/apikeys"
+	"home_automation_dashboard/mqtt-api/services/ingest"
+	"home_automation_dashboard/mqtt-api/services/limits"
+	"home_automation_dashboard/mqtt-api/services/materialize"
+	"home_automation_dashboard/mqtt-api/services/media"
+	"home_automation_dashboard/mqtt-api/services/oidc"
+	"home_automation_dashboard/mqtt-api/services/querycache"
+	"home_automation_dashboard/mqtt-api/services/state"
+	"home_automation_dashboard/shared/db"
+
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // Handler struct for API
 type Handler struct {
-	client     *mongo.Client
-	database   string
+	mongoDb    *db.MongoDB
 	collection string
+	retention  *db.Retention
+
+	materializer *materialize.Materializer
+	state        *state.Cache
+	media        media.Rules
+	ingestTokens ingest.Tokens
+	keys         *apikeys.Store
+	oidc         *oidc.Verifier
+
+	limits     limits.Config
+	ipLimiter  *limits.Limiter
+	keyLimiter *limits.Limiter
+
+	queries *querycache.Cache
 }
 
+// Topics of the switches and Roku devices whose durations are tracked
+var (
+	switchTopics = []string{
+		"home/ezras_room_heater/state",
+		"home/nikos_room_heater/state",
+		"home/bulb_b/state",
+		"home/bulb_d/state",
+		"home/doorbell_motion/state",
+		"home/aquarium_power_monitor/state",
+	}
+	rokuTopics = []string{
+		"home/living_room_roku_active_app",
+		"home/office_roku_active_app",
+		"home/basement_roku_active_app",
+	}
+)
+
 // Prometheus metrics
 var (
 	switchOnDuration = prometheus.NewGaugeVec(
@@ -54,10 +93,37 @@ var (
 	appUsage = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "app_usage_seconds_total",
-			Help: "Total time spent on each app.",
+			Help: "Total time spent on each app, in seconds",
 		},
 		[]string{"topic", "app"},
 	)
+	apiAuthFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_auth_failures_total",
+			Help: "Requests rejected for a missing, invalid, revoked or insufficient API key",
+		},
+		[]string{"reason"},
+	)
+	apiRequestsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_requests_rejected_total",
+			Help: "Requests rejected by a rate, time range, point or body size limit",
+		},
+		[]string{"reason"},
+	)
+	queryCacheHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_query_cache_hits_total",
+			Help: "Query results served from the cache, by the layer that held them",
+		},
+		[]string{"layer"},
+	)
+	queryCacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "api_query_cache_misses_total",
+			Help: "Cacheable queries answered from the database",
+		},
+	)
 )
 
 func init() {
@@ -66,17 +132,84 @@ func init() {
 	prometheus.MustRegister(kitchenTemperature)
 	prometheus.MustRegister(temperatureHistogram)
 	prometheus.MustRegister(appUsage)
+	prometheus.MustRegister(apiAuthFailures)
+	prometheus.MustRegister(apiRequestsRejected)
+	prometheus.MustRegister(queryCacheHits)
+	prometheus.MustRegister(queryCacheMisses)
+}
+
+// HandlerOptions holds the optional dependencies of a Handler.
+type HandlerOptions struct {
+	// Retention routes queries to the rollup tiers coarse enough to answer
+	// them, queries read raw readings when it is nil
+	Retention *db.Retention
+	// State serves the latest readings and live stream, only commands that
+	// serve no requests may leave it nil
+	State *state.Cache
+	// Media defines the app sessions of the media devices
+	Media media.Rules
+	// IngestTokens are accepted by the HTTP ingest routes besides API keys
+	IngestTokens ingest.Tokens
+	// Requests need an API key from Keys or a user token accepted by OIDC,
+	// unless both are nil
+	Keys *apikeys.Store
+	OIDC *oidc.Verifier
+	// Limits bounds the rate, time range, points and body size of requests
+	Limits limits.Config
+	// Queries caches aggregates when it is not nil
+	Queries *querycache.Cache
 }
 
-// NewHandler initializes a new Handler instance
-func NewHandler(client *mongo.Client, database string) *Handler {
+// NewHandler initializes a new Handler instance reading the readings of
+// mongoDb.
+func NewHandler(mongoDb *db.MongoDB, opts HandlerOptions) *Handler {
+	retention := opts.Retention
+	if retention == nil {
+		retention = db.NewRetention(mongoDb.Database, "mqtt_events", nil)
+	}
+
 	return &Handler{
-		client:     client,
-		database:   database,
+		mongoDb:    mongoDb,
 		collection: "mqtt_events",
+		retention:  retention,
+
+		materializer: materialize.New(mongoDb.Database, "mqtt_events", switchTopics, rokuTopics, opts.Media),
+		state:        opts.State,
+		media:        opts.Media,
+		ingestTokens: opts.IngestTokens,
+		keys:         opts.Keys,
+		oidc:         opts.OIDC,
+
+		limits:     opts.Limits,
+		ipLimiter:  limits.NewLimiter(opts.Limits.IPRate),
+		keyLimiter: limits.NewLimiter(opts.Limits.KeyRate),
+
+		queries: opts.Queries,
 	}
 }
 
+// EnsureIndexes creates the indexes the handler's queries rely on
+func (h *Handler) EnsureIndexes(ctx context.Context) error {
+	// Pages of events across all topics are read in (timestamp, _id) order
+	_, err := h.mongoDb.Database.Collection(h.collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+	if h.keys != nil {
+		if err := h.keys.EnsureIndexes(ctx); err != nil {
+			return err
+		}
+	}
+	return h.materializer.EnsureIndexes(ctx)
+}
+
+// TemperatureResponse is returned by GET /api/v1/temperature/{average,max,min}
+type TemperatureResponse struct {
+	Value float64 `json:"value"`
+}
+
 // GetAverageTemperature handles requests to calculate the average temperature
 func (h *Handler) GetAverageTemperature(c *gin.Context) {
 	h.aggregateTemperature(c, "$avg")
@@ -96,35 +229,64 @@ func (h *Handler) GetMinTemperature(c *gin.Context) {
 func (h *Handler) aggregateTemperature(c *gin.Context, aggregation string) {
 	topic, startTime, endTime, err := h.parseQueryParams(c)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		badRequest(c, err)
 		return
 	}
+	if !h.authorizeTopic(c, topic) {
+		return
+	}
+
+	now := time.Now()
+	key := queryCacheKey(c, startTime, endTime, now, aggregation, topic)
+	if h.respondCached(c, key) {
+		return
+	}
+
+	// A single value over the whole range can be answered by any tier
+	source := h.retention.Select(topic, startTime, endTime, endTime.Sub(startTime))
 
-	pipeline := h.buildAggregationPipeline(topic, startTime, endTime, aggregation)
+	var pipeline bson.A
+	if source.IsRollup() {
+		pipeline = h.buildRollupAggregationPipeline(topic, startTime, endTime, aggregation)
+	} else {
+		pipeline = h.buildAggregationPipeline(topic, startTime, endTime, aggregation)
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := h.mongoDb.WithTimeout(c.Request.Context())
 	defer cancel()
 
-	collection := h.client.Database(h.database).Collection(h.collection)
+	collection := h.mongoDb.Database.Collection(source.Collection)
 	cursor, err := collection.Aggregate(ctx, pipeline)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		internalError(c, err)
 		return
 	}
 	defer cursor.Close(ctx)
 
 	var result []bson.M
 	if err = cursor.All(ctx, &result); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		internalError(c, err)
 		return
 	}
 
 	if len(result) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"message": "No data found"})
+		respondError(c, http.StatusNotFound, "No data found")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"value": result[0]["result"]})
+	var value float64
+	switch v := result[0]["result"].(type) {
+	case float64:
+		value = v
+	case int32:
+		value = float64(v)
+	case int64:
+		value = float64(v)
+	default:
+		respondError(c, http.StatusNotFound, "No data found")
+		return
+	}
+	h.respondAndCache(c, key, endTime, now, TemperatureResponse{Value: value})
 }
 
 // parseQueryParams extracts and validates query parameters
@@ -134,21 +296,10 @@ func (h *Handler) parseQueryParams(c *gin.Context) (string, time.Time, time.Time
 		topic = "home/kitchen_temperature/state"
 	}
 
-	layout := "2006-01-02"
-	startDate := c.Query("start")
-	endDate := c.Query("end")
-
-	startTime, err := time.Parse(layout, startDate)
-	if err != nil {
-		return "", time.Time{}, time.Time{}, err
-	}
-
-	endTime, err := time.Parse(layout, endDate)
+	startTime, endTime, err := h.parseTimeRange(c)
 	if err != nil {
 		return "", time.Time{}, time.Time{}, err
 	}
-
-	endTime = endTime.Add(24 * time.Hour) // Include the entire day
 	return topic, startTime, endTime, nil
 }
 
@@ -157,298 +308,106 @@ func (h *Handler) buildAggregationPipeline(topic string, startTime, endTime time
 	return bson.A{
 		bson.D{{Key: "$match", Value: bson.D{
 			{Key: "topic", Value: topic},
-			{Key: "time", Value: bson.D{
+			{Key: "timestamp", Value: bson.D{
 				{Key: "$gte", Value: startTime},
 				{Key: "$lt", Value: endTime},
 			}},
-		}}},
-		bson.D{{Key: "$addFields", Value: bson.D{
-			{Key: "numeric_payload", Value: bson.D{{Key: "$toDouble", Value: "$payload"}}},
+			{Key: "value", Value: bson.D{{Key: "$type", Value: "number"}}},
 		}}},
 		bson.D{{Key: "$group", Value: bson.D{
 			{Key: "_id", Value: nil},
-			{Key: "result", Value: bson.D{{Key: aggregation, Value: "$numeric_payload"}}},
+			{Key: "result", Value: bson.D{{Key: aggregation, Value: "$value"}}},
 		}}},
 	}
 }
 
-func (h *Handler) UpdateSwitchMetrics() {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	collection := h.client.Database(h.database).Collection(h.collection)
+// buildRollupAggregationPipeline constructs the aggregation pipeline over the
+// buckets of a rollup tier
+func (h *Handler) buildRollupAggregationPipeline(topic string, startTime, endTime time.Time, aggregation string) bson.A {
+	var result interface{}
+	switch aggregation {
+	case "$avg":
+		result = bson.D{{Key: "$divide", Value: bson.A{"$sum", "$count"}}}
+	case "$max":
+		result = "$max"
+	case "$min":
+		result = "$min"
+	}
 
-	// Aggregation pipeline to get the latest state for each switch
-	pipeline := bson.A{
+	return bson.A{
 		bson.D{{Key: "$match", Value: bson.D{
-			{Key: "topic", Value: bson.D{{Key: "$in", Value: []string{
-				"home/ezras_room_heater/state",
-				"home/nikos_room_heater/state",
-				"home/bulb_b/state",
-				"home/bulb_d/state",
-				"home/doorbell_motion/state",
-				"home/aquarium_power_monitor/state",
-			}}}},
-		}}}, // Filter documents with matching topics
-		bson.D{{Key: "$sort", Value: bson.D{{Key: "timestamp", Value: -1}}}}, // Sort by latest timestamp first
+			{Key: "topic", Value: topic},
+			{Key: "timestamp", Value: bson.D{
+				{Key: "$gte", Value: startTime},
+				{Key: "$lt", Value: endTime},
+			}},
+		}}},
 		bson.D{{Key: "$group", Value: bson.D{
-			{Key: "_id", Value: "$topic"},
-			{Key: "lastState", Value: bson.D{{Key: "$first", Value: "$value"}}},
-			{Key: "lastTimestamp", Value: bson.D{{Key: "$first", Value: "$timestamp"}}},
+			{Key: "_id", Value: nil},
+			{Key: "sum", Value: bson.D{{Key: "$sum", Value: "$sum"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: "$count"}}},
+			{Key: "max", Value: bson.D{{Key: "$max", Value: "$max"}}},
+			{Key: "min", Value: bson.D{{Key: "$min", Value: "$min"}}},
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "result", Value: result},
 		}}},
 	}
+}
 
-	cursor, err := collection.Aggregate(ctx, pipeline)
-	if err != nil {
-		log.Printf("Failed to aggregate switch metrics: %v", err)
-		return
-	}
-	defer cursor.Close(ctx)
-
+// UpdateSwitchMetrics sets how long each switch has been on from its latest
+// reading in the state cache
+func (h *Handler) UpdateSwitchMetrics() {
 	currentTime := time.Now()
 
-	for cursor.Next(ctx) {
-		var result struct {
-			Topic         string    `bson:"_id"`
-			LastState     string    `bson:"lastState"`
-			LastTimestamp time.Time `bson:"lastTimestamp"`
-		}
-
-		if err := cursor.Decode(&result); err != nil {
-			log.Printf("Failed to decode aggregation result: %v", err)
+	for _, topic := range switchTopics {
+		entry, ok := h.state.Get(topic)
+		if !ok {
 			continue
 		}
 
-		if result.LastState == "on" {
+		if entry.Value == "on" {
 			// Calculate the duration since the last ON state
-			onDuration := currentTime.Sub(result.LastTimestamp).Seconds()
+			onDuration := currentTime.Sub(entry.Timestamp).Seconds()
 
 			// Update Prometheus metric
-			switchOnDuration.WithLabelValues(result.Topic).Set(onDuration)
-			// log.Printf("Topic: %s, Running Duration: %.2f seconds", result.Topic, onDuration)
+			switchOnDuration.WithLabelValues(topic).Set(onDuration)
 		} else {
 			// If the switch is OFF, set the duration to 0
-			switchOnDuration.WithLabelValues(result.Topic).Set(0)
-			// log.Printf("Topic: %s, Currently OFF", result.Topic)
+			switchOnDuration.WithLabelValues(topic).Set(0)
 		}
 	}
-
-	if err := cursor.Err(); err != nil {
-		log.Printf("Cursor error: %v", err)
-	}
 }
 
-func (h *Handler) UpdateTotalSwitchOnDuration() {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// UpdateDurationMetrics folds new switch and active app events into the
+// materialized state and exports the total ON duration of every switch and
+// the time spent in each app
+func (h *Handler) UpdateDurationMetrics() {
+	ctx, cancel := h.mongoDb.WithTimeout(context.Background())
 	defer cancel()
 
-	collection := h.client.Database(h.database).Collection(h.collection)
-
-	// Aggregation pipeline to calculate total ON duration
-	pipeline := bson.A{
-		bson.D{{Key: "$match", Value: bson.D{
-			{Key: "topic", Value: bson.D{{Key: "$in", Value: []string{
-				"home/ezras_room_heater/state",
-				"home/nikos_room_heater/state",
-				"home/bulb_b/state",
-				"home/bulb_d/state",
-				"home/doorbell_motion/state",
-				"home/aquarium_power_monitor/state",
-			}}}},
-		}}}, // Filter documents with matching topics
-		bson.D{{Key: "$sort", Value: bson.D{
-			{Key: "topic", Value: 1},     // Sort by topic
-			{Key: "timestamp", Value: 1}, // Then sort by timestamp (ascending)
-		}}},
-		bson.D{{Key: "$group", Value: bson.D{
-			{Key: "_id", Value: "$topic"},
-			{Key: "events", Value: bson.D{{Key: "$push", Value: bson.D{
-				{Key: "value", Value: "$value"},
-				{Key: "timestamp", Value: "$timestamp"},
-			}}}},
-		}}},
-	}
-
-	cursor, err := collection.Aggregate(ctx, pipeline)
+	states, err := h.materializer.Update(ctx)
 	if err != nil {
-		log.Printf("Failed to aggregate switch metrics: %v", err)
+		log.Printf("Failed to update materialized state: %v", err)
 		return
 	}
-	defer cursor.Close(ctx)
-
-	for cursor.Next(ctx) {
-		var result struct {
-			Topic  string `bson:"_id"`
-			Events []struct {
-				Value     string    `bson:"value"`
-				Timestamp time.Time `bson:"timestamp"`
-			} `bson:"events"`
-		}
-
-		if err := cursor.Decode(&result); err != nil {
-			log.Printf("Failed to decode aggregation result: %v", err)
-			continue
-		}
-
-		totalOnDuration := calculateTotalOnDuration(result.Events)
-
-		// Update Prometheus metric for total ON duration
-		switchTotalOnDuration.WithLabelValues(result.Topic).Set(totalOnDuration)
-		// log.Printf("Topic: %s, Total ON Duration: %.2f seconds", result.Topic, totalOnDuration)
-	}
-
-	if err := cursor.Err(); err != nil {
-		log.Printf("Cursor error: %v", err)
-	}
-}
 
-func calculateTotalOnDuration(events []struct {
-	Value     string    `bson:"value"`
-	Timestamp time.Time `bson:"timestamp"`
-}) float64 {
-	var totalDuration float64
-	var lastOnTime *time.Time
-	inOnState := false
-
-	for _, event := range events {
-		if event.Value == "on" {
-			if !inOnState {
-				lastOnTime = &event.Timestamp
-				inOnState = true
-			}
-			// Ignore extra 'on' events
-		} else if event.Value == "off" {
-			if inOnState && lastOnTime != nil {
-				duration := event.Timestamp.Sub(*lastOnTime).Seconds()
-				totalDuration += duration
-				lastOnTime = nil
-				inOnState = false
+	now := time.Now()
+	for _, state := range states {
+		switch state.Kind {
+		case materialize.KindSwitch:
+			switchTotalOnDuration.WithLabelValues(state.Topic).Set(state.TotalOnSeconds(now))
+		case materialize.KindApp:
+			for app, seconds := range state.AppSeconds(now, h.media) {
+				appUsage.WithLabelValues(state.Topic, app).Set(seconds)
 			}
 		}
 	}
-
-	// Handle the case where the last event is 'on' without a corresponding 'off'
-	if inOnState && lastOnTime != nil {
-		currentTime := time.Now()
-		duration := currentTime.Sub(*lastOnTime).Seconds()
-		totalDuration += duration
-	}
-
-	// log.Printf("Total ON Duration: %.2f seconds", totalDuration)
-	return totalDuration
-}
-
-func (h *Handler) RokuAppDetails() {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	col := h.client.Database(h.database).Collection(h.collection)
-
-	// Aggregation pipeline to calculate total ON duration
-	pipeline := bson.A{
-		bson.D{{Key: "$match", Value: bson.D{
-			{Key: "topic", Value: bson.D{{Key: "$in", Value: []string{
-				"home/living_room_roku_active_app",
-				"home/office_roku_active_app",
-				"home/basement_roku_active_app",
-			}}}},
-		}}},
-		bson.D{{Key: "$sort", Value: bson.D{
-			{Key: "topic", Value: 1},
-			{Key: "timestamp", Value: 1},
-		}}},
-		bson.D{{Key: "$group", Value: bson.D{
-			{Key: "_id", Value: "$topic"},
-			{Key: "events", Value: bson.D{{Key: "$push", Value: bson.D{
-				{Key: "value", Value: "$value"},
-				{Key: "timestamp", Value: "$timestamp"},
-			}}}},
-		}}},
-	}
-
-	cursor, err := col.Aggregate(context.TODO(), pipeline)
-	if err != nil {
-		log.Printf("Failed to aggregate roku metrics: %v", err)
-		return
-	}
-	defer cursor.Close(ctx)
-
-	var results []bson.M
-	if err = cursor.All(context.TODO(), &results); err != nil {
-		panic(err)
-	}
-
-	processAndExportMetrics(results)
-
-	// Print results for debugging
-	// for _, result := range results {
-	// 	log.Printf("Topic: %v\n", result["_id"])
-	// 	events := result["events"].(bson.A)
-	// 	for _, event := range events {
-	// 		eventDoc := event.(bson.M)
-	// 		log.Printf("  Value: %v, Timestamp: %v\n", eventDoc["value"], eventDoc["timestamp"])
-	// 	}
-	// }
 }
 
-func processAndExportMetrics(results []bson.M) {
-	excludedApps := map[string]bool{
-		"Roku":              true,
-		"Home":              true,
-		"Roku Dynamic Menu": true,
-		"unknown":           true,
-	}
-
-	for _, result := range results {
-		topic := result["_id"].(string)
-		events := result["events"].(bson.A)
-
-		// Map to store total durations for each app
-		totalDurations := make(map[string]float64)
-		var activeApp string     // Tracks the currently active app
-		var startTime *time.Time // Tracks the start time of the current app
-
-		for _, event := range events {
-			currentEvent := event.(bson.M)
-			appName := currentEvent["value"].(string)
-			timestamp := currentEvent["timestamp"].(primitive.DateTime).Time()
-
-			// If the current app is excluded
-			if excludedApps[appName] {
-				if activeApp != "" && startTime != nil {
-					duration := timestamp.Sub(*startTime).Minutes()
-					totalDurations[activeApp] += duration
-					startTime = nil
-					activeApp = "" // Clear the active app
-				}
-				continue
-			}
-
-			if activeApp != "" && appName != activeApp {
-				if startTime != nil {
-					duration := timestamp.Sub(*startTime).Minutes()
-					totalDurations[activeApp] += duration
-				}
-				activeApp = appName
-				startTime = &timestamp
-				continue
-			}
-
-			if activeApp == "" {
-				activeApp = appName
-				startTime = &timestamp
-			}
-		}
-
-		if activeApp != "" && startTime != nil {
-			currentTime := time.Now()
-			duration := currentTime.Sub(*startTime).Minutes()
-			totalDurations[activeApp] += duration
-		}
-
-		for app, duration := range totalDurations {
-			appUsage.WithLabelValues(topic, app).Set(duration)
-			// log.Printf("App: %s, Duration: %.2f minutes", app, duration)
-		}
-	}
+// RebuildMaterializedState recomputes the switch and app totals from all
+// stored events, for when the persisted state has drifted
+func (h *Handler) RebuildMaterializedState(ctx context.Context) error {
+	_, err := h.materializer.Rebuild(ctx)
+	return err
 }
@@ -0,0 +1,245 @@
+package api
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/mqtt-api/services/apikeys"
+	"home_automation_dashboard/mqtt-api/services/ingest"
+	"home_automation_dashboard/shared/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IngestResponse is returned by POST /api/v1/ingest
+type IngestResponse struct {
+	Accepted int `json:"accepted"`
+}
+
+// PostIngest handles readings sent as JSON, a single object or an array
+func (h *Handler) PostIngest(c *gin.Context) {
+	source, ok := h.authorizeIngest(c)
+	if !ok {
+		return
+	}
+
+	body, err := h.readIngestBody(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+	readings, err := ingest.ParseReadings(body)
+	if err != nil {
+		badRequest(c, &RequestError{Code: "invalid_body", Message: err.Error()})
+		return
+	}
+	if len(readings) > ingest.MaxBatch {
+		badRequest(c, &RequestError{Code: "batch_too_large", Message: fmt.Sprintf("at most %d readings may be sent at once", ingest.MaxBatch)})
+		return
+	}
+
+	now := time.Now().UTC()
+	messages := make([]models.MqttMessage, 0, len(readings))
+	for i, reading := range readings {
+		msg, err := reading.Message(source, now)
+		if err != nil {
+			badRequest(c, &RequestError{Code: "invalid_reading", Message: fmt.Sprintf("reading %d: %v", i, err)})
+			return
+		}
+		messages = append(messages, msg)
+	}
+
+	if !h.storeIngested(c, messages) {
+		return
+	}
+	c.JSON(http.StatusOK, IngestResponse{Accepted: len(messages)})
+}
+
+// PostInfluxWrite handles readings sent as InfluxDB line protocol, like the
+// InfluxDB 2 write API. The org and bucket parameters are ignored.
+func (h *Handler) PostInfluxWrite(c *gin.Context) {
+	source, ok := h.authorizeIngest(c)
+	if !ok {
+		return
+	}
+
+	precision, ok := ingest.Precisions[c.DefaultQuery("precision", "ns")]
+	if !ok {
+		badRequest(c, &RequestError{Code: "invalid_precision", Param: "precision", Message: fmt.Sprintf("invalid precision %q, expected ns, us, ms or s", c.Query("precision"))})
+		return
+	}
+
+	body, err := h.readIngestBody(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+	messages, err := ingest.ParseLineProtocol(body, precision, source, time.Now().UTC())
+	if err != nil {
+		badRequest(c, &RequestError{Code: "invalid_line_protocol", Message: err.Error()})
+		return
+	}
+
+	if !h.storeIngested(c, messages) {
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// authorizeIngest returns the source of the request's ingest token, sent as
+// "Authorization: Bearer <token>" or, as InfluxDB clients do, "Token <token>".
+// With authentication on, the name of an API key or user with the
+// write:ingest scope is the source instead. It responds with an error and returns false when there is
+// neither.
+func (h *Handler) authorizeIngest(c *gin.Context) (string, bool) {
+	if len(h.ingestTokens) == 0 && !h.authRequired() {
+		respondError(c, http.StatusServiceUnavailable, "ingestion is disabled, set INGEST_TOKENS to enable it")
+		return "", false
+	}
+
+	scheme, token, _ := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") && !strings.EqualFold(scheme, "Token") {
+		token = ""
+	}
+	if source, ok := h.ingestTokens.Source(strings.TrimSpace(token)); ok {
+		if !h.limitClient(c, "ingest:"+source) {
+			return "", false
+		}
+		return source, true
+	}
+
+	if h.authRequired() {
+		p, ok := h.authenticate(c, apikeys.ScopeWriteIngest)
+		if !ok {
+			return "", false
+		}
+		return principalName(p), true
+	}
+	c.Header("WWW-Authenticate", `Bearer realm="ingest"`)
+	respondError(c, http.StatusUnauthorized, "missing or invalid ingest token")
+	return "", false
+}
+
+// storeIngested inserts the messages, responding with an error and returning
+// false when that fails
+func (h *Handler) storeIngested(c *gin.Context, messages []models.MqttMessage) bool {
+	if len(messages) == 0 {
+		return true
+	}
+	if !messagesAllowed(c, messages) || !h.retainable(c, messages) {
+		return false
+	}
+
+	ctx, cancel := h.mongoDb.WithTimeout(c.Request.Context())
+	defer cancel()
+
+	if err := ingest.Store(ctx, h.mongoDb.Database.Collection(h.collection), messages); err != nil {
+		internalError(c, err)
+		return false
+	}
+	// The switch and app totals are folded in timestamp order
+	if err := h.materializer.Invalidate(ctx, messages); err != nil {
+		internalError(c, err)
+		return false
+	}
+	if err := h.backfillLate(c.Request.Context(), messages); err != nil {
+		internalError(c, err)
+		return false
+	}
+	h.invalidateHistorical(c.Request.Context(), messages)
+	return true
+}
+
+// retainable responds with an error and returns false when a message is
+// older than the raw retention of its topic. Its rollup buckets could no
+// longer be rebuilt to include it.
+func (h *Handler) retainable(c *gin.Context, messages []models.MqttMessage) bool {
+	now := time.Now()
+	for _, msg := range messages {
+		if h.retention.Expired(msg.Topic, msg.Timestamp, now) {
+			badRequest(c, &RequestError{Code: "reading_expired", Message: fmt.Sprintf(
+				"reading of %s at %s is older than the raw retention of its topic", msg.Topic, msg.Timestamp.Format(time.RFC3339))})
+			return false
+		}
+	}
+	return true
+}
+
+// backfillLate rebuilds the rollup buckets of the stored messages that
+// arrived after their buckets had been built, which would otherwise never
+// include them. The ranges are queued first, a rebuild that fails is retried
+// by the next retention pass. It returns an error when they could not be
+// queued.
+func (h *Handler) backfillLate(ctx context.Context, messages []models.MqttMessage) error {
+	type span struct{ from, to time.Time }
+	late := make(map[string]span)
+	for _, msg := range messages {
+		if !h.retention.RolledUp(msg.Topic, msg.Timestamp) {
+			continue
+		}
+		s, ok := late[msg.Topic]
+		if !ok || msg.Timestamp.Before(s.from) {
+			s.from = msg.Timestamp
+		}
+		if !ok || msg.Timestamp.After(s.to) {
+			s.to = msg.Timestamp
+		}
+		late[msg.Topic] = s
+	}
+
+	if len(late) == 0 {
+		return nil
+	}
+
+	ctx, cancel := h.mongoDb.WithTimeout(ctx)
+	defer cancel()
+
+	topics := make([]string, 0, len(late))
+	for topic, s := range late {
+		// Backfill rounds the end up to whole buckets, a reading at the start
+		// of a bucket needs that bucket too
+		if err := h.retention.QueueBackfill(ctx, topic, s.from, s.to.Add(time.Millisecond)); err != nil {
+			return fmt.Errorf("queue backfill of %s: %w", topic, err)
+		}
+		topics = append(topics, topic)
+	}
+	if err := h.retention.RunQueuedBackfills(ctx, topics...); err != nil {
+		log.Printf("Backfill of late readings failed, the next retention pass retries it: %v", err)
+	}
+	return nil
+}
+
+// readIngestBody reads the request body, gzip compressed or not, up to the
+// maximum body size both before and after decompression
+func (h *Handler) readIngestBody(c *gin.Context) ([]byte, error) {
+	maxSize := h.limits.BodySize()
+	tooLarge := &RequestError{Code: "body_too_large", Message: fmt.Sprintf("request body exceeds %d bytes", maxSize)}
+	if c.Request.ContentLength > maxSize {
+		return nil, tooLarge
+	}
+
+	var reader io.Reader = io.LimitReader(c.Request.Body, maxSize+1)
+	if strings.EqualFold(c.GetHeader("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	body, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > int(maxSize) {
+		return nil, tooLarge
+	}
+	return body, nil
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// limitIP is middleware rejecting requests of clients that exceed the rate
+// per IP address
+func (h *Handler) limitIP(c *gin.Context) {
+	if ok, delay := h.ipLimiter.Allow(c.ClientIP()); !ok {
+		tooManyRequests(c, delay, "rate_limited_ip")
+		c.Abort()
+	}
+}
+
+// limitClient takes a request of the API key, user or ingest source client
+// from its rate. It responds with an error and returns false when the rate
+// is exceeded.
+func (h *Handler) limitClient(c *gin.Context, client string) bool {
+	if ok, delay := h.keyLimiter.Allow(client); !ok {
+		tooManyRequests(c, delay, "rate_limited_key")
+		return false
+	}
+	return true
+}
+
+// tooManyRequests responds with 429, asking the client to retry after delay
+func tooManyRequests(c *gin.Context, delay time.Duration, reason string) {
+	apiRequestsRejected.WithLabelValues(reason).Inc()
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, ErrorResponse{Error: "rate limit exceeded, retry later", Code: "rate_limited"})
+}
+
+// endpointName names the endpoint of a route for its limits: the first path
+// segment after /api/v1, or the first one of other routes, e.g. "stats" for
+// /api/v1/stats and "grafana" for /grafana/query
+func endpointName(route string) string {
+	route = strings.TrimPrefix(strings.TrimPrefix(route, "/api/v1"), "/")
+	name, _, _ := strings.Cut(route, "/")
+	return name
+}
@@ -0,0 +1,55 @@
+package api
+
+import "sync"
+
+// batchLoader loads values by key in batches. Keys requested while a level
+// of a GraphQL query resolves are loaded together the first time one of
+// their values is needed, so a list of entities costs one query per field
+// instead of one per entity.
+type batchLoader[K comparable, V any] struct {
+	load func(keys []K) (map[K]V, error)
+
+	mu      sync.Mutex
+	pending []K
+	queued  map[K]bool
+	values  map[K]V
+	errs    map[K]error
+}
+
+func newBatchLoader[K comparable, V any](load func(keys []K) (map[K]V, error)) *batchLoader[K, V] {
+	return &batchLoader[K, V]{
+		load:   load,
+		queued: make(map[K]bool),
+		values: make(map[K]V),
+		errs:   make(map[K]error),
+	}
+}
+
+// Load queues key and returns a thunk of its value. Keys the batch did not
+// return have the zero value.
+func (l *batchLoader[K, V]) Load(key K) func() (V, error) {
+	l.mu.Lock()
+	if !l.queued[key] {
+		l.queued[key] = true
+		l.pending = append(l.pending, key)
+	}
+	l.mu.Unlock()
+
+	return func() (V, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if len(l.pending) > 0 {
+			keys := l.pending
+			l.pending = nil
+			values, err := l.load(keys)
+			for _, k := range keys {
+				if err != nil {
+					l.errs[k] = err
+				} else if value, ok := values[k]; ok {
+					l.values[k] = value
+				}
+			}
+		}
+		return l.values[key], l.errs[key]
+	}
+}
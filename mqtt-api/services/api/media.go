@@ -0,0 +1,221 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/mqtt-api/services/media"
+	"home_automation_dashboard/shared/db"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MediaUsageResponse is returned by GET /api/v1/media/usage
+type MediaUsageResponse struct {
+	Start   time.Time     `json:"start"`
+	End     time.Time     `json:"end"`
+	Devices []DeviceUsage `json:"devices"`
+}
+
+// DeviceUsage is the app usage of one streaming device
+type DeviceUsage struct {
+	Device       string             `json:"device"`
+	Topic        string             `json:"topic"`
+	TotalSeconds float64            `json:"total_seconds"`
+	Apps         map[string]float64 `json:"apps"`
+	Daily        []UsagePeriod      `json:"daily"`
+	Weekly       []UsagePeriod      `json:"weekly"`
+	Sessions     []AppSession       `json:"sessions"`
+}
+
+// UsagePeriod totals the app usage of a day or of a week starting on Monday
+type UsagePeriod struct {
+	Start        time.Time          `json:"start"`
+	TotalSeconds float64            `json:"total_seconds"`
+	Apps         map[string]float64 `json:"apps"`
+}
+
+// AppSession is a period an app was active, clipped to the requested range.
+// Open sessions were still running at the end of the range.
+type AppSession struct {
+	App             string    `json:"app"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Open            bool      `json:"open"`
+}
+
+// GetMediaUsage handles requests for the app sessions of the streaming
+// devices and their daily and weekly totals. Days and weeks follow the tz
+// parameter.
+func (h *Handler) GetMediaUsage(c *gin.Context) {
+	startTime, endTime, err := h.parseTimeRange(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	// Running sessions only count up to now
+	if now := time.Now(); endTime.After(now) {
+		endTime = now
+		if endTime.Before(startTime) {
+			endTime = startTime
+		}
+	}
+
+	devices := queryList(c, "device")
+
+	ctx, cancel := h.mongoDb.WithTimeout(c.Request.Context())
+	defer cancel()
+
+	response := MediaUsageResponse{Start: startTime, End: endTime, Devices: []DeviceUsage{}}
+	for _, topic := range rokuTopics {
+		device := mediaDeviceName(topic)
+		if len(devices) > 0 && !contains(devices, device) || !h.topicAllowed(c, topic) {
+			continue
+		}
+
+		events, err := h.appEvents(ctx, topic, startTime, endTime)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		sessions := h.media.Sessions(events, startTime, endTime)
+		response.Devices = append(response.Devices, newDeviceUsage(device, topic, sessions))
+	}
+	sort.Slice(response.Devices, func(i, j int) bool {
+		return response.Devices[i].Device < response.Devices[j].Device
+	})
+
+	c.JSON(http.StatusOK, response)
+}
+
+// appEvents returns the app events of topic between start and end, preceded
+// by the last event before start so that a running session is included
+func (h *Handler) appEvents(ctx context.Context, topic string, start, end time.Time) ([]media.Event, error) {
+	collection := h.mongoDb.Database.Collection(h.collection)
+	projection := bson.D{{Key: "value", Value: 1}, {Key: "timestamp", Value: 1}}
+
+	type appEvent struct {
+		Value     interface{} `bson:"value"`
+		Timestamp time.Time   `bson:"timestamp"`
+	}
+	toEvent := func(e appEvent) media.Event {
+		app, _ := e.Value.(string)
+		return media.Event{App: app, Timestamp: e.Timestamp}
+	}
+
+	var events []media.Event
+
+	var previous appEvent
+	err := collection.FindOne(ctx,
+		bson.D{{Key: "topic", Value: topic}, {Key: "timestamp", Value: bson.D{{Key: "$lt", Value: start}}}},
+		options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).SetProjection(projection),
+	).Decode(&previous)
+	switch {
+	case err == nil:
+		events = append(events, toEvent(previous))
+	case !errors.Is(err, mongo.ErrNoDocuments):
+		return nil, err
+	}
+
+	filter := append(bson.D{{Key: "topic", Value: topic}}, db.TimeRangeFilter(start, end)...)
+	cursor, err := collection.Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}).SetProjection(projection))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var e appEvent
+		if err := cursor.Decode(&e); err != nil {
+			return nil, err
+		}
+		events = append(events, toEvent(e))
+	}
+	return events, cursor.Err()
+}
+
+func newDeviceUsage(device, topic string, sessions []media.Session) DeviceUsage {
+	usage := DeviceUsage{
+		Device:   device,
+		Topic:    topic,
+		Apps:     make(map[string]float64),
+		Daily:    usagePeriods(sessions, "d"),
+		Weekly:   usagePeriods(sessions, "w"),
+		Sessions: make([]AppSession, 0, len(sessions)),
+	}
+	for _, session := range sessions {
+		seconds := session.Duration().Seconds()
+		usage.TotalSeconds += seconds
+		usage.Apps[session.App] += seconds
+		usage.Sessions = append(usage.Sessions, AppSession{
+			App:             session.App,
+			Start:           session.Start,
+			End:             session.End,
+			DurationSeconds: seconds,
+			Open:            session.Open,
+		})
+	}
+	return usage
+}
+
+// usagePeriods totals sessions per day or week ("d" or "w") in the location
+// of the session times, splitting sessions that cross a period boundary
+func usagePeriods(sessions []media.Session, unit string) []UsagePeriod {
+	byStart := make(map[int64]*UsagePeriod)
+	var periods []*UsagePeriod
+	for _, session := range sessions {
+		for periodStart := truncateToUnit(session.Start, unit); periodStart.Before(session.End); periodStart = addUnits(periodStart, unit, 1) {
+			from, to := periodStart, addUnits(periodStart, unit, 1)
+			if session.Start.After(from) {
+				from = session.Start
+			}
+			if session.End.Before(to) {
+				to = session.End
+			}
+
+			period, ok := byStart[periodStart.Unix()]
+			if !ok {
+				period = &UsagePeriod{Start: periodStart, Apps: make(map[string]float64)}
+				byStart[periodStart.Unix()] = period
+				periods = append(periods, period)
+			}
+			seconds := to.Sub(from).Seconds()
+			period.TotalSeconds += seconds
+			period.Apps[session.App] += seconds
+		}
+	}
+
+	result := make([]UsagePeriod, 0, len(periods))
+	for _, period := range periods {
+		result = append(result, *period)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Start.Before(result[j].Start)
+	})
+	return result
+}
+
+// mediaDeviceName names a streaming device after its active app topic,
+// e.g. living_room_roku for home/living_room_roku_active_app
+func mediaDeviceName(topic string) string {
+	return strings.TrimSuffix(topic[strings.LastIndex(topic, "/")+1:], "_active_app")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// sourceQuery is the part of a query answered by one source.
+type sourceQuery struct {
+	source db.Source
+	filter bson.D
+}
+
+// planQuery splits the readings selected by sel between start and end over
+// the sources that should answer them. Topics may fall under different
+// retention policies, so each topic is routed to the coarsest source whose
+// resolution is no coarser than step.
+func (h *Handler) planQuery(ctx context.Context, sel db.Selector, start, end time.Time, step time.Duration) ([]sourceQuery, error) {
+	filter := sel.Filter()
+	raw := db.Source{Collection: h.collection}
+	if len(h.retention.Policies()) == 0 {
+		return []sourceQuery{{source: raw, filter: filter}}, nil
+	}
+
+	// Raw readings may have expired, so topics are looked up in every tier
+	seen := make(map[string]bool)
+	var topics []string
+	for _, collection := range append([]string{h.collection}, h.retention.RollupCollections()...) {
+		found, err := db.DistinctTopics(ctx, h.mongoDb.Database.Collection(collection), filter, start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, topic := range found {
+			if !seen[topic] {
+				seen[topic] = true
+				topics = append(topics, topic)
+			}
+		}
+	}
+
+	var order []db.Source
+	bySource := make(map[db.Source][]string)
+	for _, topic := range topics {
+		source := h.retention.Select(topic, start, end, step)
+		if _, ok := bySource[source]; !ok {
+			order = append(order, source)
+		}
+		bySource[source] = append(bySource[source], topic)
+	}
+
+	queries := make([]sourceQuery, 0, len(order))
+	for _, source := range order {
+		queries = append(queries, sourceQuery{
+			source: source,
+			filter: bson.D{{Key: "topic", Value: bson.D{{Key: "$in", Value: bySource[source]}}}},
+		})
+	}
+	return queries, nil
+}
+
+// countSeries returns the number of series the queries yield between start
+// and end, one per topic with readings to aggregate
+func (h *Handler) countSeries(ctx context.Context, queries []sourceQuery, start, end time.Time) (int, error) {
+	count := 0
+	for _, query := range queries {
+		topics, err := db.SeriesTopics(ctx, h.mongoDb.Database.Collection(query.source.Collection), query.source, query.filter, start, end)
+		if err != nil {
+			return 0, err
+		}
+		count += len(topics)
+	}
+	return count, nil
+}
+
+// parseSelector reads the topic, device, room and sensor_type query
+// parameters. Each may be repeated or hold a comma separated list. The
+// selection is limited to the readings the request's API key may access.
+func parseSelector(c *gin.Context) (db.Selector, error) {
+	sel := db.Selector{
+		Topics:      queryList(c, "topic"),
+		Devices:     queryList(c, "device"),
+		Rooms:       queryList(c, "room"),
+		SensorTypes: queryList(c, "sensor_type"),
+	}
+	if sel.IsEmpty() {
+		return sel, fmt.Errorf("at least one of topic, device, room or sensor_type is required")
+	}
+	sel.Allowed = allowlist(c)
+	return sel, nil
+}
+
+// queryList returns all values of a repeatable, comma separated query parameter
+func queryList(c *gin.Context, name string) []string {
+	var values []string
+	for _, param := range c.QueryArray(name) {
+		values = append(values, splitList(param)...)
+	}
+	return values
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(value string) []string {
+	var values []string
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			values = append(values, field)
+		}
+	}
+	return values
+}
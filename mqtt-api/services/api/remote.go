@@ -0,0 +1,161 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/mqtt-api/services/promremote"
+	"home_automation_dashboard/shared/db"
+	"home_automation_dashboard/shared/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/snappy"
+)
+
+// RemoteRead implements the Prometheus remote read protocol over the stored
+// readings, so PromQL can look back over the full history
+func (h *Handler) RemoteRead(c *gin.Context) {
+	body, err := h.readRemoteBody(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	request, err := promremote.UnmarshalReadRequest(body)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	maxSpan := h.limits.Span(endpointName(c.FullPath()))
+	for _, query := range request.Queries {
+		if time.Duration(query.EndMs-query.StartMs)*time.Millisecond > maxSpan {
+			badRequest(c, &RequestError{Code: "range_too_large", Message: fmt.Sprintf("time range exceeds the maximum of %s", db.FormatDuration(maxSpan))})
+			return
+		}
+	}
+
+	// Large reads may take longer than the operation timeout, they end with the request
+	maxPoints := h.limits.Points()
+	collection := h.mongoDb.Database.Collection(h.collection)
+	response, err := promremote.Read(c.Request.Context(), collection, request, allowlist(c), maxPoints)
+	var matcherErr *promremote.MatcherError
+	switch {
+	case errors.As(err, &matcherErr):
+		badRequest(c, err)
+		return
+	case errors.Is(err, promremote.ErrTooManyPoints):
+		badRequest(c, &RequestError{Code: "too_many_points", Message: fmt.Sprintf("a series holds more than %d samples, narrow the time range", maxPoints)})
+		return
+	case errors.Is(err, promremote.ErrTooManySamples):
+		badRequest(c, &RequestError{Code: "too_many_points", Message: err.Error()})
+		return
+	case err != nil:
+		internalError(c, err)
+		return
+	}
+
+	c.Header("Content-Encoding", "snappy")
+	c.Data(http.StatusOK, "application/x-protobuf", snappy.Encode(nil, response.Marshal()))
+}
+
+// RemoteWrite implements the Prometheus remote write receiver, storing the
+// received samples as readings alongside those from MQTT
+func (h *Handler) RemoteWrite(c *gin.Context) {
+	// Version 2 of the protocol uses a different message
+	if strings.Contains(c.GetHeader("Content-Type"), "io.prometheus.write.v2.Request") {
+		respondError(c, http.StatusUnsupportedMediaType, "only remote write 1.0 is supported")
+		return
+	}
+
+	body, err := h.readRemoteBody(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	request, err := promremote.UnmarshalWriteRequest(body)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	// The labels of a series decide the room and device of all its samples
+	var first []models.MqttMessage
+	for _, series := range request.Series {
+		if len(series.Samples) > 0 {
+			first = append(first, promremote.Message(series.Labels, series.Samples[0]))
+		}
+	}
+	if !messagesAllowed(c, first) {
+		return
+	}
+	// NaN and infinite values, including staleness markers, are skipped
+	var messages []models.MqttMessage
+	for _, series := range request.Series {
+		for _, sample := range series.Samples {
+			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				continue
+			}
+			messages = append(messages, promremote.Message(series.Labels, sample))
+		}
+	}
+	if !h.retainable(c, messages) {
+		return
+	}
+
+	ctx, cancel := h.mongoDb.WithTimeout(c.Request.Context())
+	defer cancel()
+
+	// Prometheus retries server errors, duplicates are skipped on the next attempt
+	collection := h.mongoDb.Database.Collection(h.collection)
+	result, err := promremote.Write(ctx, collection, messages)
+	if err != nil {
+		log.Printf("Remote write failed after %d samples: %v", result.Inserted, err)
+		internalError(c, err)
+		return
+	}
+	if err := h.materializer.Invalidate(ctx, messages); err != nil {
+		internalError(c, err)
+		return
+	}
+	if err := h.backfillLate(c.Request.Context(), messages); err != nil {
+		internalError(c, err)
+		return
+	}
+	h.invalidateHistorical(c.Request.Context(), messages)
+
+	c.Status(http.StatusNoContent)
+}
+
+// readRemoteBody reads and decompresses a snappy encoded protobuf body of at
+// most the body size limit, compressed and not
+func (h *Handler) readRemoteBody(c *gin.Context) ([]byte, error) {
+	maxSize := h.limits.BodySize()
+	tooLarge := &RequestError{Code: "body_too_large", Message: fmt.Sprintf("request body exceeds %d bytes", maxSize)}
+	if c.Request.ContentLength > maxSize {
+		return nil, tooLarge
+	}
+
+	compressed, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) > int(maxSize) {
+		return nil, tooLarge
+	}
+	if n, err := snappy.DecodedLen(compressed); err == nil && n > int(maxSize) {
+		return nil, tooLarge
+	}
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy body: %w", err)
+	}
+	return body, nil
+}
@@ -1,21 +1,69 @@
 package api
 
 import (
+	"home_automation_dashboard/mqtt-api/services/apikeys"
+
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // SetupRoutes initializes all API routes
-func SetupRoutes(router *gin.Engine, client *mongo.Client, databaseName string) {
-	handler := NewHandler(client, databaseName)
-	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+func SetupRoutes(router *gin.Engine, handler *Handler) {
+	router.Use(handler.limitIP)
+	readReadings := handler.requireScope(apikeys.ScopeReadReadings)
+
+	// Metrics cover every topic, so keys restricted to some readings cannot scrape them
+	router.GET("/metrics", handler.requireUnrestricted(apikeys.ScopeReadReadings), gin.WrapH(promhttp.Handler()))
 
 	api := router.Group("/api/v1")
 	{
-		temperature := api.Group("/temperature")
+		// The API description is public
+		api.GET("/openapi.json", handler.GetOpenAPI)
+		api.GET("/docs", handler.GetDocs)
+
+		// Ingest routes also accept the tokens of INGEST_TOKENS
+		api.POST("/ingest", handler.PostIngest)
+		api.POST("/write", handler.requireScope(apikeys.ScopeWriteIngest), handler.RemoteWrite)
+
+		read := api.Group("", readReadings)
+		read.GET("/topics", handler.GetTopics)
+		read.GET("/devices", handler.GetDevices)
+		read.GET("/rooms", handler.GetRooms)
+		read.GET("/events", handler.GetEvents)
+		read.GET("/export", handler.GetExport)
+		read.GET("/stream", handler.GetStream)
+		read.GET("/stream/ws", handler.GetStreamWebSocket)
+		read.GET("/stats", handler.GetStats)
+		read.GET("/series", handler.GetSeries)
+		read.GET("/state", handler.GetState)
+		read.GET("/state/*topic", handler.GetTopicState)
+		read.GET("/switches/*path", handler.GetSwitchActivity)
+		read.GET("/media/usage", handler.GetMediaUsage)
+		read.POST("/read", handler.RemoteRead)
+
+		temperature := read.Group("/temperature")
 		temperature.GET("/average", handler.GetAverageTemperature)
 		temperature.GET("/max", handler.GetMaxTemperature)
 		temperature.GET("/min", handler.GetMinTemperature)
+
+		api.DELETE("/cache", handler.requireScope(apikeys.ScopeAdmin), handler.PurgeCache)
+	}
+
+	// GraphQL queries for dashboards
+	router.GET("/graphql", readReadings, handler.GraphQL)
+	router.POST("/graphql", readReadings, handler.GraphQL)
+
+	// InfluxDB 2 compatible write API
+	router.POST("/api/v2/write", handler.PostInfluxWrite)
+
+	// Grafana JSON datasource
+	grafana := router.Group("/grafana", readReadings)
+	{
+		grafana.GET("/", handler.GrafanaTest)
+		grafana.POST("/search", handler.GrafanaSearch)
+		grafana.POST("/query", handler.GrafanaQuery)
+		grafana.POST("/annotations", handler.GrafanaAnnotations)
+		grafana.POST("/tag-keys", handler.GrafanaTagKeys)
+		grafana.POST("/tag-values", handler.GrafanaTagValues)
 	}
 }
@@ -0,0 +1,294 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"home_automation_dashboard/mqtt-api/services/ingest"
+	"home_automation_dashboard/mqtt-api/services/openapi"
+	"home_automation_dashboard/mqtt-api/services/state"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/snappy"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const ingestToken = "s3cret"
+
+// newTestRouter serves the routes of a handler over an empty fake database,
+// with authentication off and an ingest token
+func newTestRouter(t *testing.T) (*gin.Engine, *fakeMongo) {
+	gin.SetMode(gin.TestMode)
+	fake, mongoDb := startFakeMongo(t)
+	handler := NewHandler(mongoDb, HandlerOptions{
+		State:        state.New(mongoDb.Database.Collection("mqtt_events"), nil),
+		IngestTokens: ingest.Tokens{{Source: "test", Token: ingestToken}},
+	})
+
+	router := gin.New()
+	SetupRoutes(router, handler)
+	return router, fake
+}
+
+func TestRoutesMatchOperations(t *testing.T) {
+	router, _ := newTestRouter(t)
+	if err := openapi.CheckRoutes(router.Routes(), Operations()); err != nil {
+		t.Fatalf("routes and operations differ:\n%v", err)
+	}
+}
+
+// operationRequest is a successful request of an operation
+type operationRequest struct {
+	method, target string
+	body           []byte
+	header         map[string]string
+	// results are returned by the database's find and aggregate commands
+	results []interface{}
+}
+
+func jsonBody(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// remoteReadBody encodes a remote read request of one query for the
+// readings of a topic over the last hour
+func remoteReadBody() []byte {
+	var matcher []byte
+	matcher = protowire.AppendTag(matcher, 2, protowire.BytesType)
+	matcher = protowire.AppendString(matcher, "topic")
+	matcher = protowire.AppendTag(matcher, 3, protowire.BytesType)
+	matcher = protowire.AppendString(matcher, "home/kitchen_temperature/state")
+
+	now := time.Now()
+	var query []byte
+	query = protowire.AppendTag(query, 1, protowire.VarintType)
+	query = protowire.AppendVarint(query, uint64(now.Add(-time.Hour).UnixMilli()))
+	query = protowire.AppendTag(query, 2, protowire.VarintType)
+	query = protowire.AppendVarint(query, uint64(now.UnixMilli()))
+	query = protowire.AppendTag(query, 3, protowire.BytesType)
+	query = protowire.AppendBytes(query, matcher)
+
+	var request []byte
+	request = protowire.AppendTag(request, 1, protowire.BytesType)
+	request = protowire.AppendBytes(request, query)
+	return snappy.Encode(nil, request)
+}
+
+// remoteWriteBody encodes a remote write request of one sample
+func remoteWriteBody() []byte {
+	var series []byte
+	for _, label := range [][2]string{{"__name__", "node_load1"}, {"job", "node"}, {"instance", "pi:9100"}} {
+		var encoded []byte
+		encoded = protowire.AppendTag(encoded, 1, protowire.BytesType)
+		encoded = protowire.AppendString(encoded, label[0])
+		encoded = protowire.AppendTag(encoded, 2, protowire.BytesType)
+		encoded = protowire.AppendString(encoded, label[1])
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, encoded)
+	}
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, 0x3ff8000000000000) // 1.5
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(time.Now().UnixMilli()))
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+
+	var request []byte
+	request = protowire.AppendTag(request, 1, protowire.BytesType)
+	request = protowire.AppendBytes(request, series)
+	return snappy.Encode(nil, request)
+}
+
+// operationRequests returns a successful request of every operation but the
+// WebSocket stream, by operation id
+func operationRequests(t *testing.T) map[string]operationRequest {
+	now := time.Now().UTC()
+	grafanaRange := GrafanaRange{From: now.Add(-time.Hour), To: now}
+	ingestAuth := map[string]string{"Authorization": "Bearer " + ingestToken}
+	temperature := []interface{}{bson.D{{Key: "result", Value: 21.5}}}
+
+	return map[string]operationRequest{
+		"GetMetrics":            {method: http.MethodGet, target: "/metrics"},
+		"GetTopics":             {method: http.MethodGet, target: "/api/v1/topics"},
+		"GetDevices":            {method: http.MethodGet, target: "/api/v1/devices?prefix=kitchen"},
+		"GetRooms":              {method: http.MethodGet, target: "/api/v1/rooms?limit=10"},
+		"GetEvents":             {method: http.MethodGet, target: "/api/v1/events?topic=home/+/state&start=now-1h"},
+		"GetExport":             {method: http.MethodGet, target: "/api/v1/export?topic=home/kitchen_temperature/state&start=now-1h"},
+		"GetStream":             {method: http.MethodGet, target: "/api/v1/stream?room=kitchen"},
+		"GetStats":              {method: http.MethodGet, target: "/api/v1/stats?topic=home/kitchen_temperature/state&start=now-1d"},
+		"GetSeries":             {method: http.MethodGet, target: "/api/v1/series?topic=home/kitchen_temperature/state&start=now-1d&step=1h"},
+		"GetState":              {method: http.MethodGet, target: "/api/v1/state"},
+		"GetTopicState":         {method: http.MethodGet, target: "/api/v1/state/home/+/state"},
+		"GetSwitchActivity":     {method: http.MethodGet, target: "/api/v1/switches/home/bulb_b/state/activity?start=now/d"},
+		"GetMediaUsage":         {method: http.MethodGet, target: "/api/v1/media/usage?start=now-7d/d"},
+		"RemoteRead":            {method: http.MethodPost, target: "/api/v1/read", body: remoteReadBody(), header: map[string]string{"Content-Type": "application/x-protobuf", "Content-Encoding": "snappy"}},
+		"RemoteWrite":           {method: http.MethodPost, target: "/api/v1/write", body: remoteWriteBody(), header: map[string]string{"Content-Type": "application/x-protobuf", "Content-Encoding": "snappy"}},
+		"PostIngest":            {method: http.MethodPost, target: "/api/v1/ingest", body: []byte(`[{"topic": "home/garden_temperature/state", "value": 12.5}]`), header: ingestAuth},
+		"GetOpenAPI":            {method: http.MethodGet, target: "/api/v1/openapi.json"},
+		"GetDocs":               {method: http.MethodGet, target: "/api/v1/docs"},
+		"GetAverageTemperature": {method: http.MethodGet, target: "/api/v1/temperature/average?start=now-1d", results: temperature},
+		"GetMaxTemperature":     {method: http.MethodGet, target: "/api/v1/temperature/max?start=now-1d", results: temperature},
+		"GetMinTemperature":     {method: http.MethodGet, target: "/api/v1/temperature/min?start=now-1d", results: temperature},
+		"PurgeCache":            {method: http.MethodDelete, target: "/api/v1/cache"},
+		"PostInfluxWrite":       {method: http.MethodPost, target: "/api/v2/write?precision=s", body: []byte("weather,device=station1 temperature=12.5"), header: ingestAuth},
+		"GetGraphQL":            {method: http.MethodGet, target: "/graphql?query=" + strings.ReplaceAll("{ rooms { name } }", " ", "%20")},
+		"PostGraphQL":           {method: http.MethodPost, target: "/graphql", body: jsonBody(t, GraphQLRequest{Query: "{ devices { name } }"})},
+		"GrafanaTest":           {method: http.MethodGet, target: "/grafana/"},
+		"GrafanaSearch":         {method: http.MethodPost, target: "/grafana/search", body: jsonBody(t, GrafanaSearchRequest{Target: "home/"})},
+		"GrafanaQuery": {method: http.MethodPost, target: "/grafana/query", body: jsonBody(t, GrafanaQueryRequest{
+			Range: grafanaRange, IntervalMs: 60000, MaxDataPoints: 100,
+			Targets: []GrafanaTarget{{Target: "home/kitchen_temperature/state", RefID: "A", Type: "timeserie"}},
+		})},
+		"GrafanaAnnotations": {method: http.MethodPost, target: "/grafana/annotations", body: jsonBody(t, GrafanaAnnotationRequest{Range: grafanaRange})},
+		"GrafanaTagKeys":     {method: http.MethodPost, target: "/grafana/tag-keys", body: []byte("{}")},
+		"GrafanaTagValues":   {method: http.MethodPost, target: "/grafana/tag-values", body: jsonBody(t, GrafanaTagValuesRequest{Key: "room"})},
+	}
+}
+
+func TestOperationResponses(t *testing.T) {
+	router, fake := newTestRouter(t)
+	requests := operationRequests(t)
+
+	for _, op := range Operations() {
+		op := op
+		if op.ID == "GetStreamWebSocket" {
+			continue
+		}
+		t.Run(op.ID, func(t *testing.T) {
+			req, ok := requests[op.ID]
+			if !ok {
+				t.Fatalf("no request of %s %s", op.Method, op.Route)
+			}
+			if req.method != op.Method {
+				t.Fatalf("request method %s, operation %s", req.method, op.Method)
+			}
+			fake.setResults(req.results...)
+
+			r := httptest.NewRequest(req.method, req.target, bytes.NewReader(req.body))
+			for name, value := range req.header {
+				r.Header.Set(name, value)
+			}
+			// Streams run until the client goes away
+			ctx, cancel := context.WithTimeout(r.Context(), 200*time.Millisecond)
+			defer cancel()
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r.WithContext(ctx))
+
+			checkResponse(t, op, w.Code, w.Header().Get("Content-Type"), w.Body.Bytes())
+		})
+	}
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	router, _ := newTestRouter(t)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	var op openapi.Operation
+	for _, candidate := range Operations() {
+		if candidate.ID == "GetStreamWebSocket" {
+			op = candidate
+		}
+	}
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/stream/ws?room=kitchen"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if resp.StatusCode != op.Responses[0].Status {
+		t.Errorf("status %d, want %d", resp.StatusCode, op.Responses[0].Status)
+	}
+}
+
+// checkResponse checks that a response is the successful response of op,
+// with a body decoding into the declared type without unknown fields
+func checkResponse(t *testing.T, op openapi.Operation, status int, contentType string, body []byte) {
+	t.Helper()
+	var declared *openapi.Response
+	for i, response := range op.Responses {
+		if response.Status < 300 {
+			declared = &op.Responses[i]
+			break
+		}
+	}
+	if declared == nil {
+		t.Fatalf("%s declares no successful response", op.ID)
+	}
+	if status != declared.Status {
+		t.Fatalf("status %d, want %d: %s", status, declared.Status, body)
+	}
+
+	if len(declared.ContentTypes) > 0 {
+		for _, declaredType := range declared.ContentTypes {
+			if strings.HasPrefix(contentType, declaredType) {
+				return
+			}
+		}
+		t.Fatalf("content type %q, want one of %v", contentType, declared.ContentTypes)
+	}
+	if declared.Body == nil || declared.Body == "" {
+		return
+	}
+	if !strings.HasPrefix(contentType, "application/json") {
+		t.Fatalf("content type %q, want application/json", contentType)
+	}
+	if err := decodeStrict(body, declared.Body); err != nil {
+		t.Fatalf("response does not decode into %T: %v\n%s", declared.Body, err, body)
+	}
+}
+
+// decodeStrict decodes data into a new value of the type of schema,
+// rejecting fields the type does not declare
+func decodeStrict(data []byte, schema interface{}) error {
+	switch schema := schema.(type) {
+	case openapi.OneOf:
+		var errs []string
+		for _, alternative := range schema {
+			err := decodeStrict(data, alternative)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return fmt.Errorf("matches none of %d alternatives: %s", len(schema), strings.Join(errs, "; "))
+	case openapi.ArrayOf:
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		for i, item := range items {
+			if err := decodeStrict(item, schema.Items); err != nil {
+				return fmt.Errorf("item %d: %w", i, err)
+			}
+		}
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(reflect.New(reflect.TypeOf(schema)).Interface()); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("data after the value")
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Gap filling modes for buckets without readings
+const (
+	FillNull     = "null"
+	FillPrevious = "previous"
+	FillLinear   = "linear"
+)
+
+// autoSteps are the step sizes picked when a request does not specify one
+var autoSteps = []time.Duration{
+	time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour,
+	db.Day, db.Week,
+}
+
+// autoStepPoints is the number of buckets an automatic step aims for
+const autoStepPoints = 300
+
+// SeriesResponse is returned by GET /api/v1/series
+type SeriesResponse struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Step        string    `json:"step"`
+	Aggregation string    `json:"agg"`
+	Fill        string    `json:"fill"`
+	Series      []Series  `json:"series"`
+}
+
+// Series holds the evenly spaced buckets of one topic
+type Series struct {
+	Topic      string  `json:"topic"`
+	Resolution string  `json:"resolution"`
+	Points     []Point `json:"points"`
+}
+
+// Point is one bucket of a series, Value is null for gaps that were not filled
+type Point struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     *float64  `json:"value"`
+}
+
+// GetSeries handles requests for the readings of the selected topics,
+// aggregated into evenly spaced buckets
+func (h *Handler) GetSeries(c *gin.Context) {
+	sel, err := parseSelector(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	startTime, endTime, err := h.parseTimeRange(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	step, err := parseStep(c.Query("step"), endTime.Sub(startTime), h.limits.Points())
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	aggregation := c.DefaultQuery("agg", "avg")
+	if !contains(db.SeriesAggregations, aggregation) {
+		badRequest(c, &RequestError{Code: "invalid_aggregation", Param: "agg", Message: fmt.Sprintf("invalid agg %q, expected one of %s", aggregation, strings.Join(db.SeriesAggregations, ", "))})
+		return
+	}
+
+	fill := c.DefaultQuery("fill", FillNull)
+	if fill != FillNull && fill != FillPrevious && fill != FillLinear {
+		badRequest(c, &RequestError{Code: "invalid_fill", Param: "fill", Message: fmt.Sprintf("invalid fill %q, expected null, previous or linear", fill)})
+		return
+	}
+
+	ctx, cancel := h.mongoDb.WithTimeout(c.Request.Context())
+	defer cancel()
+
+	queries, err := h.planQuery(ctx, sel, startTime, endTime, step)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	count, err := h.countSeries(ctx, queries, startTime, endTime)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	if err := checkPoints(count*bucketCount(endTime.Sub(startTime), step), h.limits.Points()); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	response := SeriesResponse{
+		Start:       startTime,
+		End:         endTime,
+		Step:        db.FormatDuration(step),
+		Aggregation: aggregation,
+		Fill:        fill,
+		Series:      []Series{},
+	}
+	for _, query := range queries {
+		collection := h.mongoDb.Database.Collection(query.source.Collection)
+		buckets, err := db.AggregateSeries(ctx, collection, query.source, query.filter, startTime, endTime, step, aggregation)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		for _, series := range buildSeries(buckets, startTime, endTime, step, fill) {
+			series.Resolution = resolutionName(query.source)
+			response.Series = append(response.Series, series)
+		}
+	}
+	sort.Slice(response.Series, func(i, j int) bool {
+		return response.Series[i].Topic < response.Series[j].Topic
+	})
+
+	c.JSON(http.StatusOK, response)
+}
+
+// parseStep parses the step parameter, picking one that yields about
+// autoStepPoints buckets over span when it is empty. A step may yield at most
+// maxPoints buckets.
+func parseStep(value string, span time.Duration, maxPoints int) (time.Duration, error) {
+	if value == "" {
+		for _, step := range autoSteps {
+			if bucketCount(span, step) <= autoStepPoints {
+				return step, nil
+			}
+		}
+		return autoSteps[len(autoSteps)-1], nil
+	}
+
+	step, err := db.ParseDuration(value)
+	if err != nil {
+		return 0, &RequestError{Code: "invalid_step", Param: "step", Message: err.Error()}
+	}
+	if step < time.Second {
+		return 0, &RequestError{Code: "invalid_step", Param: "step", Message: "step must be at least 1s"}
+	}
+	if bucketCount(span, step) > maxPoints {
+		return 0, &RequestError{Code: "too_many_points", Param: "step", Message: fmt.Sprintf("step %s yields more than %d points, use a larger step", value, maxPoints)}
+	}
+	return step, nil
+}
+
+// checkPoints refuses queries whose series hold more than maxPoints points
+// together, so selecting many topics cannot get around the limit of a series
+func checkPoints(points, maxPoints int) error {
+	if points > maxPoints {
+		return &RequestError{Code: "too_many_points", Message: fmt.Sprintf("the selected series hold %d points, more than the maximum of %d, select fewer topics or use a larger step", points, maxPoints)}
+	}
+	return nil
+}
+
+// bucketCount returns the number of steps covering span, the last one may
+// be partial
+func bucketCount(span, step time.Duration) int {
+	return int((span + step - 1) / step)
+}
+
+// buildSeries turns the buckets of each topic into evenly spaced points from
+// start to end, filling buckets without readings according to fill
+func buildSeries(buckets []db.Bucket, start, end time.Time, step time.Duration, fill string) []Series {
+	count := bucketCount(end.Sub(start), step)
+
+	var series []Series
+	for i := 0; i < len(buckets); {
+		topic := buckets[i].Topic
+		values := make([]*float64, count)
+		for ; i < len(buckets) && buckets[i].Topic == topic; i++ {
+			index := int(buckets[i].Timestamp.Sub(start) / step)
+			if index >= 0 && index < count {
+				value := buckets[i].Value
+				values[index] = &value
+			}
+		}
+
+		fillGaps(values, fill)
+
+		points := make([]Point, count)
+		for k := range points {
+			points[k] = Point{Timestamp: start.Add(time.Duration(k) * step), Value: values[k]}
+		}
+		series = append(series, Series{Topic: topic, Points: points})
+	}
+	return series
+}
+
+// fillGaps fills nil values in place. Gaps before the first value stay nil,
+// and so do gaps after the last value for linear interpolation.
+func fillGaps(values []*float64, fill string) {
+	switch fill {
+	case FillPrevious:
+		var previous *float64
+		for k, value := range values {
+			if value == nil {
+				values[k] = previous
+			} else {
+				previous = value
+			}
+		}
+	case FillLinear:
+		last := -1
+		for k, value := range values {
+			if value == nil {
+				continue
+			}
+			if last >= 0 && k-last > 1 {
+				from, to := *values[last], *value
+				for gap := last + 1; gap < k; gap++ {
+					interpolated := from + (to-from)*float64(gap-last)/float64(k-last)
+					values[gap] = &interpolated
+				}
+			}
+			last = k
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSeriesPointsAcrossTopics(t *testing.T) {
+	router, fake := newTestRouter(t)
+	var topics []string
+	for i := 0; i < 20; i++ {
+		topics = append(topics, fmt.Sprintf("home/sensor_%d/temperature", i))
+	}
+	fake.setDistinct(topics...)
+
+	tests := []struct {
+		target     string
+		wantStatus int
+	}{
+		// 20 series of 24 points
+		{"/api/v1/series?topic=home/%2B/temperature&start=now-1d&step=1h", http.StatusOK},
+		// 20 series of 1440 points, each within the limit of a series
+		{"/api/v1/series?topic=home/%2B/temperature&start=now-1d&step=1m", http.StatusBadRequest},
+		{"/api/v1/series?room=kitchen&start=now-1d&step=1m", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("GET %s status = %d, want %d: %s", tt.target, w.Code, tt.wantStatus, w.Body.Bytes())
+			continue
+		}
+		if tt.wantStatus == http.StatusOK {
+			continue
+		}
+		var response ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.Code != "too_many_points" {
+			t.Errorf("GET %s error = %+v, want code too_many_points", tt.target, response)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+
+	"home_automation_dashboard/mqtt-api/services/apikeys"
+	"home_automation_dashboard/mqtt-api/services/export"
+	"home_automation_dashboard/mqtt-api/services/ingest"
+	"home_automation_dashboard/mqtt-api/services/openapi"
+	"home_automation_dashboard/shared/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SpecInfo describes the API in the OpenAPI document
+var SpecInfo = openapi.Info{
+	Title:       "Home Automation Dashboard API",
+	Version:     "1.0.0",
+	Description: "Readings of the MQTT sensors and switches of the home, their statistics and live state.",
+}
+
+// Security schemes: API keys created with the keys command, and the tokens
+// of INGEST_TOKENS, which only the ingestion routes accept
+const (
+	apiKeySecurity = "apiKey"
+	ingestSecurity = "ingestToken"
+)
+
+// Security requirements of the routes, the scopes an API key needs
+var (
+	readSecurity  = []openapi.Security{{Scheme: apiKeySecurity, Scopes: []string{apikeys.ScopeReadReadings}}}
+	writeSecurity = []openapi.Security{{Scheme: apiKeySecurity, Scopes: []string{apikeys.ScopeWriteIngest}}}
+	adminSecurity = []openapi.Security{{Scheme: apiKeySecurity, Scopes: []string{apikeys.ScopeAdmin}}}
+	ingestAuth    = []openapi.Security{{Scheme: ingestSecurity}, {Scheme: apiKeySecurity, Scopes: []string{apikeys.ScopeWriteIngest}}}
+)
+
+// Parameters shared by several operations
+var (
+	startParam = openapi.Param{Name: "start", In: "query", Default: defaultStart, Description: "Start of the range: RFC3339, a date, epoch seconds or milliseconds, or relative to now such as now-6h"}
+	endParam   = openapi.Param{Name: "end", In: "query", Default: defaultEnd, Description: "End of the range, in the same forms as start"}
+	tzParam    = openapi.Param{Name: "tz", In: "query", Description: "IANA time zone of dates, timestamps without an offset and rounding, UTC by default"}
+
+	selectorParams = []openapi.Param{
+		{Name: "topic", In: "query", Repeated: true, Description: "Topics or MQTT topic filters"},
+		{Name: "device", In: "query", Repeated: true, Description: "Devices"},
+		{Name: "room", In: "query", Repeated: true, Description: "Rooms"},
+		{Name: "sensor_type", In: "query", Repeated: true, Description: "Sensor types"},
+	}
+
+	discoveryParams = []openapi.Param{
+		{Name: "prefix", In: "query", Description: "Only names starting with prefix"},
+		{Name: "after", In: "query", Description: "Next of the previous page"},
+		{Name: "limit", In: "query", Type: "integer", Default: "100", Description: "Page size, at most 1000"},
+	}
+
+	temperatureParams = []openapi.Param{
+		{Name: "topic", In: "query", Default: "home/kitchen_temperature/state", Description: "Temperature topic"},
+		startParam, endParam, tzParam,
+	}
+)
+
+// Responses shared by several operations
+var (
+	badRequestResponse   = openapi.Response{Status: http.StatusBadRequest, Description: "Invalid parameters", Body: ErrorResponse{}}
+	notFoundResponse     = openapi.Response{Status: http.StatusNotFound, Body: ErrorResponse{}}
+	internalResponse     = openapi.Response{Status: http.StatusInternalServerError, Body: ErrorResponse{}}
+	unauthorizedResponse = openapi.Response{Status: http.StatusUnauthorized, Description: "Missing, invalid or revoked API key", Body: ErrorResponse{}}
+	forbiddenResponse    = openapi.Response{Status: http.StatusForbidden, Description: "The API key lacks the scope or may not access the readings", Body: ErrorResponse{}}
+	unavailableResponse  = openapi.Response{Status: http.StatusServiceUnavailable, Body: ErrorResponse{}}
+	tooLargeResponse     = openapi.Response{Status: http.StatusRequestEntityTooLarge, Description: "The body or batch exceeds the size limit", Body: ErrorResponse{}}
+
+	tooManyRequestsResponse = openapi.Response{Status: http.StatusTooManyRequests, Description: "Rate limit exceeded, retry after the Retry-After header's seconds", Body: ErrorResponse{}}
+)
+
+// joinParams concatenates parameter lists
+func joinParams(lists ...[]openapi.Param) []openapi.Param {
+	var all []openapi.Param
+	for _, list := range lists {
+		all = append(all, list...)
+	}
+	return all
+}
+
+// okResponse is the successful JSON response with body
+func okResponse(body interface{}) openapi.Response {
+	return openapi.Response{Status: http.StatusOK, Description: "OK", Body: body}
+}
+
+// Operations describes every route served by SetupRoutes. The openapi command
+// checks that the two agree.
+func Operations() []openapi.Operation {
+	timeRange := []openapi.Param{startParam, endParam, tzParam}
+
+	return []openapi.Operation{
+		{
+			ID: "GetMetrics", Method: http.MethodGet, Route: "/metrics", Tag: "metrics",
+			Summary:   "Prometheus metrics",
+			Responses: []openapi.Response{{Status: http.StatusOK, ContentTypes: []string{"text/plain"}, Body: ""}, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			NoClient:  true,
+			Security:  readSecurity,
+		},
+		{
+			ID: "GetTopics", Method: http.MethodGet, Route: "/api/v1/topics", Tag: "discovery",
+			Summary:   "List the stored topics",
+			Params:    discoveryParams,
+			Responses: []openapi.Response{okResponse(DiscoveryResponse{}), badRequestResponse, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			Security:  readSecurity,
+		},
+		{
+			ID: "GetDevices", Method: http.MethodGet, Route: "/api/v1/devices", Tag: "discovery",
+			Summary:   "List the devices of the stored readings",
+			Params:    discoveryParams,
+			Responses: []openapi.Response{okResponse(DiscoveryResponse{}), badRequestResponse, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			Security:  readSecurity,
+		},
+		{
+			ID: "GetRooms", Method: http.MethodGet, Route: "/api/v1/rooms", Tag: "discovery",
+			Summary:   "List the rooms of the stored readings",
+			Params:    discoveryParams,
+			Responses: []openapi.Response{okResponse(DiscoveryResponse{}), badRequestResponse, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			Security:  readSecurity,
+		},
+		{
+			ID: "GetEvents", Method: http.MethodGet, Route: "/api/v1/events", Tag: "readings",
+			Summary: "List stored readings, a page at a time",
+			Params: joinParams(timeRange, selectorParams, []openapi.Param{
+				{Name: "tag", In: "query", Repeated: true, Description: "Tag predicates, <key>:<value>"},
+				{Name: "value", In: "query", Repeated: true, Description: "Value predicates, [<op>:]<value> with op one of eq, ne, gt, gte, lt, lte"},
+				{Name: "limit", In: "query", Type: "integer", Default: "100", Description: "Page size, at most 1000"},
+				{Name: "order", In: "query", Enum: []string{"asc", "desc"}, Default: "desc", Description: "Order of the timestamps"},
+				{Name: "cursor", In: "query", Description: "Next of the previous page"},
+			}),
+			Responses: []openapi.Response{okResponse(EventsResponse{}), badRequestResponse, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			Security:  readSecurity,
+		},
+		{
+			ID: "GetExport", Method: http.MethodGet, Route: "/api/v1/export", Tag: "readings",
+			Summary: "Download the selected readings",
+			Params: joinParams(selectorParams, timeRange, []openapi.Param{
+				{Name: "format", In: "query", Enum: export.Formats, Default: export.FormatCSV, Description: "File format"},
+			}),
+			Responses: []openapi.Response{
+				{Status: http.StatusOK, Description: "The readings, streamed", ContentTypes: []string{"text/csv", "application/x-ndjson", "application/vnd.apache.parquet"}, Body: ""},
+				badRequestResponse,
+				unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse,
+			},
+			Security: readSecurity,
+		},
+		{
+			ID: "GetStream", Method: http.MethodGet, Route: "/api/v1/stream", Tag: "readings",
+			Summary: "Server-Sent Events stream of new readings",
+			Params: joinParams(selectorParams, []openapi.Param{
+				{Name: "last_event_id", In: "query", Description: "Resume after this reading id, like the Last-Event-ID header"},
+				{Name: "Last-Event-ID", In: "header", Description: "Resume after this reading id"},
+			}),
+			Responses: []openapi.Response{
+				{Status: http.StatusOK, Description: "A reading event per reading", ContentTypes: []string{"text/event-stream"}, Body: ""},
+				badRequestResponse, unavailableResponse,
+				unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse,
+			},
+			Security: readSecurity,
+		},
+		{
+			ID: "GetStreamWebSocket", Method: http.MethodGet, Route: "/api/v1/stream/ws", Tag: "readings",
+			Summary: "WebSocket stream of new readings, one JSON message per reading",
+			Params: joinParams(selectorParams, []openapi.Param{
+				{Name: "last_event_id", In: "query", Description: "Resume after this reading id"},
+			}),
+			Responses: []openapi.Response{
+				{Status: http.StatusSwitchingProtocols, Description: "Messages are EventEntry objects"},
+				badRequestResponse, unavailableResponse,
+				unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse,
+			},
+			NoClient: true,
+			Security: readSecurity,
+		},
+		{
+			ID: "GetStats", Method: http.MethodGet, Route: "/api/v1/stats", Tag: "readings",
+			Summary: "Statistics over the numeric readings of the selected topics",
+			Params: joinParams(selectorParams, timeRange, []openapi.Param{
+				{Name: "percentiles", In: "query", Default: "50,90,95,99", Description: "Comma separated percentiles, or none"},
+			}),
+			Responses: []openapi.Response{okResponse(StatsResponse{}), badRequestResponse, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			Security:  readSecurity,
+		},
+		{
+			ID: "GetSeries", Method: http.MethodGet, Route: "/api/v1/series", Tag: "readings",
+			Summary: "Readings aggregated into evenly spaced buckets",
+			Params: joinParams(selectorParams, timeRange, []openapi.Param{
+				{Name: "step", In: "query", Description: "Bucket size such as 5m or 1h, picked from the range when empty"},
+				{Name: "agg", In: "query", Enum: db.SeriesAggregations, Default: "avg", Description: "Aggregation of each bucket"},
+				{Name: "fill", In: "query", Enum: []string{FillNull, FillPrevious, FillLinear}, Default: FillNull, Description: "Filling of empty buckets"},
+			}),
+			Responses: []openapi.Response{okResponse(SeriesResponse{}), badRequestResponse, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			Security:  readSecurity,
+		},
+		{
+			ID: "GetState", Method: http.MethodGet, Route: "/api/v1/state", Tag: "state",
+			Summary: "Latest reading of every topic",
+			Params: []openapi.Param{
+				{Name: "topic", In: "query", Repeated: true, Description: "Topics or MQTT topic filters"},
+			},
+			Responses: []openapi.Response{okResponse(StateResponse{}), unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			Security:  readSecurity,
+		},
+		{
+			ID: "GetTopicState", Method: http.MethodGet, Route: "/api/v1/state/*topic", Tag: "state",
+			Summary: "Latest reading of a topic, or of the topics matching a topic filter",
+			Params: []openapi.Param{
+				{Name: "topic", In: "path", Description: "Topic or MQTT topic filter"},
+			},
+			Responses: []openapi.Response{okResponse(openapi.OneOf{StateEntry{}, StateResponse{}}), notFoundResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			Security:  readSecurity,
+		},
+		{
+			ID: "GetSwitchActivity", Method: http.MethodGet, Route: "/api/v1/switches/*path", Path: "/api/v1/switches/{topic}/activity", Tag: "state",
+			Summary: "On/off activity of a switch",
+			Params: joinParams([]openapi.Param{
+				{Name: "topic", In: "path", Description: "Switch topic"},
+			}, timeRange),
+			Responses: []openapi.Response{okResponse(SwitchActivity{}), badRequestResponse, notFoundResponse, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			Security:  readSecurity,
+		},
+		{
+			ID: "GetMediaUsage", Method: http.MethodGet, Route: "/api/v1/media/usage", Tag: "media",
+			Summary: "App sessions of the streaming devices with daily and weekly totals",
+			Params: joinParams(timeRange, []openapi.Param{
+				{Name: "device", In: "query", Repeated: true, Description: "Streaming devices"},
+			}),
+			Responses: []openapi.Response{okResponse(MediaUsageResponse{}), badRequestResponse, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			Security:  readSecurity,
+		},
+		{
+			ID: "RemoteRead", Method: http.MethodPost, Route: "/api/v1/read", Tag: "prometheus",
+			Summary:            "Prometheus remote read",
+			RequestContentType: "application/x-protobuf",
+			Request:            "",
+			Responses: []openapi.Response{
+				{Status: http.StatusOK, Description: "Snappy compressed ReadResponse", ContentTypes: []string{"application/x-protobuf"}, Body: ""},
+				badRequestResponse, internalResponse,
+				unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse, tooLargeResponse,
+			},
+			NoClient: true,
+			Security: readSecurity,
+		},
+		{
+			ID: "RemoteWrite", Method: http.MethodPost, Route: "/api/v1/write", Tag: "prometheus",
+			Summary:            "Prometheus remote write",
+			RequestContentType: "application/x-protobuf",
+			Request:            "",
+			Responses: []openapi.Response{
+				{Status: http.StatusNoContent},
+				badRequestResponse,
+				{Status: http.StatusUnsupportedMediaType, Body: ErrorResponse{}},
+				internalResponse,
+				unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse, tooLargeResponse,
+			},
+			NoClient: true,
+			Security: writeSecurity,
+		},
+		{
+			ID: "PostIngest", Method: http.MethodPost, Route: "/api/v1/ingest", Tag: "ingest",
+			Summary:   "Store readings sent as JSON",
+			Request:   []ingest.Reading{},
+			Responses: []openapi.Response{okResponse(IngestResponse{}), badRequestResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse, tooLargeResponse, unavailableResponse, internalResponse},
+			Security:  ingestAuth,
+		},
+		{
+			ID: "GetOpenAPI", Method: http.MethodGet, Route: "/api/v1/openapi.json", Tag: "docs",
+			Summary:   "This OpenAPI document",
+			Responses: []openapi.Response{okResponse(map[string]interface{}{})},
+			NoClient:  true,
+		},
+		{
+			ID: "GetDocs", Method: http.MethodGet, Route: "/api/v1/docs", Tag: "docs",
+			Summary:   "Swagger UI of this document",
+			Responses: []openapi.Response{{Status: http.StatusOK, ContentTypes: []string{"text/html"}, Body: ""}},
+			NoClient:  true,
+		},
+		{
+			ID: "GetAverageTemperature", Method: http.MethodGet, Route: "/api/v1/temperature/average", Tag: "temperature",
+			Summary:   "Average temperature over the range",
+			Params:    temperatureParams,
+			Responses: []openapi.Response{okResponse(TemperatureResponse{}), badRequestResponse, notFoundResponse, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			Security:  readSecurity,
+		},
+		{
+			ID: "GetMaxTemperature", Method: http.MethodGet, Route: "/api/v1/temperature/max", Tag: "temperature",
+			Summary:   "Highest temperature over the range",
+			Params:    temperatureParams,
+			Responses: []openapi.Response{okResponse(TemperatureResponse{}), badRequestResponse, notFoundResponse, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			Security:  readSecurity,
+		},
+		{
+			ID: "GetMinTemperature", Method: http.MethodGet, Route: "/api/v1/temperature/min", Tag: "temperature",
+			Summary:   "Lowest temperature over the range",
+			Params:    temperatureParams,
+			Responses: []openapi.Response{okResponse(TemperatureResponse{}), badRequestResponse, notFoundResponse, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			Security:  readSecurity,
+		},
+		{
+			ID: "PurgeCache", Method: http.MethodDelete, Route: "/api/v1/cache", Tag: "admin",
+			Summary:   "Drop every cached query result, e.g. after importing older readings",
+			Responses: []openapi.Response{{Status: http.StatusNoContent}, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			Security:  adminSecurity,
+		},
+		{
+			ID: "PostInfluxWrite", Method: http.MethodPost, Route: "/api/v2/write", Tag: "ingest",
+			Summary: "Store readings sent as InfluxDB line protocol",
+			Params: []openapi.Param{
+				{Name: "precision", In: "query", Enum: []string{"ns", "us", "ms", "s"}, Default: "ns", Description: "Unit of the line timestamps"},
+			},
+			RequestContentType: "text/plain",
+			Request:            "",
+			Responses:          []openapi.Response{{Status: http.StatusNoContent}, badRequestResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse, tooLargeResponse, unavailableResponse, internalResponse},
+			Security:           ingestAuth,
+			NoClient:           true,
+		},
+		{
+			ID: "GetGraphQL", Method: http.MethodGet, Route: "/graphql", Tag: "graphql",
+			Summary: "GraphQL query over rooms, devices and entities, sent as parameters",
+			Params: []openapi.Param{
+				{Name: "query", In: "query", Required: true, Description: "GraphQL query"},
+				{Name: "operationName", In: "query", Description: "Operation to run when the query has several"},
+				{Name: "variables", In: "query", Description: "Variables as a JSON object"},
+			},
+			Responses: []openapi.Response{okResponse(GraphQLResponse{}), badRequestResponse, unavailableResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			NoClient:  true,
+			Security:  readSecurity,
+		},
+		{
+			ID: "PostGraphQL", Method: http.MethodPost, Route: "/graphql", Tag: "graphql",
+			Summary:   "GraphQL query over rooms, devices and entities",
+			Request:   GraphQLRequest{},
+			Responses: []openapi.Response{okResponse(GraphQLResponse{}), badRequestResponse, unavailableResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			NoClient:  true,
+			Security:  readSecurity,
+		},
+		{
+			ID: "GrafanaTest", Method: http.MethodGet, Route: "/grafana/", Tag: "grafana",
+			Summary:   "Connection test of the Grafana datasource",
+			Responses: []openapi.Response{{Status: http.StatusOK, ContentTypes: []string{"text/plain"}, Body: ""}, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			NoClient:  true,
+			Security:  readSecurity,
+		},
+		{
+			ID: "GrafanaSearch", Method: http.MethodPost, Route: "/grafana/search", Tag: "grafana",
+			Summary:   "Topics matching a target",
+			Request:   GrafanaSearchRequest{},
+			Responses: []openapi.Response{okResponse([]string{}), badRequestResponse, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			NoClient:  true,
+			Security:  readSecurity,
+		},
+		{
+			ID: "GrafanaQuery", Method: http.MethodPost, Route: "/grafana/query", Tag: "grafana",
+			Summary:   "Time series and tables of a Grafana panel",
+			Request:   GrafanaQueryRequest{},
+			Responses: []openapi.Response{okResponse(openapi.ArrayOf{Items: openapi.OneOf{GrafanaTimeSeries{}, GrafanaTable{}}}), badRequestResponse, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			NoClient:  true,
+			Security:  readSecurity,
+		},
+		{
+			ID: "GrafanaAnnotations", Method: http.MethodPost, Route: "/grafana/annotations", Tag: "grafana",
+			Summary:   "Value changes of a topic as annotations",
+			Request:   GrafanaAnnotationRequest{},
+			Responses: []openapi.Response{okResponse([]GrafanaAnnotation{}), badRequestResponse, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			NoClient:  true,
+			Security:  readSecurity,
+		},
+		{
+			ID: "GrafanaTagKeys", Method: http.MethodPost, Route: "/grafana/tag-keys", Tag: "grafana",
+			Summary:   "Keys of the ad-hoc filters",
+			Responses: []openapi.Response{okResponse([]GrafanaTagKey{}), unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			NoClient:  true,
+			Security:  readSecurity,
+		},
+		{
+			ID: "GrafanaTagValues", Method: http.MethodPost, Route: "/grafana/tag-values", Tag: "grafana",
+			Summary:   "Values of an ad-hoc filter key",
+			Request:   GrafanaTagValuesRequest{},
+			Responses: []openapi.Response{okResponse([]GrafanaTagValue{}), badRequestResponse, internalResponse, unauthorizedResponse, forbiddenResponse, tooManyRequestsResponse},
+			NoClient:  true,
+			Security:  readSecurity,
+		},
+	}
+}
+
+// Spec returns the OpenAPI document of the API
+func Spec() (*openapi.Document, error) {
+	return openapi.Generate(SpecInfo, Operations())
+}
+
+var (
+	specOnce sync.Once
+	specJSON []byte
+	specErr  error
+)
+
+// GetOpenAPI serves the OpenAPI document of the API
+func (h *Handler) GetOpenAPI(c *gin.Context) {
+	specOnce.Do(func() {
+		var doc *openapi.Document
+		if doc, specErr = Spec(); specErr == nil {
+			specJSON, specErr = doc.JSON()
+		}
+	})
+	if specErr != nil {
+		internalError(c, specErr)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", specJSON)
+}
+
+// swaggerUI renders the OpenAPI document with Swagger UI from a CDN
+const swaggerUI = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Home Automation Dashboard API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js" crossorigin></script>
+  <script>
+    window.onload = () => {
+      window.ui = SwaggerUIBundle({ url: "openapi.json", dom_id: "#swagger-ui" });
+    };
+  </script>
+</body>
+</html>
+`
+
+// GetDocs serves the Swagger UI of the API
+func (h *Handler) GetDocs(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(swaggerUI))
+}
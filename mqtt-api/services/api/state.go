@@ -0,0 +1,98 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/mqtt-api/services/state"
+	"home_automation_dashboard/shared/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StateEntry is the latest reading of a topic
+type StateEntry struct {
+	Topic      string      `json:"topic"`
+	Device     string      `json:"device"`
+	Room       string      `json:"room"`
+	SensorType string      `json:"sensor_type"`
+	Value      interface{} `json:"value"`
+	Unit       string      `json:"unit,omitempty"`
+	Timestamp  time.Time   `json:"timestamp"`
+	AgeSeconds float64     `json:"age_seconds"`
+}
+
+// StateResponse is returned by GET /api/v1/state
+type StateResponse struct {
+	States []StateEntry `json:"states"`
+}
+
+// GetState handles requests for the latest reading of every known topic, or
+// of the topics matching the topic query parameters
+func (h *Handler) GetState(c *gin.Context) {
+	patterns := queryList(c, "topic")
+	if len(patterns) == 0 {
+		patterns = []string{""}
+	}
+
+	now := time.Now()
+	allowed := allowlist(c)
+	seen := make(map[string]bool)
+	response := StateResponse{States: []StateEntry{}}
+	for _, pattern := range patterns {
+		for _, entry := range h.state.Match(pattern) {
+			if !seen[entry.Topic] && allowed.Allows(entry.Room, entry.Device) {
+				seen[entry.Topic] = true
+				response.States = append(response.States, newStateEntry(entry, now))
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// GetTopicState handles requests for the latest reading of one topic. A topic
+// filter with wildcards returns the matching topics like GetState.
+func (h *Handler) GetTopicState(c *gin.Context) {
+	topic := strings.TrimPrefix(c.Param("topic"), "/")
+	if topic == "" {
+		h.GetState(c)
+		return
+	}
+
+	now := time.Now()
+	allowed := allowlist(c)
+	if db.IsTopicPattern(topic) {
+		response := StateResponse{States: []StateEntry{}}
+		for _, entry := range h.state.Match(topic) {
+			if allowed.Allows(entry.Room, entry.Device) {
+				response.States = append(response.States, newStateEntry(entry, now))
+			}
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	// Topics the API key may not read are reported as unknown
+	entry, ok := h.state.Get(topic)
+	if !ok || !allowed.Allows(entry.Room, entry.Device) {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("no readings for topic %q", topic))
+		return
+	}
+	c.JSON(http.StatusOK, newStateEntry(entry, now))
+}
+
+func newStateEntry(entry state.Entry, now time.Time) StateEntry {
+	return StateEntry{
+		Topic:      entry.Topic,
+		Device:     entry.Device,
+		Room:       entry.Room,
+		SensorType: entry.SensorType,
+		Value:      entry.Value,
+		Unit:       entry.Unit,
+		Timestamp:  entry.Timestamp,
+		AgeSeconds: now.Sub(entry.Timestamp).Seconds(),
+	}
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultPercentiles are reported when the request does not ask for others
+var defaultPercentiles = []float64{50, 90, 95, 99}
+
+// StatsResponse is returned by GET /api/v1/stats
+type StatsResponse struct {
+	Start   time.Time    `json:"start"`
+	End     time.Time    `json:"end"`
+	Results []TopicStats `json:"results"`
+}
+
+// TopicStats summarises the numeric readings of one topic
+type TopicStats struct {
+	Topic string `json:"topic"`
+	// Resolution is "raw", or the rollup tier the statistics were computed
+	// from once raw readings have expired
+	Resolution  string             `json:"resolution"`
+	Count       int64              `json:"count"`
+	Sum         float64            `json:"sum"`
+	Avg         float64            `json:"avg"`
+	Min         float64            `json:"min"`
+	Max         float64            `json:"max"`
+	StdDev      float64            `json:"stddev"`
+	Percentiles map[string]float64 `json:"percentiles,omitempty"`
+	First       Sample             `json:"first"`
+	Last        Sample             `json:"last"`
+}
+
+// Sample is a single value at a point in time
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// GetStats handles requests for statistics over the numeric readings of the
+// selected topics
+func (h *Handler) GetStats(c *gin.Context) {
+	sel, err := parseSelector(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	startTime, endTime, err := h.parseTimeRange(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	percentiles, err := parsePercentiles(c.Query("percentiles"))
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+	fractions := make([]float64, len(percentiles))
+	for i, p := range percentiles {
+		fractions[i] = p / 100
+	}
+
+	ctx, cancel := h.mongoDb.WithTimeout(c.Request.Context())
+	defer cancel()
+
+	// Exact statistics need raw readings, rollups are only used once those expired
+	queries, err := h.planQuery(ctx, sel, startTime, endTime, 0)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	response := StatsResponse{Start: startTime, End: endTime, Results: []TopicStats{}}
+	for _, query := range queries {
+		collection := h.mongoDb.Database.Collection(query.source.Collection)
+		results, err := db.ComputeNumericStats(ctx, collection, query.source, query.filter, startTime, endTime, fractions)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		for _, result := range results {
+			response.Results = append(response.Results, newTopicStats(result, query.source, percentiles))
+		}
+	}
+	sort.Slice(response.Results, func(i, j int) bool {
+		return response.Results[i].Topic < response.Results[j].Topic
+	})
+
+	c.JSON(http.StatusOK, response)
+}
+
+func newTopicStats(result db.NumericStats, source db.Source, percentiles []float64) TopicStats {
+	stats := TopicStats{
+		Topic:      result.Topic,
+		Resolution: resolutionName(source),
+		Count:      result.Count,
+		Sum:        result.Sum,
+		Avg:        result.Avg,
+		Min:        result.Min,
+		Max:        result.Max,
+		StdDev:     result.StdDev,
+		First:      Sample{Timestamp: result.First.Timestamp, Value: result.First.Value},
+		Last:       Sample{Timestamp: result.Last.Timestamp, Value: result.Last.Value},
+	}
+	if len(result.Percentiles) == len(percentiles) && len(percentiles) > 0 {
+		stats.Percentiles = make(map[string]float64, len(percentiles))
+		for i, p := range percentiles {
+			stats.Percentiles["p"+strconv.FormatFloat(p, 'f', -1, 64)] = result.Percentiles[i]
+		}
+	}
+	return stats
+}
+
+func resolutionName(source db.Source) string {
+	if !source.IsRollup() {
+		return "raw"
+	}
+	return db.FormatDuration(source.Resolution)
+}
+
+// parsePercentiles parses a comma separated list of percentiles between 0
+// and 100, "none" disables them
+func parsePercentiles(value string) ([]float64, error) {
+	switch value {
+	case "":
+		return defaultPercentiles, nil
+	case "none":
+		return nil, nil
+	}
+
+	var percentiles []float64
+	for _, field := range splitList(value) {
+		p, err := strconv.ParseFloat(field, 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("invalid percentile %q", field)
+		}
+		percentiles = append(percentiles, p)
+	}
+	return percentiles, nil
+}
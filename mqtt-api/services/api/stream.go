@@ -0,0 +1,294 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Settings of the live stream endpoints
+const (
+	// streamBuffer is how many readings a client may fall behind before it is
+	// disconnected, to resume with its last event id
+	streamBuffer = 256
+	// heartbeatInterval keeps idle connections open through proxies
+	heartbeatInterval = 15 * time.Second
+	// replayPage is how many stored readings are read at a time when a client
+	// resumes, and how many of their ids are kept to skip them on the
+	// subscription
+	replayPage = 1000
+	// resumeOverlap is how far before the last event id a resuming client
+	// sent the replay starts. Ids are generated by the writers, so a reading
+	// of another writer may be stored after readings with later ids. The
+	// readings in between are sent again.
+	resumeOverlap = 30 * time.Second
+	// retryMillis is the reconnection delay suggested to SSE clients
+	retryMillis = 3000
+	// writeTimeout bounds each WebSocket write
+	writeTimeout = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// readingStream delivers the readings of one client: stored readings after
+// the id it resumes from, page by page until caught up, then new readings as
+// they are inserted.
+type readingStream struct {
+	sel    db.Selector
+	live   <-chan db.Event
+	stop   func()
+	replay []db.Event
+	// fetch reads the next page of stored readings, nil once caught up
+	fetch  func(ctx context.Context, after primitive.ObjectID) ([]db.Event, error)
+	lastID primitive.ObjectID
+	// replayed holds the ids of the last replayed readings, which the
+	// subscription may deliver again
+	replayed recentIDs
+}
+
+// next returns the next reading of the stream. It returns false when ctx is
+// done or the client fell behind and was dropped.
+func (s *readingStream) next(ctx context.Context, heartbeat <-chan time.Time, onHeartbeat func() error) (db.Event, bool, error) {
+	if len(s.replay) == 0 && s.fetch != nil {
+		page, err := s.fetch(ctx, s.lastID)
+		if err != nil {
+			log.Printf("Stream: failed to replay readings after %s: %v", s.lastID.Hex(), err)
+			return db.Event{}, false, err
+		}
+		if len(page) < replayPage {
+			s.fetch = nil
+		}
+		s.replay = page
+	}
+	if len(s.replay) > 0 {
+		event := s.replay[0]
+		s.replay = s.replay[1:]
+		s.lastID = event.ID
+		s.replayed.add(event.ID)
+		return event, true, nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return db.Event{}, false, nil
+		case <-heartbeat:
+			if err := onHeartbeat(); err != nil {
+				return db.Event{}, false, err
+			}
+		case event, ok := <-s.live:
+			if !ok {
+				return db.Event{}, false, nil
+			}
+			// Readings inserted while replaying arrive again on the
+			// subscription. Ids are only compared with those, as readings of
+			// other writers may have lower ids than the last one sent.
+			if !s.sel.Matches(event) || s.replayed.contains(event.ID) {
+				continue
+			}
+			return event, true, nil
+		}
+	}
+}
+
+// recentIDs is a set of the last replayPage ids added to it
+type recentIDs struct {
+	ids   map[primitive.ObjectID]struct{}
+	order []primitive.ObjectID
+}
+
+func (r *recentIDs) add(id primitive.ObjectID) {
+	if r.ids == nil {
+		r.ids = make(map[primitive.ObjectID]struct{}, replayPage)
+	}
+	if len(r.order) == replayPage {
+		delete(r.ids, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.ids[id] = struct{}{}
+	r.order = append(r.order, id)
+}
+
+func (r *recentIDs) contains(id primitive.ObjectID) bool {
+	_, ok := r.ids[id]
+	return ok
+}
+
+// openStream subscribes to new readings matching the topic, device, room and
+// sensor_type query parameters, all readings without any. A client resuming
+// with the Last-Event-ID header or last_event_id parameter first receives the
+// readings stored since, and again those with ids up to resumeOverlap older.
+// It writes an error response and returns nil when the stream cannot be
+// opened.
+func (h *Handler) openStream(c *gin.Context) *readingStream {
+	if h.state == nil {
+		respondError(c, http.StatusServiceUnavailable, "live stream is not available")
+		return nil
+	}
+
+	sel := db.Selector{
+		Topics:      queryList(c, "topic"),
+		Devices:     queryList(c, "device"),
+		Rooms:       queryList(c, "room"),
+		SensorTypes: queryList(c, "sensor_type"),
+		Allowed:     allowlist(c),
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	var after primitive.ObjectID
+	if lastEventID != "" {
+		id, err := primitive.ObjectIDFromHex(lastEventID)
+		if err != nil {
+			badRequest(c, &RequestError{Code: "invalid_last_event_id", Param: "last_event_id", Message: fmt.Sprintf("invalid event id %q", lastEventID)})
+			return nil
+		}
+		after = id
+	}
+
+	// Subscribe before replaying, so no reading is missed in between
+	live, stop := h.state.Subscribe(streamBuffer)
+	stream := &readingStream{sel: sel, live: live, stop: stop}
+	if !after.IsZero() {
+		// The reading the client resumes from is the only one known to have
+		// been sent
+		filter := append(sel.Filter(), bson.E{Key: "_id", Value: bson.D{{Key: "$ne", Value: after}}})
+		stream.fetch = func(ctx context.Context, after primitive.ObjectID) ([]db.Event, error) {
+			return h.mongoDb.FindEventsAfterID(ctx, h.collection, filter, after, replayPage)
+		}
+		stream.lastID = primitive.NewObjectIDFromTimestamp(after.Timestamp().Add(-resumeOverlap))
+		// The first page is read before responding, so a failure is an error
+		// response rather than an empty stream
+		replay, err := stream.fetch(c.Request.Context(), stream.lastID)
+		if err != nil {
+			stop()
+			internalError(c, err)
+			return nil
+		}
+		if len(replay) < replayPage {
+			stream.fetch = nil
+		}
+		stream.replay = replay
+	}
+	return stream
+}
+
+// GetStream handles requests for a Server-Sent Events stream of readings.
+// Each reading is sent as a "reading" event with the reading's id, so clients
+// resume where they left off after reconnecting.
+func (h *Handler) GetStream(c *gin.Context) {
+	stream := h.openStream(c)
+	if stream == nil {
+		return
+	}
+	defer stream.stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Stops nginx from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	w := c.Writer
+	fmt.Fprintf(w, "retry: %d\n\n", retryMillis)
+	w.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	sendHeartbeat := func() error {
+		if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+			return err
+		}
+		w.Flush()
+		return nil
+	}
+
+	for {
+		event, ok, err := stream.next(c.Request.Context(), heartbeat.C, sendHeartbeat)
+		if err != nil || !ok {
+			return
+		}
+		data, err := json.Marshal(newEventEntry(event))
+		if err != nil {
+			log.Printf("Stream: failed to encode reading %s: %v", event.ID.Hex(), err)
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: reading\ndata: %s\n\n", event.ID.Hex(), data); err != nil {
+			return
+		}
+		w.Flush()
+	}
+}
+
+// GetStreamWebSocket handles requests for a WebSocket stream of readings. It
+// takes the same parameters as GetStream and sends each reading as a JSON
+// text message.
+func (h *Handler) GetStreamWebSocket(c *gin.Context) {
+	stream := h.openStream(c)
+	if stream == nil {
+		return
+	}
+	defer stream.stop()
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already responded
+		log.Printf("Stream: WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Reading handles pings, pongs and close messages, and notices when the
+	// client goes away
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	conn.SetReadDeadline(time.Now().Add(2 * heartbeatInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * heartbeatInterval))
+	})
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	sendPing := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+	}
+
+	for {
+		event, ok, err := stream.next(ctx, heartbeat.C, sendPing)
+		if err != nil {
+			return
+		}
+		if !ok {
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(writeTimeout))
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := conn.WriteJSON(newEventEntry(event)); err != nil {
+			return
+		}
+	}
+}
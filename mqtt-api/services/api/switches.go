@@ -0,0 +1,106 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SwitchActivity is returned by GET /api/v1/switches/{topic}/activity.
+// Intervals holds at most the first db.MaxIntervals intervals,
+// IntervalsTruncated is set when there were more. The totals cover all.
+type SwitchActivity struct {
+	Topic              string       `json:"topic"`
+	Start              time.Time    `json:"start"`
+	End                time.Time    `json:"end"`
+	OnCount            int64        `json:"on_count"`
+	OffCount           int64        `json:"off_count"`
+	OnSeconds          float64      `json:"on_seconds"`
+	DutyCyclePercent   float64      `json:"duty_cycle_percent"`
+	LongestOnSeconds   float64      `json:"longest_on_seconds"`
+	Intervals          []OnInterval `json:"intervals"`
+	IntervalsTruncated bool         `json:"intervals_truncated"`
+}
+
+// OnInterval is a period the switch was on, clipped to the requested range.
+// Open intervals were still running at the end of the range.
+type OnInterval struct {
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Open            bool      `json:"open"`
+}
+
+// GetSwitchActivity handles requests for the on/off activity of a switch
+// topic. The topic is the path between /switches/ and /activity.
+func (h *Handler) GetSwitchActivity(c *gin.Context) {
+	topic, ok := strings.CutSuffix(strings.TrimPrefix(c.Param("path"), "/"), "/activity")
+	if !ok || topic == "" {
+		respondError(c, http.StatusNotFound, "expected /api/v1/switches/{topic}/activity")
+		return
+	}
+	if !h.authorizeTopic(c, topic) {
+		return
+	}
+
+	startTime, endTime, err := h.parseTimeRange(c)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	startTime, endTime = untilNow(startTime, endTime)
+
+	ctx, cancel := h.mongoDb.WithTimeout(c.Request.Context())
+	defer cancel()
+
+	histories, err := db.SwitchHistories(ctx, h.mongoDb.Database.Collection(h.collection), []string{topic}, startTime, endTime)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newSwitchActivity(topic, startTime, endTime, histories[topic]))
+}
+
+// untilNow ends a range reaching into the future now, so the running
+// interval and the duty cycle only cover time that has passed
+func untilNow(start, end time.Time) (time.Time, time.Time) {
+	if now := time.Now(); end.After(now) {
+		end = now
+		if end.Before(start) {
+			end = start
+		}
+	}
+	return start, end
+}
+
+func newSwitchActivity(topic string, start, end time.Time, history *db.SwitchHistory) SwitchActivity {
+	activity := SwitchActivity{
+		Topic:              topic,
+		Start:              start,
+		End:                end,
+		OnCount:            history.OnCount,
+		OffCount:           history.OffCount,
+		OnSeconds:          history.OnTime.Seconds(),
+		LongestOnSeconds:   history.LongestOn.Seconds(),
+		Intervals:          make([]OnInterval, 0, len(history.Intervals)),
+		IntervalsTruncated: history.Truncated,
+	}
+	for _, interval := range history.Intervals {
+		activity.Intervals = append(activity.Intervals, OnInterval{
+			Start:           interval.Start,
+			End:             interval.End,
+			DurationSeconds: interval.Duration().Seconds(),
+			Open:            interval.Open,
+		})
+	}
+	if span := end.Sub(start).Seconds(); span > 0 {
+		activity.DutyCyclePercent = activity.OnSeconds / span * 100
+	}
+	return activity
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Defaults for requests that omit start or end
+const (
+	defaultStart = "now-24h"
+	defaultEnd   = "now"
+)
+
+// epochMillisThreshold separates epoch seconds from epoch milliseconds, it
+// is in the year 5138 as seconds and in 1973 as milliseconds
+const epochMillisThreshold = 1e11
+
+// relativeTerm matches one offset (-6h, +1d) or rounding (/d) of a relative
+// time expression
+var relativeTerm = regexp.MustCompile(`^(?:([+-])(\d+)|/)(s|m|h|d|w|M|y)`)
+
+// parseTimeRange extracts the start, end and tz query parameters. Each bound
+// is an RFC3339 timestamp, a date, Unix epoch seconds or milliseconds, or an
+// expression relative to now such as now-6h or now/d. Dates, timestamps
+// without an offset and rounding use the tz time zone, UTC by default. The
+// range may span at most the limit of the route's endpoint.
+func (h *Handler) parseTimeRange(c *gin.Context) (time.Time, time.Time, error) {
+	maxSpan := h.limits.Span(endpointName(c.FullPath()))
+	return parseTimeRangeValues(c.DefaultQuery("start", defaultStart), c.DefaultQuery("end", defaultEnd), c.Query("tz"), time.Now(), maxSpan)
+}
+
+func parseTimeRangeValues(startValue, endValue, tz string, now time.Time, maxSpan time.Duration) (time.Time, time.Time, error) {
+	location := time.UTC
+	if tz != "" {
+		var err error
+		if location, err = time.LoadLocation(tz); err != nil {
+			return time.Time{}, time.Time{}, &RequestError{Code: "invalid_timezone", Param: "tz", Message: fmt.Sprintf("unknown time zone %q", tz)}
+		}
+	}
+	now = now.In(location)
+
+	startTime, err := parseTime(startValue, now, false)
+	if err != nil {
+		return time.Time{}, time.Time{}, &RequestError{Code: "invalid_time", Param: "start", Message: err.Error()}
+	}
+	endTime, err := parseTime(endValue, now, true)
+	if err != nil {
+		return time.Time{}, time.Time{}, &RequestError{Code: "invalid_time", Param: "end", Message: err.Error()}
+	}
+
+	if !endTime.After(startTime) {
+		return time.Time{}, time.Time{}, &RequestError{Code: "invalid_range", Param: "end", Message: fmt.Sprintf("end %s is not after start %s", endTime.Format(time.RFC3339), startTime.Format(time.RFC3339))}
+	}
+	if endTime.Sub(startTime) > maxSpan {
+		return time.Time{}, time.Time{}, &RequestError{Code: "range_too_large", Param: "end", Message: fmt.Sprintf("time range exceeds the maximum of %s", db.FormatDuration(maxSpan))}
+	}
+	return startTime, endTime, nil
+}
+
+// parseTime parses a single bound in the location of now. An end bound given
+// as a date or rounded to a unit covers that whole date or unit.
+func parseTime(value string, now time.Time, end bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	location := now.Location()
+
+	if strings.HasPrefix(value, "now") {
+		return parseRelativeTime(value, now, end)
+	}
+
+	if epoch, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if epoch >= epochMillisThreshold || epoch <= -epochMillisThreshold {
+			return time.UnixMilli(epoch).In(location), nil
+		}
+		return time.Unix(epoch, 0).In(location), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t.In(location), nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, location); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1) // Include the entire day
+		}
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q, expected RFC3339, a date, epoch seconds or milliseconds, or an expression like now-6h or now/d", value)
+}
+
+// parseRelativeTime parses now followed by offsets such as -6h or +1d and
+// roundings such as /d, applied left to right. Days, weeks, months and years
+// follow the calendar, so they span DST changes.
+func parseRelativeTime(value string, now time.Time, end bool) (time.Time, error) {
+	t := now
+	rest := strings.TrimPrefix(value, "now")
+	for rest != "" {
+		match := relativeTerm.FindStringSubmatch(rest)
+		if match == nil {
+			return time.Time{}, fmt.Errorf("invalid relative time %q", value)
+		}
+		rest = rest[len(match[0]):]
+
+		unit := match[3]
+		if match[1] == "" {
+			t = truncateToUnit(t, unit)
+			if end {
+				t = addUnits(t, unit, 1)
+			}
+			continue
+		}
+
+		n, err := strconv.Atoi(match[2])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid relative time %q", value)
+		}
+		if match[1] == "-" {
+			n = -n
+		}
+		t = addUnits(t, unit, n)
+	}
+	return t, nil
+}
+
+// addUnits adds n of unit to t, one of s, m, h, d, w, M or y
+func addUnits(t time.Time, unit string, n int) time.Time {
+	switch unit {
+	case "s":
+		return t.Add(time.Duration(n) * time.Second)
+	case "m":
+		return t.Add(time.Duration(n) * time.Minute)
+	case "h":
+		return t.Add(time.Duration(n) * time.Hour)
+	case "d":
+		return t.AddDate(0, 0, n)
+	case "w":
+		return t.AddDate(0, 0, 7*n)
+	case "M":
+		return t.AddDate(0, n, 0)
+	default:
+		return t.AddDate(n, 0, 0)
+	}
+}
+
+// truncateToUnit rounds t down to the start of its unit in its location.
+// Weeks start on Monday.
+func truncateToUnit(t time.Time, unit string) time.Time {
+	year, month, day := t.Date()
+	hour, minute, second := t.Clock()
+	location := t.Location()
+
+	switch unit {
+	case "s":
+		return time.Date(year, month, day, hour, minute, second, 0, location)
+	case "m":
+		return time.Date(year, month, day, hour, minute, 0, 0, location)
+	case "h":
+		return time.Date(year, month, day, hour, 0, 0, 0, location)
+	case "d":
+		return time.Date(year, month, day, 0, 0, 0, 0, location)
+	case "w":
+		return time.Date(year, month, day-(int(t.Weekday())+6)%7, 0, 0, 0, 0, location)
+	case "M":
+		return time.Date(year, month, 1, 0, 0, 0, 0, location)
+	default:
+		return time.Date(year, time.January, 1, 0, 0, 0, 0, location)
+	}
+}
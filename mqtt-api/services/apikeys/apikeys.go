@@ -0,0 +1,277 @@
+package apikeys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Scopes a key may carry. Admin implies every other scope.
+const (
+	ScopeReadReadings = "read:readings"
+	ScopeWriteIngest  = "write:ingest"
+	ScopeAdmin        = "admin"
+	// ScopeControl is reserved for routes that act on devices
+	ScopeControl = "control"
+)
+
+// Scopes lists the valid scopes
+var Scopes = []string{ScopeReadReadings, ScopeWriteIngest, ScopeAdmin, ScopeControl}
+
+// collection holds one Key document per API key.
+const collection = "api_keys"
+
+// tokenPrefix starts every key, so leaked keys are easy to recognise.
+// prefixLength characters of a key are stored in the clear to tell keys apart.
+const (
+	tokenPrefix  = "hak_"
+	prefixLength = len(tokenPrefix) + 8
+)
+
+// cacheTTL is how long an authenticated key is trusted without reading it
+// again, so revoking a key takes up to this long to take effect.
+const cacheTTL = 30 * time.Second
+
+var (
+	// ErrUnknownKey is returned for keys that were never created
+	ErrUnknownKey = errors.New("unknown API key")
+	// ErrRevokedKey is returned for keys that were revoked
+	ErrRevokedKey = errors.New("API key has been revoked")
+)
+
+// Key is a stored API key. Only the SHA-256 hash of the key itself is kept.
+type Key struct {
+	ID     primitive.ObjectID `bson:"_id"`
+	Name   string             `bson:"name"`
+	Prefix string             `bson:"prefix"`
+	Hash   string             `bson:"hash"`
+	Scopes []string           `bson:"scopes"`
+
+	// Rooms and Devices restrict the key to their readings, a key without
+	// either may access all readings.
+	Rooms   []string `bson:"rooms,omitempty"`
+	Devices []string `bson:"devices,omitempty"`
+
+	CreatedAt  time.Time `bson:"created_at"`
+	LastUsedAt time.Time `bson:"last_used_at,omitempty"`
+	RevokedAt  time.Time `bson:"revoked_at,omitempty"`
+}
+
+// HasScope reports whether the key grants scope.
+func (k *Key) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowlist returns the readings the key may access.
+func (k *Key) Allowlist() db.Allowlist {
+	return db.Allowlist{Rooms: k.Rooms, Devices: k.Devices}
+}
+
+// Revoked reports whether the key has been revoked.
+func (k *Key) Revoked() bool {
+	return !k.RevokedAt.IsZero()
+}
+
+// Hash returns the hex encoded SHA-256 hash under which key is stored. Keys
+// are random, so they need no salt or slow hash.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseScopes parses a comma separated list of scopes.
+func ParseScopes(spec string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(spec, ",") {
+		if scope = strings.TrimSpace(scope); scope == "" {
+			continue
+		}
+		if !validScope(scope) {
+			return nil, fmt.Errorf("unknown scope %q, expected one of %s", scope, strings.Join(Scopes, ", "))
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+func validScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// EnabledFromEnv reads API_AUTH, "required" or "off" (the default) to leave
+// the API open.
+func EnabledFromEnv() (bool, error) {
+	switch value := os.Getenv("API_AUTH"); value {
+	case "required":
+		return true, nil
+	case "", "off":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid API_AUTH %q, expected required or off", value)
+	}
+}
+
+// Store keeps API keys in the database.
+type Store struct {
+	collection *mongo.Collection
+
+	mu    sync.Mutex
+	cache map[string]cachedKey
+}
+
+type cachedKey struct {
+	key     *Key
+	expires time.Time
+}
+
+// NewStore creates a Store of the keys in database.
+func NewStore(database *mongo.Database) *Store {
+	return &Store{
+		collection: database.Collection(collection),
+		cache:      make(map[string]cachedKey),
+	}
+}
+
+// EnsureIndexes creates the index keys are looked up by.
+func (s *Store) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// Create generates and stores a new key. The key itself is returned only
+// here, it cannot be recovered later.
+func (s *Store) Create(ctx context.Context, name string, scopes, rooms, devices []string) (string, *Key, error) {
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return "", nil, fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", nil, err
+	}
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(random)
+
+	key := &Key{
+		ID:        primitive.NewObjectID(),
+		Name:      name,
+		Prefix:    token[:prefixLength],
+		Hash:      Hash(token),
+		Scopes:    scopes,
+		Rooms:     rooms,
+		Devices:   devices,
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := s.collection.InsertOne(ctx, key); err != nil {
+		return "", nil, err
+	}
+	return token, key, nil
+}
+
+// List returns all keys, revoked ones included, oldest first.
+func (s *Store) List(ctx context.Context) ([]Key, error) {
+	cursor, err := s.collection.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	keys := []Key{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Revoke revokes the key with the given id or prefix. Revoked keys are kept
+// so List still shows them.
+func (s *Store) Revoke(ctx context.Context, ref string) (*Key, error) {
+	filter := bson.D{{Key: "prefix", Value: ref}}
+	if id, err := primitive.ObjectIDFromHex(ref); err == nil {
+		filter = bson.D{{Key: "_id", Value: id}}
+	}
+
+	var key Key
+	err := s.collection.FindOneAndUpdate(ctx, filter,
+		bson.D{{Key: "$set", Value: bson.D{{Key: "revoked_at", Value: time.Now().UTC()}}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&key)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("no key with id or prefix %q", ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// Authenticate returns the key for token, ErrUnknownKey or ErrRevokedKey.
+// Keys are cached for cacheTTL, and their last use is recorded each time
+// they are read from the database.
+func (s *Store) Authenticate(ctx context.Context, token string) (*Key, error) {
+	hash := Hash(token)
+	now := time.Now()
+
+	s.mu.Lock()
+	cached, ok := s.cache[hash]
+	s.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.key, nil
+	}
+
+	var key Key
+	err := s.collection.FindOneAndUpdate(ctx,
+		bson.D{{Key: "hash", Value: hash}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "last_used_at", Value: now.UTC()}}}},
+	).Decode(&key)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrUnknownKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.Revoked() {
+		return nil, ErrRevokedKey
+	}
+
+	s.mu.Lock()
+	// Drop expired keys rather than letting unused ones accumulate
+	for h, c := range s.cache {
+		if !now.Before(c.expires) {
+			delete(s.cache, h)
+		}
+	}
+	s.cache[hash] = cachedKey{key: &key, expires: now.Add(cacheTTL)}
+	s.mu.Unlock()
+	return &key, nil
+}
@@ -0,0 +1,288 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FormatVersion is the archive layout version written to the manifest.
+// Restore refuses archives with a newer version.
+const FormatVersion = 1
+
+const manifestName = "manifest.json"
+
+// Supported compression formats
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// Manifest describes the contents of a backup archive.
+type Manifest struct {
+	FormatVersion int                  `json:"format_version"`
+	CreatedAt     time.Time            `json:"created_at"`
+	Database      string               `json:"database"`
+	Compression   string               `json:"compression"`
+	Start         *time.Time           `json:"start,omitempty"`
+	End           *time.Time           `json:"end,omitempty"`
+	Collections   []CollectionManifest `json:"collections"`
+}
+
+// CollectionManifest describes one exported collection.
+type CollectionManifest struct {
+	Name      string          `json:"name"`
+	File      string          `json:"file"`
+	Documents int64           `json:"documents"`
+	TimeField string          `json:"time_field,omitempty"` // set when the time range was applied
+	Indexes   []IndexManifest `json:"indexes,omitempty"`
+}
+
+// IndexManifest describes a secondary index to recreate on restore.
+type IndexManifest struct {
+	Name               string          `json:"name"`
+	Keys               json.RawMessage `json:"keys"` // canonical extended JSON
+	Unique             bool            `json:"unique,omitempty"`
+	ExpireAfterSeconds *int32          `json:"expire_after_seconds,omitempty"`
+}
+
+// Options select what a backup contains.
+type Options struct {
+	Collections []string  // empty exports every collection
+	Start, End  time.Time // zero values leave the range open
+	Compression string    // CompressionZstd (default) or CompressionGzip
+}
+
+// Backup writes the selected collections of database to w as a compressed tar
+// archive holding a manifest followed by one NDJSON file per collection.
+// Documents are encoded as canonical extended JSON so that types such as
+// dates and ObjectIDs survive a restore. Collections with a "timestamp" field
+// are limited to the requested time range, all others are exported whole.
+func Backup(ctx context.Context, database *mongo.Database, w io.Writer, opts Options) (*Manifest, error) {
+	if opts.Compression == "" {
+		opts.Compression = CompressionZstd
+	}
+
+	collections := opts.Collections
+	if len(collections) == 0 {
+		names, err := database.ListCollectionNames(ctx, bson.D{})
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if !strings.HasPrefix(name, "system.") {
+				collections = append(collections, name)
+			}
+		}
+	}
+
+	manifest := &Manifest{
+		FormatVersion: FormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		Database:      database.Name(),
+		Compression:   opts.Compression,
+	}
+	if !opts.Start.IsZero() {
+		manifest.Start = &opts.Start
+	}
+	if !opts.End.IsZero() {
+		manifest.End = &opts.End
+	}
+
+	// Tar headers need the size of each entry up front, so collections are
+	// staged in temporary files before the archive is written.
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	for _, name := range collections {
+		f, err := os.CreateTemp("", "backup-*.ndjson")
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+
+		entry, err := exportCollection(ctx, database.Collection(name), f, opts)
+		if err != nil {
+			return nil, fmt.Errorf("export %s: %w", name, err)
+		}
+		manifest.Collections = append(manifest.Collections, *entry)
+	}
+
+	compressed, err := newCompressor(w, opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+	archive := tar.NewWriter(compressed)
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeEntry(archive, manifestName, int64(len(manifestJSON)), strings.NewReader(string(manifestJSON))); err != nil {
+		return nil, err
+	}
+
+	for i, f := range files {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err := writeEntry(archive, manifest.Collections[i].File, info.Size(), f); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	if err := compressed.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func exportCollection(ctx context.Context, collection *mongo.Collection, w io.Writer, opts Options) (*CollectionManifest, error) {
+	entry := &CollectionManifest{
+		Name: collection.Name(),
+		File: "collections/" + collection.Name() + ".ndjson",
+	}
+
+	indexes, err := listIndexes(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	entry.Indexes = indexes
+
+	filter := bson.D{}
+	if !opts.Start.IsZero() || !opts.End.IsZero() {
+		timestamped, err := hasTimestamp(ctx, collection)
+		if err != nil {
+			return nil, err
+		}
+		if timestamped {
+			entry.TimeField = "timestamp"
+			filter = timeRangeFilter(opts.Start, opts.End)
+		}
+	}
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	buffered := bufio.NewWriter(w)
+	for cursor.Next(ctx) {
+		line, err := bson.MarshalExtJSON(cursor.Current, true, false)
+		if err != nil {
+			return nil, err
+		}
+		buffered.Write(line)
+		buffered.WriteByte('\n')
+		entry.Documents++
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return entry, buffered.Flush()
+}
+
+func listIndexes(ctx context.Context, collection *mongo.Collection) ([]IndexManifest, error) {
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var indexes []IndexManifest
+	for cursor.Next(ctx) {
+		var spec struct {
+			Name               string   `bson:"name"`
+			Key                bson.Raw `bson:"key"`
+			Unique             bool     `bson:"unique"`
+			ExpireAfterSeconds *int32   `bson:"expireAfterSeconds"`
+		}
+		if err := cursor.Decode(&spec); err != nil {
+			return nil, err
+		}
+		if spec.Name == "_id_" {
+			continue
+		}
+
+		keys, err := bson.MarshalExtJSON(spec.Key, true, false)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, IndexManifest{
+			Name:               spec.Name,
+			Keys:               keys,
+			Unique:             spec.Unique,
+			ExpireAfterSeconds: spec.ExpireAfterSeconds,
+		})
+	}
+	return indexes, cursor.Err()
+}
+
+func hasTimestamp(ctx context.Context, collection *mongo.Collection) (bool, error) {
+	err := collection.FindOne(ctx, bson.D{{Key: "timestamp", Value: bson.D{{Key: "$type", Value: "date"}}}}).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func timeRangeFilter(start, end time.Time) bson.D {
+	condition := bson.D{}
+	if !start.IsZero() {
+		condition = append(condition, bson.E{Key: "$gte", Value: start})
+	}
+	if !end.IsZero() {
+		condition = append(condition, bson.E{Key: "$lt", Value: end})
+	}
+	return bson.D{{Key: "timestamp", Value: condition}}
+}
+
+func writeEntry(archive *tar.Writer, name string, size int64, r io.Reader) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(archive, r)
+	return err
+}
+
+func newCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
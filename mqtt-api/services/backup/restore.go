@@ -0,0 +1,237 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"home_automation_dashboard/shared/db"
+
+	"github.com/klauspost/compress/zstd"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// restoreBatchSize is the number of documents inserted per request.
+const restoreBatchSize = 1000
+
+// RestoreResult counts what a restore did per collection.
+type RestoreResult struct {
+	Collection string
+	Inserted   int64
+	Duplicates int64
+}
+
+// Restore loads an archive written by Backup into database, detecting
+// whether it is zstd or gzip compressed. Documents keep their original _id,
+// so documents that already exist are skipped and a restore can safely be
+// repeated. Their expiry is set again from the policies of retention rather
+// than the ones in force when the backup was taken.
+func Restore(ctx context.Context, database *mongo.Database, r io.Reader, retention *db.Retention) (*Manifest, []RestoreResult, error) {
+	decompressed, err := newDecompressor(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer decompressed.Close()
+
+	archive := tar.NewReader(decompressed)
+
+	header, err := archive.Next()
+	if err != nil {
+		return nil, nil, fmt.Errorf("read archive: %w", err)
+	}
+	if header.Name != manifestName {
+		return nil, nil, fmt.Errorf("archive does not start with %s", manifestName)
+	}
+
+	var manifest Manifest
+	if err := json.NewDecoder(archive).Decode(&manifest); err != nil {
+		return nil, nil, fmt.Errorf("read manifest: %w", err)
+	}
+	if manifest.FormatVersion > FormatVersion {
+		return nil, nil, fmt.Errorf("archive format version %d is newer than the supported version %d", manifest.FormatVersion, FormatVersion)
+	}
+
+	files := make(map[string]CollectionManifest, len(manifest.Collections))
+	for _, entry := range manifest.Collections {
+		files[entry.File] = entry
+	}
+
+	var results []RestoreResult
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &manifest, results, fmt.Errorf("read archive: %w", err)
+		}
+
+		entry, ok := files[header.Name]
+		if !ok {
+			log.Printf("Skipping unknown archive entry %s", header.Name)
+			continue
+		}
+
+		collection := database.Collection(entry.Name)
+		if err := restoreIndexes(ctx, collection, entry.Indexes); err != nil {
+			return &manifest, results, fmt.Errorf("restore indexes of %s: %w", entry.Name, err)
+		}
+
+		result, err := restoreCollection(ctx, collection, archive, retention)
+		if err != nil {
+			return &manifest, results, fmt.Errorf("restore %s: %w", entry.Name, err)
+		}
+		results = append(results, *result)
+	}
+	return &manifest, results, nil
+}
+
+func restoreCollection(ctx context.Context, collection *mongo.Collection, r io.Reader, retention *db.Retention) (*RestoreResult, error) {
+	result := &RestoreResult{Collection: collection.Name()}
+	reader := bufio.NewReader(r)
+
+	batch := make([]interface{}, 0, restoreBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		inserted, duplicates, err := insertBatch(ctx, collection, batch)
+		result.Inserted += inserted
+		result.Duplicates += duplicates
+		batch = batch[:0]
+		return err
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var doc bson.D
+			if err := bson.UnmarshalExtJSON(line, true, &doc); err != nil {
+				return result, err
+			}
+			batch = append(batch, resetExpiry(doc, collection.Name(), retention))
+			if len(batch) == restoreBatchSize {
+				if err := flush(); err != nil {
+					return result, err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, flush()
+}
+
+// resetExpiry replaces the expire_at of a restored reading or rollup bucket
+// with the one retention gives it, or drops it when retention keeps it
+// forever or leaves it to the retention pass
+func resetExpiry(doc bson.D, collection string, retention *db.Retention) bson.D {
+	var topic string
+	var timestamp primitive.DateTime
+	kept := doc[:0]
+	for _, element := range doc {
+		switch element.Key {
+		case "expire_at":
+			continue
+		case "topic":
+			topic, _ = element.Value.(string)
+		case "timestamp":
+			timestamp, _ = element.Value.(primitive.DateTime)
+		}
+		kept = append(kept, element)
+	}
+
+	if topic == "" || timestamp == 0 {
+		return kept
+	}
+	if expireAt, ok := retention.ExpireAt(collection, topic, timestamp.Time()); ok {
+		kept = append(kept, bson.E{Key: "expire_at", Value: primitive.NewDateTimeFromTime(expireAt)})
+	}
+	return kept
+}
+
+// insertBatch inserts docs without stopping at the first error and counts
+// documents whose _id already exists as duplicates rather than failures.
+func insertBatch(ctx context.Context, collection *mongo.Collection, docs []interface{}) (inserted, duplicates int64, err error) {
+	res, err := collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if res != nil {
+		inserted = int64(len(res.InsertedIDs))
+	}
+	if err == nil {
+		return inserted, 0, nil
+	}
+
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return inserted, 0, err
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if !mongo.IsDuplicateKeyError(writeErr) {
+			return inserted, duplicates, writeErr
+		}
+		duplicates++
+	}
+	return int64(len(docs)) - duplicates, duplicates, nil
+}
+
+func restoreIndexes(ctx context.Context, collection *mongo.Collection, indexes []IndexManifest) error {
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.IndexModel, 0, len(indexes))
+	for _, index := range indexes {
+		var keys bson.D
+		if err := bson.UnmarshalExtJSON(index.Keys, true, &keys); err != nil {
+			return err
+		}
+
+		opts := options.Index().SetName(index.Name)
+		if index.Unique {
+			opts.SetUnique(true)
+		}
+		if index.ExpireAfterSeconds != nil {
+			opts.SetExpireAfterSeconds(*index.ExpireAfterSeconds)
+		}
+		models = append(models, mongo.IndexModel{Keys: keys, Options: opts})
+	}
+
+	_, err := collection.Indexes().CreateMany(ctx, models)
+	return err
+}
+
+// newDecompressor detects the compression of r from its magic bytes.
+func newDecompressor(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("read archive: %w", err)
+	}
+
+	switch {
+	case magic[0] == 0x1f && magic[1] == 0x8b:
+		return gzip.NewReader(buffered)
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("archive is neither gzip nor zstd compressed")
+	}
+}
@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestResetExpiry(t *testing.T) {
+	retention := db.NewRetention(nil, "mqtt_events", []db.RetentionPolicy{
+		{Pattern: "home/#", RawTTL: 7 * 24 * time.Hour, Tiers: []db.RollupTier{{Resolution: time.Hour, TTL: 30 * 24 * time.Hour}}},
+	})
+	at := primitive.NewDateTimeFromTime(time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC))
+	stale := primitive.NewDateTimeFromTime(time.Date(2024, 3, 11, 12, 0, 0, 0, time.UTC))
+
+	tests := []struct {
+		name       string
+		collection string
+		doc        bson.D
+		want       bson.D
+	}{
+		{
+			name:       "bucket expires by the current tier",
+			collection: "mqtt_events_rollup_1h",
+			doc:        bson.D{{Key: "topic", Value: "home/hall/temperature"}, {Key: "expire_at", Value: stale}, {Key: "timestamp", Value: at}},
+			want: bson.D{
+				{Key: "topic", Value: "home/hall/temperature"}, {Key: "timestamp", Value: at},
+				{Key: "expire_at", Value: primitive.NewDateTimeFromTime(at.Time().Add(30 * 24 * time.Hour))},
+			},
+		},
+		{
+			name:       "raw reading is left to the retention pass",
+			collection: "mqtt_events",
+			doc:        bson.D{{Key: "topic", Value: "home/hall/temperature"}, {Key: "timestamp", Value: at}, {Key: "expire_at", Value: stale}},
+			want:       bson.D{{Key: "topic", Value: "home/hall/temperature"}, {Key: "timestamp", Value: at}},
+		},
+		{
+			name:       "topic without a policy is kept",
+			collection: "mqtt_events_rollup_1h",
+			doc:        bson.D{{Key: "topic", Value: "garden/pump/state"}, {Key: "timestamp", Value: at}, {Key: "expire_at", Value: stale}},
+			want:       bson.D{{Key: "topic", Value: "garden/pump/state"}, {Key: "timestamp", Value: at}},
+		},
+		{
+			name:       "other documents are unchanged",
+			collection: "api_keys",
+			doc:        bson.D{{Key: "name", Value: "grafana"}},
+			want:       bson.D{{Key: "name", Value: "grafana"}},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := resetExpiry(tt.doc, tt.collection, retention); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: resetExpiry() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
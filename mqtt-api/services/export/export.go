@@ -0,0 +1,337 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"github.com/xitongsys/parquet-go-source/writerfile"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Supported formats
+const (
+	FormatCSV     = "csv"
+	FormatNDJSON  = "ndjson"
+	FormatParquet = "parquet"
+)
+
+// Formats lists the supported formats.
+var Formats = []string{FormatCSV, FormatNDJSON, FormatParquet}
+
+// batchSize is the number of readings fetched from the cursor at a time.
+const batchSize = 1000
+
+// flushEvery is the number of rows after which buffered CSV and NDJSON output
+// is flushed, so clients receive data while the export runs.
+const flushEvery = 1000
+
+// parquetRowGroupSize bounds the rows buffered in memory before a Parquet row
+// group is written.
+const parquetRowGroupSize = 16 * 1024 * 1024
+
+// ContentType returns the MIME type of format.
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatNDJSON:
+		return "application/x-ndjson"
+	default:
+		return "application/vnd.apache.parquet"
+	}
+}
+
+// Row is one exported reading. Value is a number, a string or a JSON object.
+type Row struct {
+	Timestamp  time.Time              `bson:"timestamp"`
+	Topic      string                 `bson:"topic"`
+	Device     string                 `bson:"device"`
+	Value      interface{}            `bson:"value"`
+	Tags       map[string]interface{} `bson:"tags"`
+	Room       string                 `bson:"-"`
+	SensorType string                 `bson:"-"`
+}
+
+// Filter matches the readings selected by sel between start and end. Zero
+// times leave the range open and an empty selector selects all topics.
+func Filter(sel db.Selector, start, end time.Time) bson.D {
+	conditions := bson.A{sel.Filter()}
+
+	timestamp := bson.D{}
+	if !start.IsZero() {
+		timestamp = append(timestamp, bson.E{Key: "$gte", Value: start})
+	}
+	if !end.IsZero() {
+		timestamp = append(timestamp, bson.E{Key: "$lt", Value: end})
+	}
+	if len(timestamp) > 0 {
+		conditions = append(conditions, bson.D{{Key: "timestamp", Value: timestamp}})
+	}
+	return bson.D{{Key: "$and", Value: conditions}}
+}
+
+// rowWriter writes rows in one format.
+type rowWriter interface {
+	Write(row Row) error
+	Close() error
+}
+
+// flusher is implemented by writers that can push buffered output to the
+// client, such as http.Flusher.
+type flusher interface {
+	Flush()
+}
+
+// Export writes the readings of collection matching filter to w in format,
+// ordered by time. Readings are streamed from a cursor, so memory use does not
+// depend on the number of readings. It returns the number of rows written.
+func Export(ctx context.Context, collection *mongo.Collection, filter bson.D, format string, w io.Writer) (int64, error) {
+	rows, err := newRowWriter(format, w)
+	if err != nil {
+		return 0, err
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}).
+		SetBatchSize(batchSize).
+		SetProjection(bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "timestamp", Value: 1},
+			{Key: "topic", Value: 1},
+			{Key: "device", Value: 1},
+			{Key: "value", Value: 1},
+			{Key: "tags.room", Value: 1},
+			{Key: "tags.sensor_type", Value: 1},
+		})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var count int64
+	for cursor.Next(ctx) {
+		var row Row
+		if err := cursor.Decode(&row); err != nil {
+			return count, err
+		}
+		row.Room, _ = row.Tags["room"].(string)
+		row.SensorType, _ = row.Tags["sensor_type"].(string)
+
+		if err := rows.Write(row); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := cursor.Err(); err != nil {
+		return count, err
+	}
+	return count, rows.Close()
+}
+
+func newRowWriter(format string, w io.Writer) (rowWriter, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVWriter(w)
+	case FormatNDJSON:
+		return newNDJSONWriter(w), nil
+	case FormatParquet:
+		return newParquetWriter(w)
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+// csvHeader are the columns of CSV exports
+var csvHeader = []string{"timestamp", "topic", "device", "room", "sensor_type", "value"}
+
+type csvWriter struct {
+	out    *bufio.Writer
+	csv    *csv.Writer
+	target io.Writer
+	rows   int
+}
+
+func newCSVWriter(w io.Writer) (*csvWriter, error) {
+	out := bufio.NewWriter(w)
+	cw := &csvWriter{out: out, csv: csv.NewWriter(out), target: w}
+	return cw, cw.csv.Write(csvHeader)
+}
+
+func (w *csvWriter) Write(row Row) error {
+	value, err := formatValue(row.Value)
+	if err != nil {
+		return err
+	}
+	record := []string{row.Timestamp.UTC().Format(time.RFC3339Nano), row.Topic, row.Device, row.Room, row.SensorType, value}
+	if err := w.csv.Write(record); err != nil {
+		return err
+	}
+
+	if w.rows++; w.rows%flushEvery == 0 {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *csvWriter) flush() error {
+	w.csv.Flush()
+	if err := w.csv.Error(); err != nil {
+		return err
+	}
+	if err := w.out.Flush(); err != nil {
+		return err
+	}
+	if f, ok := w.target.(flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (w *csvWriter) Close() error {
+	return w.flush()
+}
+
+// formatValue renders a value as a CSV field, JSON objects as JSON
+func formatValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
+
+type ndjsonWriter struct {
+	out     *bufio.Writer
+	encoder *json.Encoder
+	target  io.Writer
+	rows    int
+}
+
+// ndjsonRow is the JSON form of a Row
+type ndjsonRow struct {
+	Timestamp  time.Time   `json:"timestamp"`
+	Topic      string      `json:"topic"`
+	Device     string      `json:"device"`
+	Room       string      `json:"room"`
+	SensorType string      `json:"sensor_type"`
+	Value      interface{} `json:"value"`
+}
+
+func newNDJSONWriter(w io.Writer) *ndjsonWriter {
+	out := bufio.NewWriter(w)
+	return &ndjsonWriter{out: out, encoder: json.NewEncoder(out), target: w}
+}
+
+func (w *ndjsonWriter) Write(row Row) error {
+	err := w.encoder.Encode(ndjsonRow{
+		Timestamp:  row.Timestamp.UTC(),
+		Topic:      row.Topic,
+		Device:     row.Device,
+		Room:       row.Room,
+		SensorType: row.SensorType,
+		Value:      row.Value,
+	})
+	if err != nil {
+		return err
+	}
+
+	if w.rows++; w.rows%flushEvery == 0 {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *ndjsonWriter) flush() error {
+	if err := w.out.Flush(); err != nil {
+		return err
+	}
+	if f, ok := w.target.(flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (w *ndjsonWriter) Close() error {
+	return w.flush()
+}
+
+// parquetRow is the Parquet schema of exports. Numeric values go to value,
+// everything else to value_text, JSON objects as JSON.
+type parquetRow struct {
+	Timestamp  int64    `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Topic      string   `parquet:"name=topic, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Device     string   `parquet:"name=device, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Room       string   `parquet:"name=room, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	SensorType string   `parquet:"name=sensor_type, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Value      *float64 `parquet:"name=value, type=DOUBLE, repetitiontype=OPTIONAL"`
+	ValueText  *string  `parquet:"name=value_text, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+}
+
+type parquetWriter struct {
+	writer *writer.ParquetWriter
+}
+
+func newParquetWriter(w io.Writer) (*parquetWriter, error) {
+	pw, err := writer.NewParquetWriter(writerfile.NewWriterFile(w), new(parquetRow), 1)
+	if err != nil {
+		return nil, err
+	}
+	pw.RowGroupSize = parquetRowGroupSize
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetWriter{writer: pw}, nil
+}
+
+func (w *parquetWriter) Write(row Row) error {
+	record := parquetRow{
+		Timestamp:  row.Timestamp.UnixMilli(),
+		Topic:      row.Topic,
+		Device:     row.Device,
+		Room:       row.Room,
+		SensorType: row.SensorType,
+	}
+	switch v := row.Value.(type) {
+	case float64:
+		record.Value = &v
+	case int32:
+		number := float64(v)
+		record.Value = &number
+	case int64:
+		number := float64(v)
+		record.Value = &number
+	case nil:
+	default:
+		text, err := formatValue(v)
+		if err != nil {
+			return err
+		}
+		record.ValueText = &text
+	}
+	return w.writer.Write(record)
+}
+
+func (w *parquetWriter) Close() error {
+	return w.writer.WriteStop()
+}
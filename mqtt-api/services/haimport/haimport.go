@@ -0,0 +1,413 @@
+package haimport
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+	"home_automation_dashboard/shared/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	_ "modernc.org/sqlite"
+)
+
+// Sources tagged on imported readings
+const (
+	SourceStates     = "ha_recorder"
+	SourceStatistics = "ha_statistics"
+)
+
+// DefaultTopicTemplate maps "switch.bulb_b" to "home/bulb_b/state".
+const DefaultTopicTemplate = "home/{object_id}/state"
+
+const insertBatchSize = 1000
+
+// skippedStates are recorder states that do not represent a reading.
+var skippedStates = map[string]bool{
+	"":            true,
+	"unavailable": true,
+	"unknown":     true,
+}
+
+// Options control which recorder history is imported and how entities map
+// onto topics.
+type Options struct {
+	// TopicTemplate builds a topic from an entity id, expanding {entity_id},
+	// {domain} and {object_id}. TopicMap overrides it for single entities.
+	TopicTemplate string
+	TopicMap      map[string]string
+
+	Entities   []string  // entity id globs such as "sensor.*", empty imports all
+	Start, End time.Time // zero values leave the range open
+	Statistics bool      // also import long-term statistics older than the states
+	DryRun     bool
+}
+
+// Result counts what was imported for one entity.
+type Result struct {
+	EntityID string
+	Topic    string
+
+	// States and Statistics count the readings inserted, or that would be
+	// in a dry run, Duplicates those skipped as already stored by a
+	// previous import
+	States     int64
+	Statistics int64
+	Duplicates int64
+
+	// StoredSince is when other sources started storing readings of the
+	// topic, history from then on was not imported.
+	StoredSince time.Time
+}
+
+// OpenRecorder opens a copy of the Home Assistant recorder database read-only.
+func OpenRecorder(file string) (*sql.DB, error) {
+	recorder, err := sql.Open("sqlite", "file:"+file+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	if err := recorder.Ping(); err != nil {
+		recorder.Close()
+		return nil, err
+	}
+	return recorder, nil
+}
+
+// Importer backfills readings from a recorder database into the events
+// collection, with the timestamps Home Assistant recorded them at.
+type Importer struct {
+	recorder  *sql.DB
+	events    *mongo.Collection
+	retention *db.Retention
+	opts      Options
+}
+
+// New creates an Importer. When retention is set, rollups are built for the
+// imported range so that the readings survive raw expiry.
+func New(recorder *sql.DB, events *mongo.Collection, retention *db.Retention, opts Options) *Importer {
+	if opts.TopicTemplate == "" {
+		opts.TopicTemplate = DefaultTopicTemplate
+	}
+	return &Importer{recorder: recorder, events: events, retention: retention, opts: opts}
+}
+
+// Topic returns the topic readings of entityID are stored under.
+func (im *Importer) Topic(entityID string) string {
+	if topic, ok := im.opts.TopicMap[entityID]; ok {
+		return topic
+	}
+	domain, objectID, _ := strings.Cut(entityID, ".")
+	return strings.NewReplacer(
+		"{entity_id}", entityID,
+		"{domain}", domain,
+		"{object_id}", objectID,
+	).Replace(im.opts.TopicTemplate)
+}
+
+func (im *Importer) selected(entityID string) bool {
+	if len(im.opts.Entities) == 0 {
+		return true
+	}
+	for _, pattern := range im.opts.Entities {
+		if ok, _ := path.Match(pattern, entityID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Import imports every selected entity, calling progress after each one.
+func (im *Importer) Import(ctx context.Context, progress func(Result)) ([]Result, error) {
+	rows, err := im.recorder.QueryContext(ctx, `SELECT metadata_id, entity_id FROM states_meta ORDER BY entity_id`)
+	if err != nil {
+		return nil, fmt.Errorf("read states_meta: %w", err)
+	}
+
+	type entity struct {
+		id       int64
+		entityID string
+	}
+	var entities []entity
+	for rows.Next() {
+		var e entity
+		if err := rows.Scan(&e.id, &e.entityID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if im.selected(e.entityID) {
+			entities = append(entities, e)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var results []Result
+	for _, e := range entities {
+		result, err := im.importEntity(ctx, e.id, e.entityID)
+		if err != nil {
+			return results, fmt.Errorf("import %s: %w", e.entityID, err)
+		}
+		results = append(results, result)
+		if progress != nil {
+			progress(result)
+		}
+	}
+	return results, nil
+}
+
+func (im *Importer) importEntity(ctx context.Context, metadataID int64, entityID string) (Result, error) {
+	result := Result{EntityID: entityID, Topic: im.Topic(entityID)}
+
+	// Anything from the first reading stored by other sources on is already
+	// covered, importing it again would double count.
+	cutoff, err := im.storedSince(ctx, result.Topic)
+	if err != nil {
+		return result, err
+	}
+	result.StoredSince = cutoff
+	end := im.opts.End
+	if !cutoff.IsZero() && (end.IsZero() || cutoff.Before(end)) {
+		end = cutoff
+	}
+
+	writer := &batchWriter{events: im.events, topic: result.Topic, dryRun: im.opts.DryRun, inserted: make(map[string]int64)}
+
+	first, last, err := im.importStates(ctx, metadataID, end, writer, &result)
+	if err != nil {
+		return result, err
+	}
+
+	if im.opts.Statistics {
+		statisticsEnd := end
+		if !first.IsZero() {
+			statisticsEnd = first
+		}
+		statisticsFirst, statisticsLast, err := im.importStatistics(ctx, entityID, statisticsEnd, writer, &result)
+		if err != nil {
+			return result, err
+		}
+		if !statisticsFirst.IsZero() {
+			first = statisticsFirst
+			if last.IsZero() {
+				last = statisticsLast
+			}
+		}
+	}
+
+	if err := writer.flush(ctx); err != nil {
+		return result, err
+	}
+	result.States = writer.inserted[SourceStates]
+	result.Statistics = writer.inserted[SourceStatistics]
+	result.Duplicates = writer.duplicates
+
+	if im.retention != nil && !im.opts.DryRun && !first.IsZero() {
+		until := last.Add(time.Millisecond)
+		if !cutoff.IsZero() {
+			until = cutoff
+		}
+		if err := im.retention.Backfill(ctx, result.Topic, first, until); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// importStates imports state changes of the entity before end and returns
+// the time of the first and last imported state.
+func (im *Importer) importStates(ctx context.Context, metadataID int64, end time.Time, writer *batchWriter, result *Result) (first, last time.Time, err error) {
+	rows, err := im.recorder.QueryContext(ctx, `
+		SELECT state, last_updated_ts FROM states
+		WHERE metadata_id = ? AND last_updated_ts >= ? AND last_updated_ts < ?
+		ORDER BY last_updated_ts`,
+		metadataID, unixSeconds(im.opts.Start, 0), unixSeconds(end, float64(1<<53)))
+	if err != nil {
+		return first, last, fmt.Errorf("read states: %w", err)
+	}
+	defer rows.Close()
+
+	previous := ""
+	for rows.Next() {
+		var state sql.NullString
+		var updated float64
+		if err := rows.Scan(&state, &updated); err != nil {
+			return first, last, err
+		}
+
+		// Attribute-only changes repeat the state, MQTT only publishes changes
+		if skippedStates[state.String] || state.String == previous {
+			continue
+		}
+		previous = state.String
+
+		timestamp := fromUnixSeconds(updated)
+		msg := models.NewMqttMessage(result.Topic, models.ParsePayload([]byte(state.String)), timestamp)
+		msg.Tags["source"] = SourceStates
+		if err := writer.add(ctx, msg); err != nil {
+			return first, last, err
+		}
+
+		if first.IsZero() {
+			first = timestamp
+		}
+		last = timestamp
+	}
+	return first, last, rows.Err()
+}
+
+// importStatistics imports the hourly long-term statistics of the entity
+// from before end, which covers history the recorder has already purged
+// states for. The mean is stored for measurements and the state for meters.
+// It returns the time of the first and last imported statistic.
+func (im *Importer) importStatistics(ctx context.Context, entityID string, end time.Time, writer *batchWriter, result *Result) (first, last time.Time, err error) {
+	rows, err := im.recorder.QueryContext(ctx, `
+		SELECT s.start_ts, s.mean, s.state FROM statistics s
+		JOIN statistics_meta m ON m.id = s.metadata_id
+		WHERE m.statistic_id = ? AND s.start_ts >= ? AND s.start_ts < ?
+		ORDER BY s.start_ts`,
+		entityID, unixSeconds(im.opts.Start, 0), unixSeconds(end, float64(1<<53)))
+	if err != nil {
+		return first, last, fmt.Errorf("read statistics: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var start float64
+		var mean, state sql.NullFloat64
+		if err := rows.Scan(&start, &mean, &state); err != nil {
+			return first, last, err
+		}
+
+		value := mean
+		if !value.Valid {
+			value = state
+		}
+		if !value.Valid {
+			continue
+		}
+
+		timestamp := fromUnixSeconds(start)
+		msg := models.NewMqttMessage(result.Topic, value.Float64, timestamp)
+		msg.Tags["source"] = SourceStatistics
+		if err := writer.add(ctx, msg); err != nil {
+			return first, last, err
+		}
+
+		if first.IsZero() {
+			first = timestamp
+		}
+		last = timestamp
+	}
+	return first, last, rows.Err()
+}
+
+// storedSince returns the time of the first reading of topic that was not
+// imported from the recorder, or the zero time if there is none.
+func (im *Importer) storedSince(ctx context.Context, topic string) (time.Time, error) {
+	filter := bson.D{
+		{Key: "topic", Value: topic},
+		{Key: "tags.source", Value: bson.D{{Key: "$nin", Value: bson.A{SourceStates, SourceStatistics}}}},
+	}
+	var doc struct {
+		Timestamp time.Time `bson:"timestamp"`
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: 1}}).SetProjection(bson.D{{Key: "timestamp", Value: 1}})
+	err := im.events.FindOne(ctx, filter, opts).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return time.Time{}, nil
+	}
+	return doc.Timestamp, err
+}
+
+// batchWriter inserts readings of one topic in batches, skipping readings
+// whose timestamp is already stored. It counts the inserted readings by
+// source and the skipped ones.
+type batchWriter struct {
+	events     *mongo.Collection
+	topic      string
+	dryRun     bool
+	batch      []models.MqttMessage
+	inserted   map[string]int64
+	duplicates int64
+}
+
+func (w *batchWriter) add(ctx context.Context, msg models.MqttMessage) error {
+	w.batch = append(w.batch, msg)
+	if len(w.batch) >= insertBatchSize {
+		return w.flush(ctx)
+	}
+	return nil
+}
+
+func (w *batchWriter) flush(ctx context.Context) error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	defer func() { w.batch = w.batch[:0] }()
+
+	timestamps := make(bson.A, len(w.batch))
+	for i, msg := range w.batch {
+		timestamps[i] = msg.Timestamp
+	}
+
+	cursor, err := w.events.Find(ctx,
+		bson.D{
+			{Key: "topic", Value: w.topic},
+			{Key: "timestamp", Value: bson.D{{Key: "$in", Value: timestamps}}},
+		},
+		options.Find().SetProjection(bson.D{{Key: "timestamp", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+	existing := make(map[int64]bool)
+	for cursor.Next(ctx) {
+		var doc struct {
+			Timestamp time.Time `bson:"timestamp"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			cursor.Close(ctx)
+			return err
+		}
+		existing[doc.Timestamp.UnixMilli()] = true
+	}
+	cursor.Close(ctx)
+
+	var docs []interface{}
+	for _, msg := range w.batch {
+		if existing[msg.Timestamp.UnixMilli()] {
+			w.duplicates++
+			continue
+		}
+		docs = append(docs, msg)
+		source, _ := msg.Tags["source"].(string)
+		w.inserted[source]++
+	}
+	if len(docs) == 0 || w.dryRun {
+		return nil
+	}
+
+	_, err = w.events.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	return err
+}
+
+func unixSeconds(t time.Time, fallback float64) float64 {
+	if t.IsZero() {
+		return fallback
+	}
+	return float64(t.UnixMilli()) / 1000
+}
+
+// fromUnixSeconds converts a recorder timestamp, truncated to the millisecond
+// precision MongoDB stores.
+func fromUnixSeconds(seconds float64) time.Time {
+	return time.UnixMilli(int64(seconds * 1000)).UTC()
+}
@@ -0,0 +1,217 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+	"home_automation_dashboard/shared/models"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxBatch bounds the readings accepted in one request
+const MaxBatch = 5000
+
+// MaxFuture bounds how far ahead of the time received a reading may be
+// timestamped. Readings further ahead come from a wrong clock or precision,
+// and would sort after every reading sent correctly.
+const MaxFuture = 5 * time.Minute
+
+// Token authorises one source to ingest readings. The source name is tagged
+// on every reading it sends.
+type Token struct {
+	Source string
+	Token  string
+}
+
+// Tokens are the configured ingest tokens, none disables ingestion.
+type Tokens []Token
+
+// ParseTokens parses tokens of the form "weather_station=s3cret;garage=t0ken".
+func ParseTokens(spec string) (Tokens, error) {
+	var tokens Tokens
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		source, token, ok := strings.Cut(entry, "=")
+		source, token = strings.TrimSpace(source), strings.TrimSpace(token)
+		if !ok || source == "" || token == "" {
+			return nil, fmt.Errorf("ingest token %q: expected <source>=<token>", entry)
+		}
+		tokens = append(tokens, Token{Source: source, Token: token})
+	}
+	return tokens, nil
+}
+
+// TokensFromEnv reads INGEST_TOKENS.
+func TokensFromEnv() (Tokens, error) {
+	tokens, err := ParseTokens(os.Getenv("INGEST_TOKENS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid INGEST_TOKENS: %w", err)
+	}
+	return tokens, nil
+}
+
+// Source returns the source authorised by token. Every token is compared, in
+// constant time, so the time taken does not reveal which one nearly matched.
+func (t Tokens) Source(token string) (string, bool) {
+	source, found := "", false
+	for _, candidate := range t {
+		if subtle.ConstantTimeCompare([]byte(candidate.Token), []byte(token)) == 1 {
+			source, found = candidate.Source, true
+		}
+	}
+	return source, found
+}
+
+// Reading is a reading sent as JSON. Device and the room and sensor_type tags
+// default to what MQTT readings derive from the topic levels. Timestamp is
+// RFC 3339 or Unix seconds or milliseconds, and defaults to the time received.
+type Reading struct {
+	Topic     string                 `json:"topic"`
+	Value     json.RawMessage        `json:"value"`
+	Timestamp json.RawMessage        `json:"timestamp,omitempty"`
+	Device    string                 `json:"device,omitempty"`
+	Tags      map[string]interface{} `json:"tags,omitempty"`
+}
+
+// ParseReadings decodes a single reading object or an array of them.
+func ParseReadings(body []byte) ([]Reading, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var readings []Reading
+		if err := json.Unmarshal(body, &readings); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		return readings, nil
+	}
+
+	var reading Reading
+	if err := json.Unmarshal(body, &reading); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	return []Reading{reading}, nil
+}
+
+// Message builds the stored document of the reading, as MessageHandler does
+// for MQTT messages, tagging it with source.
+func (r Reading) Message(source string, now time.Time) (models.MqttMessage, error) {
+	if err := checkTopic(r.Topic); err != nil {
+		return models.MqttMessage{}, err
+	}
+	value, err := parseValue(r.Value)
+	if err != nil {
+		return models.MqttMessage{}, fmt.Errorf("%s: %w", r.Topic, err)
+	}
+	timestamp, err := parseTimestamp(r.Timestamp, now)
+	if err == nil {
+		err = checkTimestamp(timestamp, now)
+	}
+	if err != nil {
+		return models.MqttMessage{}, fmt.Errorf("%s: %w", r.Topic, err)
+	}
+
+	msg := models.NewMqttMessage(r.Topic, value, timestamp)
+	if r.Device != "" {
+		msg.Device = r.Device
+	}
+	for key, tag := range r.Tags {
+		if key == "state" || strings.ContainsAny(key, ".$") {
+			continue
+		}
+		msg.Tags[key] = tag
+	}
+	msg.Tags["source"] = source
+	return msg, nil
+}
+
+// checkTopic rejects topics an MQTT client could not publish to: empty ones
+// and those with wildcards or null characters.
+func checkTopic(topic string) error {
+	switch {
+	case topic == "":
+		return fmt.Errorf("topic is required")
+	case db.IsTopicPattern(topic):
+		return fmt.Errorf("topic %q contains a wildcard, readings are stored under a single topic", topic)
+	case strings.ContainsRune(topic, 0):
+		return fmt.Errorf("topic %q contains a null character", topic)
+	}
+	return nil
+}
+
+// checkTimestamp rejects timestamps more than MaxFuture ahead of now.
+func checkTimestamp(t, now time.Time) error {
+	if t.After(now.Add(MaxFuture)) {
+		return fmt.Errorf("timestamp %s is in the future", t.Format(time.RFC3339Nano))
+	}
+	return nil
+}
+
+// parseValue converts a JSON value the way ParsePayload converts MQTT
+// payloads: numeric strings become numbers and booleans become strings.
+func parseValue(raw json.RawMessage) (interface{}, error) {
+	var value interface{}
+	if len(raw) == 0 || json.Unmarshal(raw, &value) != nil || value == nil {
+		return nil, fmt.Errorf("value is required")
+	}
+
+	switch v := value.(type) {
+	case float64, map[string]interface{}:
+		return v, nil
+	case string:
+		return models.ParsePayload([]byte(v)), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return nil, fmt.Errorf("value must be a number, string, boolean or object")
+}
+
+// parseTimestamp reads an RFC 3339 string or Unix seconds or milliseconds,
+// told apart like the time parameters of the API.
+func parseTimestamp(raw json.RawMessage, now time.Time) (time.Time, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return now, nil
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		t, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q, expected RFC 3339", text)
+		}
+		return t.UTC(), nil
+	}
+
+	var number float64
+	if err := json.Unmarshal(raw, &number); err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %s", raw)
+	}
+	if number >= 1e11 {
+		return time.UnixMilli(int64(number)).UTC(), nil
+	}
+	seconds, fraction := math.Modf(number)
+	return time.Unix(int64(seconds), int64(fraction*1e9)).UTC(), nil
+}
+
+// Store inserts the messages into collection.
+func Store(ctx context.Context, collection *mongo.Collection, messages []models.MqttMessage) error {
+	docs := make([]interface{}, len(messages))
+	for i, msg := range messages {
+		docs[i] = msg
+	}
+	_, err := collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	return err
+}
@@ -0,0 +1,214 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/shared/models"
+)
+
+// Precisions maps the precision parameter of InfluxDB writes to the unit of
+// line timestamps
+var Precisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// ParseLineProtocol converts InfluxDB line protocol into stored documents,
+// one per field. The measurement is the topic, followed by the field name
+// unless the field is "value", so "home/kitchen/temperature value=21.5" is
+// stored like an MQTT reading of home/kitchen/temperature. A device tag sets
+// the device, other tags are stored as tags, and every reading is tagged
+// with source.
+func ParseLineProtocol(body []byte, precision time.Duration, source string, now time.Time) ([]models.MqttMessage, error) {
+	var messages []models.MqttMessage
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), len(body)+1)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parsed, err := parseLine(line, precision, source, now)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number, err)
+		}
+		messages = append(messages, parsed...)
+		if len(messages) > MaxBatch {
+			return nil, fmt.Errorf("more than %d readings in one request", MaxBatch)
+		}
+	}
+	return messages, scanner.Err()
+}
+
+func parseLine(line string, precision time.Duration, source string, now time.Time) ([]models.MqttMessage, error) {
+	keyEnd := indexUnescaped(line, ' ', false)
+	if keyEnd < 0 {
+		return nil, fmt.Errorf("missing fields")
+	}
+	rest := strings.TrimLeft(line[keyEnd:], " ")
+	fieldsEnd := indexUnescaped(rest, ' ', true)
+	if fieldsEnd < 0 {
+		fieldsEnd = len(rest)
+	}
+
+	keys := splitUnescaped(line[:keyEnd], ',', false)
+	measurement := unescape(keys[0])
+	if measurement == "" {
+		return nil, fmt.Errorf("missing measurement")
+	}
+	tags := make(map[string]string, len(keys)-1)
+	for _, pair := range keys[1:] {
+		key, value, err := splitPair(pair)
+		if err != nil {
+			return nil, err
+		}
+		tags[key] = value
+	}
+
+	timestamp := now
+	if text := strings.TrimSpace(rest[fieldsEnd:]); text != "" {
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", text)
+		}
+		if limit := int64(math.MaxInt64 / precision); n > limit || n < -limit {
+			return nil, fmt.Errorf("timestamp %q out of range for precision %s", text, precision)
+		}
+		timestamp = time.Unix(0, n*int64(precision)).UTC()
+		if err := checkTimestamp(timestamp, now); err != nil {
+			return nil, err
+		}
+	}
+
+	var messages []models.MqttMessage
+	for _, pair := range splitUnescaped(rest[:fieldsEnd], ',', true) {
+		key, raw, ok := cutUnescaped(pair, '=')
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid field %q", pair)
+		}
+		value, err := parseFieldValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", unescape(key), err)
+		}
+
+		topic := measurement
+		if field := unescape(key); field != "value" {
+			topic += "/" + field
+		}
+		if err := checkTopic(topic); err != nil {
+			return nil, err
+		}
+		msg := models.NewMqttMessage(topic, value, timestamp)
+		for name, tag := range tags {
+			switch {
+			case name == "device":
+				msg.Device = tag
+			case name != "state" && !strings.ContainsAny(name, ".$"):
+				msg.Tags[name] = tag
+			}
+		}
+		msg.Tags["source"] = source
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// parseFieldValue converts a field value the way MQTT payloads are
+// converted: integers and floats become numbers, booleans become "true" or
+// "false", and strings are parsed like payloads.
+func parseFieldValue(raw string) (interface{}, error) {
+	switch {
+	case raw == "":
+		return nil, fmt.Errorf("missing value")
+	case strings.HasPrefix(raw, `"`):
+		if len(raw) < 2 || !strings.HasSuffix(raw, `"`) {
+			return nil, fmt.Errorf("unterminated string %s", raw)
+		}
+		text := strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(raw[1 : len(raw)-1])
+		return models.ParsePayload([]byte(text)), nil
+	case raw == "t" || raw == "T" || raw == "true" || raw == "True" || raw == "TRUE":
+		return "true", nil
+	case raw == "f" || raw == "F" || raw == "false" || raw == "False" || raw == "FALSE":
+		return "false", nil
+	case strings.HasSuffix(raw, "i"):
+		n, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %s", raw)
+		}
+		return float64(n), nil
+	case strings.HasSuffix(raw, "u"):
+		n, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unsigned integer %s", raw)
+		}
+		return float64(n), nil
+	}
+
+	n, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %s", raw)
+	}
+	return n, nil
+}
+
+func splitPair(pair string) (string, string, error) {
+	key, value, ok := cutUnescaped(pair, '=')
+	if !ok || key == "" || value == "" {
+		return "", "", fmt.Errorf("invalid tag %q", pair)
+	}
+	return unescape(key), unescape(value), nil
+}
+
+// indexUnescaped returns the index of the first sep not escaped by a
+// backslash, nor inside a double quoted string when quotes is set
+func indexUnescaped(s string, sep byte, quotes bool) int {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			return i
+		}
+	}
+	return -1
+}
+
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var parts []string
+	for {
+		i := indexUnescaped(s, sep, quotes)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+func cutUnescaped(s string, sep byte) (string, string, bool) {
+	i := indexUnescaped(s, sep, false)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// unescape removes the backslashes escaping commas, equals signs and spaces
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ", `\\`, `\`).Replace(s)
+}
@@ -0,0 +1,153 @@
+package ingest
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+	now := time.Date(2024, 12, 1, 8, 0, 0, 0, time.UTC)
+	type reading struct {
+		topic     string
+		value     interface{}
+		timestamp time.Time
+	}
+	tests := []struct {
+		name      string
+		line      string
+		precision time.Duration
+		want      []reading
+	}{
+		{
+			name: "value field is the measurement",
+			line: "home/garden_temperature/state value=12.5 1733040000000000000",
+			want: []reading{{"home/garden_temperature/state", 12.5, time.Unix(1733040000, 0).UTC()}},
+		},
+		{
+			name: "other fields extend the topic",
+			line: "weather,device=station1 temperature=12.5,humidity=81i",
+			want: []reading{{"weather/temperature", 12.5, now}, {"weather/humidity", 81.0, now}},
+		},
+		{
+			name: "integer, unsigned and boolean suffixes",
+			line: "sensor a=-3i,b=18446744073709551615u,c=t,d=FALSE,e=True",
+			want: []reading{
+				{"sensor/a", -3.0, now}, {"sensor/b", 18446744073709551615.0, now},
+				{"sensor/c", "true", now}, {"sensor/d", "false", now}, {"sensor/e", "true", now},
+			},
+		},
+		{
+			name: "quoted strings keep separators and unescape quotes",
+			line: `door state="open, then \"closed\" = shut",count="42"`,
+			want: []reading{{"door/state", `open, then "closed" = shut`, now}, {"door/count", 42.0, now}},
+		},
+		{
+			name: "escaped separators in the measurement and field keys",
+			line: `living\ room\,tv power\ draw=95.5`,
+			want: []reading{{"living room,tv/power draw", 95.5, now}},
+		},
+		{
+			name:      "precision of the timestamp",
+			line:      "home/x value=1 1733040000",
+			precision: time.Second,
+			want:      []reading{{"home/x", 1.0, time.Unix(1733040000, 0).UTC()}},
+		},
+	}
+
+	for _, tt := range tests {
+		precision := tt.precision
+		if precision == 0 {
+			precision = time.Nanosecond
+		}
+		messages, err := ParseLineProtocol([]byte(tt.line), precision, "test", now)
+		if err != nil {
+			t.Errorf("%s: ParseLineProtocol(%q) error = %v", tt.name, tt.line, err)
+			continue
+		}
+		var got []reading
+		for _, msg := range messages {
+			got = append(got, reading{msg.Topic, msg.Value, msg.Timestamp})
+			if msg.Tags["source"] != "test" {
+				t.Errorf("%s: %s tagged with source %v, want test", tt.name, msg.Topic, msg.Tags["source"])
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseLineProtocol(%q) = %v, want %v", tt.name, tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseLineProtocolTags(t *testing.T) {
+	now := time.Now()
+	messages, err := ParseLineProtocol([]byte(`weather,device=station\ 1,room=back\,garden,state=x,a.b=y temperature=12.5`), time.Nanosecond, "test", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := messages[0]
+	if msg.Device != "station 1" {
+		t.Errorf("device = %q, want %q", msg.Device, "station 1")
+	}
+	if msg.Tags["room"] != "back,garden" {
+		t.Errorf("room tag = %v, want %q", msg.Tags["room"], "back,garden")
+	}
+	// The state tag holds the value, keys with dots cannot be stored
+	if msg.Tags["state"] != 12.5 {
+		t.Errorf("state tag = %v, want the value", msg.Tags["state"])
+	}
+	if _, ok := msg.Tags["a.b"]; ok {
+		t.Error("tag a.b stored")
+	}
+}
+
+func TestParseLineProtocolErrors(t *testing.T) {
+	now := time.Date(2024, 12, 1, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		line      string
+		precision time.Duration
+		wantErr   string
+	}{
+		{"no fields", "weather", time.Nanosecond, "missing fields"},
+		{"empty measurement", ",room=x value=1", time.Nanosecond, "missing measurement"},
+		{"tag without value", "weather,room value=1", time.Nanosecond, "invalid tag"},
+		{"field without value", "weather temperature=", time.Nanosecond, "missing value"},
+		{"unterminated string", `weather note="open`, time.Nanosecond, "unterminated string"},
+		{"integer overflow", "weather count=9223372036854775808i", time.Nanosecond, "invalid integer"},
+		{"negative unsigned", "weather count=-1u", time.Nanosecond, "invalid unsigned integer"},
+		{"invalid float", "weather temperature=warm", time.Nanosecond, "invalid value"},
+		{"invalid timestamp", "weather value=1 yesterday", time.Nanosecond, "invalid timestamp"},
+		{"seconds overflowing nanoseconds", "weather value=1 9223372037", time.Second, "out of range"},
+		{"milliseconds overflowing nanoseconds", "weather value=1 -9223372036855", time.Millisecond, "out of range"},
+		{"timestamp in the future", "weather value=1 1733045400", time.Second, "in the future"},
+		{"wildcard topic", "home/+/state value=1", time.Nanosecond, "wildcard"},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseLineProtocol([]byte(tt.line), tt.precision, "test", now)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: ParseLineProtocol(%q) error = %v, want %q", tt.name, tt.line, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseLineProtocolLimits(t *testing.T) {
+	now := time.Now()
+	// The largest timestamp representable at second precision is accepted as
+	// far as the range goes, and then rejected for being in the future
+	if _, err := ParseLineProtocol([]byte("weather value=1 9223372036"), time.Second, "test", now); err == nil || !strings.Contains(err.Error(), "in the future") {
+		t.Errorf("error = %v, want the timestamp rejected for being in the future", err)
+	}
+
+	lines := strings.Repeat("weather value=1\n", MaxBatch+1)
+	if _, err := ParseLineProtocol([]byte(lines), time.Nanosecond, "test", now); err == nil {
+		t.Errorf("%d readings accepted, want at most %d", MaxBatch+1, MaxBatch)
+	}
+
+	// Comments and blank lines are skipped, errors name the line
+	_, err := ParseLineProtocol([]byte("# comment\n\nweather value=1\nweather value=x\n"), time.Nanosecond, "test", now)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 4:") {
+		t.Errorf("error = %v, want it on line 4", err)
+	}
+}
@@ -0,0 +1,252 @@
+package limits
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"golang.org/x/time/rate"
+)
+
+// Defaults of the limits left unset
+const (
+	DefaultMaxSpan     = 2 * db.Year
+	DefaultMaxPoints   = 10000
+	DefaultMaxBodySize = 10 * 1024 * 1024
+)
+
+// Default rates of requests per client IP and per API key or user
+var (
+	DefaultIPRate  = Rate{Limit: 50, Burst: 100}
+	DefaultKeyRate = Rate{Limit: 20, Burst: 50}
+)
+
+// Config holds the limits of API requests. The zero value applies the
+// defaults without rate limiting.
+type Config struct {
+	IPRate  Rate
+	KeyRate Rate
+
+	// MaxSpan bounds the time range of a query, MaxSpans overrides it per
+	// endpoint, e.g. "stats" or "grafana"
+	MaxSpan  time.Duration
+	MaxSpans map[string]time.Duration
+	// MaxPoints bounds the points of each series
+	MaxPoints int
+	// MaxBodySize bounds ingest and remote read and write request bodies,
+	// after decompression
+	MaxBodySize int64
+}
+
+// Span returns the maximum time range of queries to endpoint.
+func (c Config) Span(endpoint string) time.Duration {
+	if span, ok := c.MaxSpans[endpoint]; ok {
+		return span
+	}
+	if c.MaxSpan > 0 {
+		return c.MaxSpan
+	}
+	return DefaultMaxSpan
+}
+
+// Points returns the maximum number of points of a series.
+func (c Config) Points() int {
+	if c.MaxPoints > 0 {
+		return c.MaxPoints
+	}
+	return DefaultMaxPoints
+}
+
+// BodySize returns the maximum size of an ingest or remote request body.
+func (c Config) BodySize() int64 {
+	if c.MaxBodySize > 0 {
+		return c.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
+
+// FromEnv reads RATE_LIMIT_IP and RATE_LIMIT_KEY, e.g. "20/s:50" or "off",
+// QUERY_MAX_SPAN, QUERY_MAX_SPANS, e.g. "stats=90d;events=30d",
+// QUERY_MAX_POINTS and INGEST_MAX_BODY_SIZE, e.g. "10MB".
+func FromEnv() (Config, error) {
+	config := Config{IPRate: DefaultIPRate, KeyRate: DefaultKeyRate}
+	var err error
+
+	if value, ok := os.LookupEnv("RATE_LIMIT_IP"); ok {
+		if config.IPRate, err = ParseRate(value); err != nil {
+			return config, fmt.Errorf("invalid RATE_LIMIT_IP: %w", err)
+		}
+	}
+	if value, ok := os.LookupEnv("RATE_LIMIT_KEY"); ok {
+		if config.KeyRate, err = ParseRate(value); err != nil {
+			return config, fmt.Errorf("invalid RATE_LIMIT_KEY: %w", err)
+		}
+	}
+
+	if value := os.Getenv("QUERY_MAX_SPAN"); value != "" {
+		if config.MaxSpan, err = db.ParseDuration(value); err != nil || config.MaxSpan <= 0 {
+			return config, fmt.Errorf("invalid QUERY_MAX_SPAN %q", value)
+		}
+	}
+	for _, pair := range strings.Split(os.Getenv("QUERY_MAX_SPANS"), ";") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		endpoint, value, ok := strings.Cut(pair, "=")
+		span, err := db.ParseDuration(strings.TrimSpace(value))
+		if !ok || err != nil || span <= 0 {
+			return config, fmt.Errorf("invalid QUERY_MAX_SPANS entry %q, expected <endpoint>=<duration>", pair)
+		}
+		if config.MaxSpans == nil {
+			config.MaxSpans = make(map[string]time.Duration)
+		}
+		config.MaxSpans[strings.TrimSpace(endpoint)] = span
+	}
+
+	if value := os.Getenv("QUERY_MAX_POINTS"); value != "" {
+		if config.MaxPoints, err = strconv.Atoi(value); err != nil || config.MaxPoints < 1 {
+			return config, fmt.Errorf("invalid QUERY_MAX_POINTS %q", value)
+		}
+	}
+	if value := os.Getenv("INGEST_MAX_BODY_SIZE"); value != "" {
+		if config.MaxBodySize, err = ParseSize(value); err != nil {
+			return config, fmt.Errorf("invalid INGEST_MAX_BODY_SIZE: %w", err)
+		}
+	}
+	return config, nil
+}
+
+// Rate is a token bucket refilled with Limit tokens per second, holding at
+// most Burst. The zero Rate does not limit.
+type Rate struct {
+	Limit rate.Limit
+	Burst int
+}
+
+// ParseRate parses "<n>/<s|m|h>" with an optional ":<burst>", which defaults
+// to n. "off" and "0" disable the limit.
+func ParseRate(spec string) (Rate, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "off" || spec == "0" || spec == "" {
+		return Rate{}, nil
+	}
+
+	spec, burstValue, hasBurst := strings.Cut(spec, ":")
+	countValue, unit, _ := strings.Cut(spec, "/")
+	count, err := strconv.ParseFloat(countValue, 64)
+	if err != nil || count <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q, expected e.g. 20/s or 600/m:50", spec)
+	}
+	periods := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+	period, ok := periods[unit]
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate unit %q, expected s, m or h", unit)
+	}
+
+	r := Rate{Limit: rate.Limit(count / period.Seconds()), Burst: int(math.Ceil(count))}
+	if hasBurst {
+		if r.Burst, err = strconv.Atoi(burstValue); err != nil || r.Burst < 1 {
+			return Rate{}, fmt.Errorf("invalid burst %q", burstValue)
+		}
+	}
+	return r, nil
+}
+
+// ParseSize parses a byte count with an optional KB, MB or GB suffix.
+func ParseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(value, suffix) {
+			value, multiplier = strings.TrimSpace(strings.TrimSuffix(value, suffix)), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// idleTimeout is how long the bucket of an idle client is kept. Buckets are
+// full again long before, so dropping them changes nothing.
+const idleTimeout = 10 * time.Minute
+
+// maxBuckets bounds the clients tracked at once. Further clients share one
+// bucket until idle ones are dropped, so memory stays bounded however many
+// client addresses or keys requests claim.
+const maxBuckets = 50000
+
+// Limiter keeps a token bucket per client.
+type Limiter struct {
+	rate Rate
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	overflow  *bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewLimiter creates a Limiter of r, nil when r does not limit. A nil
+// Limiter allows every request.
+func NewLimiter(r Rate) *Limiter {
+	if r.Limit <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:     r,
+		buckets:  make(map[string]*bucket),
+		overflow: &bucket{limiter: rate.NewLimiter(r.Limit, r.Burst)},
+	}
+}
+
+// Allow takes a token from the bucket of client. Without one it returns
+// false and how long until the next token.
+func (l *Limiter) Allow(client string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > idleTimeout {
+		for key, b := range l.buckets {
+			if now.Sub(b.lastSeen) > idleTimeout {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[client]
+	switch {
+	case ok:
+	case len(l.buckets) >= maxBuckets:
+		b = l.overflow
+	default:
+		b = &bucket{limiter: rate.NewLimiter(l.rate.Limit, l.rate.Burst)}
+		l.buckets[client] = b
+	}
+	b.lastSeen = now
+
+	reservation := b.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
@@ -0,0 +1,31 @@
+package limits
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestLimiterBoundsClients(t *testing.T) {
+	l := NewLimiter(Rate{Limit: 1, Burst: 1})
+	for i := 0; i < maxBuckets; i++ {
+		if ok, _ := l.Allow(strconv.Itoa(i)); !ok {
+			t.Fatalf("first request of client %d refused", i)
+		}
+	}
+
+	// Clients beyond the bound share one bucket
+	if ok, _ := l.Allow("overflow-1"); !ok {
+		t.Fatal("first request beyond the bound refused")
+	}
+	if ok, _ := l.Allow("overflow-2"); ok {
+		t.Error("second client beyond the bound got a bucket of its own")
+	}
+	if len(l.buckets) != maxBuckets {
+		t.Errorf("%d buckets, want %d", len(l.buckets), maxBuckets)
+	}
+
+	// Tracked clients keep their own bucket
+	if ok, _ := l.Allow("0"); ok {
+		t.Error("tracked client allowed past its burst")
+	}
+}
@@ -0,0 +1,370 @@
+package materialize
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"home_automation_dashboard/mqtt-api/services/media"
+	"home_automation_dashboard/shared/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of materialized topics
+const (
+	KindSwitch = "switch"
+	KindApp    = "app"
+)
+
+// stateCollection holds one TopicState document per materialized topic.
+const stateCollection = "materialized_state"
+
+// checkpointEvents is how many events are folded between saves of a state, so
+// a first fold of a long history that runs out of time keeps its progress.
+const checkpointEvents = 1000
+
+// TopicState is the running state of a switch or app topic, folded from all
+// events up to (LastTimestamp, LastID).
+type TopicState struct {
+	Topic string `bson:"_id"`
+	Kind  string `bson:"kind"`
+
+	// Value is the current switch state, or the active app ("" when idle),
+	// and Since is when it became current.
+	Value string    `bson:"value"`
+	Since time.Time `bson:"since"`
+	// LastSeen is the last event of the running app session, which ends
+	// after the idle timeout without further events.
+	LastSeen time.Time `bson:"last_seen,omitempty"`
+
+	// Totals of completed periods, the running period is added by
+	// TotalOnSeconds and AppSeconds.
+	OnSeconds  float64            `bson:"on_seconds,omitempty"`
+	AppTotals  map[string]float64 `bson:"app_seconds,omitempty"`
+	EventCount int64              `bson:"event_count"`
+
+	LastTimestamp time.Time          `bson:"last_timestamp"`
+	LastID        primitive.ObjectID `bson:"last_id"`
+	UpdatedAt     time.Time          `bson:"updated_at"`
+
+	// Rebuild is set by Invalidate when events were stored behind the
+	// watermark. The state is then folded again from the first event.
+	Rebuild bool `bson:"rebuild,omitempty"`
+}
+
+// TotalOnSeconds returns the total time a switch has been on up to now.
+func (s *TopicState) TotalOnSeconds(now time.Time) float64 {
+	total := s.OnSeconds
+	if s.Value == "on" && !s.Since.IsZero() {
+		total += now.Sub(s.Since).Seconds()
+	}
+	return total
+}
+
+// AppSeconds returns the total time spent in each app up to now, ending the
+// running session after the idle timeout of rules.
+func (s *TopicState) AppSeconds(now time.Time, rules media.Rules) map[string]float64 {
+	totals := make(map[string]float64, len(s.AppTotals)+1)
+	for app, seconds := range s.AppTotals {
+		totals[app] = seconds
+	}
+	if s.Value != "" && !s.Since.IsZero() {
+		totals[s.Value] += rules.SessionEnd(s.lastSeen(), now).Sub(s.Since).Seconds()
+	}
+	return totals
+}
+
+// lastSeen returns the last event of the running app session. States saved
+// before it was tracked only know when the session started.
+func (s *TopicState) lastSeen() time.Time {
+	if s.LastSeen.IsZero() {
+		return s.Since
+	}
+	return s.LastSeen
+}
+
+// Materializer keeps per-topic running totals up to date by folding in only
+// the events stored since the previous update.
+type Materializer struct {
+	events *mongo.Collection
+	states *mongo.Collection
+	topics map[string]string
+	media  media.Rules
+}
+
+// New creates a Materializer for the given switch and app topics of the
+// events collection. App sessions follow the media rules.
+func New(database *mongo.Database, eventsCollection string, switchTopics, appTopics []string, rules media.Rules) *Materializer {
+	m := &Materializer{
+		events: database.Collection(eventsCollection),
+		states: database.Collection(stateCollection),
+		topics: make(map[string]string),
+		media:  rules,
+	}
+	for _, topic := range switchTopics {
+		m.topics[topic] = KindSwitch
+	}
+	for _, topic := range appTopics {
+		m.topics[topic] = KindApp
+	}
+	return m
+}
+
+// EnsureIndexes creates the index used to read events after a watermark.
+func (m *Materializer) EnsureIndexes(ctx context.Context) error {
+	_, err := m.events.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "topic", Value: 1}, {Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	return err
+}
+
+// Update folds newly stored events into the persisted state of every topic
+// and returns the resulting states. States flagged by Invalidate are folded
+// again from the first event.
+func (m *Materializer) Update(ctx context.Context) ([]*TopicState, error) {
+	states, err := m.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*TopicState, 0, len(m.topics))
+	for topic, kind := range m.topics {
+		state, ok := states[topic]
+		if ok && state.Rebuild {
+			if state, err = m.reset(ctx, state); err != nil {
+				return nil, fmt.Errorf("reset state of %s: %w", topic, err)
+			}
+		}
+		if state == nil {
+			state = &TopicState{Topic: topic, Kind: kind}
+		}
+
+		if err := m.apply(ctx, state); err != nil {
+			return nil, fmt.Errorf("materialize %s: %w", topic, err)
+		}
+		results = append(results, state)
+	}
+	return results, nil
+}
+
+// Invalidate flags the states of the topics of messages for a rebuild when
+// a message was stored at or before their watermark. Folding it in after
+// later events would count the wrong periods.
+func (m *Materializer) Invalidate(ctx context.Context, messages []models.MqttMessage) error {
+	earliest := make(map[string]time.Time)
+	for _, msg := range messages {
+		if _, ok := m.topics[msg.Topic]; !ok {
+			continue
+		}
+		if t, ok := earliest[msg.Topic]; !ok || msg.Timestamp.Before(t) {
+			earliest[msg.Topic] = msg.Timestamp
+		}
+	}
+	if len(earliest) == 0 {
+		return nil
+	}
+
+	behind := make(bson.A, 0, len(earliest))
+	for topic, t := range earliest {
+		behind = append(behind, bson.D{
+			{Key: "_id", Value: topic},
+			{Key: "last_timestamp", Value: bson.D{{Key: "$gte", Value: t}}},
+		})
+	}
+	_, err := m.states.UpdateMany(ctx,
+		bson.D{{Key: "$or", Value: behind}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "rebuild", Value: true}}}})
+	return err
+}
+
+// InvalidateAll flags every state for a rebuild, after events were written
+// without knowing which topics, as by a restore.
+func InvalidateAll(ctx context.Context, database *mongo.Database) error {
+	_, err := database.Collection(stateCollection).UpdateMany(ctx, bson.D{},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "rebuild", Value: true}}}})
+	return err
+}
+
+// Rebuild discards the persisted state and recomputes it from all events.
+func (m *Materializer) Rebuild(ctx context.Context) ([]*TopicState, error) {
+	if _, err := m.states.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: m.topicList()}}}}); err != nil {
+		return nil, err
+	}
+	return m.Update(ctx)
+}
+
+func (m *Materializer) topicList() []string {
+	topics := make([]string, 0, len(m.topics))
+	for topic := range m.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func (m *Materializer) load(ctx context.Context) (map[string]*TopicState, error) {
+	cursor, err := m.states.Find(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: m.topicList()}}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	states := make(map[string]*TopicState)
+	for cursor.Next(ctx) {
+		var state TopicState
+		if err := cursor.Decode(&state); err != nil {
+			return nil, err
+		}
+		states[state.Topic] = &state
+	}
+	return states, cursor.Err()
+}
+
+// reset replaces state with an empty one, without the rebuild flag, to fold
+// the events into again. A rebuild cut short continues from its last save.
+func (m *Materializer) reset(ctx context.Context, state *TopicState) (*TopicState, error) {
+	empty := &TopicState{Topic: state.Topic, Kind: state.Kind, UpdatedAt: time.Now()}
+	if _, err := m.states.ReplaceOne(ctx, bson.D{{Key: "_id", Value: state.Topic}}, empty); err != nil {
+		return nil, err
+	}
+	return empty, nil
+}
+
+// save persists state unless Invalidate flagged it while it was folded, the
+// next Update then starts over.
+func (m *Materializer) save(ctx context.Context, state *TopicState) error {
+	state.UpdatedAt = time.Now()
+	filter := bson.D{
+		{Key: "_id", Value: state.Topic},
+		{Key: "rebuild", Value: bson.D{{Key: "$ne", Value: true}}},
+	}
+	_, err := m.states.ReplaceOne(ctx, filter, state, options.Replace().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// apply folds the events stored after the state's watermark into it, in
+// (timestamp, _id) order, saving it every checkpointEvents events and at
+// the end.
+func (m *Materializer) apply(ctx context.Context, state *TopicState) error {
+	filter := bson.D{{Key: "topic", Value: state.Topic}}
+	if !state.LastTimestamp.IsZero() {
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "timestamp", Value: bson.D{{Key: "$gt", Value: state.LastTimestamp}}}},
+			bson.D{
+				{Key: "timestamp", Value: state.LastTimestamp},
+				{Key: "_id", Value: bson.D{{Key: "$gt", Value: state.LastID}}},
+			},
+		}})
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}).
+		SetProjection(bson.D{{Key: "value", Value: 1}, {Key: "timestamp", Value: 1}})
+
+	cursor, err := m.events.Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	unsaved := 0
+	for cursor.Next(ctx) {
+		var event struct {
+			ID        primitive.ObjectID `bson:"_id"`
+			Value     interface{}        `bson:"value"`
+			Timestamp time.Time          `bson:"timestamp"`
+		}
+		if err := cursor.Decode(&event); err != nil {
+			return err
+		}
+
+		value, _ := event.Value.(string)
+		if state.Kind == KindApp {
+			m.applyApp(state, value, event.Timestamp)
+		} else {
+			applySwitch(state, value, event.Timestamp)
+		}
+
+		state.EventCount++
+		state.LastTimestamp = event.Timestamp
+		state.LastID = event.ID
+
+		if unsaved++; unsaved == checkpointEvents {
+			if err := m.save(ctx, state); err != nil {
+				return fmt.Errorf("save state: %w", err)
+			}
+			unsaved = 0
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if unsaved > 0 {
+		if err := m.save(ctx, state); err != nil {
+			return fmt.Errorf("save state: %w", err)
+		}
+	}
+	return nil
+}
+
+// applySwitch tracks on periods. Repeated "on" events keep the original start
+// and "off" events while already off are ignored.
+func applySwitch(state *TopicState, value string, timestamp time.Time) {
+	switch value {
+	case "on":
+		if state.Value != "on" {
+			state.Value = "on"
+			state.Since = timestamp
+		}
+	case "off":
+		if state.Value == "on" {
+			state.OnSeconds += timestamp.Sub(state.Since).Seconds()
+		}
+		if state.Value != "off" {
+			state.Value = "off"
+			state.Since = timestamp
+		}
+	}
+}
+
+// applyApp tracks app sessions like media.Rules.Sessions. A different app
+// ends the running session and starts a new one, an excluded app only ends
+// it, and a session without events for the idle timeout ends then.
+func (m *Materializer) applyApp(state *TopicState, app string, timestamp time.Time) {
+	if state.Value != "" {
+		if end := m.media.SessionEnd(state.lastSeen(), timestamp); end.Before(timestamp) {
+			endSession(state, end)
+		}
+	}
+
+	if state.Value != "" && app == state.Value {
+		state.LastSeen = timestamp
+		return
+	}
+
+	if state.Value != "" {
+		endSession(state, timestamp)
+	}
+
+	if !m.media.Excluded(app) {
+		state.Value = app
+		state.Since = timestamp
+		state.LastSeen = timestamp
+	}
+}
+
+func endSession(state *TopicState, end time.Time) {
+	if state.AppTotals == nil {
+		state.AppTotals = make(map[string]float64)
+	}
+	state.AppTotals[state.Value] += end.Sub(state.Since).Seconds()
+	state.Value = ""
+	state.Since = time.Time{}
+	state.LastSeen = time.Time{}
+}
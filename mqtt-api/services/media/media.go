@@ -0,0 +1,148 @@
+package media
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+)
+
+// DefaultExcludedApps are the Roku screens that are not watching anything.
+var DefaultExcludedApps = []string{"Roku", "Home", "Roku Dynamic Menu", "unknown"}
+
+// DefaultIdleTimeout closes sessions that never received a terminating event,
+// e.g. when a device was switched off at the wall.
+const DefaultIdleTimeout = 4 * time.Hour
+
+// Rules decide how active app events are grouped into sessions.
+type Rules struct {
+	// ExcludedApps end the running session without starting a new one
+	ExcludedApps []string
+	// IdleTimeout ends a session this long after its last event, zero
+	// disables it. Repeated events for the running app keep it alive.
+	IdleTimeout time.Duration
+}
+
+// RulesFromEnv reads MEDIA_EXCLUDED_APPS, a comma separated list of apps,
+// and MEDIA_IDLE_TIMEOUT, e.g. "4h" or "0" to disable.
+func RulesFromEnv() (Rules, error) {
+	rules := Rules{ExcludedApps: DefaultExcludedApps, IdleTimeout: DefaultIdleTimeout}
+
+	if value, ok := os.LookupEnv("MEDIA_EXCLUDED_APPS"); ok {
+		rules.ExcludedApps = nil
+		for _, app := range strings.Split(value, ",") {
+			if app = strings.TrimSpace(app); app != "" {
+				rules.ExcludedApps = append(rules.ExcludedApps, app)
+			}
+		}
+	}
+
+	if value := os.Getenv("MEDIA_IDLE_TIMEOUT"); value != "" {
+		timeout, err := db.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return rules, fmt.Errorf("invalid MEDIA_IDLE_TIMEOUT %q", value)
+		}
+		rules.IdleTimeout = timeout
+	}
+	return rules, nil
+}
+
+// Excluded reports whether app does not start a session. Events without an
+// app are excluded too.
+func (r Rules) Excluded(app string) bool {
+	if app == "" {
+		return true
+	}
+	for _, excluded := range r.ExcludedApps {
+		if app == excluded {
+			return true
+		}
+	}
+	return false
+}
+
+// SessionEnd returns when a session last seen at lastSeen ends if nothing
+// else ends it before at.
+func (r Rules) SessionEnd(lastSeen, at time.Time) time.Time {
+	if r.IdleTimeout > 0 {
+		if idle := lastSeen.Add(r.IdleTimeout); idle.Before(at) {
+			return idle
+		}
+	}
+	return at
+}
+
+// Event is an active app change reported by a device.
+type Event struct {
+	App       string
+	Timestamp time.Time
+}
+
+// Session is a period an app was active on a device.
+type Session struct {
+	App   string
+	Start time.Time
+	End   time.Time
+	// Open is set when the session was still running at the end of the range.
+	Open bool
+}
+
+// Duration returns the length of the session.
+func (s Session) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// Sessions groups events, ordered by time, into the sessions between start
+// and end, clipped to that range. Events may begin before start so that a
+// session already running at start is included.
+func (r Rules) Sessions(events []Event, start, end time.Time) []Session {
+	var sessions []Session
+	var current *Session
+	var lastSeen time.Time
+
+	closeAt := func(at time.Time) {
+		current.End = at
+		sessions = append(sessions, *current)
+		current = nil
+	}
+
+	for _, event := range events {
+		if current != nil {
+			if idle := r.SessionEnd(lastSeen, event.Timestamp); idle.Before(event.Timestamp) {
+				closeAt(idle)
+			}
+		}
+		if current != nil && event.App == current.App {
+			lastSeen = event.Timestamp
+			continue
+		}
+		if current != nil {
+			closeAt(event.Timestamp)
+		}
+		if !r.Excluded(event.App) {
+			current = &Session{App: event.App, Start: event.Timestamp}
+			lastSeen = event.Timestamp
+		}
+	}
+	if current != nil {
+		sessionEnd := r.SessionEnd(lastSeen, end)
+		current.Open = !sessionEnd.Before(end)
+		closeAt(sessionEnd)
+	}
+
+	clipped := sessions[:0]
+	for _, session := range sessions {
+		if session.Start.Before(start) {
+			session.Start = start
+		}
+		if session.End.After(end) {
+			session.End = end
+		}
+		if session.End.After(session.Start) {
+			clipped = append(clipped, session)
+		}
+	}
+	return clipped
+}
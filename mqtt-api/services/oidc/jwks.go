@@ -0,0 +1,196 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The signing keys are fetched again after jwksTTL, or earlier when a token
+// names an unknown key, as after the provider rotated its keys. Unknown keys
+// trigger at most one fetch per jwksMinRefresh so forged tokens cannot make
+// every request reach the provider.
+const (
+	jwksTTL        = time.Hour
+	jwksMinRefresh = time.Minute
+)
+
+// jwks caches the public keys of a JSON Web Key Set by key id
+type jwks struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]interface{}
+	fetched   time.Time // of the keys
+	attempted time.Time // of the last fetch, whether it failed or not
+	err       error     // of the last fetch
+	fetching  chan struct{}
+}
+
+// key returns the public key with id kid, fetching the key set when it is
+// stale or does not have the key. One request fetches while concurrent ones
+// wait for it, without holding the lock.
+func (s *jwks) key(ctx context.Context, kid string) (interface{}, error) {
+	s.mu.Lock()
+	now := time.Now()
+	if key, ok := s.keys[kid]; ok && now.Sub(s.fetched) < jwksTTL {
+		s.mu.Unlock()
+		return key, nil
+	}
+	if s.fetching == nil && now.Sub(s.attempted) < jwksMinRefresh {
+		defer s.mu.Unlock()
+		return s.cached(kid)
+	}
+
+	if done := s.fetching; done != nil {
+		s.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	} else {
+		done = make(chan struct{})
+		s.fetching, s.attempted = done, now
+		s.mu.Unlock()
+
+		keys, err := fetchJWKS(ctx, s.client, s.url)
+
+		s.mu.Lock()
+		if err == nil {
+			s.keys, s.fetched = keys, time.Now()
+		}
+		s.err, s.fetching = err, nil
+		close(done)
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cached(kid)
+}
+
+// cached returns the key with id kid from the last keys fetched, or the error
+// of the last fetch when they do not have it. s.mu must be held.
+func (s *jwks) cached(kid string) (interface{}, error) {
+	// Keep using the previous keys while the provider is unreachable
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	return nil, fmt.Errorf("%w: unknown key id %q", ErrInvalidToken, kid)
+}
+
+// jsonWebKey is a key of a JSON Web Key Set, RFC 7517
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA modulus and exponent
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC curve and point
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func fetchJWKS(ctx context.Context, client *http.Client, url string) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, client, url, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %q: %w", jwk.Kid, err)
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey decodes an RSA or EC key, nil for other key types
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid base64url integer %q", value)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// getJSON decodes the JSON document at url into v
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
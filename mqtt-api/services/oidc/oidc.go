@@ -0,0 +1,247 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"home_automation_dashboard/mqtt-api/services/apikeys"
+	"home_automation_dashboard/shared/db"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Roles of users, granted by the claims of their tokens
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// RoleScopes are the API key scopes each role grants
+var RoleScopes = map[string][]string{
+	RoleViewer:   {apikeys.ScopeReadReadings},
+	RoleOperator: {apikeys.ScopeReadReadings, apikeys.ScopeWriteIngest, apikeys.ScopeControl},
+	RoleAdmin:    {apikeys.ScopeAdmin},
+}
+
+// signingMethods are the accepted JWT algorithms. Symmetric algorithms are
+// excluded, the public keys of the provider must not be usable as secrets.
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// leeway allows for clock skew between the API and the provider
+const leeway = time.Minute
+
+var (
+	// ErrInvalidToken is returned for tokens that are malformed, not signed
+	// by the provider, or meant for another issuer or audience
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrExpired is returned for tokens that have expired
+	ErrExpired = errors.New("token has expired")
+)
+
+// Config configures the OpenID Connect provider whose tokens are accepted.
+type Config struct {
+	Issuer   string
+	Audience string
+	// JWKSURL is discovered from the issuer's openid-configuration when empty
+	JWKSURL string
+	// RolesClaim is the claim holding the user's roles or groups, a dotted
+	// path for nested claims such as Keycloak's realm_access.roles
+	RolesClaim string
+	// RoleMap maps claim values to roles. Values that are role names already
+	// need no entry.
+	RoleMap map[string]string
+}
+
+// ConfigFromEnv reads OIDC_ISSUER, OIDC_AUDIENCE, OIDC_JWKS_URL,
+// OIDC_ROLES_CLAIM and OIDC_ROLE_MAP, e.g. "parents=admin;kids=viewer". It
+// returns nil without OIDC_ISSUER.
+func ConfigFromEnv() (*Config, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	config := &Config{
+		Issuer:     issuer,
+		Audience:   os.Getenv("OIDC_AUDIENCE"),
+		JWKSURL:    os.Getenv("OIDC_JWKS_URL"),
+		RolesClaim: os.Getenv("OIDC_ROLES_CLAIM"),
+		RoleMap:    make(map[string]string),
+	}
+	if config.Audience == "" {
+		return nil, fmt.Errorf("OIDC_AUDIENCE is required with OIDC_ISSUER")
+	}
+	if config.RolesClaim == "" {
+		config.RolesClaim = "roles"
+	}
+
+	for _, pair := range strings.Split(os.Getenv("OIDC_ROLE_MAP"), ";") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		value, role, ok := strings.Cut(pair, "=")
+		role = strings.TrimSpace(role)
+		if _, known := RoleScopes[role]; !ok || !known {
+			return nil, fmt.Errorf("invalid OIDC_ROLE_MAP entry %q, expected <claim value>=viewer|operator|admin", pair)
+		}
+		config.RoleMap[strings.TrimSpace(value)] = role
+	}
+	return config, nil
+}
+
+// Identity is a user authenticated by a token of the provider
+type Identity struct {
+	Subject string
+	Email   string
+	Roles   []string
+}
+
+// HasScope reports whether one of the user's roles grants scope.
+func (i *Identity) HasScope(scope string) bool {
+	for _, role := range i.Roles {
+		for _, s := range RoleScopes[role] {
+			if s == scope || s == apikeys.ScopeAdmin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Allowlist returns the readings the user may access, all of them.
+func (i *Identity) Allowlist() db.Allowlist {
+	return db.Allowlist{}
+}
+
+// IsToken reports whether credential looks like a JWT rather than an API key.
+func IsToken(credential string) bool {
+	return strings.Count(credential, ".") == 2
+}
+
+// Verifier validates the tokens of the provider.
+type Verifier struct {
+	config Config
+	client *http.Client
+
+	mu   sync.Mutex
+	keys *jwks
+}
+
+// NewVerifier creates a Verifier of tokens issued as configured, fetching
+// the provider's documents with client.
+func NewVerifier(config Config, client *http.Client) *Verifier {
+	return &Verifier{config: config, client: client}
+}
+
+// Verify checks the signature, issuer, audience and expiry of token and
+// returns the identity it carries.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Identity, error) {
+	keys, err := v.keySet(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyErr error
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := keys.key(ctx, kid)
+		if err != nil && !errors.Is(err, ErrInvalidToken) {
+			keyErr = err
+		}
+		return key, err
+	},
+		jwt.WithValidMethods(signingMethods),
+		jwt.WithIssuer(v.config.Issuer),
+		jwt.WithAudience(v.config.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(leeway),
+	)
+	switch {
+	case keyErr != nil:
+		// The provider could not be reached, the token may well be valid
+		return nil, keyErr
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return nil, ErrExpired
+	case err != nil:
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	identity := &Identity{Roles: v.roles(claims)}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	return identity, nil
+}
+
+// roles returns the roles granted by the roles claim
+func (v *Verifier) roles(claims jwt.MapClaims) []string {
+	var value interface{} = map[string]interface{}(claims)
+	for _, name := range strings.Split(v.config.RolesClaim, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+
+	var values []string
+	switch value := value.(type) {
+	case string:
+		values = strings.Fields(value)
+	case []interface{}:
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	var roles []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		role, ok := v.config.RoleMap[value]
+		if !ok {
+			role = value
+		}
+		if _, known := RoleScopes[role]; known && !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// keySet returns the provider's key set, discovering its URL on first use
+func (v *Verifier) keySet(ctx context.Context) (*jwks, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.keys != nil {
+		return v.keys, nil
+	}
+
+	url := v.config.JWKSURL
+	if url == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		err := getJSON(ctx, v.client, strings.TrimSuffix(v.config.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+		if err != nil {
+			return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+		}
+		if discovery.Issuer != v.config.Issuer || discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("OIDC discovery of %s returned issuer %q and jwks_uri %q", v.config.Issuer, discovery.Issuer, discovery.JWKSURI)
+		}
+		url = discovery.JWKSURI
+	}
+
+	v.keys = &jwks{url: url, client: v.client}
+	return v.keys, nil
+}
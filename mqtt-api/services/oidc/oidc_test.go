@@ -0,0 +1,300 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const audience = "mqtt-api"
+
+// provider is an OpenID Connect provider serving its discovery document and
+// key set, counting the key set requests
+type provider struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    []jsonWebKey
+	failing bool
+	fetches atomic.Int32
+}
+
+func newProvider(t *testing.T) *provider {
+	p := &provider{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": p.URL, "jwks_uri": p.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.fetches.Add(1)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": p.keys})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// publish replaces the served key set
+func (p *provider) publish(keys ...jsonWebKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+}
+
+func (p *provider) setFailing(failing bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failing = failing
+}
+
+func (p *provider) verifier(roleMap map[string]string, rolesClaim string) *Verifier {
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+	return NewVerifier(Config{Issuer: p.URL, Audience: audience, RolesClaim: rolesClaim, RoleMap: roleMap}, p.Client())
+}
+
+func encodeInt(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaKey(t *testing.T, kid string) (*rsa.PrivateKey, jsonWebKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, jsonWebKey{Kty: "RSA", Kid: kid, Use: "sig", N: encodeInt(key.N.Bytes()), E: encodeInt(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func ecKey(t *testing.T, kid string) (*ecdsa.PrivateKey, jsonWebKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := make([]byte, 32), make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return key, jsonWebKey{Kty: "EC", Kid: kid, Use: "sig", Crv: "P-256", X: encodeInt(x), Y: encodeInt(y)}
+}
+
+// sign creates a token with claims, valid for the provider unless overridden
+func sign(t *testing.T, p *provider, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	full := jwt.MapClaims{
+		"iss": p.URL,
+		"aud": audience,
+		"sub": "user-1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	for name, value := range claims {
+		if value == nil {
+			delete(full, name)
+		} else {
+			full[name] = value
+		}
+	}
+
+	token := jwt.NewWithClaims(method, full)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerify(t *testing.T) {
+	p := newProvider(t)
+	rsaPrivate, rsaPublic := rsaKey(t, "rsa-1")
+	ecPrivate, ecPublic := ecKey(t, "ec-1")
+	p.publish(rsaPublic, ecPublic)
+
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaPrivate.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPrivate, _ := rsaKey(t, "rsa-1")
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"RSA", sign(t, p, jwt.SigningMethodRS256, "rsa-1", rsaPrivate, nil), nil},
+		{"EC", sign(t, p, jwt.SigningMethodES256, "ec-1", ecPrivate, nil), nil},
+		{"expired within leeway", sign(t, p, jwt.SigningMethodRS256, "rsa-1", rsaPrivate, jwt.MapClaims{"exp": now.Add(-leeway / 2).Unix()}), nil},
+		{"expired", sign(t, p, jwt.SigningMethodRS256, "rsa-1", rsaPrivate, jwt.MapClaims{"exp": now.Add(-2 * leeway).Unix()}), ErrExpired},
+		{"without expiry", sign(t, p, jwt.SigningMethodRS256, "rsa-1", rsaPrivate, jwt.MapClaims{"exp": nil}), ErrInvalidToken},
+		{"not yet valid within leeway", sign(t, p, jwt.SigningMethodRS256, "rsa-1", rsaPrivate, jwt.MapClaims{"nbf": now.Add(leeway / 2).Unix()}), nil},
+		{"not yet valid", sign(t, p, jwt.SigningMethodRS256, "rsa-1", rsaPrivate, jwt.MapClaims{"nbf": now.Add(2 * leeway).Unix()}), ErrInvalidToken},
+		{"wrong issuer", sign(t, p, jwt.SigningMethodRS256, "rsa-1", rsaPrivate, jwt.MapClaims{"iss": "https://evil.example"}), ErrInvalidToken},
+		{"wrong audience", sign(t, p, jwt.SigningMethodRS256, "rsa-1", rsaPrivate, jwt.MapClaims{"aud": "other"}), ErrInvalidToken},
+		{"HS256 with the public key", sign(t, p, jwt.SigningMethodHS256, "rsa-1", publicDER, nil), ErrInvalidToken},
+		{"none", sign(t, p, jwt.SigningMethodNone, "rsa-1", jwt.UnsafeAllowNoneSignatureType, nil), ErrInvalidToken},
+		{"other key", sign(t, p, jwt.SigningMethodRS256, "rsa-1", otherPrivate, nil), ErrInvalidToken},
+		{"unknown kid", sign(t, p, jwt.SigningMethodRS256, "rsa-2", rsaPrivate, nil), ErrInvalidToken},
+	}
+
+	v := p.verifier(nil, "")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := v.Verify(context.Background(), tt.token)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if identity.Subject != "user-1" {
+				t.Errorf("Subject = %q, want user-1", identity.Subject)
+			}
+		})
+	}
+}
+
+func TestVerifyRoles(t *testing.T) {
+	p := newProvider(t)
+	private, public := rsaKey(t, "rsa-1")
+	p.publish(public)
+
+	tests := []struct {
+		name       string
+		rolesClaim string
+		roleMap    map[string]string
+		claims     jwt.MapClaims
+		want       []string
+	}{
+		{"role names", "roles", nil, jwt.MapClaims{"roles": []string{"viewer", "unknown"}}, []string{"viewer"}},
+		{"space separated", "roles", nil, jwt.MapClaims{"roles": "operator admin"}, []string{"operator", "admin"}},
+		{
+			"nested and mapped", "realm_access.roles", map[string]string{"parents": "admin", "kids": "viewer"},
+			jwt.MapClaims{"realm_access": map[string]interface{}{"roles": []string{"kids", "parents", "offline_access"}}},
+			[]string{"viewer", "admin"},
+		},
+		{"mapped once", "groups", map[string]string{"family": "viewer"}, jwt.MapClaims{"groups": []string{"family", "viewer"}}, []string{"viewer"}},
+		{"missing", "realm_access.roles", nil, jwt.MapClaims{"realm_access": "admin"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := p.verifier(tt.roleMap, tt.rolesClaim)
+			identity, err := v.Verify(context.Background(), sign(t, p, jwt.SigningMethodRS256, "rsa-1", private, tt.claims))
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if !reflect.DeepEqual(identity.Roles, tt.want) {
+				t.Errorf("Roles = %v, want %v", identity.Roles, tt.want)
+			}
+		})
+	}
+}
+
+// expireRefreshThrottle lets the next unknown key id fetch the key set again
+func expireRefreshThrottle(v *Verifier) {
+	v.keys.mu.Lock()
+	defer v.keys.mu.Unlock()
+	v.keys.attempted = v.keys.attempted.Add(-jwksMinRefresh)
+}
+
+func TestKeyRotation(t *testing.T) {
+	p := newProvider(t)
+	oldPrivate, oldPublic := rsaKey(t, "old")
+	newPrivate, newPublic := rsaKey(t, "new")
+	p.publish(oldPublic)
+
+	v := p.verifier(nil, "")
+	ctx := context.Background()
+	if _, err := v.Verify(ctx, sign(t, p, jwt.SigningMethodRS256, "old", oldPrivate, nil)); err != nil {
+		t.Fatalf("Verify() with the old key error = %v", err)
+	}
+
+	p.publish(newPublic)
+	newToken := sign(t, p, jwt.SigningMethodRS256, "new", newPrivate, nil)
+	if _, err := v.Verify(ctx, newToken); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Verify() with the new key right after the last fetch error = %v, want %v", err, ErrInvalidToken)
+	}
+
+	expireRefreshThrottle(v)
+	if _, err := v.Verify(ctx, newToken); err != nil {
+		t.Fatalf("Verify() with the new key error = %v", err)
+	}
+	if _, err := v.Verify(ctx, sign(t, p, jwt.SigningMethodRS256, "old", oldPrivate, nil)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Verify() with the removed key error = %v, want %v", err, ErrInvalidToken)
+	}
+	if got := p.fetches.Load(); got != 2 {
+		t.Errorf("key set fetched %d times, want 2", got)
+	}
+}
+
+func TestRefreshThrottle(t *testing.T) {
+	p := newProvider(t)
+	private, public := rsaKey(t, "rsa-1")
+	p.publish(public)
+
+	v := p.verifier(nil, "")
+	ctx := context.Background()
+	if _, err := v.Verify(ctx, sign(t, p, jwt.SigningMethodRS256, "rsa-1", private, nil)); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+
+	// Forged tokens naming unknown keys, concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token := sign(t, p, jwt.SigningMethodRS256, fmt.Sprintf("forged-%d", i), private, nil)
+			if _, err := v.Verify(ctx, token); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("Verify() of an unknown key id error = %v, want %v", err, ErrInvalidToken)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got := p.fetches.Load(); got != 1 {
+		t.Errorf("key set fetched %d times within %s, want 1", got, jwksMinRefresh)
+	}
+
+	// A failed fetch counts as an attempt too
+	expireRefreshThrottle(v)
+	p.setFailing(true)
+	for i := 0; i < 5; i++ {
+		_, err := v.Verify(ctx, sign(t, p, jwt.SigningMethodRS256, "forged", private, nil))
+		if err == nil || errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("Verify() while the provider fails error = %v, want the fetch error", err)
+		}
+	}
+	if got := p.fetches.Load(); got != 2 {
+		t.Errorf("key set fetched %d times, want 2 after a failed fetch", got)
+	}
+
+	// Known keys keep working while the provider is unreachable
+	if _, err := v.Verify(ctx, sign(t, p, jwt.SigningMethodRS256, "rsa-1", private, nil)); err != nil {
+		t.Errorf("Verify() with a known key while the provider fails error = %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package openapi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CheckRoutes reports routes of the router that no operation describes and
+// operations whose route the router does not serve.
+func CheckRoutes(routes gin.RoutesInfo, ops []Operation) error {
+	described := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		described[op.Method+" "+op.Route] = true
+	}
+	served := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		served[route.Method+" "+route.Path] = true
+	}
+
+	var problems []string
+	for route := range served {
+		if !described[route] {
+			problems = append(problems, "route without operation: "+route)
+		}
+	}
+	for route := range described {
+		if !served[route] {
+			problems = append(problems, "operation without route: "+route)
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,516 @@
+package openapi
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// clientCore is the part of the generated client shared by all operations
+const clientCore = `
+// Client calls the API of the home automation dashboard
+type Client struct {
+	// BaseURL is the address of the API, e.g. http://localhost:8080
+	BaseURL string
+	// HTTPClient sends the requests, http.DefaultClient when nil
+	HTTPClient *http.Client
+	// Token is sent as a bearer token when set
+	Token string
+}
+
+// New returns a client of the API at baseURL
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Error is returned for responses with an error status. Code and Param are
+// set when a parameter of the request is invalid.
+type Error struct {
+	StatusCode int    ` + "`json:\"-\"`" + `
+	Message    string ` + "`json:\"error\"`" + `
+	Code       string ` + "`json:\"code\"`" + `
+	Param      string ` + "`json:\"param\"`" + `
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Message)
+}
+
+// send sends a request and returns the response of a successful status
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	target := c.BaseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		json.Unmarshal(data, apiErr)
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+// do sends a request with an optional JSON body and decodes the JSON
+// response into out, if set
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	resp, err := c.send(ctx, method, path, query, "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// escapePath escapes each segment of a path parameter, keeping the slashes
+// of MQTT topics
+func escapePath(value string) string {
+	segments := strings.Split(value, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func setString(query url.Values, name, value string) {
+	if value != "" {
+		query.Set(name, value)
+	}
+}
+
+func setList(query url.Values, name string, values []string) {
+	for _, value := range values {
+		query.Add(name, value)
+	}
+}
+
+func setInt(query url.Values, name string, value int) {
+	if value != 0 {
+		query.Set(name, strconv.Itoa(value))
+	}
+}
+
+func setBool(query url.Values, name string, value bool) {
+	if value {
+		query.Set(name, "true")
+	}
+}
+`
+
+// reservedNames are declared by the client core
+var reservedNames = map[string]bool{"Client": true, "New": true, "Error": true}
+
+// GenerateClient returns the gofmt'ed source of package pkg, a typed client
+// of the operations not marked NoClient along with the types of their bodies.
+func GenerateClient(pkg string, ops []Operation) ([]byte, error) {
+	g := &clientGenerator{types: make(map[string]reflect.Type), decls: make(map[string]string)}
+
+	var methods bytes.Buffer
+	for _, op := range ops {
+		if op.NoClient {
+			continue
+		}
+		if reservedNames[op.ID] {
+			return nil, fmt.Errorf("operation %s clashes with the client core", op.ID)
+		}
+		if err := g.method(&methods, op); err != nil {
+			return nil, fmt.Errorf("%s: %w", op.ID, err)
+		}
+	}
+	if err := g.declareTypes(); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by mqtt-api openapi; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&out, "// Package %s is a typed client of the home automation dashboard API.\n", pkg)
+	fmt.Fprintf(&out, "package %s\n\nimport (\n", pkg)
+	imports := []string{"bytes", "context", "encoding/json", "fmt", "io", "net/http", "net/url", "strconv", "strings"}
+	if g.usesTime {
+		imports = append(imports, "time")
+	}
+	for _, path := range imports {
+		fmt.Fprintf(&out, "\t%q\n", path)
+	}
+	out.WriteString(")\n")
+	out.WriteString(clientCore)
+	out.Write(methods.Bytes())
+
+	names := make([]string, 0, len(g.decls))
+	for name := range g.decls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out.WriteString(g.decls[name])
+	}
+
+	source, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format client: %w", err)
+	}
+	return source, nil
+}
+
+// clientGenerator collects the named types used by the client methods
+type clientGenerator struct {
+	types    map[string]reflect.Type
+	pending  []reflect.Type
+	decls    map[string]string
+	usesTime bool
+}
+
+// method writes the parameters struct and method of op
+func (g *clientGenerator) method(w *bytes.Buffer, op Operation) error {
+	var args, queryParams []Param
+	for _, param := range op.Params {
+		switch param.In {
+		case "path":
+			args = append(args, param)
+		case "query":
+			queryParams = append(queryParams, param)
+		}
+	}
+
+	signature := []string{"ctx context.Context"}
+	for _, param := range args {
+		signature = append(signature, goIdentifier(param.Name, false)+" string")
+	}
+
+	if len(queryParams) > 0 {
+		fmt.Fprintf(w, "\n// %sParams are the query parameters of %s\ntype %sParams struct {\n", op.ID, op.ID, op.ID)
+		for _, param := range queryParams {
+			fieldType, err := paramType(param)
+			if err != nil {
+				return err
+			}
+			if param.Description != "" {
+				fmt.Fprintf(w, "\t// %s\n", param.Description)
+			}
+			fmt.Fprintf(w, "\t%s %s\n", goIdentifier(param.Name, true), fieldType)
+		}
+		w.WriteString("}\n")
+		signature = append(signature, "params "+op.ID+"Params")
+	}
+
+	requestJSON := true
+	if op.Request != nil {
+		contentType := op.RequestContentType
+		if contentType != "" && !strings.Contains(contentType, "json") {
+			requestJSON = false
+			signature = append(signature, "body io.Reader")
+		} else {
+			bodyType, err := g.valueType(op.Request)
+			if err != nil {
+				return err
+			}
+			signature = append(signature, "body "+bodyType)
+		}
+	}
+
+	// The first successful response decides the result
+	var success *Response
+	for i := range op.Responses {
+		if op.Responses[i].Status >= 200 && op.Responses[i].Status < 300 {
+			success = &op.Responses[i]
+			break
+		}
+	}
+	if success == nil {
+		return fmt.Errorf("no successful response")
+	}
+
+	var result, zero, out string
+	raw := success.Body != nil && !strings.Contains(contentTypes(*success)[0], "json")
+	switch {
+	case success.Body == nil:
+	case raw:
+		result, zero = "io.ReadCloser", "nil"
+	default:
+		value := success.Body
+		if alternatives, ok := value.(OneOf); ok {
+			value = alternatives[0]
+		}
+		if _, ok := value.(ArrayOf); ok {
+			return fmt.Errorf("array of alternatives is not supported")
+		}
+		t := reflect.TypeOf(value)
+		name, err := g.goType(t)
+		if err != nil {
+			return err
+		}
+		if t.Kind() == reflect.Struct {
+			result, zero, out = "*"+name, "nil", "new("+name+")"
+		} else {
+			result, zero = name, "nil"
+		}
+	}
+
+	returns := "error"
+	if result != "" {
+		returns = "(" + result + ", error)"
+	}
+	if op.Summary != "" {
+		fmt.Fprintf(w, "\n// %s calls %s %s: %s\n", op.ID, op.Method, op.OpenAPIPath(), op.Summary)
+	} else {
+		fmt.Fprintf(w, "\n// %s calls %s %s\n", op.ID, op.Method, op.OpenAPIPath())
+	}
+	fmt.Fprintf(w, "func (c *Client) %s(%s) %s {\n", op.ID, strings.Join(signature, ", "), returns)
+
+	query := "nil"
+	if len(queryParams) > 0 {
+		query = "query"
+		w.WriteString("\tquery := url.Values{}\n")
+		for _, param := range queryParams {
+			field := "params." + goIdentifier(param.Name, true)
+			switch {
+			case param.Repeated:
+				fmt.Fprintf(w, "\tsetList(query, %q, %s)\n", param.Name, field)
+			case param.Type == "integer":
+				fmt.Fprintf(w, "\tsetInt(query, %q, %s)\n", param.Name, field)
+			case param.Type == "boolean":
+				fmt.Fprintf(w, "\tsetBool(query, %q, %s)\n", param.Name, field)
+			default:
+				fmt.Fprintf(w, "\tsetString(query, %q, %s)\n", param.Name, field)
+			}
+		}
+	}
+
+	path := pathExpression(op.OpenAPIPath())
+	method := "http.Method" + methodName(op.Method)
+	body := "nil"
+	if op.Request != nil {
+		body = "body"
+	}
+
+	switch {
+	case raw || !requestJSON:
+		contentType := op.RequestContentType
+		fmt.Fprintf(w, "\tresp, err := c.send(ctx, %s, %s, %s, %q, %s)\n", method, path, query, contentType, body)
+		if raw {
+			w.WriteString("\tif err != nil {\n\t\treturn nil, err\n\t}\n\treturn resp.Body, nil\n}\n")
+		} else {
+			w.WriteString("\tif err != nil {\n\t\treturn err\n\t}\n\treturn resp.Body.Close()\n}\n")
+		}
+	case result == "":
+		fmt.Fprintf(w, "\treturn c.do(ctx, %s, %s, %s, %s, nil)\n}\n", method, path, query, body)
+	case out != "":
+		fmt.Fprintf(w, "\tout := %s\n", out)
+		fmt.Fprintf(w, "\tif err := c.do(ctx, %s, %s, %s, %s, out); err != nil {\n\t\treturn %s, err\n\t}\n\treturn out, nil\n}\n", method, path, query, body, zero)
+	default:
+		fmt.Fprintf(w, "\tvar out %s\n", result)
+		fmt.Fprintf(w, "\tif err := c.do(ctx, %s, %s, %s, %s, &out); err != nil {\n\t\treturn %s, err\n\t}\n\treturn out, nil\n}\n", method, path, query, body, zero)
+	}
+	return nil
+}
+
+// valueType returns the Go type of a JSON body
+func (g *clientGenerator) valueType(value interface{}) (string, error) {
+	switch value.(type) {
+	case OneOf, ArrayOf:
+		return "", fmt.Errorf("request bodies with alternatives are not supported")
+	}
+	return g.goType(reflect.TypeOf(value))
+}
+
+// goType returns the Go type expression of t, queueing named structs to be
+// declared
+func (g *clientGenerator) goType(t reflect.Type) (string, error) {
+	switch {
+	case t == timeType:
+		g.usesTime = true
+		return "time.Time", nil
+	case t == rawType:
+		return "json.RawMessage", nil
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+		return "interface{}", nil
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		elem, err := g.goType(t.Elem())
+		if err != nil {
+			return "", err
+		}
+		switch t.Kind() {
+		case reflect.Pointer:
+			return "*" + elem, nil
+		case reflect.Slice:
+			return "[]" + elem, nil
+		case reflect.Array:
+			return fmt.Sprintf("[%d]%s", t.Len(), elem), nil
+		}
+		if t.Key().Kind() != reflect.String {
+			return "", fmt.Errorf("map key %s is not a string", t.Key())
+		}
+		return "map[string]" + elem, nil
+	case reflect.Struct:
+		if t.Name() == "" {
+			fields, err := g.fields(t)
+			if err != nil {
+				return "", err
+			}
+			return "struct {\n" + fields + "}", nil
+		}
+		if reservedNames[t.Name()] || strings.HasSuffix(t.Name(), "Params") {
+			return "", fmt.Errorf("type %s clashes with the client", t)
+		}
+		if existing, ok := g.types[t.Name()]; ok {
+			if existing != t {
+				return "", fmt.Errorf("types %s and %s share the name %s", existing, t, t.Name())
+			}
+			return t.Name(), nil
+		}
+		g.types[t.Name()] = t
+		g.pending = append(g.pending, t)
+		return t.Name(), nil
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return t.Kind().String(), nil
+	}
+	return "", fmt.Errorf("unsupported type %s", t)
+}
+
+// declareTypes declares the queued structs and the structs they use
+func (g *clientGenerator) declareTypes() error {
+	for len(g.pending) > 0 {
+		t := g.pending[0]
+		g.pending = g.pending[1:]
+
+		fields, err := g.fields(t)
+		if err != nil {
+			return fmt.Errorf("%s: %w", t, err)
+		}
+		g.decls[t.Name()] = fmt.Sprintf("\n// %s mirrors %s\ntype %s struct {\n%s}\n", t.Name(), t, t.Name(), fields)
+	}
+	return nil
+}
+
+// fields returns the field declarations of struct t
+func (g *clientGenerator) fields(t reflect.Type) (string, error) {
+	var b strings.Builder
+	for _, field := range Fields(t) {
+		fieldType, err := g.goType(field.Type)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", field.GoName, err)
+		}
+		tag := field.Name
+		if field.OmitEmpty {
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(&b, "\t%s %s `json:%q`\n", field.GoName, fieldType, tag)
+	}
+	return b.String(), nil
+}
+
+// paramType returns the Go type of a query parameter field
+func paramType(param Param) (string, error) {
+	switch {
+	case param.Repeated:
+		return "[]string", nil
+	case param.Type == "" || param.Type == "string":
+		return "string", nil
+	case param.Type == "integer":
+		return "int", nil
+	case param.Type == "boolean":
+		return "bool", nil
+	}
+	return "", fmt.Errorf("parameter %s: unsupported type %s", param.Name, param.Type)
+}
+
+// pathExpression returns a Go expression building path, escaping its
+// parameters
+func pathExpression(path string) string {
+	var parts []string
+	for path != "" {
+		open := strings.Index(path, "{")
+		if open < 0 {
+			parts = append(parts, strconv.Quote(path))
+			break
+		}
+		end := strings.Index(path[open:], "}") + open
+		if open > 0 {
+			parts = append(parts, strconv.Quote(path[:open]))
+		}
+		parts = append(parts, "escapePath("+goIdentifier(path[open+1:end], false)+")")
+		path = path[end+1:]
+	}
+	return strings.Join(parts, " + ")
+}
+
+// methodName returns the suffix of the net/http constant of method
+func methodName(method string) string {
+	switch method {
+	case http.MethodGet:
+		return "Get"
+	case http.MethodPost:
+		return "Post"
+	case http.MethodPut:
+		return "Put"
+	case http.MethodPatch:
+		return "Patch"
+	case http.MethodDelete:
+		return "Delete"
+	}
+	return method[:1] + strings.ToLower(method[1:])
+}
+
+// commonInitialisms are written in upper case in Go identifiers
+var commonInitialisms = map[string]bool{"id": true, "url": true, "tz": true}
+
+// goIdentifier turns a snake_case parameter name into a Go identifier
+func goIdentifier(name string, exported bool) string {
+	var b strings.Builder
+	for i, word := range strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' }) {
+		switch {
+		case i == 0 && !exported:
+			b.WriteString(strings.ToLower(word))
+		case commonInitialisms[strings.ToLower(word)]:
+			b.WriteString(strings.ToUpper(word))
+		default:
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
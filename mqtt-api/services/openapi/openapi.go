@@ -0,0 +1,469 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is the OpenAPI version of generated documents
+const Version = "3.0.3"
+
+// Param is a query, path or header parameter of an operation
+type Param struct {
+	Name        string
+	In          string // "query", "path" or "header"
+	Description string
+	Type        string // "string", "integer", "number" or "boolean"
+	Required    bool
+	// Repeated parameters may be given several times
+	Repeated bool
+	Enum     []string
+	Default  string
+}
+
+// Response is a possible response of an operation. Body is a value of the Go
+// type of JSON bodies; other content types are described as strings.
+type Response struct {
+	Status       int
+	Description  string
+	ContentTypes []string // application/json when empty
+	Body         interface{}
+}
+
+// Operation describes one route of the API
+type Operation struct {
+	// ID names the operation and the client method, e.g. "GetEvents"
+	ID      string
+	Method  string
+	Route   string // gin route, e.g. "/api/v1/state/*topic"
+	Path    string // OpenAPI path, derived from Route when empty
+	Tag     string
+	Summary string
+	Params  []Param
+
+	RequestContentType string // application/json when empty
+	Request            interface{}
+
+	Responses []Response
+	// Security lists the security requirements of which any one authorises
+	// the operation, none when it is public
+	Security []Security
+	// NoClient leaves the operation out of the generated client, e.g. for
+	// WebSocket or protobuf routes
+	NoClient bool
+}
+
+// Security requires a bearer token of Scheme. Scopes are the roles the token
+// needs, described in the document for readers.
+type Security struct {
+	Scheme string
+	Scopes []string
+}
+
+// OneOf describes a body that is one of several Go types
+type OneOf []interface{}
+
+// ArrayOf describes an array whose items are Items, e.g. a OneOf
+type ArrayOf struct {
+	Items interface{}
+}
+
+// Info is the info object of a document
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// Document is an OpenAPI 3 document
+type Document struct {
+	OpenAPI    string                                `json:"openapi"`
+	Info       Info                                  `json:"info"`
+	Paths      map[string]map[string]operationObject `json:"paths"`
+	Components components                            `json:"components"`
+}
+
+type components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]securityScheme `json:"securitySchemes,omitempty"`
+}
+
+type securityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme"`
+}
+
+type operationObject struct {
+	OperationID string                    `json:"operationId"`
+	Summary     string                    `json:"summary,omitempty"`
+	Description string                    `json:"description,omitempty"`
+	Tags        []string                  `json:"tags,omitempty"`
+	Parameters  []parameterObject         `json:"parameters,omitempty"`
+	RequestBody *requestBodyObject        `json:"requestBody,omitempty"`
+	Responses   map[string]responseObject `json:"responses"`
+	Security    []map[string][]string     `json:"security,omitempty"`
+}
+
+type parameterObject struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Style       string  `json:"style,omitempty"`
+	Explode     *bool   `json:"explode,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type requestBodyObject struct {
+	Required bool                     `json:"required"`
+	Content  map[string]contentObject `json:"content"`
+}
+
+type responseObject struct {
+	Description string                   `json:"description"`
+	Content     map[string]contentObject `json:"content,omitempty"`
+}
+
+type contentObject struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema is a JSON schema object
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Default              interface{}        `json:"default,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// Generate builds the document describing ops.
+func Generate(info Info, ops []Operation) (*Document, error) {
+	g := &generator{schemas: make(map[string]*Schema), types: make(map[string]reflect.Type)}
+	doc := &Document{
+		OpenAPI:    Version,
+		Info:       info,
+		Paths:      make(map[string]map[string]operationObject),
+		Components: components{Schemas: g.schemas},
+	}
+
+	for _, op := range ops {
+		object := operationObject{
+			OperationID: lowerFirst(op.ID),
+			Summary:     op.Summary,
+			Responses:   make(map[string]responseObject),
+		}
+		if op.Tag != "" {
+			object.Tags = []string{op.Tag}
+		}
+		for _, param := range op.Params {
+			object.Parameters = append(object.Parameters, parameter(param))
+		}
+
+		if op.Request != nil {
+			contentType := op.RequestContentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			schema, err := g.body(op.Request, contentType)
+			if err != nil {
+				return nil, fmt.Errorf("%s request: %w", op.ID, err)
+			}
+			object.RequestBody = &requestBodyObject{Required: true, Content: map[string]contentObject{contentType: {Schema: schema}}}
+		}
+
+		for _, response := range op.Responses {
+			description := response.Description
+			if description == "" {
+				description = http.StatusText(response.Status)
+			}
+			responseObj := responseObject{Description: description}
+			if response.Body != nil {
+				responseObj.Content = make(map[string]contentObject)
+				for _, contentType := range contentTypes(response) {
+					schema, err := g.body(response.Body, contentType)
+					if err != nil {
+						return nil, fmt.Errorf("%s response %d: %w", op.ID, response.Status, err)
+					}
+					responseObj.Content[contentType] = contentObject{Schema: schema}
+				}
+			}
+			object.Responses[strconv.Itoa(response.Status)] = responseObj
+		}
+
+		for _, security := range op.Security {
+			// OpenAPI 3.0 only lists scopes of OAuth2, so they are described instead
+			object.Security = append(object.Security, map[string][]string{security.Scheme: {}})
+			if len(security.Scopes) > 0 {
+				object.Description = fmt.Sprintf("Requires %s with the %s scope.", security.Scheme, strings.Join(security.Scopes, ", "))
+			}
+			if doc.Components.SecuritySchemes == nil {
+				doc.Components.SecuritySchemes = make(map[string]securityScheme)
+			}
+			doc.Components.SecuritySchemes[security.Scheme] = securityScheme{Type: "http", Scheme: "bearer"}
+		}
+
+		path := op.OpenAPIPath()
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]operationObject)
+		}
+		method := strings.ToLower(op.Method)
+		if _, ok := doc.Paths[path][method]; ok {
+			return nil, fmt.Errorf("duplicate operation %s %s", op.Method, path)
+		}
+		doc.Paths[path][method] = object
+	}
+	return doc, nil
+}
+
+// OpenAPIPath returns the OpenAPI path of the operation, turning gin's
+// :name and *name parameters into {name}
+func (op Operation) OpenAPIPath() string {
+	if op.Path != "" {
+		return op.Path
+	}
+	segments := strings.Split(op.Route, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// JSON encodes the document, indented and with a trailing newline
+func (d *Document) JSON() ([]byte, error) {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func contentTypes(response Response) []string {
+	if len(response.ContentTypes) == 0 {
+		return []string{"application/json"}
+	}
+	return response.ContentTypes
+}
+
+func parameter(param Param) parameterObject {
+	schema := &Schema{Type: param.Type, Enum: param.Enum}
+	if schema.Type == "" {
+		schema.Type = "string"
+	}
+	if param.Default != "" {
+		schema.Default = param.Default
+	}
+
+	object := parameterObject{
+		Name:        param.Name,
+		In:          param.In,
+		Description: param.Description,
+		Required:    param.Required || param.In == "path",
+		Schema:      schema,
+	}
+	if param.Repeated {
+		explode := true
+		object.Style, object.Explode = "form", &explode
+		object.Schema = &Schema{Type: "array", Items: schema}
+	}
+	return object
+}
+
+// generator collects the component schemas of the Go types it describes
+type generator struct {
+	schemas map[string]*Schema
+	types   map[string]reflect.Type
+}
+
+// body describes a request or response body
+func (g *generator) body(body interface{}, contentType string) (*Schema, error) {
+	if !strings.Contains(contentType, "json") {
+		if contentType == "application/x-protobuf" || strings.HasPrefix(contentType, "application/vnd.") {
+			return &Schema{Type: "string", Format: "binary"}, nil
+		}
+		return &Schema{Type: "string"}, nil
+	}
+	return g.value(body)
+}
+
+func (g *generator) value(value interface{}) (*Schema, error) {
+	switch v := value.(type) {
+	case OneOf:
+		schema := &Schema{}
+		for _, alternative := range v {
+			s, err := g.value(alternative)
+			if err != nil {
+				return nil, err
+			}
+			schema.OneOf = append(schema.OneOf, s)
+		}
+		return schema, nil
+	case ArrayOf:
+		items, err := g.value(v.Items)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "array", Items: items}, nil
+	}
+	return g.schema(reflect.TypeOf(value))
+}
+
+// schema describes t, adding named structs to the components
+func (g *generator) schema(t reflect.Type) (*Schema, error) {
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}, nil
+	case t == rawType || t.Kind() == reflect.Interface:
+		return &Schema{}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		elem, err := g.schema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		if elem.Ref != "" {
+			return &Schema{AllOf: []*Schema{elem}, Nullable: true}, nil
+		}
+		elem.Nullable = true
+		return elem, nil
+	case reflect.Slice, reflect.Array:
+		items, err := g.schema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		schema := &Schema{Type: "array", Items: items}
+		if t.Kind() == reflect.Array {
+			n := t.Len()
+			schema.MinItems, schema.MaxItems = &n, &n
+		}
+		return schema, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("map key %s is not a string", t.Key())
+		}
+		values, err := g.schema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "object", AdditionalProperties: values}, nil
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		return g.named(t)
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}, nil
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}, nil
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}, nil
+	case reflect.String:
+		return &Schema{Type: "string"}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", t)
+}
+
+// named adds the schema of a named struct to the components once and refers
+// to it
+func (g *generator) named(t reflect.Type) (*Schema, error) {
+	ref := &Schema{Ref: "#/components/schemas/" + t.Name()}
+	if existing, ok := g.types[t.Name()]; ok {
+		if existing != t {
+			return nil, fmt.Errorf("types %s and %s share the name %s", existing, t, t.Name())
+		}
+		return ref, nil
+	}
+	g.types[t.Name()] = t
+
+	schema, err := g.object(t)
+	if err != nil {
+		return nil, err
+	}
+	g.schemas[t.Name()] = schema
+	return ref, nil
+}
+
+// object describes the JSON encoding of a struct
+func (g *generator) object(t reflect.Type) (*Schema, error) {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for _, field := range Fields(t) {
+		property, err := g.schema(field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", t.Name(), field.GoName, err)
+		}
+		schema.Properties[field.Name] = property
+		if !field.OmitEmpty {
+			schema.Required = append(schema.Required, field.Name)
+		}
+	}
+	sort.Strings(schema.Required)
+	return schema, nil
+}
+
+// Field is a struct field as encoded to JSON
+type Field struct {
+	GoName    string
+	Name      string
+	Type      reflect.Type
+	OmitEmpty bool
+}
+
+// Fields returns the fields of struct t encoded to JSON, in order
+func Fields(t reflect.Type) []Field {
+	var fields []Field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, Field{
+			GoName:    f.Name,
+			Name:      name,
+			Type:      f.Type,
+			OmitEmpty: strings.Contains(","+options+",", ",omitempty,"),
+		})
+	}
+	return fields
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
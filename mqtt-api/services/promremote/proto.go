@@ -0,0 +1,269 @@
+package promremote
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages below are the parts of the Prometheus remote storage protocol
+// (prompb) used here, encoded by hand to avoid depending on Prometheus itself.
+
+// MatchType is the operator of a LabelMatcher
+type MatchType int32
+
+// Label matcher operators
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+// LabelMatcher selects series by one label
+type LabelMatcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+}
+
+// Query asks for the samples of the series matching all matchers between
+// StartMs and EndMs inclusive
+type Query struct {
+	StartMs  int64
+	EndMs    int64
+	Matchers []LabelMatcher
+}
+
+// ReadRequest is the body of a remote read request
+type ReadRequest struct {
+	Queries []Query
+}
+
+// Label is a name and value pair identifying a series
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a value at a time in milliseconds
+type Sample struct {
+	Value       float64
+	TimestampMs int64
+}
+
+// TimeSeries is a series of samples with its labels
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// QueryResult holds the series answering one Query
+type QueryResult struct {
+	Series []TimeSeries
+}
+
+// ReadResponse is the body of a remote read response, one result per query
+type ReadResponse struct {
+	Results []QueryResult
+}
+
+// UnmarshalReadRequest decodes a ReadRequest. Fields that are not needed,
+// such as hints and accepted response types, are skipped.
+func UnmarshalReadRequest(b []byte) (*ReadRequest, error) {
+	request := &ReadRequest{}
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		query, err := unmarshalQuery(value)
+		if err != nil {
+			return err
+		}
+		request.Queries = append(request.Queries, query)
+		return nil
+	})
+	return request, err
+}
+
+func unmarshalQuery(b []byte) (Query, error) {
+	var query Query
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			query.StartMs = int64(decodeVarint(value))
+		case num == 2 && typ == protowire.VarintType:
+			query.EndMs = int64(decodeVarint(value))
+		case num == 3 && typ == protowire.BytesType:
+			matcher, err := unmarshalLabelMatcher(value)
+			if err != nil {
+				return err
+			}
+			query.Matchers = append(query.Matchers, matcher)
+		}
+		return nil
+	})
+	return query, err
+}
+
+func unmarshalLabelMatcher(b []byte) (LabelMatcher, error) {
+	var matcher LabelMatcher
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			matcher.Type = MatchType(decodeVarint(value))
+		case num == 2 && typ == protowire.BytesType:
+			matcher.Name = string(value)
+		case num == 3 && typ == protowire.BytesType:
+			matcher.Value = string(value)
+		}
+		return nil
+	})
+	return matcher, err
+}
+
+// WriteRequest is the body of a remote write request
+type WriteRequest struct {
+	Series []TimeSeries
+}
+
+// UnmarshalWriteRequest decodes a WriteRequest. Metadata, exemplars and
+// native histograms are skipped.
+func UnmarshalWriteRequest(b []byte) (*WriteRequest, error) {
+	request := &WriteRequest{}
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		series, err := unmarshalTimeSeries(value)
+		if err != nil {
+			return err
+		}
+		request.Series = append(request.Series, series)
+		return nil
+	})
+	return request, err
+}
+
+func unmarshalTimeSeries(b []byte) (TimeSeries, error) {
+	var series TimeSeries
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			label, err := unmarshalLabel(value)
+			if err != nil {
+				return err
+			}
+			series.Labels = append(series.Labels, label)
+		case num == 2 && typ == protowire.BytesType:
+			sample, err := unmarshalSample(value)
+			if err != nil {
+				return err
+			}
+			series.Samples = append(series.Samples, sample)
+		}
+		return nil
+	})
+	return series, err
+}
+
+func unmarshalLabel(b []byte) (Label, error) {
+	var label Label
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			label.Name = string(value)
+		case num == 2 && typ == protowire.BytesType:
+			label.Value = string(value)
+		}
+		return nil
+	})
+	return label, err
+}
+
+func unmarshalSample(b []byte) (Sample, error) {
+	var sample Sample
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			bits, _ := protowire.ConsumeFixed64(value)
+			sample.Value = math.Float64frombits(bits)
+		case num == 2 && typ == protowire.VarintType:
+			sample.TimestampMs = int64(decodeVarint(value))
+		}
+		return nil
+	})
+	return sample, err
+}
+
+// Marshal encodes the response
+func (r *ReadResponse) Marshal() []byte {
+	var b []byte
+	for _, result := range r.Results {
+		var resultBytes []byte
+		for _, series := range result.Series {
+			resultBytes = protowire.AppendTag(resultBytes, 1, protowire.BytesType)
+			resultBytes = protowire.AppendBytes(resultBytes, series.marshal())
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, resultBytes)
+	}
+	return b
+}
+
+func (s TimeSeries) marshal() []byte {
+	var b []byte
+	for _, label := range s.Labels {
+		var labelBytes []byte
+		labelBytes = protowire.AppendTag(labelBytes, 1, protowire.BytesType)
+		labelBytes = protowire.AppendString(labelBytes, label.Name)
+		labelBytes = protowire.AppendTag(labelBytes, 2, protowire.BytesType)
+		labelBytes = protowire.AppendString(labelBytes, label.Value)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, labelBytes)
+	}
+	for _, sample := range s.Samples {
+		var sampleBytes []byte
+		sampleBytes = protowire.AppendTag(sampleBytes, 1, protowire.Fixed64Type)
+		sampleBytes = protowire.AppendFixed64(sampleBytes, math.Float64bits(sample.Value))
+		sampleBytes = protowire.AppendTag(sampleBytes, 2, protowire.VarintType)
+		sampleBytes = protowire.AppendVarint(sampleBytes, uint64(sample.TimestampMs))
+
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, sampleBytes)
+	}
+	return b
+}
+
+// forEachField calls fn with every field of the message b. Varints are passed
+// in their encoded form, length-delimited fields without their length.
+func forEachField(b []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("invalid protobuf message: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return fmt.Errorf("invalid protobuf field %d: %w", num, protowire.ParseError(n))
+		}
+		value := b[:n]
+		if typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(value)
+		}
+		if err := fn(num, typ, value); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func decodeVarint(b []byte) uint64 {
+	v, _ := protowire.ConsumeVarint(b)
+	return v
+}
@@ -0,0 +1,273 @@
+package promremote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MetricName is the metric name of the series of stored readings
+const MetricName = "mqtt_reading"
+
+// MaxSamples bounds the samples returned for one request, as responses are
+// buffered whole in memory, here and by Prometheus
+const MaxSamples = 1000000
+
+// batchSize is the number of readings fetched from the cursor at a time
+const batchSize = 1000
+
+// labelFields maps the labels of stored readings to their fields
+var labelFields = map[string]string{
+	"topic":       "topic",
+	"device":      "device",
+	"room":        "tags.room",
+	"sensor_type": "tags.sensor_type",
+}
+
+var (
+	// ErrTooManySamples is returned when a request selects more than MaxSamples
+	ErrTooManySamples = fmt.Errorf("request selects more than %d samples, narrow the matchers or time range", MaxSamples)
+	// ErrTooManyPoints is returned when a series holds more samples than
+	// the points allowed per series
+	ErrTooManyPoints = errors.New("series holds too many samples")
+)
+
+// MatcherError is a label matcher that cannot be evaluated
+type MatcherError struct {
+	Matcher LabelMatcher
+	Err     error
+}
+
+func (e *MatcherError) Error() string {
+	return fmt.Sprintf("invalid matcher on %s: %v", e.Matcher.Name, e.Err)
+}
+
+func (e *MatcherError) Unwrap() error {
+	return e.Err
+}
+
+// Read answers every query of request from the numeric readings of
+// collection, at their original resolution. Each distinct combination of
+// topic, device, room and sensor type is a series of MetricName, holding at
+// most maxPoints samples. Only the allowed readings are read.
+func Read(ctx context.Context, collection *mongo.Collection, request *ReadRequest, allowed db.Allowlist, maxPoints int) (*ReadResponse, error) {
+	response := &ReadResponse{Results: make([]QueryResult, 0, len(request.Queries))}
+	samples := 0
+	for _, query := range request.Queries {
+		result, err := readQuery(ctx, collection, query, allowed, maxPoints, &samples)
+		if err != nil {
+			return nil, err
+		}
+		response.Results = append(response.Results, result)
+	}
+	return response, nil
+}
+
+func readQuery(ctx context.Context, collection *mongo.Collection, query Query, allowed db.Allowlist, maxPoints int, samples *int) (QueryResult, error) {
+	result := QueryResult{Series: []TimeSeries{}}
+	filter, ok, err := Filter(query)
+	if err != nil || !ok {
+		return result, err
+	}
+	if !allowed.IsEmpty() {
+		filter = bson.D{{Key: "$and", Value: bson.A{filter, allowed.Filter()}}}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "topic", Value: 1}, {Key: "timestamp", Value: 1}}).
+		SetBatchSize(batchSize).
+		SetProjection(bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "timestamp", Value: 1},
+			{Key: "topic", Value: 1},
+			{Key: "device", Value: 1},
+			{Key: "value", Value: 1},
+			{Key: "tags.room", Value: 1},
+			{Key: "tags.sensor_type", Value: 1},
+		})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return result, err
+	}
+	defer cursor.Close(ctx)
+
+	index := make(map[string]int)
+	for cursor.Next(ctx) {
+		var reading struct {
+			Timestamp time.Time   `bson:"timestamp"`
+			Topic     string      `bson:"topic"`
+			Device    string      `bson:"device"`
+			Value     interface{} `bson:"value"`
+			Tags      struct {
+				Room       string `bson:"room"`
+				SensorType string `bson:"sensor_type"`
+			} `bson:"tags"`
+		}
+		if err := cursor.Decode(&reading); err != nil {
+			return result, err
+		}
+		value, ok := number(reading.Value)
+		if !ok {
+			continue
+		}
+
+		if *samples++; *samples > MaxSamples {
+			return result, ErrTooManySamples
+		}
+
+		labels := seriesLabels(reading.Topic, reading.Device, reading.Tags.Room, reading.Tags.SensorType)
+		key := labelsKey(labels)
+		i, ok := index[key]
+		if !ok {
+			i = len(result.Series)
+			index[key] = i
+			result.Series = append(result.Series, TimeSeries{Labels: labels})
+		}
+		if len(result.Series[i].Samples) >= maxPoints {
+			return result, ErrTooManyPoints
+		}
+		result.Series[i].Samples = append(result.Series[i].Samples, Sample{Value: value, TimestampMs: reading.Timestamp.UnixMilli()})
+	}
+	if err := cursor.Err(); err != nil {
+		return result, err
+	}
+
+	// Prometheus merges series in label order
+	sort.Slice(result.Series, func(i, j int) bool {
+		return labelsKey(result.Series[i].Labels) < labelsKey(result.Series[j].Labels)
+	})
+	return result, nil
+}
+
+// Filter translates a query into a MongoDB filter. It returns false when no
+// stored reading can match, as when the query asks for another metric.
+func Filter(query Query) (bson.D, bool, error) {
+	conditions := bson.A{
+		bson.D{{Key: "timestamp", Value: bson.D{
+			{Key: "$gte", Value: time.UnixMilli(query.StartMs).UTC()},
+			{Key: "$lte", Value: time.UnixMilli(query.EndMs).UTC()},
+		}}},
+		bson.D{{Key: "value", Value: bson.D{{Key: "$type", Value: "number"}}}},
+	}
+
+	for _, matcher := range query.Matchers {
+		matchesEmpty, err := matches(matcher, "")
+		if err != nil {
+			return nil, false, err
+		}
+
+		field, ok := labelFields[matcher.Name]
+		if !ok {
+			// Other labels are either the metric name or absent, i.e. empty
+			value := ""
+			if matcher.Name == "__name__" {
+				value = MetricName
+			}
+			if match, _ := matches(matcher, value); !match {
+				return nil, false, nil
+			}
+			continue
+		}
+
+		// Absent and empty labels are the same to Prometheus
+		condition := valueCondition(field, matcher)
+		absent := bson.A{nil, ""}
+		if matchesEmpty {
+			condition = bson.D{{Key: "$or", Value: bson.A{condition, bson.D{{Key: field, Value: bson.D{{Key: "$in", Value: absent}}}}}}}
+		} else {
+			condition = bson.D{{Key: "$and", Value: bson.A{condition, bson.D{{Key: field, Value: bson.D{{Key: "$nin", Value: absent}}}}}}}
+		}
+		conditions = append(conditions, condition)
+	}
+	return bson.D{{Key: "$and", Value: conditions}}, true, nil
+}
+
+// valueCondition matches field against the matcher for non-empty values
+func valueCondition(field string, matcher LabelMatcher) bson.D {
+	regex := primitive.Regex{Pattern: anchor(matcher.Value)}
+	switch matcher.Type {
+	case MatchNotEqual:
+		return bson.D{{Key: field, Value: bson.D{{Key: "$ne", Value: matcher.Value}}}}
+	case MatchRegexp:
+		return bson.D{{Key: field, Value: regex}}
+	case MatchNotRegexp:
+		return bson.D{{Key: field, Value: bson.D{{Key: "$not", Value: regex}}}}
+	}
+	return bson.D{{Key: field, Value: matcher.Value}}
+}
+
+// matches evaluates the matcher against a label value
+func matches(matcher LabelMatcher, value string) (bool, error) {
+	switch matcher.Type {
+	case MatchEqual:
+		return value == matcher.Value, nil
+	case MatchNotEqual:
+		return value != matcher.Value, nil
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile(anchor(matcher.Value))
+		if err != nil {
+			return false, &MatcherError{Matcher: matcher, Err: err}
+		}
+		return re.MatchString(value) == (matcher.Type == MatchRegexp), nil
+	}
+	return false, &MatcherError{Matcher: matcher, Err: errors.New("unknown match type")}
+}
+
+// anchor makes a regular expression match whole values, as in PromQL
+func anchor(pattern string) string {
+	return "^(?:" + pattern + ")$"
+}
+
+// seriesLabels returns the sorted labels of a reading, leaving out empty ones
+func seriesLabels(topic, device, room, sensorType string) []Label {
+	labels := []Label{{Name: "__name__", Value: MetricName}}
+	for _, label := range []Label{
+		{Name: "device", Value: device},
+		{Name: "room", Value: room},
+		{Name: "sensor_type", Value: sensorType},
+		{Name: "topic", Value: topic},
+	} {
+		if label.Value != "" {
+			labels = append(labels, label)
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+func labelsKey(labels []Label) string {
+	var sb strings.Builder
+	for _, label := range labels {
+		sb.WriteString(label.Name)
+		sb.WriteByte(0)
+		sb.WriteString(label.Value)
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
+
+// number returns the value of numeric readings
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
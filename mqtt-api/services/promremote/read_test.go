@@ -0,0 +1,188 @@
+package promremote
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// readRequestFixture is a remote read request of one query, encoded as
+// Prometheus sends it, with hints and accepted response types to skip
+var readRequestFixture = []byte("" +
+	"\x0a\x47" + // query
+	"\x08\x80\x98\xef\x89\xb8\x32" + // start 1733040000000
+	"\x10\x80\xf5\xca\x8b\xb8\x32" + // end 1733043600000
+	"\x1a\x1a\x08\x00\x12\x08__name__\x1a\x0cmqtt_reading" +
+	"\x1a\x17\x08\x02\x12\x04room\x1a\x0dkitchen|attic" +
+	"\x22\x02\x08\x01" + // hints
+	"\x10\x01") // accepted response types
+
+func TestUnmarshalReadRequest(t *testing.T) {
+	request, err := UnmarshalReadRequest(readRequestFixture)
+	if err != nil {
+		t.Fatalf("UnmarshalReadRequest() error = %v", err)
+	}
+	want := &ReadRequest{Queries: []Query{{
+		StartMs: 1733040000000,
+		EndMs:   1733043600000,
+		Matchers: []LabelMatcher{
+			{Type: MatchEqual, Name: "__name__", Value: MetricName},
+			{Type: MatchRegexp, Name: "room", Value: "kitchen|attic"},
+		},
+	}}}
+	if !reflect.DeepEqual(request, want) {
+		t.Errorf("UnmarshalReadRequest() = %+v, want %+v", request, want)
+	}
+
+	if _, err := UnmarshalReadRequest(readRequestFixture[:30]); err == nil {
+		t.Error("UnmarshalReadRequest() of a truncated request succeeded, want an error")
+	}
+}
+
+func TestReadResponseMarshal(t *testing.T) {
+	series := TimeSeries{
+		Labels:  seriesLabels("home/attic/temperature", "attic_sensor", "attic", "temperature"),
+		Samples: []Sample{{Value: 21.5, TimestampMs: 1733040000000}, {Value: -3, TimestampMs: 1733040015000}},
+	}
+	response := &ReadResponse{Results: []QueryResult{{Series: []TimeSeries{series}}}}
+
+	// A response holds results, holding series
+	want := []byte("" +
+		"\x0a\xa5\x01" + // result
+		"\x0a\xa2\x01" + // timeseries
+		"\x0a\x18\x0a\x08__name__\x12\x0cmqtt_reading" +
+		"\x0a\x16\x0a\x06device\x12\x0cattic_sensor" +
+		"\x0a\x0d\x0a\x04room\x12\x05attic" +
+		"\x0a\x1a\x0a\x0bsensor_type\x12\x0btemperature" +
+		"\x0a\x1f\x0a\x05topic\x12\x16home/attic/temperature" +
+		"\x12\x10\x09\x00\x00\x00\x00\x00\x80\x35\x40\x10\x80\x98\xef\x89\xb8\x32" +
+		"\x12\x10\x09\x00\x00\x00\x00\x00\x00\x08\xc0\x10\x98\x8d\xf0\x89\xb8\x32")
+	got := response.Marshal()
+	if string(got) != string(want) {
+		t.Errorf("Marshal() = %q, want %q", got, want)
+	}
+
+	// The series decodes back unchanged
+	var decoded []TimeSeries
+	err := forEachField(got, func(_ protowire.Number, _ protowire.Type, result []byte) error {
+		return forEachField(result, func(_ protowire.Number, _ protowire.Type, value []byte) error {
+			s, err := unmarshalTimeSeries(value)
+			decoded = append(decoded, s)
+			return err
+		})
+	})
+	if err != nil || !reflect.DeepEqual(decoded, []TimeSeries{series}) {
+		t.Errorf("decoded response = %+v, %v, want %+v", decoded, err, series)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	absent := bson.A{nil, ""}
+	regex := func(pattern string) primitive.Regex {
+		return primitive.Regex{Pattern: "^(?:" + pattern + ")$"}
+	}
+	tests := []struct {
+		name     string
+		matchers []LabelMatcher
+		want     bson.A // conditions following the time range and numeric value
+		wantOK   bool
+	}{
+		{
+			name:     "metric name",
+			matchers: []LabelMatcher{{Type: MatchEqual, Name: "__name__", Value: MetricName}},
+			want:     bson.A{},
+			wantOK:   true,
+		},
+		{
+			name:     "other metric",
+			matchers: []LabelMatcher{{Type: MatchEqual, Name: "__name__", Value: "up"}},
+		},
+		{
+			name:     "label that is never set",
+			matchers: []LabelMatcher{{Type: MatchEqual, Name: "job", Value: "node"}},
+		},
+		{
+			name:     "label that is never set matched empty",
+			matchers: []LabelMatcher{{Type: MatchNotRegexp, Name: "job", Value: ".+"}},
+			want:     bson.A{},
+			wantOK:   true,
+		},
+		{
+			name:     "equal",
+			matchers: []LabelMatcher{{Type: MatchEqual, Name: "room", Value: "kitchen"}},
+			want: bson.A{bson.D{{Key: "$and", Value: bson.A{
+				bson.D{{Key: "tags.room", Value: "kitchen"}},
+				bson.D{{Key: "tags.room", Value: bson.D{{Key: "$nin", Value: absent}}}},
+			}}}},
+			wantOK: true,
+		},
+		{
+			name:     "not equal includes readings without the label",
+			matchers: []LabelMatcher{{Type: MatchNotEqual, Name: "device", Value: "pump"}},
+			want: bson.A{bson.D{{Key: "$or", Value: bson.A{
+				bson.D{{Key: "device", Value: bson.D{{Key: "$ne", Value: "pump"}}}},
+				bson.D{{Key: "device", Value: bson.D{{Key: "$in", Value: absent}}}},
+			}}}},
+			wantOK: true,
+		},
+		{
+			name:     "regular expressions are anchored",
+			matchers: []LabelMatcher{{Type: MatchRegexp, Name: "sensor_type", Value: "temp.*"}},
+			want: bson.A{bson.D{{Key: "$and", Value: bson.A{
+				bson.D{{Key: "tags.sensor_type", Value: regex("temp.*")}},
+				bson.D{{Key: "tags.sensor_type", Value: bson.D{{Key: "$nin", Value: absent}}}},
+			}}}},
+			wantOK: true,
+		},
+		{
+			name:     "negated regular expression",
+			matchers: []LabelMatcher{{Type: MatchNotRegexp, Name: "topic", Value: "home/garden/.*"}},
+			want: bson.A{bson.D{{Key: "$or", Value: bson.A{
+				bson.D{{Key: "topic", Value: bson.D{{Key: "$not", Value: regex("home/garden/.*")}}}},
+				bson.D{{Key: "topic", Value: bson.D{{Key: "$in", Value: absent}}}},
+			}}}},
+			wantOK: true,
+		},
+	}
+
+	for _, tt := range tests {
+		query := Query{StartMs: 1733040000000, EndMs: 1733043600000, Matchers: tt.matchers}
+		filter, ok, err := Filter(query)
+		if err != nil || ok != tt.wantOK {
+			t.Errorf("%s: Filter() ok = %v, error = %v, want ok %v", tt.name, ok, err, tt.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		conditions := filter[0].Value.(bson.A)
+		timeRange := bson.D{{Key: "timestamp", Value: bson.D{
+			{Key: "$gte", Value: time.UnixMilli(query.StartMs).UTC()},
+			{Key: "$lte", Value: time.UnixMilli(query.EndMs).UTC()},
+		}}}
+		if !reflect.DeepEqual(conditions[0], timeRange) {
+			t.Errorf("%s: Filter() time range = %v, want %v", tt.name, conditions[0], timeRange)
+		}
+		if got := conditions[2:]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Filter() conditions = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFilterInvalidMatchers(t *testing.T) {
+	for _, matcher := range []LabelMatcher{
+		{Type: MatchRegexp, Name: "room", Value: "kitchen("},
+		{Type: MatchType(7), Name: "room", Value: "kitchen"},
+	} {
+		_, _, err := Filter(Query{Matchers: []LabelMatcher{matcher}})
+		var matcherErr *MatcherError
+		if !errors.As(err, &matcherErr) {
+			t.Errorf("Filter() with matcher %+v error = %v, want a MatcherError", matcher, err)
+		}
+	}
+}
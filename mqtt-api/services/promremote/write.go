@@ -0,0 +1,206 @@
+package promremote
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"home_automation_dashboard/shared/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Source is tagged on readings received through remote write
+const Source = "prometheus"
+
+// TopicPrefix is the first level of the topics of received series
+const TopicPrefix = "prometheus"
+
+// reservedTags are tags set from the series itself, labels of the same name
+// are not copied
+var reservedTags = map[string]bool{
+	"room":        true,
+	"sensor_type": true,
+	"source":      true,
+	"state":       true,
+}
+
+// topicReplacer keeps label values from adding levels or wildcards to topics
+var topicReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// WriteResult counts the readings of a write request
+type WriteResult struct {
+	Inserted   int64
+	Duplicates int64 // already stored by an earlier attempt
+}
+
+// Topic returns the topic a series is stored under:
+// prometheus/<job>/<instance>/<metric> followed by a <name>=<value> level per
+// other label, in label order. Missing job and instance levels are "_".
+func Topic(labels []Label) string {
+	values := make(map[string]string, len(labels))
+	var rest []Label
+	for _, label := range labels {
+		values[label.Name] = label.Value
+		switch label.Name {
+		case "__name__", "job", "instance":
+		default:
+			rest = append(rest, label)
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		return rest[i].Name < rest[j].Name
+	})
+
+	levels := []string{TopicPrefix, topicLevel(values["job"]), topicLevel(values["instance"]), topicLevel(values["__name__"])}
+	for _, label := range rest {
+		levels = append(levels, topicLevel(label.Name+"="+label.Value))
+	}
+	return strings.Join(levels, "/")
+}
+
+func topicLevel(value string) string {
+	if value == "" {
+		return "_"
+	}
+	return topicReplacer.Replace(value)
+}
+
+// Message builds the stored reading of a sample. The device is the instance,
+// or the job without one, the sensor type is the metric name, and the other
+// labels become tags.
+func Message(labels []Label, sample Sample) models.MqttMessage {
+	values := make(map[string]string, len(labels))
+	for _, label := range labels {
+		values[label.Name] = label.Value
+	}
+
+	device := values["instance"]
+	if device == "" {
+		device = values["job"]
+	}
+	if device == "" {
+		device = "unknown_device"
+	}
+	room := values["room"]
+	if room == "" {
+		room = "unknown_room"
+	}
+
+	tags := map[string]interface{}{
+		"room":        room,
+		"sensor_type": values["__name__"],
+		"source":      Source,
+		"state":       sample.Value,
+	}
+	for name, value := range values {
+		if name != "__name__" && !reservedTags[name] {
+			tags[name] = value
+		}
+	}
+
+	return models.MqttMessage{
+		Topic:     Topic(labels),
+		Device:    device,
+		Value:     sample.Value,
+		Timestamp: time.UnixMilli(sample.TimestampMs).UTC(),
+		Tags:      tags,
+	}
+}
+
+// Write stores messages, built with Message from the samples of a write
+// request, as readings of collection. Prometheus retries failed requests, so
+// samples already stored are skipped.
+func Write(ctx context.Context, collection *mongo.Collection, messages []models.MqttMessage) (WriteResult, error) {
+	var result WriteResult
+	if len(messages) == 0 {
+		return result, nil
+	}
+
+	existing, err := storedSamples(ctx, collection, messages)
+	if err != nil {
+		return result, err
+	}
+
+	var docs []interface{}
+	for _, msg := range messages {
+		if existing[sampleKey(msg.Topic, msg.Timestamp)] {
+			result.Duplicates++
+			continue
+		}
+		docs = append(docs, msg)
+	}
+	if len(docs) == 0 {
+		return result, nil
+	}
+
+	res, err := collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if res != nil {
+		result.Inserted = int64(len(res.InsertedIDs))
+	}
+	return result, err
+}
+
+// storedSamples returns the keys of the messages that are already stored
+func storedSamples(ctx context.Context, collection *mongo.Collection, messages []models.MqttMessage) (map[string]bool, error) {
+	cursor, err := collection.Find(ctx,
+		storedFilter(messages),
+		options.Find().SetProjection(bson.D{{Key: "_id", Value: 0}, {Key: "topic", Value: 1}, {Key: "timestamp", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	existing := make(map[string]bool)
+	for cursor.Next(ctx) {
+		var doc struct {
+			Topic     string    `bson:"topic"`
+			Timestamp time.Time `bson:"timestamp"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		existing[sampleKey(doc.Topic, doc.Timestamp)] = true
+	}
+	return existing, cursor.Err()
+}
+
+// storedFilter matches the stored readings of the topics of messages. Each
+// topic is looked up over the range of its own samples, so a series resent
+// from far back does not load the readings of all others since then.
+func storedFilter(messages []models.MqttMessage) bson.D {
+	type timeRange struct{ start, end time.Time }
+	ranges := make(map[string]*timeRange)
+	var topics []string
+	for _, msg := range messages {
+		r, ok := ranges[msg.Topic]
+		if !ok {
+			ranges[msg.Topic] = &timeRange{start: msg.Timestamp, end: msg.Timestamp}
+			topics = append(topics, msg.Topic)
+			continue
+		}
+		if msg.Timestamp.Before(r.start) {
+			r.start = msg.Timestamp
+		}
+		if msg.Timestamp.After(r.end) {
+			r.end = msg.Timestamp
+		}
+	}
+
+	conditions := make(bson.A, 0, len(topics))
+	for _, topic := range topics {
+		conditions = append(conditions, bson.D{
+			{Key: "topic", Value: topic},
+			{Key: "timestamp", Value: bson.D{{Key: "$gte", Value: ranges[topic].start}, {Key: "$lte", Value: ranges[topic].end}}},
+		})
+	}
+	return bson.D{{Key: "$or", Value: conditions}}
+}
+
+func sampleKey(topic string, timestamp time.Time) string {
+	return topic + "\x00" + timestamp.UTC().Format(time.RFC3339Nano)
+}
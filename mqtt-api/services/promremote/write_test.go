@@ -0,0 +1,135 @@
+package promremote
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"home_automation_dashboard/shared/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// writeRequestFixture is a remote write request of two series, encoded as
+// Prometheus sends it, with exemplars and metadata to skip
+var writeRequestFixture = []byte("" +
+	"\x0a\x6c" + // timeseries
+	"\x0a\x15\x0a\x08__name__\x12\x09node_temp" +
+	"\x0a\x0b\x0a\x03job\x12\x04node" +
+	"\x0a\x13\x0a\x08instance\x12\x07pi:9100" +
+	"\x0a\x0d\x0a\x04room\x12\x05attic" +
+	"\x12\x10\x09\x00\x00\x00\x00\x00\x80\x35\x40\x10\x80\x98\xef\x89\xb8\x32" + // 21.5 at 1733040000000
+	"\x12\x10\x09\x00\x00\x00\x00\x00\x00\x36\x40\x10\x98\x8d\xf0\x89\xb8\x32" + // 22 at 1733040015000
+	"\x0a\x26" + // timeseries
+	"\x0a\x0e\x0a\x08__name__\x12\x02up" +
+	"\x12\x10\x09\x00\x00\x00\x00\x00\x00\xf0\x3f\x10\x80\x98\xef\x89\xb8\x32" + // 1 at 1733040000000
+	"\x1a\x02\x0a\x00" + // exemplar
+	"\x1a\x02\x08\x01") // metadata
+
+func TestUnmarshalWriteRequest(t *testing.T) {
+	request, err := UnmarshalWriteRequest(writeRequestFixture)
+	if err != nil {
+		t.Fatalf("UnmarshalWriteRequest() error = %v", err)
+	}
+	want := &WriteRequest{Series: []TimeSeries{
+		{
+			Labels: []Label{{"__name__", "node_temp"}, {"job", "node"}, {"instance", "pi:9100"}, {"room", "attic"}},
+			Samples: []Sample{
+				{Value: 21.5, TimestampMs: 1733040000000},
+				{Value: 22, TimestampMs: 1733040015000},
+			},
+		},
+		{
+			Labels:  []Label{{"__name__", "up"}},
+			Samples: []Sample{{Value: 1, TimestampMs: 1733040000000}},
+		},
+	}}
+	if !reflect.DeepEqual(request, want) {
+		t.Errorf("UnmarshalWriteRequest() = %+v, want %+v", request, want)
+	}
+
+	// Every prefix cutting a field short is refused
+	for _, n := range []int{1, 5, 40} {
+		if _, err := UnmarshalWriteRequest(writeRequestFixture[:n]); err == nil {
+			t.Errorf("UnmarshalWriteRequest() of the first %d bytes succeeded, want an error", n)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	request, err := UnmarshalWriteRequest(writeRequestFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := Message(request.Series[0].Labels, request.Series[0].Samples[0])
+	want := models.MqttMessage{
+		Topic:     "prometheus/node/pi:9100/node_temp/room=attic",
+		Device:    "pi:9100",
+		Value:     21.5,
+		Timestamp: time.Date(2024, 12, 1, 8, 0, 0, 0, time.UTC),
+		Tags: map[string]interface{}{
+			"room":        "attic",
+			"sensor_type": "node_temp",
+			"source":      Source,
+			"state":       21.5,
+			"job":         "node",
+			"instance":    "pi:9100",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Message() = %+v, want %+v", got, want)
+	}
+
+	got = Message(request.Series[1].Labels, request.Series[1].Samples[0])
+	if got.Topic != "prometheus/_/_/up" || got.Device != "unknown_device" || got.Tags["room"] != "unknown_room" {
+		t.Errorf("Message() of a series without job, instance and room = %+v", got)
+	}
+}
+
+func TestTopic(t *testing.T) {
+	tests := []struct {
+		labels []Label
+		want   string
+	}{
+		{[]Label{{"__name__", "up"}, {"job", "node"}}, "prometheus/node/_/up"},
+		// Other labels follow in name order
+		{[]Label{{"zone", "b"}, {"__name__", "up"}, {"area", "a"}}, "prometheus/_/_/up/area=a/zone=b"},
+		// Values cannot add levels or wildcards
+		{[]Label{{"__name__", "up"}, {"job", "a/b"}, {"instance", "+"}, {"path", "#"}}, "prometheus/a_b/_/up/path=_"},
+	}
+
+	for _, tt := range tests {
+		if got := Topic(tt.labels); got != tt.want {
+			t.Errorf("Topic(%v) = %q, want %q", tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestStoredFilter(t *testing.T) {
+	at := func(minutes int) time.Time {
+		return time.Date(2024, 12, 1, 8, minutes, 0, 0, time.UTC)
+	}
+	messages := []models.MqttMessage{
+		{Topic: "prometheus/node/_/up", Timestamp: at(30)},
+		{Topic: "prometheus/node/_/load", Timestamp: at(59)},
+		// A series resent from far back only widens its own range
+		{Topic: "prometheus/node/_/up", Timestamp: at(-600)},
+		{Topic: "prometheus/node/_/up", Timestamp: at(45)},
+	}
+
+	got := storedFilter(messages)
+	want := bson.D{{Key: "$or", Value: bson.A{
+		bson.D{
+			{Key: "topic", Value: "prometheus/node/_/up"},
+			{Key: "timestamp", Value: bson.D{{Key: "$gte", Value: at(-600)}, {Key: "$lte", Value: at(45)}}},
+		},
+		bson.D{
+			{Key: "topic", Value: "prometheus/node/_/load"},
+			{Key: "timestamp", Value: bson.D{{Key: "$gte", Value: at(59)}, {Key: "$lte", Value: at(59)}}},
+		},
+	}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("storedFilter() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,290 @@
+package querycache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Defaults of the settings left unset. Writers that do not purge the cache,
+// such as restore without Redis, leave historical results stale for up to
+// DefaultTTL.
+const (
+	DefaultSize      = 1000
+	DefaultTTL       = time.Hour
+	DefaultRecentTTL = 30 * time.Second
+)
+
+// settleTime is how long after its end a range is considered historical.
+// Readings may arrive late, e.g. when a device buffered them while offline.
+const settleTime = 5 * time.Minute
+
+// redisPrefix namespaces the cache's keys in a shared Redis database
+const redisPrefix = "mqtt-api:query:"
+
+// generationKey counts the purges of the cache, outside redisPrefix so that
+// purging keeps it. Instances compare it at most every generationCheck and
+// drop their results in memory once another process purged the cache.
+const (
+	generationKey   = "mqtt-api:query-generation"
+	generationCheck = 10 * time.Second
+)
+
+// Layers answering a lookup
+const (
+	LayerMemory = "memory"
+	LayerRedis  = "redis"
+)
+
+// Config configures the cache of query results.
+type Config struct {
+	// Size is the number of results kept in memory, 0 disables the cache
+	Size int
+	// TTL is how long results of historical ranges are kept, RecentTTL how
+	// long those of ranges including now are
+	TTL       time.Duration
+	RecentTTL time.Duration
+	// RedisURL, when set, shares the results with other instances and keeps
+	// them across restarts
+	RedisURL string
+}
+
+// FromEnv reads QUERY_CACHE_SIZE, QUERY_CACHE_TTL, QUERY_CACHE_RECENT_TTL and
+// QUERY_CACHE_REDIS_URL, e.g. "redis://localhost:6379/0".
+func FromEnv() (Config, error) {
+	config := Config{Size: DefaultSize, TTL: DefaultTTL, RecentTTL: DefaultRecentTTL, RedisURL: os.Getenv("QUERY_CACHE_REDIS_URL")}
+	var err error
+
+	if value := os.Getenv("QUERY_CACHE_SIZE"); value != "" {
+		if value == "off" {
+			config.Size = 0
+		} else if config.Size, err = strconv.Atoi(value); err != nil || config.Size < 0 {
+			return config, fmt.Errorf("invalid QUERY_CACHE_SIZE %q", value)
+		}
+	}
+	if value := os.Getenv("QUERY_CACHE_TTL"); value != "" {
+		if config.TTL, err = db.ParseDuration(value); err != nil || config.TTL < 0 {
+			return config, fmt.Errorf("invalid QUERY_CACHE_TTL %q", value)
+		}
+	}
+	if value := os.Getenv("QUERY_CACHE_RECENT_TTL"); value != "" {
+		if config.RecentTTL, err = db.ParseDuration(value); err != nil || config.RecentTTL < 0 {
+			return config, fmt.Errorf("invalid QUERY_CACHE_RECENT_TTL %q", value)
+		}
+	}
+	return config, nil
+}
+
+// Cache keeps query results in an in-memory LRU, backed by Redis when
+// configured. Redis failures are logged and treated as misses, the cache
+// never fails a query.
+type Cache struct {
+	config  Config
+	entries *lru.Cache[string, entry]
+	redis   *redis.Client
+
+	mu         sync.Mutex
+	generation int64
+	checked    time.Time
+}
+
+type entry struct {
+	value   []byte
+	expires time.Time
+}
+
+// New creates a Cache of config, nil when config.Size is 0. A nil Cache
+// misses every lookup.
+func New(config Config) (*Cache, error) {
+	if config.Size <= 0 {
+		return nil, nil
+	}
+
+	entries, err := lru.New[string, entry](config.Size)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cache{config: config, entries: entries}
+
+	if config.RedisURL != "" {
+		options, err := redis.ParseURL(config.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid QUERY_CACHE_REDIS_URL: %w", err)
+		}
+		c.redis = redis.NewClient(options)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.redis.Ping(ctx).Err(); err != nil {
+			// The client reconnects, results are only kept in memory meanwhile
+			log.Printf("Query cache Redis at %s is unreachable: %v", options.Addr, err)
+		}
+	}
+	return c, nil
+}
+
+// TTL returns how long to keep the result of a query of the range ending at
+// end, 0 when it should not be cached.
+func (c *Cache) TTL(end, now time.Time) time.Duration {
+	if c == nil {
+		return 0
+	}
+	if Historical(end, now) {
+		return c.config.TTL
+	}
+	return c.config.RecentTTL
+}
+
+// Historical reports whether a range ending at end no longer changes as
+// readings arrive.
+func Historical(end, now time.Time) bool {
+	return end.Before(now.Add(-settleTime))
+}
+
+// Get returns the result cached under key and the layer that had it.
+func (c *Cache) Get(ctx context.Context, key string) ([]byte, string, bool) {
+	if c == nil {
+		return nil, "", false
+	}
+
+	now := time.Now()
+	if c.redis != nil {
+		c.syncGeneration(ctx, now)
+	}
+	if e, ok := c.entries.Get(key); ok {
+		if now.Before(e.expires) {
+			return e.value, LayerMemory, true
+		}
+		c.entries.Remove(key)
+	}
+	if c.redis == nil {
+		return nil, "", false
+	}
+
+	var value *redis.StringCmd
+	var ttl *redis.DurationCmd
+	_, err := c.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		value = pipe.Get(ctx, redisPrefix+key)
+		ttl = pipe.PTTL(ctx, redisPrefix+key)
+		return nil
+	})
+	if errors.Is(err, redis.Nil) {
+		return nil, "", false
+	}
+	if err != nil {
+		log.Printf("Query cache Redis lookup failed: %v", err)
+		return nil, "", false
+	}
+
+	data, _ := value.Bytes()
+	if remaining := ttl.Val(); remaining > 0 {
+		c.entries.Add(key, entry{value: data, expires: now.Add(remaining)})
+	}
+	return data, LayerRedis, true
+}
+
+// syncGeneration drops the results in memory when the cache was purged by
+// another process since the last check.
+func (c *Cache) syncGeneration(ctx context.Context, now time.Time) {
+	c.mu.Lock()
+	if now.Sub(c.checked) < generationCheck {
+		c.mu.Unlock()
+		return
+	}
+	c.checked = now
+	c.mu.Unlock()
+
+	generation, err := c.redis.Get(ctx, generationKey).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		log.Printf("Query cache Redis lookup failed: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		c.generation = generation
+		c.entries.Purge()
+	}
+}
+
+// Set caches value under key for ttl.
+func (c *Cache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	if c == nil || ttl <= 0 {
+		return
+	}
+
+	c.entries.Add(key, entry{value: value, expires: time.Now().Add(ttl)})
+	if c.redis != nil {
+		if err := c.redis.Set(ctx, redisPrefix+key, value, ttl).Err(); err != nil {
+			log.Printf("Query cache Redis write failed: %v", err)
+		}
+	}
+}
+
+// Purge removes every cached result, from Redis too, and returns how many
+// results were kept in memory and in Redis. Other instances sharing Redis
+// drop their results in memory within 10 seconds.
+func (c *Cache) Purge(ctx context.Context) (int, int, error) {
+	if c == nil {
+		return 0, 0, nil
+	}
+
+	memory := c.entries.Len()
+	c.entries.Purge()
+	if c.redis == nil {
+		return memory, 0, nil
+	}
+
+	deleted := 0
+	iter := c.redis.Scan(ctx, 0, redisPrefix+"*", 500).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == 500 {
+			n, err := c.redis.Unlink(ctx, keys...).Result()
+			if err != nil {
+				return memory, deleted, err
+			}
+			deleted += int(n)
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return memory, deleted, err
+	}
+	if len(keys) > 0 {
+		n, err := c.redis.Unlink(ctx, keys...).Result()
+		if err != nil {
+			return memory, deleted, err
+		}
+		deleted += int(n)
+	}
+
+	generation, err := c.redis.Incr(ctx, generationKey).Result()
+	if err != nil {
+		return memory, deleted, err
+	}
+	c.mu.Lock()
+	c.generation = generation
+	c.mu.Unlock()
+	return memory, deleted, nil
+}
+
+// Close closes the connections to Redis.
+func (c *Cache) Close() error {
+	if c == nil || c.redis == nil {
+		return nil
+	}
+	return c.redis.Close()
+}
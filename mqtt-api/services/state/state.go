@@ -0,0 +1,423 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"home_automation_dashboard/shared/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// pollInterval is how often new events are fetched when change streams are
+// unavailable, as on a standalone server.
+const pollInterval = 5 * time.Second
+
+// pollOverlap is how far before the latest _id seen each poll looks again.
+// Ids are generated by the writers, so a reading of another writer, or of a
+// batch that took a while to insert, may be stored after readings with later
+// ids. Readings stored later than that are only found by a change stream.
+const pollOverlap = 30 * time.Second
+
+// warmTimeout bounds loading the latest readings at startup.
+const warmTimeout = 2 * time.Minute
+
+// retryDelay is the wait before reopening a change stream that failed.
+const retryDelay = 5 * time.Second
+
+// Entry is the latest reading of a topic.
+type Entry struct {
+	Topic      string      `bson:"topic"`
+	Device     string      `bson:"device"`
+	Room       string      `bson:"room"`
+	SensorType string      `bson:"sensor_type"`
+	Value      interface{} `bson:"value"`
+	Timestamp  time.Time   `bson:"timestamp"`
+	Unit       string      `bson:"-"`
+}
+
+// UnitRule assigns a unit to the topics matching an MQTT topic filter.
+type UnitRule struct {
+	Pattern string
+	Unit    string
+}
+
+// ParseUnits parses unit rules of the form
+// "home/kitchen_temperature/state=°F;home/+/power=W". The first matching
+// rule applies.
+func ParseUnits(spec string) ([]UnitRule, error) {
+	var rules []UnitRule
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		pattern, unit, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(pattern) == "" {
+			return nil, fmt.Errorf("unit rule %q: expected <pattern>=<unit>", entry)
+		}
+		rules = append(rules, UnitRule{Pattern: strings.TrimSpace(pattern), Unit: strings.TrimSpace(unit)})
+	}
+	return rules, nil
+}
+
+// Cache holds the latest reading of every topic in memory. It is warmed from
+// the events collection and then follows new inserts.
+type Cache struct {
+	events *mongo.Collection
+	units  []UnitRule
+
+	mu      sync.RWMutex
+	entries map[string]Entry
+
+	subscribersMu sync.Mutex
+	subscribers   map[chan db.Event]struct{}
+}
+
+// New creates an empty Cache over the events collection.
+func New(events *mongo.Collection, units []UnitRule) *Cache {
+	return &Cache{
+		events:  events,
+		units:   units,
+		entries: make(map[string]Entry),
+
+		subscribers: make(map[chan db.Event]struct{}),
+	}
+}
+
+// warm loads the latest reading of every topic from the database.
+func (c *Cache) warm(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, warmTimeout)
+	defer cancel()
+
+	// Sorting both keys descending walks the {topic, timestamp, _id} index
+	// backwards, so each group's first document is its latest reading
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "topic", Value: -1}, {Key: "timestamp", Value: -1}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$topic"},
+			{Key: "doc", Value: bson.D{{Key: "$first", Value: "$$ROOT"}}},
+		}}},
+		bson.D{{Key: "$replaceRoot", Value: bson.D{{Key: "newRoot", Value: "$doc"}}}},
+	}
+
+	cursor, err := c.events.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return fmt.Errorf("warm state cache: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var e db.Event
+		if err := cursor.Decode(&e); err != nil {
+			return fmt.Errorf("warm state cache: %w", err)
+		}
+		c.apply(e)
+	}
+	return cursor.Err()
+}
+
+// Start warms the cache and then follows inserts into the events collection
+// in the background until ctx is done. It uses a change stream, opened before
+// warming so no insert is missed, and falls back to polling when change
+// streams are not supported.
+func (c *Cache) Start(ctx context.Context) error {
+	stream, err := c.watch(ctx, nil)
+	if err != nil {
+		log.Printf("State cache: change stream unavailable, polling every %s: %v", pollInterval, err)
+
+		lastID, err := c.latestID(ctx)
+		if err != nil {
+			return err
+		}
+		p := &poller{latest: lastID, seen: make(map[primitive.ObjectID]struct{})}
+		// The readings of the overlap are already known, not new
+		if err := c.fetchSince(ctx, p, false); err != nil {
+			return err
+		}
+		if err := c.warm(ctx); err != nil {
+			return err
+		}
+		go c.poll(ctx, p)
+		return nil
+	}
+
+	if err := c.warm(ctx); err != nil {
+		stream.Close(context.Background())
+		return err
+	}
+	go c.follow(ctx, stream)
+	return nil
+}
+
+// follow applies the inserts of stream, reopening it after errors.
+func (c *Cache) follow(ctx context.Context, stream *mongo.ChangeStream) {
+	for {
+		for stream.Next(ctx) {
+			var change struct {
+				FullDocument db.Event `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&change); err != nil {
+				log.Printf("State cache: failed to decode change: %v", err)
+				continue
+			}
+			c.apply(change.FullDocument)
+			c.publish(change.FullDocument)
+		}
+
+		token := stream.ResumeToken()
+		err := stream.Err()
+		stream.Close(context.Background())
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("State cache: change stream closed, resuming: %v", err)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryDelay):
+			}
+
+			stream, err = c.watch(ctx, token)
+			if err != nil && token != nil && historyLost(err) {
+				// The inserts since the token are gone from the oplog, the
+				// latest readings are loaded again instead
+				log.Printf("State cache: cannot resume change stream, reloading the state: %v", err)
+				token = nil
+				stream, err = c.rewatch(ctx)
+			}
+			if err == nil {
+				break
+			}
+			log.Printf("State cache: failed to reopen change stream: %v", err)
+		}
+	}
+}
+
+// rewatch opens a change stream from now on and warms the cache again, for
+// the inserts it would have followed.
+func (c *Cache) rewatch(ctx context.Context) (*mongo.ChangeStream, error) {
+	stream, err := c.watch(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.warm(ctx); err != nil {
+		stream.Close(context.Background())
+		return nil, err
+	}
+	return stream, nil
+}
+
+// historyLost reports whether err means a change stream cannot be resumed
+// from its token, as when the oplog no longer reaches back to it.
+func historyLost(err error) bool {
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+	// ChangeStreamHistoryLost, ChangeStreamFatalError and InvalidResumeToken
+	return serverErr.HasErrorCode(286) || serverErr.HasErrorCode(280) || serverErr.HasErrorCode(260) ||
+		serverErr.HasErrorLabel("NonResumableChangeStreamError")
+}
+
+// watch opens a change stream of inserted events, resuming after token when
+// it is not nil.
+func (c *Cache) watch(ctx context.Context, token bson.Raw) (*mongo.ChangeStream, error) {
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "operationType", Value: "insert"}}}},
+	}
+	opts := options.ChangeStream()
+	if token != nil {
+		opts.SetResumeAfter(token)
+	}
+	return c.events.Watch(ctx, pipeline, opts)
+}
+
+// latestID returns the _id of the most recently inserted event.
+func (c *Cache) latestID(ctx context.Context) (primitive.ObjectID, error) {
+	var latest db.Event
+	err := c.events.FindOne(ctx, bson.D{}, options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}})).Decode(&latest)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return primitive.NilObjectID, fmt.Errorf("find latest event: %w", err)
+	}
+	return latest.ID, nil
+}
+
+// poller tracks the events found by polling: the latest _id and the ids
+// within pollOverlap of it, which are skipped when found again.
+type poller struct {
+	latest primitive.ObjectID
+	seen   map[primitive.ObjectID]struct{}
+}
+
+// poll applies the events inserted since the last poll every pollInterval
+// until ctx is done.
+func (c *Cache) poll(ctx context.Context, p *poller) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.fetchSince(ctx, p, true); err != nil {
+			log.Printf("State cache: failed to poll events: %v", err)
+		}
+	}
+}
+
+// fetchSince applies the events from pollOverlap before the latest _id seen
+// that were not seen yet, publishing them to subscribers when publish is set.
+func (c *Cache) fetchSince(ctx context.Context, p *poller, publish bool) error {
+	ctx, cancel := context.WithTimeout(ctx, pollInterval)
+	defer cancel()
+
+	from := primitive.NilObjectID
+	if !p.latest.IsZero() {
+		from = primitive.NewObjectIDFromTimestamp(p.latest.Timestamp().Add(-pollOverlap))
+	}
+	cursor, err := c.events.Find(ctx,
+		bson.D{{Key: "_id", Value: bson.D{{Key: "$gte", Value: from}}}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var e db.Event
+		if err := cursor.Decode(&e); err != nil {
+			return err
+		}
+		if _, ok := p.seen[e.ID]; ok {
+			continue
+		}
+		p.seen[e.ID] = struct{}{}
+		if bytes.Compare(e.ID[:], p.latest[:]) > 0 {
+			p.latest = e.ID
+		}
+		c.apply(e)
+		if publish {
+			c.publish(e)
+		}
+	}
+
+	cutoff := p.latest.Timestamp().Add(-pollOverlap)
+	for id := range p.seen {
+		if id.Timestamp().Before(cutoff) {
+			delete(p.seen, id)
+		}
+	}
+	return cursor.Err()
+}
+
+// apply records e unless the cache already holds a later reading of its
+// topic, as when older history is imported.
+func (c *Cache) apply(e db.Event) {
+	if e.Topic == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if current, ok := c.entries[e.Topic]; ok && current.Timestamp.After(e.Timestamp) {
+		return
+	}
+	c.entries[e.Topic] = Entry{
+		Topic:      e.Topic,
+		Device:     e.Device,
+		Room:       e.Room(),
+		SensorType: e.SensorType(),
+		Value:      e.Value,
+		Timestamp:  e.Timestamp,
+		Unit:       c.Unit(e.Topic),
+	}
+}
+
+// Unit returns the unit assigned to topic by the unit rules, if any.
+func (c *Cache) Unit(topic string) string {
+	for _, rule := range c.units {
+		if db.TopicMatches(rule.Pattern, topic) {
+			return rule.Unit
+		}
+	}
+	return ""
+}
+
+// Get returns the latest reading of topic.
+func (c *Cache) Get(topic string) (Entry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.entries[topic]
+	return entry, ok
+}
+
+// Match returns the latest reading of every topic matching the MQTT topic
+// filter pattern, ordered by topic. An empty pattern matches all topics.
+func (c *Cache) Match(pattern string) []Entry {
+	c.mu.RLock()
+	entries := make([]Entry, 0, len(c.entries))
+	for topic, entry := range c.entries {
+		if pattern == "" || db.TopicMatches(pattern, topic) {
+			entries = append(entries, entry)
+		}
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Topic < entries[j].Topic
+	})
+	return entries
+}
+
+// Subscribe returns a channel receiving every reading inserted from now on,
+// and a function ending the subscription. A subscriber that falls more than
+// buffer readings behind is dropped and its channel closed.
+func (c *Cache) Subscribe(buffer int) (<-chan db.Event, func()) {
+	ch := make(chan db.Event, buffer)
+
+	c.subscribersMu.Lock()
+	c.subscribers[ch] = struct{}{}
+	c.subscribersMu.Unlock()
+
+	return ch, func() {
+		c.subscribersMu.Lock()
+		defer c.subscribersMu.Unlock()
+		if _, ok := c.subscribers[ch]; ok {
+			delete(c.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (c *Cache) publish(e db.Event) {
+	c.subscribersMu.Lock()
+	defer c.subscribersMu.Unlock()
+
+	for ch := range c.subscribers {
+		select {
+		case ch <- e:
+		default:
+			delete(c.subscribers, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestHistoryLost(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"history lost", mongo.CommandError{Code: 286, Name: "ChangeStreamHistoryLost"}, true},
+		{"wrapped", fmt.Errorf("watch: %w", mongo.CommandError{Code: 286}), true},
+		{"invalid resume token", mongo.CommandError{Code: 260}, true},
+		{"non resumable label", mongo.CommandError{Code: 1, Labels: []string{"NonResumableChangeStreamError"}}, true},
+		{"other server error", mongo.CommandError{Code: 13, Name: "Unauthorized"}, false},
+		{"network error", errors.New("connection reset by peer"), false},
+	}
+
+	for _, tt := range tests {
+		if got := historyLost(tt.err); got != tt.want {
+			t.Errorf("%s: historyLost() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"log"
 	"os"
 
 	"home_automation_dashboard/mqtt-ingestor/service/mqtt"
@@ -9,8 +11,10 @@ import (
 
 func main() {
 	// MongoDB configuration
-	mongoURI := os.Getenv("MONGO_URI")
-	databaseName := os.Getenv("MONGO_DB")
+	mongoConfig, err := db.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid MongoDB configuration: %v", err)
+	}
 	collectionName := os.Getenv("MONGO_COLLECTION")
 
 	// MQTT configuration
@@ -21,11 +25,18 @@ func main() {
 	topics := []string{"home/#"}
 
 	// Connect to MongoDB
-	mongoDB := db.ConnectMongoDB(mongoURI, databaseName)
-	defer mongoDB.Disconnect()
+	mongoDB, err := db.ConnectMongoDB(context.Background(), mongoConfig)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := mongoDB.Disconnect(context.Background()); err != nil {
+			log.Printf("%v", err)
+		}
+	}()
 
 	// Initialize MQTT message handler with MongoDB integration
-	messageHandler := mqtt.MessageHandler(mongoDB.Client, databaseName, collectionName)
+	messageHandler := mqtt.MessageHandler(mongoDB, collectionName)
 
 	// Connect to MQTT broker
 	mqttClient := mqtt.ConnectClient(mqttBroker, clientID, mqttUsername, mqttPassword, messageHandler)
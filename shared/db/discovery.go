@@ -0,0 +1,169 @@
+package db
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxDistinctStrings bounds the distinct string values returned per entry,
+// enough to tell enums from free text.
+const maxDistinctStrings = 20
+
+// Discovered summarises the readings sharing one value of a field such as
+// topic, device or tags.room.
+type Discovered struct {
+	Name      string    `bson:"_id"`
+	FirstSeen time.Time `bson:"first_seen"`
+	LastSeen  time.Time `bson:"last_seen"`
+	Count     int64     `bson:"count"`
+	Topics    int64     `bson:"topics"`
+	// ValueTypes are the BSON types of the values, e.g. "double" or "string"
+	ValueTypes []string `bson:"value_types"`
+	// Strings holds up to maxDistinctStrings of the distinct string values,
+	// StringCount how many there are in total
+	Strings     []string `bson:"strings"`
+	StringCount int64    `bson:"string_count"`
+	// Avg is the average of the numeric values, nil without any
+	Avg *float64 `bson:"avg"`
+}
+
+// Discover summarises the readings per distinct value of field, in order of
+// that value. Only values starting with prefix and sorting after after are
+// included, at most limit of them, summarising only the allowed readings.
+func Discover(ctx context.Context, collection *mongo.Collection, field, prefix, after string, allowed Allowlist, limit int) ([]Discovered, error) {
+	nameCondition := bson.D{{Key: "$type", Value: "string"}}
+	if prefix != "" {
+		nameCondition = append(nameCondition, bson.E{Key: "$regex", Value: "^" + regexp.QuoteMeta(prefix)})
+	}
+	if after != "" {
+		nameCondition = append(nameCondition, bson.E{Key: "$gt", Value: after})
+	}
+
+	match := bson.D{{Key: field, Value: nameCondition}}
+	if !allowed.IsEmpty() {
+		match = bson.D{{Key: "$and", Value: bson.A{match, allowed.Filter()}}}
+	}
+
+	// The page of values is chosen first, so only its readings are summarised
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$" + field}}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$limit", Value: limit}},
+	}
+	var page []struct {
+		Name string `bson:"_id"`
+	}
+	if err := aggregate(ctx, collection, pipeline, &page); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(page))
+	for i, value := range page {
+		names[i] = value.Name
+	}
+	return DiscoverNames(ctx, collection, field, names, allowed)
+}
+
+// DiscoverNames summarises the readings of the given values of field, such
+// as a page of devices, in order of those values. Only the allowed readings
+// are summarised.
+func DiscoverNames(ctx context.Context, collection *mongo.Collection, field string, names []string, allowed Allowlist) ([]Discovered, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	match := bson.D{{Key: field, Value: bson.D{{Key: "$in", Value: names}}}}
+	if !allowed.IsEmpty() {
+		match = bson.D{{Key: "$and", Value: bson.A{match, allowed.Filter()}}}
+	}
+
+	// Readings are grouped per topic first, so that no accumulator grows
+	// with the number of readings
+	isNumber := bson.D{{Key: "$isNumber", Value: "$value"}}
+	summaries := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "name", Value: "$" + field}, {Key: "topic", Value: "$topic"}}},
+			{Key: "first_seen", Value: bson.D{{Key: "$min", Value: "$timestamp"}}},
+			{Key: "last_seen", Value: bson.D{{Key: "$max", Value: "$timestamp"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "value_types", Value: bson.D{{Key: "$addToSet", Value: bson.D{{Key: "$type", Value: "$value"}}}}},
+			// $sum ignores non-numeric values
+			{Key: "sum", Value: bson.D{{Key: "$sum", Value: "$value"}}},
+			{Key: "numbers", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{isNumber, 1, 0}}}}}},
+		}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$_id.name"},
+			{Key: "first_seen", Value: bson.D{{Key: "$min", Value: "$first_seen"}}},
+			{Key: "last_seen", Value: bson.D{{Key: "$max", Value: "$last_seen"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: "$count"}}},
+			{Key: "topics", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "value_types", Value: bson.D{{Key: "$push", Value: "$value_types"}}},
+			{Key: "sum", Value: bson.D{{Key: "$sum", Value: "$sum"}}},
+			{Key: "numbers", Value: bson.D{{Key: "$sum", Value: "$numbers"}}},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "first_seen", Value: 1},
+			{Key: "last_seen", Value: 1},
+			{Key: "count", Value: 1},
+			{Key: "topics", Value: 1},
+			{Key: "value_types", Value: bson.D{{Key: "$reduce", Value: bson.D{
+				{Key: "input", Value: "$value_types"},
+				{Key: "initialValue", Value: bson.A{}},
+				{Key: "in", Value: bson.D{{Key: "$setUnion", Value: bson.A{"$$value", "$$this"}}}},
+			}}}},
+			{Key: "avg", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$gt", Value: bson.A{"$numbers", 0}}},
+				bson.D{{Key: "$divide", Value: bson.A{"$sum", "$numbers"}}},
+				nil,
+			}}}},
+		}}},
+	}
+	var results []Discovered
+	if err := aggregate(ctx, collection, summaries, &results); err != nil {
+		return nil, err
+	}
+
+	// Distinct strings are grouped once each and only the first ones kept
+	stringValues := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "$and", Value: bson.A{match, bson.D{{Key: "value", Value: bson.D{{Key: "$type", Value: "string"}}}}}}}}},
+		bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: bson.D{{Key: "name", Value: "$" + field}, {Key: "value", Value: "$value"}}}}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id.name", Value: 1}, {Key: "_id.value", Value: 1}}}},
+		// $firstN requires MongoDB 5.2
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$_id.name"},
+			{Key: "strings", Value: bson.D{{Key: "$firstN", Value: bson.D{{Key: "input", Value: "$_id.value"}, {Key: "n", Value: maxDistinctStrings}}}}},
+			{Key: "string_count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	}
+	var distinct []Discovered
+	if err := aggregate(ctx, collection, stringValues, &distinct); err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]Discovered, len(distinct))
+	for _, d := range distinct {
+		byName[d.Name] = d
+	}
+	for i := range results {
+		results[i].Strings = byName[results[i].Name].Strings
+		results[i].StringCount = byName[results[i].Name].StringCount
+	}
+	return results, nil
+}
+
+// aggregate runs pipeline on collection and decodes every result into results
+func aggregate(ctx context.Context, collection *mongo.Collection, pipeline mongo.Pipeline, results interface{}) error {
+	cursor, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	return cursor.All(ctx, results)
+}
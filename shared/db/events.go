@@ -0,0 +1,152 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Event is a stored reading with its id.
+type Event struct {
+	ID        primitive.ObjectID     `bson:"_id"`
+	Topic     string                 `bson:"topic"`
+	Device    string                 `bson:"device"`
+	Value     interface{}            `bson:"value"`
+	Timestamp time.Time              `bson:"timestamp"`
+	Tags      map[string]interface{} `bson:"tags"`
+}
+
+// Room returns the room tag of the reading.
+func (e Event) Room() string {
+	room, _ := e.Tags["room"].(string)
+	return room
+}
+
+// SensorType returns the sensor type tag of the reading.
+func (e Event) SensorType() string {
+	sensorType, _ := e.Tags["sensor_type"].(string)
+	return sensorType
+}
+
+// EventCursor is a position in the (timestamp, _id) order of stored readings.
+// Readings sharing a timestamp are ordered by _id, so positions are stable
+// while new readings arrive.
+type EventCursor struct {
+	Timestamp time.Time
+	ID        primitive.ObjectID
+}
+
+// String encodes the cursor as an opaque token.
+func (c EventCursor) String() string {
+	raw := strconv.FormatInt(c.Timestamp.UnixNano(), 10) + ":" + c.ID.Hex()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseEventCursor decodes a token returned by EventCursor.String.
+func ParseEventCursor(token string) (EventCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return EventCursor{}, fmt.Errorf("invalid cursor")
+	}
+	nanos, hex, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return EventCursor{}, fmt.Errorf("invalid cursor")
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return EventCursor{}, fmt.Errorf("invalid cursor")
+	}
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return EventCursor{}, fmt.Errorf("invalid cursor")
+	}
+	return EventCursor{Timestamp: time.Unix(0, n).UTC(), ID: id}, nil
+}
+
+// FindEvents returns up to limit readings of the collection matching filter,
+// in (timestamp, _id) order, descending when descending is set. Reading
+// continues after the after cursor when it is not nil. The returned cursor
+// points at the last reading when more follow, and is nil otherwise.
+func (db *MongoDB) FindEvents(ctx context.Context, collectionName string, filter bson.D, after *EventCursor, descending bool, limit int) ([]Event, *EventCursor, error) {
+	direction, compare := 1, "$gt"
+	if descending {
+		direction, compare = -1, "$lt"
+	}
+
+	conditions := bson.A{filter}
+	if after != nil {
+		conditions = append(conditions, bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "timestamp", Value: bson.D{{Key: compare, Value: after.Timestamp}}}},
+			bson.D{
+				{Key: "timestamp", Value: after.Timestamp},
+				{Key: "_id", Value: bson.D{{Key: compare, Value: after.ID}}},
+			},
+		}}})
+	}
+
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	// One more than requested tells whether another page follows
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(int64(limit) + 1)
+	cursor, err := db.Database.Collection(collectionName).Find(ctx, bson.D{{Key: "$and", Value: conditions}}, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cursor.Close(ctx)
+
+	events := make([]Event, 0, limit)
+	for cursor.Next(ctx) {
+		var event Event
+		if err := cursor.Decode(&event); err != nil {
+			return nil, nil, err
+		}
+		events = append(events, event)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(events) <= limit {
+		return events, nil, nil
+	}
+	events = events[:limit]
+	last := events[limit-1]
+	return events, &EventCursor{Timestamp: last.Timestamp, ID: last.ID}, nil
+}
+
+// FindEventsAfterID returns up to limit readings of the collection matching
+// filter with ids after afterID, in id order. Ids are generated by each
+// writer, so readings of several writers are not stored in id order: callers
+// resuming a stream of new readings start some time before the last id seen.
+func (db *MongoDB) FindEventsAfterID(ctx context.Context, collectionName string, filter bson.D, afterID primitive.ObjectID, limit int) ([]Event, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	conditions := bson.A{filter, bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: afterID}}}}}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := db.Database.Collection(collectionName).Find(ctx, bson.D{{Key: "$and", Value: conditions}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var events []Event
+	for cursor.Next(ctx) {
+		var event Event
+		if err := cursor.Decode(&event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, cursor.Err()
+}
@@ -4,45 +4,191 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
+	"strconv"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 // MongoDB wraps the client and database for convenience
 type MongoDB struct {
 	Client   *mongo.Client
 	Database *mongo.Database
+
+	config Config
+}
+
+// Config holds the connection settings for ConnectMongoDB.
+type Config struct {
+	URI      string
+	Database string
+
+	MaxPoolSize            uint64
+	MinPoolSize            uint64
+	ConnectTimeout         time.Duration
+	ServerSelectionTimeout time.Duration
+	ReadPreference         string // primary, primaryPreferred, secondary, secondaryPreferred or nearest
+
+	// OperationTimeout bounds operations whose context has no deadline.
+	OperationTimeout time.Duration
+
+	// ConnectRetries is how often the initial connection is retried, waiting
+	// RetryBackoff before the first retry and twice as long before each
+	// further one, up to MaxRetryBackoff.
+	ConnectRetries  int
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+}
+
+// DefaultConfig returns the default settings for connecting to uri.
+func DefaultConfig(uri, database string) Config {
+	return Config{
+		URI:                    uri,
+		Database:               database,
+		MaxPoolSize:            100,
+		ConnectTimeout:         10 * time.Second,
+		ServerSelectionTimeout: 10 * time.Second,
+		ReadPreference:         "primary",
+		OperationTimeout:       10 * time.Second,
+		ConnectRetries:         10,
+		RetryBackoff:           time.Second,
+		MaxRetryBackoff:        30 * time.Second,
+	}
+}
+
+// ConfigFromEnv builds a Config from MONGO_URI and MONGO_DB, overriding the
+// defaults with the optional MONGO_MAX_POOL_SIZE, MONGO_MIN_POOL_SIZE,
+// MONGO_CONNECT_TIMEOUT, MONGO_SERVER_SELECTION_TIMEOUT, MONGO_OPERATION_TIMEOUT,
+// MONGO_READ_PREFERENCE, MONGO_CONNECT_RETRIES, MONGO_RETRY_BACKOFF and
+// MONGO_MAX_RETRY_BACKOFF.
+func ConfigFromEnv() (Config, error) {
+	cfg := DefaultConfig(os.Getenv("MONGO_URI"), os.Getenv("MONGO_DB"))
+
+	uints := map[string]*uint64{
+		"MONGO_MAX_POOL_SIZE": &cfg.MaxPoolSize,
+		"MONGO_MIN_POOL_SIZE": &cfg.MinPoolSize,
+	}
+	for name, target := range uints {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*target = n
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"MONGO_CONNECT_TIMEOUT":          &cfg.ConnectTimeout,
+		"MONGO_SERVER_SELECTION_TIMEOUT": &cfg.ServerSelectionTimeout,
+		"MONGO_OPERATION_TIMEOUT":        &cfg.OperationTimeout,
+		"MONGO_RETRY_BACKOFF":            &cfg.RetryBackoff,
+		"MONGO_MAX_RETRY_BACKOFF":        &cfg.MaxRetryBackoff,
+	}
+	for name, target := range durations {
+		if value := os.Getenv(name); value != "" {
+			d, err := ParseDuration(value)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*target = d
+		}
+	}
+
+	if value := os.Getenv("MONGO_CONNECT_RETRIES"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid MONGO_CONNECT_RETRIES: %w", err)
+		}
+		cfg.ConnectRetries = n
+	}
+	if value := os.Getenv("MONGO_READ_PREFERENCE"); value != "" {
+		cfg.ReadPreference = value
+	}
+	return cfg, nil
 }
 
 // ConnectMongoDB connects to the MongoDB instance and returns a MongoDB struct.
-func ConnectMongoDB(uri, dbName string) *MongoDB {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// The server is pinged until it answers, retrying with exponential backoff.
+func ConnectMongoDB(ctx context.Context, cfg Config) (*MongoDB, error) {
+	mode, err := readpref.ModeFromString(cfg.ReadPreference)
+	if err != nil {
+		return nil, err
+	}
+	readPref, err := readpref.New(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	clientOptions := options.Client().
+		ApplyURI(cfg.URI).
+		SetMaxPoolSize(cfg.MaxPoolSize).
+		SetMinPoolSize(cfg.MinPoolSize).
+		SetConnectTimeout(cfg.ConnectTimeout).
+		SetServerSelectionTimeout(cfg.ServerSelectionTimeout).
+		SetReadPreference(readPref).
+		// JSON payloads are stored as documents; decoding them into maps
+		// rather than ordered key/value slices lets them be re-encoded as JSON
+		SetBSONOptions(&options.BSONOptions{DefaultDocumentM: true})
 
-	clientOptions := options.Client().ApplyURI(uri)
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %v", err)
+		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
 	}
 
 	// Verify connection
-	if err := client.Ping(ctx, nil); err != nil {
-		log.Fatalf("Failed to ping MongoDB: %v", err)
+	backoff := cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
+		err = client.Ping(pingCtx, nil)
+		cancel()
+		if err == nil {
+			break
+		}
+		if attempt >= cfg.ConnectRetries {
+			client.Disconnect(context.Background())
+			return nil, fmt.Errorf("failed to ping MongoDB after %d attempts: %w", attempt+1, err)
+		}
+
+		log.Printf("Failed to ping MongoDB, retrying in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			client.Disconnect(context.Background())
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if cfg.MaxRetryBackoff > 0 && backoff > cfg.MaxRetryBackoff {
+			backoff = cfg.MaxRetryBackoff
+		}
 	}
 
-	fmt.Println("Connected to MongoDB!")
+	log.Printf("Connected to MongoDB")
 	return &MongoDB{
 		Client:   client,
-		Database: client.Database(dbName),
-	}
+		Database: client.Database(cfg.Database),
+		config:   cfg,
+	}, nil
 }
 
 // Disconnect closes the MongoDB connection.
-func (db *MongoDB) Disconnect() {
-	if err := db.Client.Disconnect(context.Background()); err != nil {
-		log.Fatalf("Failed to disconnect MongoDB: %v", err)
+func (db *MongoDB) Disconnect(ctx context.Context) error {
+	if err := db.Client.Disconnect(ctx); err != nil {
+		return fmt.Errorf("failed to disconnect MongoDB: %w", err)
+	}
+	log.Printf("Disconnected from MongoDB")
+	return nil
+}
+
+// WithTimeout bounds ctx by the configured operation timeout unless it
+// already carries a deadline.
+func (db *MongoDB) WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || db.config.OperationTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-	fmt.Println("Disconnected from MongoDB.")
+	return context.WithTimeout(ctx, db.config.OperationTimeout)
 }
@@ -7,11 +7,12 @@ import (
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // InsertDocument inserts a document into a specified collection.
-func (db *MongoDB) InsertDocument(collectionName string, document interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (db *MongoDB) InsertDocument(ctx context.Context, collectionName string, document interface{}) error {
+	ctx, cancel := db.WithTimeout(ctx)
 	defer cancel()
 
 	collection := db.Database.Collection(collectionName)
@@ -20,12 +21,14 @@ func (db *MongoDB) InsertDocument(collectionName string, document interface{}) e
 }
 
 // FindDocuments queries documents from a specified collection using a filter.
-func (db *MongoDB) FindDocuments(collectionName string, filter interface{}) ([]bson.M, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// All matches are loaded into memory, so callers should bound large results
+// with a limit in opts.
+func (db *MongoDB) FindDocuments(ctx context.Context, collectionName string, filter interface{}, opts ...*options.FindOptions) ([]bson.M, error) {
+	ctx, cancel := db.WithTimeout(ctx)
 	defer cancel()
 
 	collection := db.Database.Collection(collectionName)
-	cursor, err := collection.Find(ctx, filter)
+	cursor, err := collection.Find(ctx, filter, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -40,12 +43,12 @@ func (db *MongoDB) FindDocuments(collectionName string, filter interface{}) ([]b
 		results = append(results, doc)
 	}
 
-	return results, nil
+	return results, cursor.Err()
 }
 
 // UpdateDocument updates a document in a specified collection.
-func (db *MongoDB) UpdateDocument(collectionName string, filter, update interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (db *MongoDB) UpdateDocument(ctx context.Context, collectionName string, filter, update interface{}) error {
+	ctx, cancel := db.WithTimeout(ctx)
 	defer cancel()
 
 	collection := db.Database.Collection(collectionName)
@@ -54,8 +57,8 @@ func (db *MongoDB) UpdateDocument(collectionName string, filter, update interfac
 }
 
 // DeleteDocument deletes a document from a specified collection.
-func (db *MongoDB) DeleteDocument(collectionName string, filter interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (db *MongoDB) DeleteDocument(ctx context.Context, collectionName string, filter interface{}) error {
+	ctx, cancel := db.WithTimeout(ctx)
 	defer cancel()
 
 	collection := db.Database.Collection(collectionName)
@@ -94,7 +97,7 @@ func FetchAverageTemperature(ctx context.Context, client *mongo.Client, dbName,
 	return 0, nil
 }
 
-func GetMaxMinTemperature(collection *mongo.Collection, topic string, startTime, endTime time.Time) (max float64, min float64, err error) {
+func GetMaxMinTemperature(ctx context.Context, collection *mongo.Collection, topic string, startTime, endTime time.Time) (max float64, min float64, err error) {
 	pipeline := mongo.Pipeline{
 		bson.D{{Key: "$match", Value: bson.D{
 			{Key: "topic", Value: topic},
@@ -110,13 +113,13 @@ func GetMaxMinTemperature(collection *mongo.Collection, topic string, startTime,
 		}}},
 	}
 
-	cursor, err := collection.Aggregate(context.TODO(), pipeline)
+	cursor, err := collection.Aggregate(ctx, pipeline)
 	if err != nil {
 		return 0, 0, err
 	}
-	defer cursor.Close(context.TODO())
+	defer cursor.Close(ctx)
 
-	if cursor.Next(context.TODO()) {
+	if cursor.Next(ctx) {
 		var result struct {
 			MaxTemperature float64 `bson:"maxTemperature"`
 			MinTemperature float64 `bson:"minTemperature"`
@@ -130,7 +133,7 @@ func GetMaxMinTemperature(collection *mongo.Collection, topic string, startTime,
 }
 
 // CountOnOffEvents calculates the number of ON/OFF events for a switch topic.
-func CountOnOffEvents(collection *mongo.Collection, topic string, startTime, endTime time.Time) (onCount, offCount int64, err error) {
+func CountOnOffEvents(ctx context.Context, collection *mongo.Collection, topic string, startTime, endTime time.Time) (onCount, offCount int64, err error) {
 	pipeline := mongo.Pipeline{
 		bson.D{{Key: "$match", Value: bson.D{
 			{Key: "topic", Value: topic},
@@ -138,20 +141,21 @@ func CountOnOffEvents(collection *mongo.Collection, topic string, startTime, end
 				{Key: "$gte", Value: startTime},
 				{Key: "$lt", Value: endTime},
 			}},
+			{Key: "value", Value: bson.D{{Key: "$in", Value: bson.A{"on", "off"}}}},
 		}}},
 		bson.D{{Key: "$group", Value: bson.D{
-			{Key: "_id", Value: "$payload"},
+			{Key: "_id", Value: "$value"},
 			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
 		}}},
 	}
 
-	cursor, err := collection.Aggregate(context.TODO(), pipeline)
+	cursor, err := collection.Aggregate(ctx, pipeline)
 	if err != nil {
 		return 0, 0, err
 	}
-	defer cursor.Close(context.TODO())
+	defer cursor.Close(ctx)
 
-	for cursor.Next(context.TODO()) {
+	for cursor.Next(ctx) {
 		var result struct {
 			ID    string `bson:"_id"`
 			Count int64  `bson:"count"`
@@ -165,5 +169,5 @@ func CountOnOffEvents(collection *mongo.Collection, topic string, startTime, end
 			offCount = result.Count
 		}
 	}
-	return onCount, offCount, nil
+	return onCount, offCount, cursor.Err()
 }
@@ -0,0 +1,714 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// retentionStateCollection stores how far each rollup tier has been built.
+const retentionStateCollection = "retention_state"
+
+// backfillQueueCollection holds the ranges of topics whose rollup buckets
+// have to be rebuilt, one document per topic.
+const backfillQueueCollection = "retention_backfill"
+
+// maxBucketsPerPass bounds a single rollup aggregation so that catching up on
+// a large backlog happens in manageable chunks.
+const maxBucketsPerPass = 1000
+
+// RollupTier is one downsampled tier of a retention policy.
+type RollupTier struct {
+	Resolution time.Duration // bucket width
+	TTL        time.Duration // how long buckets are kept, 0 keeps them forever
+}
+
+// RetentionPolicy describes how long readings for topics matching Pattern
+// are kept, and which rollup tiers are built from them.
+type RetentionPolicy struct {
+	Pattern string        // MQTT topic filter, e.g. "home/#"
+	RawTTL  time.Duration // how long raw readings are kept, 0 keeps them forever
+	Tiers   []RollupTier  // ordered finest resolution first
+}
+
+// ParseRetentionPolicies parses a policy list such as
+//
+//	home/#=raw:14d,5m:1y,1h:forever;home/+/motion=raw:30d
+//
+// Policies are separated by ";" and evaluated in order, the first policy whose
+// pattern matches a topic wins.
+func ParseRetentionPolicies(spec string) ([]RetentionPolicy, error) {
+	var policies []RetentionPolicy
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		pattern, tiers, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(pattern) == "" {
+			return nil, fmt.Errorf("retention policy %q: expected <pattern>=<tiers>", entry)
+		}
+
+		policy := RetentionPolicy{Pattern: strings.TrimSpace(pattern)}
+		for _, tier := range strings.Split(tiers, ",") {
+			name, keep, ok := strings.Cut(strings.TrimSpace(tier), ":")
+			if !ok {
+				return nil, fmt.Errorf("retention policy %q: expected <resolution>:<ttl> in %q", entry, tier)
+			}
+
+			ttl, err := parseRetentionTTL(keep)
+			if err != nil {
+				return nil, fmt.Errorf("retention policy %q: %w", entry, err)
+			}
+
+			if name == "raw" {
+				policy.RawTTL = ttl
+				continue
+			}
+
+			resolution, err := ParseDuration(name)
+			if err != nil || resolution <= 0 {
+				return nil, fmt.Errorf("retention policy %q: invalid resolution %q", entry, name)
+			}
+			if n := len(policy.Tiers); n > 0 {
+				finer := policy.Tiers[n-1].Resolution
+				if resolution <= finer || resolution%finer != 0 {
+					return nil, fmt.Errorf("retention policy %q: resolution %s must be a multiple of %s", entry, name, FormatDuration(finer))
+				}
+			}
+			policy.Tiers = append(policy.Tiers, RollupTier{Resolution: resolution, TTL: ttl})
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+func parseRetentionTTL(s string) (time.Duration, error) {
+	switch strings.TrimSpace(s) {
+	case "forever", "inf", "0":
+		return 0, nil
+	}
+	return ParseDuration(s)
+}
+
+// Source identifies the collection a query should read readings from.
+type Source struct {
+	Collection string
+	Resolution time.Duration // 0 for raw readings
+}
+
+// IsRollup reports whether the source holds downsampled buckets rather than
+// raw readings.
+func (s Source) IsRollup() bool {
+	return s.Resolution > 0
+}
+
+// Retention builds rollup tiers and expires readings according to a list of
+// retention policies.
+type Retention struct {
+	database      *mongo.Database
+	rawCollection string
+	policies      []RetentionPolicy
+
+	mu         sync.RWMutex
+	watermarks map[string]time.Time
+}
+
+// NewRetention creates a Retention for the raw readings in rawCollection. A
+// Retention without policies keeps everything and always selects raw data.
+func NewRetention(database *mongo.Database, rawCollection string, policies []RetentionPolicy) *Retention {
+	return &Retention{
+		database:      database,
+		rawCollection: rawCollection,
+		policies:      policies,
+		watermarks:    make(map[string]time.Time),
+	}
+}
+
+// Policies returns the configured retention policies.
+func (r *Retention) Policies() []RetentionPolicy {
+	return r.policies
+}
+
+// RollupCollection returns the name of the collection holding a tier's buckets.
+func (r *Retention) RollupCollection(tier RollupTier) string {
+	return fmt.Sprintf("%s_rollup_%s", r.rawCollection, FormatDuration(tier.Resolution))
+}
+
+// EnsureIndexes creates the TTL indexes that expire raw readings and rollup
+// buckets, and the unique index rollups are merged on.
+func (r *Retention) EnsureIndexes(ctx context.Context) error {
+	ttlIndex := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expire_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+
+	if _, err := r.database.Collection(r.rawCollection).Indexes().CreateOne(ctx, ttlIndex); err != nil {
+		return fmt.Errorf("create TTL index on %s: %w", r.rawCollection, err)
+	}
+
+	for _, collection := range r.RollupCollections() {
+		indexes := []mongo.IndexModel{
+			ttlIndex,
+			{
+				Keys:    bson.D{{Key: "topic", Value: 1}, {Key: "timestamp", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+		}
+		if _, err := r.database.Collection(collection).Indexes().CreateMany(ctx, indexes); err != nil {
+			return fmt.Errorf("create indexes on %s: %w", collection, err)
+		}
+	}
+	return nil
+}
+
+// RollupCollections returns the names of all rollup tier collections.
+func (r *Retention) RollupCollections() []string {
+	seen := make(map[string]bool)
+	var collections []string
+	for _, policy := range r.policies {
+		for _, tier := range policy.Tiers {
+			name := r.RollupCollection(tier)
+			if !seen[name] {
+				seen[name] = true
+				collections = append(collections, name)
+			}
+		}
+	}
+	sort.Strings(collections)
+	return collections
+}
+
+// LoadWatermarks reads the progress of every rollup tier from the database.
+func (r *Retention) LoadWatermarks(ctx context.Context) error {
+	cursor, err := r.database.Collection(retentionStateCollection).Find(ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for cursor.Next(ctx) {
+		var state struct {
+			ID        string    `bson:"_id"`
+			Watermark time.Time `bson:"watermark"`
+		}
+		if err := cursor.Decode(&state); err != nil {
+			return err
+		}
+		r.watermarks[state.ID] = state.Watermark
+	}
+	return cursor.Err()
+}
+
+// Run performs one retention pass: rollup tiers are brought up to date
+// incrementally and readings that have been rolled up are marked for expiry.
+func (r *Retention) Run(ctx context.Context) error {
+	now := time.Now()
+	for i, policy := range r.policies {
+		for j := range policy.Tiers {
+			if err := r.rollup(ctx, i, j, now); err != nil {
+				return fmt.Errorf("rollup %s for %s: %w", FormatDuration(policy.Tiers[j].Resolution), policy.Pattern, err)
+			}
+		}
+		if err := r.expireRaw(ctx, i, now); err != nil {
+			return fmt.Errorf("expire raw readings for %s: %w", policy.Pattern, err)
+		}
+	}
+	return r.RunQueuedBackfills(ctx)
+}
+
+// rollup builds the buckets of tier j of policy i that completed since the
+// last pass. The first tier is built from raw readings, every further tier
+// from the tier before it.
+func (r *Retention) rollup(ctx context.Context, i, j int, now time.Time) error {
+	policy := r.policies[i]
+	tier := policy.Tiers[j]
+	target := r.RollupCollection(tier)
+
+	source := r.rawCollection
+	to := truncateTime(now, tier.Resolution)
+	if j > 0 {
+		source = r.RollupCollection(policy.Tiers[j-1])
+		if upstream := truncateTime(r.watermark(policy.Pattern, source), tier.Resolution); upstream.Before(to) {
+			to = upstream
+		}
+	}
+
+	from := r.watermark(policy.Pattern, target)
+	if from.IsZero() {
+		earliest, err := r.earliestTimestamp(ctx, source, i)
+		if err != nil || earliest.IsZero() {
+			return err
+		}
+		from = truncateTime(earliest, tier.Resolution)
+	}
+
+	for from.Before(to) {
+		until := from.Add(maxBucketsPerPass * tier.Resolution)
+		if until.After(to) {
+			until = to
+		}
+
+		pipeline := r.rollupPipeline(i, tier, source == r.rawCollection, target, from, until, nil)
+		cursor, err := r.database.Collection(source).Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+		if err != nil {
+			return err
+		}
+		cursor.Close(ctx)
+
+		if err := r.setWatermark(ctx, policy.Pattern, target, until); err != nil {
+			return err
+		}
+		from = until
+	}
+	return nil
+}
+
+func (r *Retention) rollupPipeline(i int, tier RollupTier, fromRaw bool, target string, from, to time.Time, filter bson.D) mongo.Pipeline {
+	match := bson.A{
+		r.policyFilter(i),
+		bson.D{{Key: "timestamp", Value: bson.D{
+			{Key: "$gte", Value: from},
+			{Key: "$lt", Value: to},
+		}}},
+	}
+	if filter != nil {
+		match = append(match, filter)
+	}
+	if fromRaw {
+		match = append(match, bson.D{{Key: "value", Value: bson.D{{Key: "$type", Value: "number"}}}})
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "$and", Value: match}}}},
+	}
+	if fromRaw {
+		// Shape raw readings like single-sample buckets so that both raw and
+		// rollup sources share the grouping stage below.
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: bson.D{
+			{Key: "topic", Value: 1},
+			{Key: "device", Value: 1},
+			{Key: "tags", Value: 1},
+			{Key: "timestamp", Value: 1},
+			{Key: "count", Value: bson.D{{Key: "$literal", Value: 1}}},
+			{Key: "sum", Value: "$value"},
+			{Key: "min", Value: "$value"},
+			{Key: "max", Value: "$value"},
+			{Key: "first", Value: "$value"},
+			{Key: "last", Value: "$value"},
+		}}})
+	}
+
+	project := bson.D{
+		{Key: "_id", Value: 0},
+		{Key: "topic", Value: "$_id.topic"},
+		{Key: "timestamp", Value: "$_id.bucket"},
+		{Key: "device", Value: 1},
+		{Key: "tags", Value: bson.D{
+			{Key: "room", Value: "$tags.room"},
+			{Key: "sensor_type", Value: "$tags.sensor_type"},
+		}},
+		{Key: "resolution", Value: bson.D{{Key: "$literal", Value: int64(tier.Resolution / time.Second)}}},
+		{Key: "count", Value: 1},
+		{Key: "sum", Value: 1},
+		{Key: "min", Value: 1},
+		{Key: "max", Value: 1},
+		{Key: "first", Value: 1},
+		{Key: "last", Value: 1},
+		{Key: "avg", Value: bson.D{{Key: "$divide", Value: bson.A{"$sum", "$count"}}}},
+	}
+	if tier.TTL > 0 {
+		project = append(project, bson.E{Key: "expire_at", Value: bson.D{
+			{Key: "$add", Value: bson.A{"$_id.bucket", tier.TTL.Milliseconds()}},
+		}})
+	}
+
+	return append(pipeline,
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "timestamp", Value: 1}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "topic", Value: "$topic"},
+				{Key: "bucket", Value: BucketExpression("$timestamp", time.Unix(0, 0), tier.Resolution)},
+			}},
+			{Key: "device", Value: bson.D{{Key: "$last", Value: "$device"}}},
+			{Key: "tags", Value: bson.D{{Key: "$last", Value: "$tags"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: "$count"}}},
+			{Key: "sum", Value: bson.D{{Key: "$sum", Value: "$sum"}}},
+			{Key: "min", Value: bson.D{{Key: "$min", Value: "$min"}}},
+			{Key: "max", Value: bson.D{{Key: "$max", Value: "$max"}}},
+			{Key: "first", Value: bson.D{{Key: "$first", Value: "$first"}}},
+			{Key: "last", Value: bson.D{{Key: "$last", Value: "$last"}}},
+		}}},
+		bson.D{{Key: "$project", Value: project}},
+		bson.D{{Key: "$merge", Value: bson.D{
+			{Key: "into", Value: target},
+			{Key: "on", Value: bson.A{"topic", "timestamp"}},
+			{Key: "whenMatched", Value: "replace"},
+			{Key: "whenNotMatched", Value: "insert"},
+		}}},
+	)
+}
+
+// Backfill builds the rollup buckets of topic between from and to, for
+// readings that were stored after their buckets had already been built, such
+// as imported history. The range is widened to whole buckets. A bucket that
+// is still open is built from the readings so far and rebuilt by the rollup
+// pass once it completes. Buckets are rebuilt from scratch, so those whose
+// source readings have partly expired are left out, and logged, rather than
+// replaced with what is left of them.
+func (r *Retention) Backfill(ctx context.Context, topic string, from, to time.Time) error {
+	i := r.policyIndex(topic)
+	if i < 0 {
+		return nil
+	}
+	policy := r.policies[i]
+	filter := bson.D{{Key: "topic", Value: topic}}
+
+	now := time.Now()
+	source, sourceTTL := r.rawCollection, policy.RawTTL
+	for _, tier := range policy.Tiers {
+		target := r.RollupCollection(tier)
+		start := truncateTime(from, tier.Resolution)
+		end := ceilTime(to, tier.Resolution)
+		if sourceTTL > 0 {
+			if kept := ceilTime(now.Add(-sourceTTL), tier.Resolution); start.Before(kept) && start.Before(end) {
+				log.Printf("Backfill of the %s rollup of %s skips the buckets before %s, their readings have expired",
+					FormatDuration(tier.Resolution), topic, kept.Format(time.RFC3339))
+				start = kept
+			}
+		}
+
+		for start.Before(end) {
+			until := start.Add(maxBucketsPerPass * tier.Resolution)
+			if until.After(end) {
+				until = end
+			}
+
+			pipeline := r.rollupPipeline(i, tier, source == r.rawCollection, target, start, until, filter)
+			cursor, err := r.database.Collection(source).Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+			if err != nil {
+				return fmt.Errorf("backfill %s rollup of %s: %w", FormatDuration(tier.Resolution), topic, err)
+			}
+			cursor.Close(ctx)
+			start = until
+		}
+		source, sourceTTL = target, tier.TTL
+	}
+	return nil
+}
+
+// QueueBackfill records that the rollup buckets of topic between from and to
+// have to be rebuilt, merging the range with one already queued. Queued
+// ranges are backfilled by RunQueuedBackfills until that succeeds, so late
+// readings are rolled up before their raw readings expire even when the
+// first attempt fails.
+func (r *Retention) QueueBackfill(ctx context.Context, topic string, from, to time.Time) error {
+	_, err := r.database.Collection(backfillQueueCollection).UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: topic}},
+		bson.D{
+			{Key: "$min", Value: bson.D{{Key: "from", Value: from}}},
+			{Key: "$max", Value: bson.D{{Key: "to", Value: to}}},
+			{Key: "$set", Value: bson.D{{Key: "queued_at", Value: time.Now()}}},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// RunQueuedBackfills backfills the queued ranges of topics, or of every topic
+// when none are given, and removes them from the queue once built. A range
+// widened by QueueBackfill meanwhile stays queued for the next run.
+func (r *Retention) RunQueuedBackfills(ctx context.Context, topics ...string) error {
+	queue := r.database.Collection(backfillQueueCollection)
+	filter := bson.D{}
+	if len(topics) > 0 {
+		filter = bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: topics}}}}
+	}
+	cursor, err := queue.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var queued []struct {
+		Topic string    `bson:"_id"`
+		From  time.Time `bson:"from"`
+		To    time.Time `bson:"to"`
+	}
+	if err := cursor.All(ctx, &queued); err != nil {
+		return err
+	}
+
+	for _, q := range queued {
+		if err := r.Backfill(ctx, q.Topic, q.From, q.To); err != nil {
+			return err
+		}
+		_, err := queue.DeleteOne(ctx, bson.D{
+			{Key: "_id", Value: q.Topic},
+			{Key: "from", Value: q.From},
+			{Key: "to", Value: q.To},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RolledUp reports whether the first rollup tier of topic has been built past
+// t. A reading at t stored now is missing from its bucket, and would expire
+// with the raw readings without ever being rolled up, until its range is
+// backfilled.
+func (r *Retention) RolledUp(topic string, t time.Time) bool {
+	i := r.policyIndex(topic)
+	if i < 0 || len(r.policies[i].Tiers) == 0 {
+		return false
+	}
+	policy := r.policies[i]
+	return t.Before(r.watermark(policy.Pattern, r.RollupCollection(policy.Tiers[0])))
+}
+
+// Expired reports whether raw readings of topic at t are past their retention
+// at now. Such a reading cannot be rolled up, its bucket would be rebuilt
+// without the readings that have already expired.
+func (r *Retention) Expired(topic string, t, now time.Time) bool {
+	i := r.policyIndex(topic)
+	return i >= 0 && r.policies[i].RawTTL > 0 && t.Before(now.Add(-r.policies[i].RawTTL))
+}
+
+// ExpireAt returns when a document of collection holding readings of topic
+// at t expires under the current policies, and false when it is kept
+// forever. Raw readings are never stamped up front, the retention pass
+// stamps them once they have been rolled up.
+func (r *Retention) ExpireAt(collection, topic string, t time.Time) (time.Time, bool) {
+	i := r.policyIndex(topic)
+	if i < 0 {
+		return time.Time{}, false
+	}
+	for _, tier := range r.policies[i].Tiers {
+		if r.RollupCollection(tier) == collection && tier.TTL > 0 {
+			return t.Add(tier.TTL), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// expireRaw stamps an expiry time on raw readings of policy i. Readings are
+// only stamped once the first rollup tier has been built past them, so no
+// data is lost if the rollup job falls behind.
+func (r *Retention) expireRaw(ctx context.Context, i int, now time.Time) error {
+	policy := r.policies[i]
+	if policy.RawTTL == 0 {
+		return nil
+	}
+
+	cutoff := now
+	if len(policy.Tiers) > 0 {
+		cutoff = r.watermark(policy.Pattern, r.RollupCollection(policy.Tiers[0]))
+	}
+
+	filter := bson.D{{Key: "$and", Value: bson.A{
+		r.policyFilter(i),
+		bson.D{{Key: "timestamp", Value: bson.D{{Key: "$lt", Value: cutoff}}}},
+		bson.D{{Key: "expire_at", Value: bson.D{{Key: "$exists", Value: false}}}},
+	}}}
+	update := mongo.Pipeline{
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "expire_at", Value: bson.D{{Key: "$add", Value: bson.A{"$timestamp", policy.RawTTL.Milliseconds()}}}},
+		}}},
+	}
+
+	_, err := r.database.Collection(r.rawCollection).UpdateMany(ctx, filter, update)
+	return err
+}
+
+// policyFilter matches the topics governed by policy i: those matching its
+// pattern and none of the patterns of the policies before it.
+func (r *Retention) policyFilter(i int) bson.D {
+	conditions := bson.A{
+		bson.D{{Key: "topic", Value: bson.D{{Key: "$regex", Value: TopicPatternRegex(r.policies[i].Pattern)}}}},
+	}
+	for _, earlier := range r.policies[:i] {
+		conditions = append(conditions, bson.D{{Key: "topic", Value: bson.D{
+			{Key: "$not", Value: primitive.Regex{Pattern: TopicPatternRegex(earlier.Pattern)}},
+		}}})
+	}
+	return bson.D{{Key: "$and", Value: conditions}}
+}
+
+func (r *Retention) policyIndex(topic string) int {
+	for i, policy := range r.policies {
+		if TopicMatches(policy.Pattern, topic) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *Retention) earliestTimestamp(ctx context.Context, collection string, i int) (time.Time, error) {
+	var doc struct {
+		Timestamp time.Time `bson:"timestamp"`
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: 1}}).SetProjection(bson.D{{Key: "timestamp", Value: 1}})
+	err := r.database.Collection(collection).FindOne(ctx, r.policyFilter(i), opts).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return time.Time{}, nil
+	}
+	return doc.Timestamp, err
+}
+
+func watermarkKey(pattern, collection string) string {
+	return pattern + "|" + collection
+}
+
+func (r *Retention) watermark(pattern, collection string) time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.watermarks[watermarkKey(pattern, collection)]
+}
+
+func (r *Retention) setWatermark(ctx context.Context, pattern, collection string, watermark time.Time) error {
+	key := watermarkKey(pattern, collection)
+	_, err := r.database.Collection(retentionStateCollection).UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: key}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "watermark", Value: watermark},
+			{Key: "updated_at", Value: time.Now()},
+		}}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.watermarks[key] = watermark
+	r.mu.Unlock()
+	return nil
+}
+
+// Select picks the coarsest source for topic that still holds data at start,
+// has been built up to end, and whose resolution is no coarser than step. A
+// step of 0 requires raw readings. Rollup buckets are only used when start
+// and end fall on their edges and step is a multiple of their width,
+// otherwise buckets straddling the edges of the range or of the steps from
+// start would be counted on the wrong side. When no
+// source covers the whole range the most current source retaining start is
+// used instead.
+func (r *Retention) Select(topic string, start, end time.Time, step time.Duration) Source {
+	raw := Source{Collection: r.rawCollection}
+	i := r.policyIndex(topic)
+	if i < 0 {
+		return raw
+	}
+	policy := r.policies[i]
+
+	type candidate struct {
+		source    Source
+		ttl       time.Duration
+		watermark time.Time
+	}
+	// Raw readings are always up to date.
+	candidates := []candidate{{source: raw, ttl: policy.RawTTL, watermark: end}}
+	for _, tier := range policy.Tiers {
+		collection := r.RollupCollection(tier)
+		candidates = append(candidates, candidate{
+			source:    Source{Collection: collection, Resolution: tier.Resolution},
+			ttl:       tier.TTL,
+			watermark: r.watermark(policy.Pattern, collection),
+		})
+	}
+
+	now := time.Now()
+	retains := func(c candidate) bool {
+		return c.ttl == 0 || !start.Before(now.Add(-c.ttl))
+	}
+	fits := func(c candidate) bool {
+		resolution := c.source.Resolution
+		return resolution <= step && (resolution == 0 || step%resolution == 0) && alignedTo(start, resolution) && alignedTo(end, resolution)
+	}
+
+	for k := len(candidates) - 1; k >= 0; k-- {
+		c := candidates[k]
+		if fits(c) && retains(c) && !c.watermark.Before(end) {
+			return c.source
+		}
+	}
+	for _, c := range candidates {
+		if fits(c) && retains(c) {
+			return c.source
+		}
+	}
+
+	// The start of the range has expired everywhere it could be answered
+	// exactly, fall back to the longest lived source.
+	longest := candidates[0]
+	for _, c := range candidates[1:] {
+		if longest.ttl != 0 && (c.ttl == 0 || c.ttl > longest.ttl) {
+			longest = c
+		}
+	}
+	return longest.source
+}
+
+// BucketExpression returns an aggregation expression that truncates the date
+// in field to the start of its bucket of width step, counted from origin.
+func BucketExpression(field string, origin time.Time, step time.Duration) bson.D {
+	offset := bson.D{{Key: "$subtract", Value: bson.A{
+		bson.D{{Key: "$toLong", Value: field}},
+		origin.UnixMilli(),
+	}}}
+	return bson.D{{Key: "$toDate", Value: bson.D{{Key: "$subtract", Value: bson.A{
+		bson.D{{Key: "$toLong", Value: field}},
+		bson.D{{Key: "$mod", Value: bson.A{offset, step.Milliseconds()}}},
+	}}}}}
+}
+
+// alignedTo reports whether t is the start of a bucket of width step, which
+// any time is for raw readings
+func alignedTo(t time.Time, step time.Duration) bool {
+	return step <= 0 || t.UnixMilli()%step.Milliseconds() == 0
+}
+
+func truncateTime(t time.Time, step time.Duration) time.Time {
+	ms := t.UnixMilli()
+	return time.UnixMilli(ms - ms%step.Milliseconds()).UTC()
+}
+
+// ceilTime rounds t up to the next multiple of step
+func ceilTime(t time.Time, step time.Duration) time.Time {
+	truncated := truncateTime(t, step)
+	if truncated.Before(t) {
+		return truncated.Add(step)
+	}
+	return truncated
+}
+
+// RunRetention runs retention passes every interval until ctx is cancelled.
+func RunRetention(ctx context.Context, retention *Retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := retention.Run(ctx); err != nil {
+			log.Printf("Retention pass failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
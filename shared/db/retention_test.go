@@ -0,0 +1,162 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionPolicies(t *testing.T) {
+	const day = 24 * time.Hour
+	tests := []struct {
+		spec    string
+		want    []RetentionPolicy
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{
+			spec: "home/#=raw:14d,5m:365d,1h:forever; home/+/motion=raw:30d",
+			want: []RetentionPolicy{
+				{Pattern: "home/#", RawTTL: 14 * day, Tiers: []RollupTier{
+					{Resolution: 5 * time.Minute, TTL: 365 * day},
+					{Resolution: time.Hour},
+				}},
+				{Pattern: "home/+/motion", RawTTL: 30 * day},
+			},
+		},
+		{spec: "home/#=raw:0,1m:inf", want: []RetentionPolicy{
+			{Pattern: "home/#", Tiers: []RollupTier{{Resolution: time.Minute}}},
+		}},
+		{spec: "home/#", wantErr: true},
+		{spec: "=raw:14d", wantErr: true},
+		{spec: "home/#=raw", wantErr: true},
+		{spec: "home/#=raw:soon", wantErr: true},
+		{spec: "home/#=0s:1d", wantErr: true},
+		// Coarser tiers are built from the one before them
+		{spec: "home/#=1h:1d,5m:1d", wantErr: true},
+		{spec: "home/#=5m:1d,7m:1d", wantErr: true},
+		{spec: "home/#=5m:1d,5m:7d", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRetentionPolicies(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRetentionPolicies(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRetentionPolicies(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestAlignedToAndCeilTime(t *testing.T) {
+	base := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		t       time.Time
+		step    time.Duration
+		aligned bool
+		ceil    time.Time
+	}{
+		{t: base, step: time.Hour, aligned: true, ceil: base},
+		{t: base.Add(time.Millisecond), step: time.Hour, aligned: false, ceil: base.Add(time.Hour)},
+		{t: base.Add(-time.Millisecond), step: time.Hour, aligned: false, ceil: base},
+		{t: base.Add(30 * time.Minute), step: time.Hour, aligned: false, ceil: base.Add(time.Hour)},
+		{t: base.Add(30 * time.Minute), step: 5 * time.Minute, aligned: true, ceil: base.Add(30 * time.Minute)},
+		// Buckets are counted from the Unix epoch, days start at midnight UTC
+		{t: base, step: 24 * time.Hour, aligned: false, ceil: base.Add(12 * time.Hour)},
+	}
+
+	for _, tt := range tests {
+		if got := alignedTo(tt.t, tt.step); got != tt.aligned {
+			t.Errorf("alignedTo(%s, %s) = %v, want %v", tt.t.Format(time.RFC3339Nano), tt.step, got, tt.aligned)
+		}
+		if got := ceilTime(tt.t, tt.step); !got.Equal(tt.ceil) {
+			t.Errorf("ceilTime(%s, %s) = %s, want %s", tt.t.Format(time.RFC3339Nano), tt.step, got, tt.ceil)
+		}
+	}
+	if !alignedTo(base.Add(time.Millisecond), 0) {
+		t.Error("alignedTo(t, 0) = false, raw readings have no buckets to align to")
+	}
+}
+
+func TestRetentionSelect(t *testing.T) {
+	const day = 24 * time.Hour
+	policies := []RetentionPolicy{{
+		Pattern: "home/#",
+		RawTTL:  7 * day,
+		Tiers: []RollupTier{
+			{Resolution: 5 * time.Minute, TTL: 90 * day},
+			{Resolution: time.Hour},
+		},
+	}}
+	r := NewRetention(nil, "mqtt_events", policies)
+	raw := Source{Collection: "mqtt_events"}
+	fiveMinutes := Source{Collection: "mqtt_events_rollup_5m", Resolution: 5 * time.Minute}
+	hourly := Source{Collection: "mqtt_events_rollup_1h", Resolution: time.Hour}
+
+	// Both tiers have been built up to the last full hour
+	now := time.Now().UTC()
+	built := now.Truncate(time.Hour)
+	r.watermarks[watermarkKey("home/#", fiveMinutes.Collection)] = built
+	r.watermarks[watermarkKey("home/#", hourly.Collection)] = built
+	dayAgo := built.Add(-day)
+
+	tests := []struct {
+		name       string
+		topic      string
+		start, end time.Time
+		step       time.Duration
+		want       Source
+	}{
+		{"no policy", "garden/pump/state", dayAgo, built, time.Hour, raw},
+		{"raw readings requested", "home/kitchen/temperature", dayAgo, built, 0, raw},
+		{"coarsest tier fitting the step", "home/kitchen/temperature", dayAgo, built, 2 * time.Hour, hourly},
+		{"step finer than the coarsest tier", "home/kitchen/temperature", dayAgo, built, 15 * time.Minute, fiveMinutes},
+		{"step not a multiple of the tier", "home/kitchen/temperature", dayAgo, built, 7 * time.Minute, raw},
+		{"start not on a bucket edge", "home/kitchen/temperature", dayAgo.Add(time.Minute), built, time.Hour, raw},
+		{"end not on an hour", "home/kitchen/temperature", dayAgo, built.Add(-5 * time.Minute), time.Hour, fiveMinutes},
+		{"end past the watermarks", "home/kitchen/temperature", dayAgo, built.Add(time.Hour), time.Hour, raw},
+		{"raw readings expired", "home/kitchen/temperature", built.Add(-30 * day), built, time.Hour, hourly},
+		{"expired and not on a bucket edge", "home/kitchen/temperature", built.Add(-30*day + time.Minute), built, time.Hour, hourly},
+	}
+
+	for _, tt := range tests {
+		if got := r.Select(tt.topic, tt.start, tt.end, tt.step); got != tt.want {
+			t.Errorf("%s: Select() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetentionExpireAt(t *testing.T) {
+	const day = 24 * time.Hour
+	r := NewRetention(nil, "mqtt_events", []RetentionPolicy{
+		{Pattern: "home/+/motion", RawTTL: 30 * day, Tiers: []RollupTier{{Resolution: time.Hour, TTL: 90 * day}}},
+		{Pattern: "home/#", RawTTL: 7 * day, Tiers: []RollupTier{
+			{Resolution: 5 * time.Minute, TTL: 30 * day},
+			{Resolution: time.Hour},
+		}},
+	})
+	at := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		collection, topic string
+		want              time.Time // zero when kept
+	}{
+		{"mqtt_events_rollup_5m", "home/kitchen/temperature", at.Add(30 * day)},
+		// The first matching policy decides, for buckets the same width
+		{"mqtt_events_rollup_1h", "home/hall/motion", at.Add(90 * day)},
+		{"mqtt_events_rollup_1h", "home/kitchen/temperature", time.Time{}},
+		// Raw readings are stamped by the retention pass
+		{"mqtt_events", "home/kitchen/temperature", time.Time{}},
+		{"mqtt_events_rollup_5m", "garden/pump/state", time.Time{}},
+		{"mqtt_events_rollup_15m", "home/kitchen/temperature", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		got, ok := r.ExpireAt(tt.collection, tt.topic, at)
+		if ok != !tt.want.IsZero() || !got.Equal(tt.want) {
+			t.Errorf("ExpireAt(%s, %s) = %s, %v, want %s", tt.collection, tt.topic, got, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Selector picks the readings a query covers. Values of one field are
+// alternatives, every non-empty field has to match.
+type Selector struct {
+	Topics      []string // topic names or MQTT topic filters
+	Devices     []string
+	Rooms       []string
+	SensorTypes []string
+
+	// Allowed restricts the selection further, to the readings a restricted
+	// API key may read. It is not a criterion of its own.
+	Allowed Allowlist
+}
+
+// Allowlist restricts readings to those of its rooms or devices. The zero
+// value allows every reading.
+type Allowlist struct {
+	Rooms   []string
+	Devices []string
+}
+
+// IsEmpty reports whether the allowlist allows every reading.
+func (a Allowlist) IsEmpty() bool {
+	return len(a.Rooms) == 0 && len(a.Devices) == 0
+}
+
+// Allows reports whether a reading of room or device is allowed.
+func (a Allowlist) Allows(room, device string) bool {
+	return a.IsEmpty() || matchesAny(a.Rooms, room, equal) || matchesAny(a.Devices, device, equal)
+}
+
+// Filter returns the MongoDB filter matching the allowed readings.
+func (a Allowlist) Filter() bson.D {
+	if a.IsEmpty() {
+		return bson.D{}
+	}
+	alternatives := bson.A{}
+	if len(a.Rooms) > 0 {
+		alternatives = append(alternatives, bson.D{{Key: "tags.room", Value: bson.D{{Key: "$in", Value: a.Rooms}}}})
+	}
+	if len(a.Devices) > 0 {
+		alternatives = append(alternatives, bson.D{{Key: "device", Value: bson.D{{Key: "$in", Value: a.Devices}}}})
+	}
+	return bson.D{{Key: "$or", Value: alternatives}}
+}
+
+// IsEmpty reports whether the selector has no criteria at all.
+func (s Selector) IsEmpty() bool {
+	return len(s.Topics) == 0 && len(s.Devices) == 0 && len(s.Rooms) == 0 && len(s.SensorTypes) == 0
+}
+
+// Filter returns the MongoDB filter matching the selected readings.
+func (s Selector) Filter() bson.D {
+	conditions := bson.A{}
+	if len(s.Topics) > 0 {
+		conditions = append(conditions, TopicFilter(s.Topics))
+	}
+	if len(s.Devices) > 0 {
+		conditions = append(conditions, bson.D{{Key: "device", Value: bson.D{{Key: "$in", Value: s.Devices}}}})
+	}
+	if len(s.Rooms) > 0 {
+		conditions = append(conditions, bson.D{{Key: "tags.room", Value: bson.D{{Key: "$in", Value: s.Rooms}}}})
+	}
+	if len(s.SensorTypes) > 0 {
+		conditions = append(conditions, bson.D{{Key: "tags.sensor_type", Value: bson.D{{Key: "$in", Value: s.SensorTypes}}}})
+	}
+	if !s.Allowed.IsEmpty() {
+		conditions = append(conditions, s.Allowed.Filter())
+	}
+
+	if len(conditions) == 0 {
+		return bson.D{}
+	}
+	return bson.D{{Key: "$and", Value: conditions}}
+}
+
+// Matches reports whether the selector selects e, like Filter does in queries.
+func (s Selector) Matches(e Event) bool {
+	if len(s.Topics) > 0 && !matchesAny(s.Topics, e.Topic, TopicMatches) {
+		return false
+	}
+	if len(s.Devices) > 0 && !matchesAny(s.Devices, e.Device, equal) {
+		return false
+	}
+	if len(s.Rooms) > 0 && !matchesAny(s.Rooms, e.Room(), equal) {
+		return false
+	}
+	if len(s.SensorTypes) > 0 && !matchesAny(s.SensorTypes, e.SensorType(), equal) {
+		return false
+	}
+	return s.Allowed.Allows(e.Room(), e.Device)
+}
+
+func matchesAny(alternatives []string, value string, match func(alternative, value string) bool) bool {
+	for _, alternative := range alternatives {
+		if match(alternative, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a, b string) bool {
+	return a == b
+}
+
+// TopicFilter matches any of the given topics, which may be MQTT topic filters.
+func TopicFilter(topics []string) bson.D {
+	var names []string
+	alternatives := bson.A{}
+	for _, topic := range topics {
+		if IsTopicPattern(topic) {
+			alternatives = append(alternatives, bson.D{{Key: "topic", Value: bson.D{{Key: "$regex", Value: TopicPatternRegex(topic)}}}})
+		} else {
+			names = append(names, topic)
+		}
+	}
+
+	if len(alternatives) == 0 {
+		return bson.D{{Key: "topic", Value: bson.D{{Key: "$in", Value: names}}}}
+	}
+	if len(names) > 0 {
+		alternatives = append(alternatives, bson.D{{Key: "topic", Value: bson.D{{Key: "$in", Value: names}}}})
+	}
+	return bson.D{{Key: "$or", Value: alternatives}}
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SeriesAggregations lists the aggregations AggregateSeries supports.
+var SeriesAggregations = []string{"avg", "min", "max", "sum", "count", "first", "last"}
+
+// Bucket is the aggregated value of one topic over one series step.
+type Bucket struct {
+	Topic     string
+	Timestamp time.Time // start of the bucket
+	Value     float64
+}
+
+// AggregateSeries aggregates the numeric readings matching filter into buckets
+// of width step starting at start, per topic. Buckets without readings are
+// omitted. Results are ordered by topic and time.
+func AggregateSeries(ctx context.Context, collection *mongo.Collection, source Source, filter bson.D, start, end time.Time, step time.Duration, aggregation string) ([]Bucket, error) {
+	accumulators, value, err := seriesAccumulators(source, aggregation)
+	if err != nil {
+		return nil, err
+	}
+
+	group := bson.D{{Key: "_id", Value: bson.D{
+		{Key: "topic", Value: "$topic"},
+		{Key: "bucket", Value: BucketExpression("$timestamp", start, step)},
+	}}}
+	group = append(group, accumulators...)
+
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: seriesFilter(source, filter, start, end)}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "timestamp", Value: 1}}}},
+		bson.D{{Key: "$group", Value: group}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "topic", Value: "$_id.topic"},
+			{Key: "timestamp", Value: "$_id.bucket"},
+			{Key: "value", Value: value},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "topic", Value: 1}, {Key: "timestamp", Value: 1}}}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var buckets []Bucket
+	for cursor.Next(ctx) {
+		var result struct {
+			Topic     string    `bson:"topic"`
+			Timestamp time.Time `bson:"timestamp"`
+			Value     float64   `bson:"value"`
+		}
+		if err := cursor.Decode(&result); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, Bucket{Topic: result.Topic, Timestamp: result.Timestamp, Value: result.Value})
+	}
+	return buckets, cursor.Err()
+}
+
+// SeriesTopics returns the topics AggregateSeries finds readings of, sorted,
+// so the size of a series query is known before running it.
+func SeriesTopics(ctx context.Context, collection *mongo.Collection, source Source, filter bson.D, start, end time.Time) ([]string, error) {
+	return DistinctStrings(ctx, collection, "topic", seriesFilter(source, filter, start, end))
+}
+
+// seriesFilter matches the readings of filter between start and end that
+// series are aggregated from, numeric ones for raw readings.
+func seriesFilter(source Source, filter bson.D, start, end time.Time) bson.D {
+	conditions := bson.A{filter, TimeRangeFilter(start, end)}
+	if !source.IsRollup() {
+		conditions = append(conditions, bson.D{{Key: "value", Value: bson.D{{Key: "$type", Value: "number"}}}})
+	}
+	return bson.D{{Key: "$and", Value: conditions}}
+}
+
+// seriesAccumulators returns the $group accumulators for aggregation and the
+// expression computing the bucket value from them.
+func seriesAccumulators(source Source, aggregation string) (bson.D, interface{}, error) {
+	accumulator := func(operator string, field interface{}) bson.D {
+		return bson.D{{Key: "value", Value: bson.D{{Key: operator, Value: field}}}}
+	}
+
+	if !source.IsRollup() {
+		switch aggregation {
+		case "avg", "min", "max", "sum", "first", "last":
+			return accumulator("$"+aggregation, "$value"), "$value", nil
+		case "count":
+			return accumulator("$sum", 1), "$value", nil
+		}
+		return nil, nil, fmt.Errorf("unsupported aggregation %q", aggregation)
+	}
+
+	switch aggregation {
+	case "avg":
+		return bson.D{
+			{Key: "sum", Value: bson.D{{Key: "$sum", Value: "$sum"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: "$count"}}},
+		}, bson.D{{Key: "$divide", Value: bson.A{"$sum", "$count"}}}, nil
+	case "min", "max", "first", "last":
+		return accumulator("$"+aggregation, "$"+aggregation), "$value", nil
+	case "sum", "count":
+		return accumulator("$sum", "$"+aggregation), "$value", nil
+	}
+	return nil, nil, fmt.Errorf("unsupported aggregation %q", aggregation)
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Sample is a single reading.
+type Sample struct {
+	Value     float64   `bson:"value"`
+	Timestamp time.Time `bson:"timestamp"`
+}
+
+// NumericStats summarises the numeric readings of one topic.
+type NumericStats struct {
+	Topic       string    `bson:"_id"`
+	Count       int64     `bson:"count"`
+	Sum         float64   `bson:"sum"`
+	Avg         float64   `bson:"avg"`
+	Min         float64   `bson:"min"`
+	Max         float64   `bson:"max"`
+	StdDev      float64   `bson:"stddev"`
+	Percentiles []float64 `bson:"percentiles"` // in the order they were requested
+	First       Sample    `bson:"first"`
+	Last        Sample    `bson:"last"`
+}
+
+// TimeRangeFilter matches readings with start <= timestamp < end.
+func TimeRangeFilter(start, end time.Time) bson.D {
+	return bson.D{{Key: "timestamp", Value: bson.D{
+		{Key: "$gte", Value: start},
+		{Key: "$lt", Value: end},
+	}}}
+}
+
+// ComputeNumericStats summarises the numeric readings matching filter between
+// start and end, per topic. Percentiles are fractions between 0 and 1. Over a
+// rollup source, the standard deviation and percentiles are computed from the
+// bucket averages and first/last are the first and last bucket.
+func ComputeNumericStats(ctx context.Context, collection *mongo.Collection, source Source, filter bson.D, start, end time.Time, percentiles []float64) ([]NumericStats, error) {
+	conditions := bson.A{filter, TimeRangeFilter(start, end)}
+
+	// Field names of raw readings and of rollup buckets
+	count := bson.D{{Key: "$sum", Value: 1}}
+	sumField, minField, maxField, avgField, firstField, lastField := "$value", "$value", "$value", "$value", "$value", "$value"
+	if source.IsRollup() {
+		count = bson.D{{Key: "$sum", Value: "$count"}}
+		sumField, minField, maxField, avgField, firstField, lastField = "$sum", "$min", "$max", "$avg", "$first", "$last"
+	} else {
+		conditions = append(conditions, bson.D{{Key: "value", Value: bson.D{{Key: "$type", Value: "number"}}}})
+	}
+
+	group := bson.D{
+		{Key: "_id", Value: "$topic"},
+		{Key: "count", Value: count},
+		{Key: "sum", Value: bson.D{{Key: "$sum", Value: sumField}}},
+		{Key: "min", Value: bson.D{{Key: "$min", Value: minField}}},
+		{Key: "max", Value: bson.D{{Key: "$max", Value: maxField}}},
+		{Key: "stddev", Value: bson.D{{Key: "$stdDevPop", Value: avgField}}},
+		{Key: "first", Value: bson.D{{Key: "$first", Value: bson.D{
+			{Key: "value", Value: firstField},
+			{Key: "timestamp", Value: "$timestamp"},
+		}}}},
+		{Key: "last", Value: bson.D{{Key: "$last", Value: bson.D{
+			{Key: "value", Value: lastField},
+			{Key: "timestamp", Value: "$timestamp"},
+		}}}},
+	}
+	if len(percentiles) > 0 {
+		// $percentile requires MongoDB 7.0
+		group = append(group, bson.E{Key: "percentiles", Value: bson.D{{Key: "$percentile", Value: bson.D{
+			{Key: "input", Value: avgField},
+			{Key: "p", Value: percentiles},
+			{Key: "method", Value: "approximate"},
+		}}}})
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "$and", Value: conditions}}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "timestamp", Value: 1}}}},
+		bson.D{{Key: "$group", Value: group}},
+		bson.D{{Key: "$addFields", Value: bson.D{
+			{Key: "avg", Value: bson.D{{Key: "$divide", Value: bson.A{"$sum", "$count"}}}},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []NumericStats
+	for cursor.Next(ctx) {
+		var stats NumericStats
+		if err := cursor.Decode(&stats); err != nil {
+			return nil, err
+		}
+		results = append(results, stats)
+	}
+	return results, cursor.Err()
+}
+
+// DistinctTopics returns the topics of the readings matching filter between
+// start and end.
+func DistinctTopics(ctx context.Context, collection *mongo.Collection, filter bson.D, start, end time.Time) ([]string, error) {
+	return DistinctStrings(ctx, collection, "topic", bson.D{{Key: "$and", Value: bson.A{filter, TimeRangeFilter(start, end)}}})
+}
+
+// DistinctStrings returns the distinct string values of field in the
+// documents matching filter, sorted.
+func DistinctStrings(ctx context.Context, collection *mongo.Collection, field string, filter bson.D) ([]string, error) {
+	values, err := collection.Distinct(ctx, field, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if s, ok := value.(string); ok && s != "" {
+			result = append(result, s)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
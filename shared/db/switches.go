@@ -0,0 +1,163 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Interval is a period a switch was on.
+type Interval struct {
+	Start time.Time
+	End   time.Time
+	// Open is set when the switch was still on at the end of the range.
+	Open bool
+}
+
+// Duration returns the length of the interval.
+func (i Interval) Duration() time.Duration {
+	return i.End.Sub(i.Start)
+}
+
+// MaxIntervals bounds the intervals kept of a switch history. A switch
+// flapping all day would otherwise hold thousands.
+const MaxIntervals = 1000
+
+// SwitchHistory is the activity of a switch topic over a range. Intervals
+// are clipped to the range: a switch that was on before its start is on from
+// the start, and one still on at its end is on until the end. Repeated "on"
+// events keep the original start and "off" events while already off are
+// ignored.
+type SwitchHistory struct {
+	OnCount  int64
+	OffCount int64
+	// OnTime and LongestOn cover every interval, Intervals holds the first
+	// MaxIntervals of them and Truncated is set when there were more
+	OnTime    time.Duration
+	LongestOn time.Duration
+	Intervals []Interval
+	Truncated bool
+
+	on    bool
+	since time.Time
+}
+
+// switchEvent is an "on" or "off" reading of a switch
+type switchEvent struct {
+	Topic     string    `bson:"topic"`
+	Value     string    `bson:"value"`
+	Timestamp time.Time `bson:"timestamp"`
+}
+
+func newSwitchHistory(previous string, start time.Time) *SwitchHistory {
+	return &SwitchHistory{on: previous == "on", since: start}
+}
+
+func (h *SwitchHistory) add(event switchEvent) {
+	switch event.Value {
+	case "on":
+		h.OnCount++
+		if !h.on {
+			h.on, h.since = true, event.Timestamp
+		}
+	case "off":
+		h.OffCount++
+		if h.on {
+			h.on = false
+			h.record(Interval{Start: h.since, End: event.Timestamp})
+		}
+	}
+}
+
+func (h *SwitchHistory) close(end time.Time) {
+	if h.on {
+		h.record(Interval{Start: h.since, End: end, Open: true})
+	}
+}
+
+func (h *SwitchHistory) record(interval Interval) {
+	h.OnTime += interval.Duration()
+	if interval.Duration() > h.LongestOn {
+		h.LongestOn = interval.Duration()
+	}
+	if len(h.Intervals) >= MaxIntervals {
+		h.Truncated = true
+		return
+	}
+	h.Intervals = append(h.Intervals, interval)
+}
+
+// SwitchHistories returns the activity of switch topics between start and
+// end in two queries. Topics without events in or before the range have an
+// empty history.
+func SwitchHistories(ctx context.Context, collection *mongo.Collection, topics []string, start, end time.Time) (map[string]*SwitchHistory, error) {
+	switchEvents := bson.D{
+		{Key: "topic", Value: bson.D{{Key: "$in", Value: topics}}},
+		{Key: "value", Value: bson.D{{Key: "$in", Value: bson.A{"on", "off"}}}},
+	}
+
+	// The state of each topic at start is its last event before it
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		bson.D{{Key: "$match", Value: append(switchEvents, bson.E{Key: "timestamp", Value: bson.D{{Key: "$lt", Value: start}}})}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "topic", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$topic"},
+			{Key: "value", Value: bson.D{{Key: "$first", Value: "$value"}}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	previous := make(map[string]string, len(topics))
+	for cursor.Next(ctx) {
+		var state struct {
+			Topic string `bson:"_id"`
+			Value string `bson:"value"`
+		}
+		if err := cursor.Decode(&state); err != nil {
+			cursor.Close(ctx)
+			return nil, err
+		}
+		previous[state.Topic] = state.Value
+	}
+	cursor.Close(ctx)
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	histories := make(map[string]*SwitchHistory, len(topics))
+	for _, topic := range topics {
+		histories[topic] = newSwitchHistory(previous[topic], start)
+	}
+
+	cursor, err = collection.Find(ctx,
+		append(switchEvents, TimeRangeFilter(start, end)...),
+		options.Find().
+			SetSort(bson.D{{Key: "topic", Value: 1}, {Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}).
+			SetProjection(bson.D{{Key: "topic", Value: 1}, {Key: "value", Value: 1}, {Key: "timestamp", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var event switchEvent
+		if err := cursor.Decode(&event); err != nil {
+			return nil, err
+		}
+		if history, ok := histories[event.Topic]; ok {
+			history.add(event)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, history := range histories {
+		history.close(end)
+	}
+	return histories, nil
+}
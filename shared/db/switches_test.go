@@ -0,0 +1,100 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSwitchHistory(t *testing.T) {
+	start := time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	at := func(hours int) time.Time {
+		return start.Add(time.Duration(hours) * time.Hour)
+	}
+	tests := []struct {
+		name      string
+		previous  string
+		events    []string // "on" or "off" at hour i
+		want      []Interval
+		wantOn    time.Duration
+		wantCount [2]int64
+	}{
+		{
+			name:      "on before the range starts at its start",
+			previous:  "on",
+			events:    []string{"", "", "off"},
+			want:      []Interval{{Start: start, End: at(2)}},
+			wantOn:    2 * time.Hour,
+			wantCount: [2]int64{0, 1},
+		},
+		{
+			name:      "still on at the end is open until the end",
+			events:    []string{"", "on"},
+			want:      []Interval{{Start: at(1), End: end, Open: true}},
+			wantOn:    23 * time.Hour,
+			wantCount: [2]int64{1, 0},
+		},
+		{
+			name:      "on across the whole range",
+			previous:  "on",
+			want:      []Interval{{Start: start, End: end, Open: true}},
+			wantOn:    24 * time.Hour,
+			wantCount: [2]int64{0, 0},
+		},
+		{
+			name:      "repeated on keeps the first, off while off is ignored",
+			previous:  "off",
+			events:    []string{"off", "on", "on", "off", "off"},
+			want:      []Interval{{Start: at(1), End: at(3)}},
+			wantOn:    2 * time.Hour,
+			wantCount: [2]int64{2, 3},
+		},
+	}
+
+	for _, tt := range tests {
+		history := newSwitchHistory(tt.previous, start)
+		for i, value := range tt.events {
+			if value != "" {
+				history.add(switchEvent{Value: value, Timestamp: at(i)})
+			}
+		}
+		history.close(end)
+
+		if !reflect.DeepEqual(history.Intervals, tt.want) {
+			t.Errorf("%s: intervals = %v, want %v", tt.name, history.Intervals, tt.want)
+		}
+		if history.OnTime != tt.wantOn || history.LongestOn != tt.wantOn {
+			t.Errorf("%s: on for %s, longest %s, want %s", tt.name, history.OnTime, history.LongestOn, tt.wantOn)
+		}
+		if got := [2]int64{history.OnCount, history.OffCount}; got != tt.wantCount {
+			t.Errorf("%s: on and off counts = %v, want %v", tt.name, got, tt.wantCount)
+		}
+	}
+}
+
+func TestSwitchHistoryTruncated(t *testing.T) {
+	start := time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)
+	history := newSwitchHistory("", start)
+	for i := 0; i < MaxIntervals+10; i++ {
+		on := start.Add(time.Duration(i) * time.Minute)
+		history.add(switchEvent{Value: "on", Timestamp: on})
+		history.add(switchEvent{Value: "off", Timestamp: on.Add(time.Duration(i%30+1) * time.Second)})
+	}
+	history.close(start.Add(24 * time.Hour))
+
+	if len(history.Intervals) != MaxIntervals || !history.Truncated {
+		t.Fatalf("%d intervals, truncated %v, want the first %d and truncated", len(history.Intervals), history.Truncated, MaxIntervals)
+	}
+	if last := history.Intervals[MaxIntervals-1]; !last.Start.Equal(start.Add((MaxIntervals - 1) * time.Minute)) {
+		t.Errorf("last interval starts at %s, want the first intervals kept", last.Start)
+	}
+	// The totals still cover the dropped intervals
+	var want time.Duration
+	for i := 0; i < MaxIntervals+10; i++ {
+		want += time.Duration(i%30+1) * time.Second
+	}
+	if history.OnTime != want || history.LongestOn != 30*time.Second {
+		t.Errorf("on for %s, longest %s, want %s and 30s", history.OnTime, history.LongestOn, want)
+	}
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"regexp"
+	"strings"
+)
+
+// TopicPatternRegex converts an MQTT topic filter ("home/+/state", "home/#")
+// into an anchored regular expression usable in a MongoDB $regex query.
+func TopicPatternRegex(pattern string) string {
+	levels := strings.Split(pattern, "/")
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i, level := range levels {
+		switch {
+		case level == "#":
+			// "#" also matches the parent level itself, so "home/#" matches "home"
+			if i == 0 {
+				sb.WriteString(".*")
+			} else {
+				sb.WriteString("(/.*)?")
+			}
+			sb.WriteString("$")
+			return sb.String()
+		case i > 0:
+			sb.WriteString("/")
+		}
+		if level == "+" {
+			sb.WriteString("[^/]*")
+		} else {
+			sb.WriteString(regexp.QuoteMeta(level))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
+
+// TopicMatches reports whether topic matches the MQTT topic filter pattern.
+func TopicMatches(pattern, topic string) bool {
+	patternLevels := strings.Split(pattern, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range patternLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(patternLevels) == len(topicLevels)
+}
+
+// IsTopicPattern reports whether the topic contains MQTT wildcards.
+func IsTopicPattern(topic string) bool {
+	return strings.ContainsAny(topic, "+#")
+}
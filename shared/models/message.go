@@ -0,0 +1,75 @@
+package models
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MqttMessage is the document stored for every reading, whatever its source.
+type MqttMessage struct {
+	Topic     string                 `bson:"topic"`
+	Device    string                 `bson:"device"`
+	Value     interface{}            `bson:"value"`
+	Timestamp time.Time              `bson:"timestamp"`
+	Tags      map[string]interface{} `bson:"tags"`
+}
+
+// NewMqttMessage builds the document for a reading of topic, deriving the
+// device, room and sensor type from the topic levels.
+func NewMqttMessage(topic string, value interface{}, timestamp time.Time) MqttMessage {
+	return MqttMessage{
+		Topic:     topic,
+		Device:    ExtractDeviceFromTopic(topic),
+		Value:     value,
+		Timestamp: timestamp,
+		Tags: map[string]interface{}{
+			"room":        ExtractRoomFromTopic(topic),
+			"sensor_type": ExtractSensorTypeFromTopic(topic),
+			"state":       value,
+		},
+	}
+}
+
+// ParsePayload converts a raw payload into a JSON object, a number or a string.
+func ParsePayload(payload []byte) interface{} {
+	var jsonPayload map[string]interface{}
+	if err := json.Unmarshal(payload, &jsonPayload); err == nil {
+		return jsonPayload
+	}
+
+	if numericPayload, err := strconv.ParseFloat(string(payload), 64); err == nil {
+		return numericPayload
+	}
+
+	return string(payload)
+}
+
+func ExtractDeviceFromTopic(topic string) string {
+	parts := splitTopic(topic)
+	if len(parts) > 1 {
+		return strings.Join(parts[1:len(parts)-1], "_")
+	}
+	return "unknown_device"
+}
+
+func ExtractRoomFromTopic(topic string) string {
+	parts := splitTopic(topic)
+	if len(parts) > 1 {
+		return parts[1]
+	}
+	return "unknown_room"
+}
+
+func ExtractSensorTypeFromTopic(topic string) string {
+	parts := splitTopic(topic)
+	if len(parts) > 2 {
+		return parts[2]
+	}
+	return "unknown_sensor_type"
+}
+
+func splitTopic(topic string) []string {
+	return strings.Split(topic, "/")
+}